@@ -0,0 +1,403 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lhcb-org/lbpkr/yum"
+)
+
+// bundleManifest is the name of the manifest file of a bundle
+const bundleManifest = "manifest.json"
+
+// BundleManifest describes the content of an offline install bundle: a tar
+// archive holding a yum repository with the dependency closure of some
+// packages, and this manifest.
+type BundleManifest struct {
+	Created     time.Time       `json:"created"`
+	Roots       []BundlePackage `json:"roots"`    // packages to install
+	Packages    []BundlePackage `json:"packages"` // dependency closure of the roots
+	Relocations []Relocation    `json:"relocations"`
+}
+
+// BundlePackage identifies a RPM of a bundle
+type BundlePackage struct {
+	Name    string `json:"name"`
+	Epoch   string `json:"epoch"`
+	Version string `json:"version"`
+	Release string `json:"release"`
+	Arch    string `json:"arch"`
+
+	File         string `json:"file,omitempty"` // name of the RPM file in the bundle
+	ChecksumType string `json:"checksum_type,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+}
+
+func newBundlePackage(pkg *yum.Package) BundlePackage {
+	return BundlePackage{
+		Name:    pkg.Name(),
+		Epoch:   pkg.Epoch(),
+		Version: pkg.Version(),
+		Release: pkg.Release(),
+		Arch:    pkg.Arch(),
+	}
+}
+
+// NEVRA returns the name-epoch:version-release.arch of the package
+func (p BundlePackage) NEVRA() string {
+	epoch := p.Epoch
+	if epoch == "" {
+		epoch = "0"
+	}
+	return fmt.Sprintf("%s-%s:%s-%s.%s", p.Name, epoch, p.Version, p.Release, p.Arch)
+}
+
+// bundleConfig applies the relocations recorded in a bundle, instead of the
+// ones of the wrapped Config.
+type bundleConfig struct {
+	Config
+	relocs []Relocation
+}
+
+func (cfg *bundleConfig) Relocations() []Relocation {
+	return cfg.relocs
+}
+
+func (cfg *bundleConfig) RelocateArgs() []string {
+	return relocateArgs(cfg.Siteroot(), cfg.relocs)
+}
+
+func (cfg *bundleConfig) RelocateFile(fname string) string {
+	return relocateFile(cfg.Siteroot(), cfg.relocs, fname)
+}
+
+// CreateBundle writes into fname an offline install bundle with the packages
+// described by specs, together with all their dependencies.
+// specs, platforms and allowMissing are as for SyncRepository.
+// In dry-run mode, the packages are only listed.
+func (ctx *Context) CreateBundle(fname string, specs []string, platforms string, allowMissing bool) error {
+	roots, closure, err := ctx.resolveSpecs(specs, platforms, allowMissing)
+	if err != nil {
+		return err
+	}
+	names := sortedPackageNames(closure)
+
+	if ctx.options.DryRun {
+		for _, name := range names {
+			fmt.Printf("+ %s\n", name)
+		}
+		return nil
+	}
+
+	dir, err := ioutil.TempDir(ctx.tmpdir, "bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	pkgs := make([]*yum.Package, 0, len(names))
+	for _, name := range names {
+		pkgs = append(pkgs, closure[name])
+	}
+	err = ctx.syncPackages(pkgs, dir)
+	if err != nil {
+		return err
+	}
+
+	manifest := BundleManifest{
+		Created:     time.Now().UTC(),
+		Relocations: ctx.cfg.Relocations(),
+	}
+	for _, root := range roots {
+		manifest.Roots = append(manifest.Roots, newBundlePackage(root))
+	}
+	for _, name := range names {
+		p := newBundlePackage(closure[name])
+		p.File = name
+		p.ChecksumType = "sha256"
+		p.Checksum, err = yum.FileChecksum(filepath.Join(dir, name), p.ChecksumType)
+		if err != nil {
+			return err
+		}
+		manifest.Packages = append(manifest.Packages, p)
+	}
+
+	// the bundle is a yum repository: no metadata to ship from the remote ones
+	ctx.msg.Infof("generating the repository metadata...\n")
+	rc := yum.NewRepoCreator(dir, false)
+	rc.SetLevel(ctx.msg.Level())
+	err = rc.Create()
+	if err != nil {
+		return err
+	}
+
+	err = writeBundle(fname, dir, &manifest)
+	if err != nil {
+		return err
+	}
+
+	ctx.msg.Infof("%d package(s) bundled into %s\n", len(names), fname)
+	return nil
+}
+
+// InstallBundle installs the packages of the bundle fname under the siteroot of
+// cfg, with the relocations recorded in the bundle.
+// No repository is needed: the bundle is used as the only repository, with a
+// metadata cache of its own, removed after the install.
+func InstallBundle(cfg Config, fname string, options ...func(*Context)) error {
+	tmpdir := filepath.Join(cfg.Siteroot(), "tmp")
+	err := os.MkdirAll(tmpdir, 0755)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(tmpdir, "bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := extractBundle(fname, dir)
+	if err != nil {
+		return err
+	}
+
+	cachedir, err := ioutil.TempDir(tmpdir, "bundle-cache-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(cachedir)
+
+	options = append(options, UseRepository("bundle", "file://"+dir), UseCacheDir(cachedir))
+	ctx, err := New(&bundleConfig{Config: cfg, relocs: manifest.Relocations}, options...)
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	ctx.msg.Infof("installing bundle %s (created %s)\n",
+		fname, manifest.Created.Format(time.RFC3339),
+	)
+	pkgs := make([]Package, 0, len(manifest.Roots))
+	for _, root := range manifest.Roots {
+		pkg, err := ctx.yum.FindLatestProvider(root.Name, root.Version, root.Release)
+		if err != nil {
+			return fmt.Errorf("lbpkr: bundle does not provide %s: %v", root.NEVRA(), err)
+		}
+		pkgs = append(pkgs, Package{pkg, InstallMode})
+	}
+
+	err = ctx.InstallPackages(pkgs)
+	return err
+}
+
+// writeBundle writes into fname a tar archive of manifest and of the files under dir.
+// The manifest comes first, so it can be read without going through the RPMs.
+func writeBundle(fname, dir string, manifest *BundleManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(fname + ".part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	err = tw.WriteHeader(&tar.Header{
+		Name:    bundleManifest,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: manifest.Created,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		if name == "." || name == bundleManifest {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		hdr.Uname = "root"
+		hdr.Gname = "root"
+		hdr.Uid = 0
+		hdr.Gid = 0
+		if fi.IsDir() {
+			hdr.Name += "/"
+			return tw.WriteHeader(hdr)
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("lbpkr: %s is not a regular file", fpath)
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		r, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fname)
+}
+
+// extractBundle extracts the bundle fname under dir, and returns its manifest
+// once the RPM files have been checked against it.
+func extractBundle(fname, dir string) (*BundleManifest, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lbpkr: invalid bundle %s: %v", fname, err)
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("lbpkr: invalid file name %q in bundle %s", hdr.Name, fname)
+		}
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(fpath, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(fpath, tr)
+		default:
+			err = fmt.Errorf("lbpkr: unexpected file %q in bundle %s", hdr.Name, fname)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, bundleManifest))
+	if err != nil {
+		return nil, fmt.Errorf("lbpkr: invalid bundle %s: %v", fname, err)
+	}
+	var manifest BundleManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("lbpkr: invalid manifest in bundle %s: %v", fname, err)
+	}
+
+	err = verifyBundle(dir, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func extractFile(fname string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// verifyBundle checks the RPM files under dir against manifest
+func verifyBundle(dir string, manifest *BundleManifest) error {
+	if len(manifest.Roots) <= 0 {
+		return fmt.Errorf("lbpkr: no package to install in bundle")
+	}
+	for _, r := range manifest.Relocations {
+		if !path.IsAbs(r.Old) || filepath.IsAbs(r.New) || strings.HasPrefix(filepath.Clean(r.New), "..") {
+			return fmt.Errorf("lbpkr: invalid relocation %s=%s in bundle", r.Old, r.New)
+		}
+	}
+
+	files := make([]string, 0, len(manifest.Packages))
+	for _, p := range manifest.Packages {
+		if p.File == "" || p.File != filepath.Base(p.File) {
+			return fmt.Errorf("lbpkr: invalid file name %q for %s in bundle", p.File, p.NEVRA())
+		}
+		got, err := yum.FileChecksum(filepath.Join(dir, p.File), p.ChecksumType)
+		if err != nil {
+			return fmt.Errorf("lbpkr: could not check %s: %v", p.File, err)
+		}
+		if got != p.Checksum {
+			return fmt.Errorf("lbpkr: checksum mismatch for %s (%s: got=%s, want=%s)",
+				p.File, p.ChecksumType, got, p.Checksum,
+			)
+		}
+		files = append(files, p.File)
+	}
+
+	// the bundle is only installed from its repository: it must not hold more RPMs
+	rpms, err := filepath.Glob(filepath.Join(dir, "*.rpm"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, fname := range rpms {
+		name := filepath.Base(fname)
+		if i := sort.SearchStrings(files, name); i >= len(files) || files[i] != name {
+			return fmt.Errorf("lbpkr: RPM %s not in the manifest of the bundle", name)
+		}
+	}
+	return nil
+}
+
+// EOF
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_bundle() *commander.Command {
+	cmd := &commander.Command{
+		UsageLine: "bundle [options]",
+		Short:     "create and install offline install bundles",
+		Subcommands: []*commander.Command{
+			lbpkr_make_cmd_bundle_create(),
+			lbpkr_make_cmd_bundle_install(),
+		},
+		Flag: *flag.NewFlagSet("lbpkr-bundle", flag.ExitOnError),
+	}
+	return cmd
+}
+
+// EOF
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_bundle_create() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_bundle_create,
+		UsageLine: "create [options] -o <bundle-file> <rpm-or-project> [<rpm-or-project>...]",
+		Short:     "create an offline install bundle",
+		Long: `
+create writes a single-file bundle holding packages, the full closure of their
+dependencies, a manifest with the checksums of all the RPMs and the relocation
+config. The bundle can then be installed with 'lbpkr bundle install' on a
+machine without access to any repository.
+
+Packages are given as for 'lbpkr reposync': as RPMs (name[-version[-release]])
+or as projects (NAME:VERSION), the builds of projects being selected with
+-platforms. As for reposync, requirements no repository provides (besides files
+and shared libraries) are an error, unless -allow-missing is given.
+
+ex:
+ $ lbpkr bundle create -o gaudi-v25r2.tar GAUDI:v25r2
+ $ lbpkr bundle create -o lhcb.tar -platforms=x86_64_slc6_gcc48_opt LHCb:v36r1 AIDA
+`,
+		Flag: *flag.NewFlagSet("lbpkr-bundle-create", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.String("o", "", "path of the bundle file to create")
+	cmd.Flag.String("platforms", "", "comma-separated list of (regex) platforms of projects, or all|host|compatible")
+	cmd.Flag.Bool("allow-missing", false, "bundle the closure even if some requirements are provided by no repository")
+	cmd.Flag.Bool("dry-run", false, "only list the RPMs to bundle")
+	return cmd
+}
+
+func lbpkr_run_cmd_bundle_create(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	output := cmd.Flag.Lookup("o").Value.Get().(string)
+	platforms := cmd.Flag.Lookup("platforms").Value.Get().(string)
+	missing := cmd.Flag.Lookup("allow-missing").Value.Get().(bool)
+	dry := cmd.Flag.Lookup("dry-run").Value.Get().(bool)
+
+	if output == "" {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: missing bundle file (-o)")
+	}
+	if len(args) <= 0 {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n>=1. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+
+	cfg := NewConfig(siteroot)
+	ctx, err := New(cfg, Debug(debug), EnableDryRun(dry))
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	err = ctx.CreateBundle(output, args, platforms, missing)
+	return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_bundle_install() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_bundle_install,
+		UsageLine: "install [options] <bundle-file>",
+		Short:     "install an offline install bundle",
+		Long: `
+install installs the packages of a bundle created with 'lbpkr bundle create'.
+
+No repository is needed nor used: the RPMs are checked against the manifest of
+the bundle and installed from it, with the relocation config of the bundle.
+The repositories configured under the siteroot are left untouched.
+
+ex:
+ $ lbpkr bundle install -siteroot=/opt/lhcb gaudi-v25r2.tar
+`,
+		Flag: *flag.NewFlagSet("lbpkr-bundle-install", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.Bool("force", false, "force RPM installation (by-passing any check)")
+	cmd.Flag.Bool("dry-run", false, "dry run. do not actually run the command")
+	cmd.Flag.Bool("justdb", false, "update the database, but do not modify the filesystem")
+	return cmd
+}
+
+func lbpkr_run_cmd_bundle_install(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	force := cmd.Flag.Lookup("force").Value.Get().(bool)
+	dry := cmd.Flag.Lookup("dry-run").Value.Get().(bool)
+	justdb := cmd.Flag.Lookup("justdb").Value.Get().(bool)
+
+	fname := ""
+	switch len(args) {
+	case 1:
+		fname = args[0]
+	default:
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n=1. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+
+	cfg := NewConfig(siteroot)
+	err = InstallBundle(
+		cfg, fname,
+		Debug(debug),
+		EnableForce(force), EnableDryRun(dry), EnableJustDb(justdb),
+	)
+	return err
+}
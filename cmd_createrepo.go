@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+	"github.com/gonuts/logger"
+	"github.com/lhcb-org/lbpkr/yum"
+)
+
+func lbpkr_make_cmd_createrepo() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_createrepo,
+		UsageLine: "createrepo [options] <dir>",
+		Short:     "generate the yum metadata of a directory of RPMs",
+		Long: `
+createrepo reads the headers of the RPM files under <dir> and generates the
+yum metadata of the repository (repodata/repomd.xml, primary.xml.gz,
+filelists.xml.gz and primary.sqlite.bz2).
+
+With -update, the metadata of the RPM files which did not change since the
+last run are reused from the existing repodata.
+
+ex:
+ $ lbpkr createrepo /data/rpms
+ $ lbpkr createrepo -update /data/rpms
+`,
+		Flag: *flag.NewFlagSet("lbpkr-createrepo", flag.ExitOnError),
+	}
+	cmd.Flag.Bool("v", false, "enable verbose mode")
+	cmd.Flag.Bool("update", false, "reuse the metadata of unchanged RPMs")
+	return cmd
+}
+
+func lbpkr_run_cmd_createrepo(cmd *commander.Command, args []string) error {
+	var err error
+
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	update := cmd.Flag.Lookup("update").Value.Get().(bool)
+
+	if len(args) != 1 {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n=1. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+	dir := args[0]
+
+	rc := yum.NewRepoCreator(dir, update)
+	if debug {
+		rc.SetLevel(logger.DEBUG)
+	}
+
+	err = rc.Create()
+	return err
+}
@@ -88,15 +88,6 @@ func lbpkr_run_cmd_dep_graph(cmd *commander.Command, args []string) error {
 		return err
 	}
 
-	str_in_slice := func(str string, slice []string) bool {
-		for _, v := range slice {
-			if str == v {
-				return true
-			}
-		}
-		return false
-	}
-
 	var process func(pkg *yum.Package, lvl int) error
 
 	process = func(pkg *yum.Package, lvl int) error {
@@ -105,11 +96,12 @@ func lbpkr_run_cmd_dep_graph(cmd *commander.Command, args []string) error {
 		g.AddNode("rpms", root, decorate(pkg))
 		reqs := pkg.Requires()
 		for _, req := range reqs {
-			if str_in_slice(req.Name(), yum.IGNORED_PACKAGES) {
-				continue
-			}
-			dep, err := ctx.Client().FindLatestMatchingRequire(req)
+			deps, err := ctx.Client().ResolveRequire(req)
 			if err != nil {
+				if req.IsRich() {
+					ctx.msg.Infof("no package providing %s\n", req.ID())
+					continue
+				}
 				ctx.msg.Infof("no package providing name=%q version=%q release=%q\n",
 					req.Name(),
 					req.Version(),
@@ -117,12 +109,23 @@ func lbpkr_run_cmd_dep_graph(cmd *commander.Command, args []string) error {
 				)
 				continue
 			}
-			g.AddNode("rpms", strconv.Quote(dep.ID()), decorate(dep))
-			g.AddEdge(root, strconv.Quote(dep.ID()), true, nil)
-			if lvl < dmax || dmax < 0 {
-				err = process(dep, lvl+1)
-				if err != nil {
-					return err
+			var attrs map[string]string
+			if req.IsRich() {
+				// label the edges with the boolean expression they satisfy
+				attrs = map[string]string{"label": strconv.Quote(req.ID())}
+			}
+			for _, dep := range deps {
+				if dep.Host() != nil {
+					// provided by the host, not by a RPM package
+					continue
+				}
+				g.AddNode("rpms", strconv.Quote(dep.ID()), decorate(dep))
+				g.AddEdge(root, strconv.Quote(dep.ID()), true, attrs)
+				if lvl < dmax || dmax < 0 {
+					err = process(dep, lvl+1)
+					if err != nil {
+						return err
+					}
 				}
 			}
 		}
@@ -18,11 +18,13 @@ deps lists all dependencies of the RPM package satisfying <name-pattern> [<versi
 ex:
  $ lbpkr deps GAUDI
  $ lbpkr deps GAUDI v23r2
+ $ lbpkr deps -host GAUDI v23r2
 `,
 		Flag: *flag.NewFlagSet("lbpkr-deps", flag.ExitOnError),
 	}
 	add_default_options(cmd)
 	cmd.Flag.Int("maxdepth", -1, "maximum depth level of dependency graph (-1: all)")
+	cmd.Flag.Bool("host", false, "also list the requirements satisfied by the host system")
 	return cmd
 }
 
@@ -32,6 +34,7 @@ func lbpkr_run_cmd_deps(cmd *commander.Command, args []string) error {
 	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
 	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
 	dmax := cmd.Flag.Lookup("maxdepth").Value.Get().(int)
+	host := cmd.Flag.Lookup("host").Value.Get().(bool)
 
 	name := ""
 	vers := ""
@@ -72,5 +75,9 @@ func lbpkr_run_cmd_deps(cmd *commander.Command, args []string) error {
 		return err
 	}
 
+	if host {
+		ctx.ListHostProvided()
+	}
+
 	return err
 }
@@ -10,22 +10,41 @@ import (
 func lbpkr_make_cmd_install_project() *commander.Command {
 	cmd := &commander.Command{
 		Run:       lbpkr_run_cmd_install_project,
-		UsageLine: "install-project [options] <project-name> [<version> [<release>]]",
+		UsageLine: "install-project [options] <project-name> [<version-constraint> [<release>]]",
 		Short:     "install-project a whole project from the yum repository",
 		Long: `
 install-project installs a whole project from the yum repository.
 
+<version-constraint> may be:
+ - empty or "all": all the available versions,
+ - "latest": the latest version,
+ - a glob pattern ("v25r*"): the latest version matching the pattern,
+ - a comma-separated list of ranges (">=v26r0,<v27r0"): the latest version within the ranges,
+ - a version ("v25r5"): that very version.
+The latest version is selected for each requested platform.
+
 ex:
  $ lbpkr install-project GAUDI
  $ lbpkr install-project GAUDI v42
+ $ lbpkr install-project GAUDI latest
+ $ lbpkr install-project GAUDI 'v25r*'
+ $ lbpkr install-project GAUDI '>=v26r0,<v27r0'
  $ lbpkr install-project -platforms=all GAUDI v42
+ $ lbpkr install-project -platforms=x86_64_slc6_gcc48_opt,x86_64_slc6_gcc48_dbg GAUDI v42
+ $ lbpkr install-project -platforms=host GAUDI v42
+ $ lbpkr install-project -platforms=compatible GAUDI v42
+
+-platforms=host installs, for each version, the native build for the host
+platform ($CMTCONFIG, or detected from the system).
+-platforms=compatible also considers the builds compatible with the host
+platform (e.g. slc6 builds on centos7, or opt builds when dbg is requested).
 `,
 		Flag: *flag.NewFlagSet("lbpkr-install-project", flag.ExitOnError),
 	}
 	add_default_options(cmd)
 	cmd.Flag.Bool("force", false, "force RPM installation (by-passing any check)")
 	cmd.Flag.Bool("dry-run", false, "dry run. do not actually run the command")
-	cmd.Flag.String("platforms", "", "comma-separated list of (regex) platforms to install")
+	cmd.Flag.String("platforms", "", "comma-separated list of (regex) platforms to install, or all|host|compatible")
 	cmd.Flag.Bool("nodeps", false, "do not verify package dependencies")
 	cmd.Flag.Bool("justdb", false, "update the database, but do not modify the filesystem")
 	return cmd
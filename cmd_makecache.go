@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_makecache() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_makecache,
+		UsageLine: "makecache [options]",
+		Short:     "refresh the metadata cache of all yum repositories",
+		Long: `
+makecache downloads the latest metadata of all yum repositories, regardless of their metadata_expire setting.
+
+The cached metadata can then be used offline, with the global -C (-cacheonly) flag.
+
+ex:
+ $ lbpkr makecache
+ $ lbpkr -C list ROOT
+`,
+		Flag: *flag.NewFlagSet("lbpkr-makecache", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	return cmd
+}
+
+func lbpkr_run_cmd_makecache(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+
+	switch len(args) {
+	case 0:
+		// no-op
+	default:
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected none. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+
+	if g_cacheonly {
+		return fmt.Errorf("lbpkr: makecache can not be run in cache-only mode")
+	}
+	if g_snapshot != "" {
+		return fmt.Errorf("lbpkr: makecache can not be run from a snapshot")
+	}
+
+	cfg := NewConfig(siteroot)
+	ctx, err := New(cfg, Debug(debug), EnableRefresh(true))
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	repos := ctx.Client().Repositories()
+	for _, repo := range repos {
+		ctx.msg.Debugf("repository [%s] refreshed (%s)\n", repo.Name, repo.RepoUrl)
+	}
+	ctx.msg.Infof("metadata cache created for %d repositories\n", len(repos))
+	return err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+	"github.com/gonuts/logger"
+)
+
+func lbpkr_make_cmd_pack() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_pack,
+		UsageLine: "pack [options] <dir>",
+		Short:     "create a relocatable RPM from a directory tree",
+		Long: `
+pack creates a relocatable RPM installing the files under <dir> below -prefix.
+Once installed by lbpkr, the files end up under the siteroot, as for the
+RPMs of the LHCb repositories.
+
+The RPM can also be described by a JSON manifest, with the fields name,
+version, release, arch, prefix, summary, description, license, group, url,
+requires and provides. Options override the fields of the manifest.
+
+Capabilities are comma-separated, as "name [op version]".
+
+ex:
+ $ lbpkr pack -name=MyTool -version=1.0 ./install
+ $ lbpkr pack -name=MyTool -version=1.0 -release=2 -requires='LHCB >= 38.1' ./install
+ $ lbpkr pack -manifest=mytool.json -o /data/rpms/mytool.rpm ./install
+`,
+		Flag: *flag.NewFlagSet("lbpkr-pack", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.String("manifest", "", "path to a JSON manifest describing the RPM")
+	cmd.Flag.String("name", "", "name of the RPM")
+	cmd.Flag.String("version", "", "version of the RPM")
+	cmd.Flag.String("release", "", "release of the RPM (default: 1)")
+	cmd.Flag.String("arch", "", "architecture of the RPM (default: noarch)")
+	cmd.Flag.String("prefix", "", "installation directory of the tree (default: /opt/LHCbSoft)")
+	cmd.Flag.String("summary", "", "one-line description of the RPM")
+	cmd.Flag.String("requires", "", "comma-separated list of required capabilities")
+	cmd.Flag.String("provides", "", "comma-separated list of extra provided capabilities")
+	cmd.Flag.String("o", "", "path of the RPM to create (default: <name>-<version>-<release>.<arch>.rpm)")
+	return cmd
+}
+
+func lbpkr_run_cmd_pack(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	manifest := cmd.Flag.Lookup("manifest").Value.Get().(string)
+	output := cmd.Flag.Lookup("o").Value.Get().(string)
+
+	if len(args) != 1 {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n=1. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+	dir := args[0]
+
+	spec := PackSpec{
+		Name:     cmd.Flag.Lookup("name").Value.Get().(string),
+		Version:  cmd.Flag.Lookup("version").Value.Get().(string),
+		Release:  cmd.Flag.Lookup("release").Value.Get().(string),
+		Arch:     cmd.Flag.Lookup("arch").Value.Get().(string),
+		Prefix:   cmd.Flag.Lookup("prefix").Value.Get().(string),
+		Summary:  cmd.Flag.Lookup("summary").Value.Get().(string),
+		Requires: splitCapabilities(cmd.Flag.Lookup("requires").Value.Get().(string)),
+		Provides: splitCapabilities(cmd.Flag.Lookup("provides").Value.Get().(string)),
+	}
+	if manifest != "" {
+		m, err := LoadPackSpec(manifest)
+		if err != nil {
+			return err
+		}
+		spec.Merge(m)
+	}
+	spec.Merge(&PackSpec{Release: "1", Arch: "noarch", Prefix: "/opt/LHCbSoft"})
+
+	if output == "" {
+		output = spec.RPMName()
+	}
+
+	msg := logger.New("lbpkr")
+	if debug {
+		msg.SetLevel(logger.DEBUG)
+	}
+
+	cfg := NewConfig(siteroot)
+	msg.Infof("creating [%s]...\n", output)
+	err = Pack(cfg, dir, &spec, output)
+	if err != nil {
+		return err
+	}
+	msg.Infof("creating [%s]... [ok]\n", output)
+	return err
+}
+
+// splitCapabilities splits a comma-separated list of capabilities
+func splitCapabilities(str string) []string {
+	var caps []string
+	for _, v := range strings.Split(str, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			caps = append(caps, v)
+		}
+	}
+	return caps
+}
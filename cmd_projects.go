@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_projects() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_projects,
+		UsageLine: "projects [options] [<name-pattern> [<version-constraint>]]",
+		Short:     "list available and installed projects",
+		Long: `
+projects lists the projects available from the yum repositories or installed
+in the siteroot, with their versions and the platforms of each version.
+
+<version-constraint> is as for install-project.
+
+ex:
+ $ lbpkr projects
+ $ lbpkr projects GAUDI
+ $ lbpkr projects GAUDI latest
+ $ lbpkr projects -platforms=slc6_gcc48 GAUDI '>=v25r0'
+ $ lbpkr projects -installed
+ $ lbpkr projects -json LHCB
+`,
+		Flag: *flag.NewFlagSet("lbpkr-projects", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.String("platforms", "", "only list the platforms matching this regexp")
+	cmd.Flag.Bool("installed", false, "only list installed projects")
+	cmd.Flag.Bool("json", false, "print the list of projects as JSON")
+	return cmd
+}
+
+func lbpkr_run_cmd_projects(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	platforms := cmd.Flag.Lookup("platforms").Value.Get().(string)
+	installed := cmd.Flag.Lookup("installed").Value.Get().(bool)
+	asJSON := cmd.Flag.Lookup("json").Value.Get().(bool)
+
+	filter := ProjectFilter{
+		Platforms: platforms,
+		Installed: installed,
+	}
+
+	switch len(args) {
+	case 0:
+	case 1:
+		filter.Name = "^(" + args[0] + ")$"
+	case 2:
+		filter.Name = "^(" + args[0] + ")$"
+		filter.Version = args[1]
+	default:
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n=0|1|2. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+
+	cfg := NewConfig(siteroot)
+	ctx, err := New(cfg, Debug(debug))
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	projects, err := ctx.Projects(filter)
+	if err != nil {
+		return err
+	}
+
+	return writeProjects(os.Stdout, projects, asJSON)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_remove_project() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_remove_project,
+		UsageLine: "remove-project [options] <project-name> <version-constraint>",
+		Short:     "remove a whole project installed from the yum repository",
+		Long: `
+remove-project removes the installed builds of a whole project, and the index
+of the versions left without any installed build.
+
+<version-constraint> and -platforms are as for install-project.
+The packages (externals, ...) no longer required once the project is removed are
+listed, and removed as well with -orphans.
+
+ex:
+ $ lbpkr remove-project GAUDI v25r5
+ $ lbpkr remove-project GAUDI all
+ $ lbpkr remove-project GAUDI '<v26r0'
+ $ lbpkr remove-project -platforms=x86_64_slc6_gcc48_dbg GAUDI v25r5
+ $ lbpkr remove-project -platforms=all -orphans GAUDI v25r5
+ $ lbpkr remove-project -dry-run -orphans GAUDI v25r5
+`,
+		Flag: *flag.NewFlagSet("lbpkr-remove-project", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.Bool("force", false, "force removal of RPMs")
+	cmd.Flag.Bool("dry-run", false, "dry run. do not actually run the command")
+	cmd.Flag.String("platforms", "", "comma-separated list of (regex) platforms to remove, or all|host|compatible")
+	cmd.Flag.Bool("orphans", false, "also remove the packages no longer required")
+	return cmd
+}
+
+func lbpkr_run_cmd_remove_project(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	force := cmd.Flag.Lookup("force").Value.Get().(bool)
+	dry := cmd.Flag.Lookup("dry-run").Value.Get().(bool)
+	archs := cmd.Flag.Lookup("platforms").Value.Get().(string)
+	orphans := cmd.Flag.Lookup("orphans").Value.Get().(bool)
+
+	if len(args) != 2 {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n=2. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+	projname := args[0]
+	version := args[1]
+
+	cfg := NewConfig(siteroot)
+	ctx, err := New(cfg, Debug(debug), EnableForce(force), EnableDryRun(dry))
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	ctx.msg.Infof("removing project %s %s\n", projname, version)
+
+	err = ctx.RemoveProject(projname, version, archs, force, orphans)
+	return err
+}
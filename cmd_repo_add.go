@@ -69,7 +69,7 @@ func lbpkr_run_cmd_repo_add(cmd *commander.Command, args []string) error {
 
 		repourl = url + "/rpm"
 		url += "/slot-config.json"
-		f, err := getRemoteData(url)
+		f, err := ctx.Client().OpenURL(url)
 		if err != nil {
 			ctx.msg.Errorf("could not download [%s]: %v\n", url, err)
 			return err
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_repo_check() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_repo_check,
+		UsageLine: "repo-check [options] [repo-path]",
+		Short:     "check the consistency of the yum repositories",
+		Long: `
+repo-check walks all the packages of the configured yum repositories (or of
+the repository at repo-path, a directory or a URL, checked on its own) and
+reports:
+ - the requirements no package satisfies,
+ - the requirements only satisfied by the files, libraries or rpmdb of this
+   host (listed, but not counted as problems),
+ - the packages found in several repositories,
+ - the packages whose RPM file is missing on the server (unless -locations=false),
+ - the dependency cycles.
+
+repo-check exits with a non-zero status if any problem was found.
+
+ex:
+ $ lbpkr repo-check
+ $ lbpkr repo-check /data/rpms
+ $ lbpkr repo-check -locations=false http://example.org/rpms/lhcb
+`,
+		Flag: *flag.NewFlagSet("lbpkr-repo-check", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.Bool("locations", true, "check the RPM files of the packages exist")
+	return cmd
+}
+
+func lbpkr_run_cmd_repo_check(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	locations := cmd.Flag.Lookup("locations").Value.Get().(bool)
+
+	options := []func(*Context){Debug(debug)}
+	switch len(args) {
+	case 0:
+	case 1:
+		url := args[0]
+		if !strings.Contains(url, "://") {
+			url, err = filepath.Abs(url)
+			if err != nil {
+				return err
+			}
+			url = "file://" + url
+		}
+		// the repository has nothing to do with the siteroot ones: do not
+		// mix its metadata with their cache.
+		tmpdir := filepath.Join(siteroot, "tmp")
+		err = os.MkdirAll(tmpdir, 0755)
+		if err != nil {
+			return err
+		}
+		cachedir, err := ioutil.TempDir(tmpdir, "check-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(cachedir)
+		options = append(options, UseRepository("check", url), UseCacheDir(cachedir))
+	default:
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n=0|1. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+
+	cfg := NewConfig(siteroot)
+	ctx, err := New(cfg, options...)
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	err = ctx.CheckRepositories(locations)
+	return err
+}
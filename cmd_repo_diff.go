@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_repo_diff() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_repo_diff,
+		UsageLine: "repo-diff [options] <old-repo> <new-repo>",
+		Short:     "list the differences between two yum repositories",
+		Long: `
+repo-diff compares the packages of two yum repositories, each being the name
+of a configured repository, a snapshot of its metadata (<name>@<snapshot-id>
+or <name>@<date>, see 'lbpkr snapshot ls'), a URL or a local directory, and
+prints:
+ + the added packages,
+ - the removed packages,
+ ~ the packages whose version changed,
+ ! the packages republished with the same name-version-release.arch but a
+   different checksum or different dependencies,
+together with the requires and provides added to or removed from them.
+
+ex:
+ $ lbpkr repo-diff lcg http://example.org/rpms/lcg
+ $ lbpkr repo-diff lhcb@2014-05-01 lhcb
+ $ lbpkr repo-diff /data/rpms.old /data/rpms
+ $ lbpkr repo-diff -json /data/rpms.old /data/rpms
+`,
+		Flag: *flag.NewFlagSet("lbpkr-repo-diff", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.Bool("json", false, "print the differences as JSON")
+	return cmd
+}
+
+func lbpkr_run_cmd_repo_diff(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	asJSON := cmd.Flag.Lookup("json").Value.Get().(bool)
+
+	if len(args) != 2 {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n=2. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+
+	cfg := NewConfig(siteroot)
+	ctx, err := New(cfg, Debug(debug))
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	err = ctx.DiffRepositories(args[0], args[1], asJSON)
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_repoquery() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_repoquery,
+		UsageLine: "repoquery [options] [<name-pattern> [<version-pattern> [<release-pattern>]]]",
+		Short:     "query the content of the yum repositories",
+		Long: `
+repoquery queries the content of the yum repositories.
+
+Packages are selected by name/version/release patterns (regexps), and/or by
+the capability they provide (-whatprovides) or require (-whatrequires).
+Capabilities are of the form "name [op [epoch:]version[-release]]".
+
+The selected packages are printed according to -queryformat, which supports
+the following tags: %{name}, %{version}, %{release}, %{epoch}, %{arch},
+%{group}, %{repo}, %{location} and %{url}.
+
+ex:
+ $ lbpkr repoquery GAUDI_v25r2
+ $ lbpkr repoquery -repo=lhcb -queryformat='%{name}-%{version}-%{release} %{repo}' GAUDI
+ $ lbpkr repoquery -whatprovides='LHCBEXTERNALS_v68r0_x86_64_slc6_gcc48_opt >= 1.0.0'
+ $ lbpkr repoquery -whatrequires=GAUDI_v25r2_x86_64_slc6_gcc48_opt
+ $ lbpkr repoquery -requires GAUDI_v25r2_x86_64_slc6_gcc48_opt
+ $ lbpkr repoquery -location GAUDI_v25r2_x86_64_slc6_gcc48_opt
+`,
+		Flag: *flag.NewFlagSet("lbpkr-repoquery", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.String("repo", "", "only query the given repository")
+	cmd.Flag.String("whatprovides", "", "select the packages providing the given capability")
+	cmd.Flag.String("whatrequires", "", "select the packages requiring the given capability")
+	cmd.Flag.Bool("requires", false, "list the requirements of the selected packages")
+	cmd.Flag.Bool("provides", false, "list the capabilities provided by the selected packages")
+	cmd.Flag.Bool("location", false, "list the download URLs of the selected packages")
+	cmd.Flag.String("queryformat", "%{name}-%{version}-%{release}", "format of the selected packages")
+	return cmd
+}
+
+func lbpkr_run_cmd_repoquery(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+
+	q := RepoQuery{
+		Repo:         cmd.Flag.Lookup("repo").Value.Get().(string),
+		WhatProvides: cmd.Flag.Lookup("whatprovides").Value.Get().(string),
+		WhatRequires: cmd.Flag.Lookup("whatrequires").Value.Get().(string),
+		Requires:     cmd.Flag.Lookup("requires").Value.Get().(bool),
+		Provides:     cmd.Flag.Lookup("provides").Value.Get().(bool),
+		Location:     cmd.Flag.Lookup("location").Value.Get().(bool),
+		QueryFormat:  cmd.Flag.Lookup("queryformat").Value.Get().(string),
+	}
+
+	switch len(args) {
+	case 0:
+		// no-op
+	case 1:
+		q.Name = args[0]
+	case 2:
+		q.Name = args[0]
+		q.Version = args[1]
+	case 3:
+		q.Name = args[0]
+		q.Version = args[1]
+		q.Release = args[2]
+	default:
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n=0|1|2|3. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+
+	if q.WhatProvides != "" && q.WhatRequires != "" {
+		return fmt.Errorf("lbpkr: -whatprovides and -whatrequires are mutually exclusive")
+	}
+
+	cfg := NewConfig(siteroot)
+	ctx, err := New(cfg, Debug(debug))
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	_, err = ctx.RepoQuery(q)
+	return err
+}
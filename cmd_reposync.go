@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_reposync() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_reposync,
+		UsageLine: "reposync [options] -dest <dir> <rpm-or-project> [<rpm-or-project>...]",
+		Short:     "mirror packages and their dependencies into a local yum repository",
+		Long: `
+reposync downloads packages, and the full closure of their dependencies, into
+a self-contained yum repository, e.g. for sites without network access.
+
+Packages are given as RPMs (name[-version[-release]]) or as projects
+(NAME:VERSION, where VERSION is a version constraint as for install-project,
+defaulting to the latest version). The builds of projects are selected with
+-platforms, as for install-project.
+
+The RPM files already in the repository are only downloaded again if their
+checksum does not match the one of the remote repositories: running reposync
+again updates the mirror. -prune removes the RPM files outside of the
+dependency closure.
+
+The dependencies are resolved independently of the host running reposync:
+requirements on files and shared libraries no repository provides are left to
+the hosts the packages get installed on. Any other requirement no repository
+provides is an error, unless -allow-missing is given.
+
+The mirror can then be used with 'lbpkr repo-add'.
+
+ex:
+ $ lbpkr reposync -dest /data/mirror LHCb:v36r1
+ $ lbpkr reposync -dest /data/mirror -platforms=x86_64_slc6_gcc48_opt LHCb:latest GAUDI:v25r2 AIDA
+ $ lbpkr reposync -dest /data/mirror -prune LHCb:latest
+ $ lbpkr repo-add mirror /data/mirror
+`,
+		Flag: *flag.NewFlagSet("lbpkr-reposync", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.String("dest", "", "directory of the mirror repository")
+	cmd.Flag.String("platforms", "", "comma-separated list of (regex) platforms of projects, or all|host|compatible")
+	cmd.Flag.Bool("prune", false, "remove the RPMs outside of the dependency closure")
+	cmd.Flag.Bool("allow-missing", false, "mirror the closure even if some requirements are provided by no repository")
+	cmd.Flag.Bool("dry-run", false, "only list the RPMs to download and to prune")
+	return cmd
+}
+
+func lbpkr_run_cmd_reposync(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	dest := cmd.Flag.Lookup("dest").Value.Get().(string)
+	platforms := cmd.Flag.Lookup("platforms").Value.Get().(string)
+	prune := cmd.Flag.Lookup("prune").Value.Get().(bool)
+	missing := cmd.Flag.Lookup("allow-missing").Value.Get().(bool)
+	dry := cmd.Flag.Lookup("dry-run").Value.Get().(bool)
+
+	if dest == "" {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: missing mirror directory (-dest)")
+	}
+	if len(args) <= 0 {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n>=1. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+
+	cfg := NewConfig(siteroot)
+	ctx, err := New(cfg, Debug(debug), EnableDryRun(dry))
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	err = ctx.SyncRepository(dest, args, platforms, prune, missing)
+	return err
+}
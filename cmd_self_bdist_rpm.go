@@ -2,16 +2,18 @@ package main
 
 import (
 	"fmt"
-	"html/template"
-	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"time"
 
 	"github.com/gonuts/commander"
 	"github.com/gonuts/flag"
 	"github.com/gonuts/logger"
+	"github.com/lhcb-org/lbpkr/yum"
 )
 
 func lbpkr_make_cmd_self_bdist_rpm() *commander.Command {
@@ -20,7 +22,8 @@ func lbpkr_make_cmd_self_bdist_rpm() *commander.Command {
 		UsageLine: "bdist-rpm [options]",
 		Short:     "create a RPM package of lbpkr",
 		Long: `
-bdist-rpm creates a RPM package containing lbpkr.
+bdist-rpm creates a relocatable RPM package containing lbpkr.
+The package is written directly: rpmbuild is not needed.
 
 ex:
  $ lbpkr self bdist-rpm
@@ -55,15 +58,6 @@ func lbpkr_run_cmd_self_bdist_rpm(cmd *commander.Command, args []string) error {
 		)
 	}
 
-	tmpdir, err := ioutil.TempDir("", "lbpkr-self-bdist-rpm-")
-	if err != nil {
-		return err
-	}
-	defer os.RemoveAll(tmpdir)
-	//fmt.Printf(">>> [%s]\n", tmpdir)
-
-	rpmbuildroot := filepath.Join(tmpdir, "rpmbuild")
-
 	// make sure there is no hysteresis effect from outside
 	err = os.Setenv("MYSITEROOT", "")
 	if err != nil {
@@ -77,43 +71,18 @@ func lbpkr_run_cmd_self_bdist_rpm(cmd *commander.Command, args []string) error {
 		msg.SetLevel(logger.DEBUG)
 	}
 
-	rpmbuild, err := exec.LookPath("rpmbuild")
+	lbpkr, err := exec.LookPath(os.Args[0])
 	if err != nil {
-		msg.Errorf("could not locate 'rpmbuild': %v\n", err)
+		msg.Errorf("could not locate '%s': %v\n", os.Args[0], err)
 		return err
 	}
 
-	tarcmd := newCommand("lbpkr",
-		"self", "bdist",
-		"-name="+name,
-		"-version="+vers,
-		fmt.Sprintf("-v=%v", debug),
-	)
-	tarcmd.Stdout = os.Stdout
-	tarcmd.Stderr = os.Stderr
-	tarcmd.Stdin = os.Stdin
-	err = tarcmd.Run()
+	lbpkr, err = filepath.EvalSymlinks(lbpkr)
 	if err != nil {
-		msg.Errorf("could not create tarball: %v\n", err)
+		msg.Errorf("could not find '%s' executable: %v\n", lbpkr, err)
 		return err
 	}
 
-	data := struct {
-		Url       string
-		Prefix    string
-		BuildRoot string
-		Name      string
-		Version   string
-		Release   int
-	}{
-		Url:       "http://github.com/lhcb-org/lbpkr",
-		Prefix:    cfg.Siteroot(),
-		BuildRoot: tmpdir,
-		Name:      name,
-		Version:   vers,
-		Release:   release,
-	}
-
 	rpm_arch := "x86_64"
 	switch runtime.GOARCH {
 	case "amd64":
@@ -122,59 +91,55 @@ func lbpkr_run_cmd_self_bdist_rpm(cmd *commander.Command, args []string) error {
 		rpm_arch = "i686"
 	}
 
-	rpm_fname := fmt.Sprintf("%s-%s-%d.%s.rpm", data.Name, data.Version, data.Release, rpm_arch)
+	// the RPM is relocatable: it can be installed under any siteroot
+	prefix := cfg.Siteroot()
+	spec := yum.RPMSpec{
+		Name:        name,
+		Version:     vers,
+		Release:     strconv.Itoa(release),
+		Arch:        rpm_arch,
+		Summary:     "lbpkr is a tool to install RPMs.",
+		Description: "lbpkr is a tool to install RPMs.",
+		License:     "BSD",
+		Group:       "Science",
+		URL:         "http://github.com/lhcb-org/lbpkr",
+		Prefixes:    []string{prefix},
+		Files: []yum.RPMFile{
+			{
+				Name:  path.Join(prefix, "usr", "bin", "lbpkr"),
+				Mode:  0755,
+				MTime: time.Now(),
+				Path:  lbpkr,
+			},
+		},
+	}
+
+	rpm_fname := fmt.Sprintf("%s-%s-%s.%s.rpm", spec.Name, spec.Version, spec.Release, spec.Arch)
 	msg.Infof("creating [%s]...\n", rpm_fname)
 
-	// prepare a tarball with the lbpkr binary.
-	dirname := fmt.Sprintf("%s-%s", data.Name, data.Version)
-	fname := dirname + ".tar.gz"
-	bdist_fname := dirname + "." + rpm_arch + ".tar.gz"
-
-	// create hierarchy of dirs for rpmbuild
-	for _, dir := range []string{"RPMS", "SRPMS", "BUILD", "SOURCES", "SPECS", "tmp"} {
-		err = os.MkdirAll(filepath.Join(rpmbuildroot, dir), 0755)
-		if err != nil {
-			return err
-		}
-	}
-
-	// copy tarball
-	err = bincp(filepath.Join(rpmbuildroot, "SOURCES", fname), bdist_fname)
+	f, err := os.Create(rpm_fname)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	// create spec-file
-	spec_fname := fmt.Sprintf("%s-%s-%d.spec", data.Name, data.Version, data.Release)
-	spec, err := os.Create(filepath.Join(
-		rpmbuildroot, "SPECS",
-		spec_fname,
-	))
+	err = yum.WriteRPM(f, &spec)
 	if err != nil {
+		os.Remove(rpm_fname)
 		return err
 	}
-	defer spec.Close()
-	t := template.Must(template.New("bdist-rpm-spec").Parse(rpm_tmpl))
-	err = t.Execute(spec, &data)
+	err = f.Close()
 	if err != nil {
 		return err
 	}
-	spec.Sync()
-	spec.Close()
 
-	rpm := newCommand(rpmbuild, "-ba", filepath.Join("SPECS", spec_fname))
-	rpm.Dir = rpmbuildroot
-	if debug {
-		rpm.Stdout = os.Stdout
-		rpm.Stderr = os.Stderr
-	}
-
-	err = rpm.Run()
+	// check the RPM can be read back
+	f, err = os.Open(rpm_fname)
 	if err != nil {
 		return err
 	}
-
-	err = bincp(rpm_fname, filepath.Join(rpmbuildroot, "RPMS", rpm_arch, rpm_fname))
+	defer f.Close()
+	hdr, err := yum.ReadRPMHeader(f)
 	if err != nil {
 		return err
 	}
@@ -182,56 +147,20 @@ func lbpkr_run_cmd_self_bdist_rpm(cmd *commander.Command, args []string) error {
 	msg.Infof("creating [%s]... [ok]\n", rpm_fname)
 
 	msg.Infof("content of [%s]:\n", rpm_fname)
-	rpm = newCommand("rpm", "-q", "-filesbypkg", "-p", rpm_fname)
-	rpm.Stdout = os.Stdout
-	rpm.Stderr = os.Stderr
-	err = rpm.Run()
-	if err != nil {
-		return err
+	for _, fname := range hdr.Files() {
+		fmt.Printf("%s\n", fname)
 	}
 
-	return err
-}
+	// let rpm validate the package too, when available
+	if _, err := exec.LookPath("rpm"); err == nil {
+		rpm := newCommand("rpm", "-qip", rpm_fname)
+		rpm.Stdout = os.Stdout
+		rpm.Stderr = os.Stderr
+		err = rpm.Run()
+		if err != nil {
+			return err
+		}
+	}
 
-const rpm_tmpl = `
-%define        __spec_install_post %{nil}
-%define          debug_package %{nil}
-%define        __os_install_post %{_dbpath}/brp-compress
-%define _topdir   {{.BuildRoot}}/rpmbuild
-%define _tmppath  %{_topdir}/tmp
-
-Summary: lbpkr is a tool to install RPMs.
-Name: {{.Name}}
-Version: {{.Version}}
-Release: {{.Release}}
-License: BSD
-Group: Science
-SOURCE0 : %{name}-%{version}.tar.gz
-URL: {{.Url}}
-## disable automatic dependencies extraction
-## FIXME(sbinet) remove when C-sqlite3 is not needed anymore.
-AutoReqProv: no
-
-BuildRoot: %{_tmppath}/%{name}-%{version}-%{release}-root
-
-%description
-%{summary}
-
-%prep
-%setup -q
-
-%build
-  
-%install
-rm -rf %{buildroot}
-mkdir -p  %{buildroot}/{{.Prefix}}
-/bin/cp -r ./* %{buildroot}/{{.Prefix}}
-
-%clean
-rm -rf %{buildroot}
-
-
-%files
-%defattr(-,root,root,-)
-/{{.Prefix}}/usr/bin/lbpkr
-`
+	return nil
+}
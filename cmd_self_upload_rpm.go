@@ -9,8 +9,12 @@ import (
 	"github.com/gonuts/commander"
 	"github.com/gonuts/flag"
 	"github.com/gonuts/logger"
+	"github.com/lhcb-org/lbpkr/yum"
 )
 
+// lhcbRPMDir is where the LHCb yum repositories are published
+const lhcbRPMDir = "/afs/cern.ch/lhcb/distribution/rpm"
+
 func lbpkr_make_cmd_self_upload_rpm() *commander.Command {
 	cmd := &commander.Command{
 		Run:       lbpkr_run_cmd_self_upload_rpm,
@@ -19,13 +23,18 @@ func lbpkr_make_cmd_self_upload_rpm() *commander.Command {
 		Long: `
 upload-rpm uploads a previously created RPM package containing lbpkr.
 
+The package is published (see 'lbpkr help publish') to the repository of
+the config type, or to the target given with -to.
+
 ex:
  $ lbpkr self upload-rpm lbpkr-0.1.20140620-0.x86_64.rpm
+ $ lbpkr self upload-rpm -type=atlas -to=https://example.org/dav/atlas lbpkr-0.1.20140620-0.x86_64.rpm
 `,
 		Flag: *flag.NewFlagSet("lbpkr-self-upload-rpm", flag.ExitOnError),
 	}
 	cmd.Flag.Bool("v", false, "enable verbose mode")
 	cmd.Flag.String("type", "lhcb", "config type (lhcb|atlas)")
+	cmd.Flag.String("to", "", "URL of the repository to publish to (default: the one of the config type)")
 	return cmd
 }
 
@@ -34,6 +43,7 @@ func lbpkr_run_cmd_self_upload_rpm(cmd *commander.Command, args []string) error
 
 	cfgtype := cmd.Flag.Lookup("type").Value.Get().(string)
 	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	to := cmd.Flag.Lookup("to").Value.Get().(string)
 
 	fname := ""
 	switch len(args) {
@@ -47,41 +57,43 @@ func lbpkr_run_cmd_self_upload_rpm(cmd *commander.Command, args []string) error
 		)
 	}
 
-	//cfg := NewConfig(cfgtype)
 	msg := logger.New("lbpkr")
 	if debug {
 		msg.SetLevel(logger.DEBUG)
 	}
 
-	msg.Infof("uploading [%s]...\n", fname)
-
-	switch cfgtype {
-	case "lhcb":
-		rpmdir := "/afs/cern.ch/lhcb/distribution/rpm"
-		dst := filepath.Join(rpmdir, "lhcb", fname)
-		err = bincp(dst, fname)
-		if err != nil {
-			msg.Errorf("could not copy [%s] into [%s] (err=%v)\n", fname, dst, err)
-			return err
+	// the LHCb repository also hosts the lbpkr executable, next to it
+	lhcb := false
+	if to == "" {
+		switch cfgtype {
+		case "lhcb":
+			to = filepath.Join(lhcbRPMDir, "lhcb")
+			lhcb = true
+		default:
+			return fmt.Errorf("lbpkr: no default repository for config type [%s] (use -to)", cfgtype)
 		}
+	}
 
-		msg.Debugf("updating metadata...\n")
-		updatecmd := filepath.Join(rpmdir, "update.sh")
-		regen := newCommand(updatecmd)
-		regen.Dir = rpmdir
-		regen.Stdout = os.Stdout
-		regen.Stderr = os.Stderr
-		regen.Stdin = os.Stdin
-		err = regen.Run()
-		if err != nil {
-			msg.Errorf("could not regenerate metadata: %v\n", err)
-			return err
-		}
-		msg.Debugf("updating metadata... [ok]\n")
+	msg.Infof("uploading [%s] to [%s]...\n", fname, to)
+
+	target, err := yum.NewPublishTarget(to)
+	if err != nil {
+		return err
+	}
+	pub := yum.NewPublisher(target)
+	if debug {
+		pub.SetLevel(logger.DEBUG)
+	}
+	err = pub.Publish(fname)
+	if err != nil {
+		msg.Errorf("could not publish [%s] to [%s]: %v\n", fname, to, err)
+		return err
+	}
 
+	if lhcb {
 		lbpkr, err := exec.LookPath(os.Args[0])
 		if err != nil {
-			msg.Errorf("could not locate '%s': %v\n", err, os.Args[0])
+			msg.Errorf("could not locate '%s': %v\n", os.Args[0], err)
 			return err
 		}
 
@@ -91,14 +103,11 @@ func lbpkr_run_cmd_self_upload_rpm(cmd *commander.Command, args []string) error
 			return err
 		}
 
-		err = bincp(filepath.Join(rpmdir, "lbpkr"), lbpkr)
+		err = bincp(filepath.Join(lhcbRPMDir, "lbpkr"), lbpkr)
 		if err != nil {
 			msg.Errorf("could not copy 'lbpkr': %v\n", err)
 			return err
 		}
-
-	default:
-		return fmt.Errorf("lbpkr: config type [%s] not handled", cfgtype)
 	}
 
 	msg.Infof("uploading [%s]... [ok]\n", fname)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_serve() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_serve,
+		UsageLine: "serve [options]",
+		Short:     "run a caching proxy for the yum repositories",
+		Long: `
+serve runs a pull-through caching proxy for the configured yum repositories,
+e.g. to spare the remote repositories the requests of all the nodes of a farm.
+
+Each repository is served under /<repo-name>/. The repository metadata is
+checked against the remote repository on each request (the cached one being
+served when the remote repository is unavailable). The RPMs are downloaded on
+first request, checked against the checksum of the repository metadata and
+cached. The RPMs already downloaded under the siteroot are served directly,
+unless -local=false.
+
+ex:
+ $ lbpkr serve -listen :8080
+ $ lbpkr serve -listen :8080 -cachedir /data/lbpkr-cache
+
+ # on the nodes
+ $ lbpkr repo-add lhcb-proxy http://proxy.example.org:8080/lhcb
+`,
+		Flag: *flag.NewFlagSet("lbpkr-serve", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.String("listen", ":8080", "address to listen on")
+	cmd.Flag.String("cachedir", "", "directory of the cache (default: under the siteroot)")
+	cmd.Flag.Bool("local", true, "serve the RPMs downloaded under the siteroot")
+	return cmd
+}
+
+func lbpkr_run_cmd_serve(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	addr := cmd.Flag.Lookup("listen").Value.Get().(string)
+	cachedir := cmd.Flag.Lookup("cachedir").Value.Get().(string)
+	local := cmd.Flag.Lookup("local").Value.Get().(bool)
+
+	if len(args) != 0 {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n=0. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+
+	cfg := NewConfig(siteroot)
+	ctx, err := New(cfg, Debug(debug))
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	err = ctx.Serve(addr, cachedir, local)
+	return err
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_snapshot() *commander.Command {
+	cmd := &commander.Command{
+		UsageLine: "snapshot [options]",
+		Short:     "manage the snapshots of the repositories metadata",
+		Subcommands: []*commander.Command{
+			lbpkr_make_cmd_snapshot_ls(),
+			lbpkr_make_cmd_snapshot_prune(),
+			lbpkr_make_cmd_snapshot_rm(),
+		},
+		Flag: *flag.NewFlagSet("lbpkr-snapshot", flag.ExitOnError),
+	}
+	return cmd
+}
+
+// EOF
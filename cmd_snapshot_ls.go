@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+	"github.com/lhcb-org/lbpkr/yum"
+)
+
+func lbpkr_make_cmd_snapshot_ls() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_snapshot_ls,
+		UsageLine: "ls [options] [repo-name...]",
+		Short:     "list the snapshots of the repositories metadata",
+		Long: `
+ls lists the snapshots of the metadata of the repositories (or of the given
+repositories), taken each time new metadata was downloaded.
+The snapshot in use is marked with a '*'.
+
+Any command can be run against a snapshot with the global -snapshot option,
+given the ID of a snapshot or a date (the latest snapshot taken at that date
+is then used for each repository). Dates without a time zone are in local
+time, as the dates listed.
+
+ex:
+ $ lbpkr snapshot ls
+ $ lbpkr snapshot ls lhcb
+ $ lbpkr -snapshot=20141020T101530Z install-project BRUNEL v47r0
+ $ lbpkr -snapshot=2014-10-20 install-project BRUNEL v47r0
+`,
+		Flag: *flag.NewFlagSet("lbpkr-snapshot-ls", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	return cmd
+}
+
+func lbpkr_run_cmd_snapshot_ls(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+
+	cfg := NewConfig(siteroot)
+	snaps, err := yum.Snapshots(cfg.Siteroot())
+	if err != nil {
+		return err
+	}
+
+	repos := make(map[string]bool, len(args))
+	for _, name := range args {
+		repos[name] = true
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "  REPO\tSNAPSHOT\tREVISION\tDATE\n")
+	for _, snap := range snaps {
+		if len(repos) > 0 && !repos[snap.Repo] {
+			continue
+		}
+		mark := " "
+		if snap.Current {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%s %s\t%s\t%s\t%s\n",
+			mark, snap.Repo, snap.ID, snap.Revision,
+			snap.Timestamp.Local().Format("2006-01-02 15:04:05"),
+		)
+	}
+	return w.Flush()
+}
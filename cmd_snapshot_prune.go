@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+	"github.com/lhcb-org/lbpkr/yum"
+)
+
+func lbpkr_make_cmd_snapshot_prune() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_snapshot_prune,
+		UsageLine: "prune [options] [repo-name...]",
+		Short:     "remove the old snapshots of the repositories metadata",
+		Long: `
+prune removes the snapshots of the metadata of the repositories (or of the
+given repositories), but the latest ones and the ones in use.
+
+Old snapshots are also pruned each time new metadata is downloaded, keeping
+the snapshot_keep latest ones set in the [main] section of etc/yum.conf.
+
+ex:
+ $ lbpkr snapshot prune
+ $ lbpkr snapshot prune -keep=3 lhcb
+`,
+		Flag: *flag.NewFlagSet("lbpkr-snapshot-prune", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.Int("keep", yum.DefaultSnapshotKeep, "number of snapshots to keep for each repository")
+	return cmd
+}
+
+func lbpkr_run_cmd_snapshot_prune(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	keep := cmd.Flag.Lookup("keep").Value.Get().(int)
+
+	cfg := NewConfig(siteroot)
+	snaps, err := yum.PruneSnapshots(cfg.Siteroot(), keep, args...)
+	for _, snap := range snaps {
+		fmt.Printf("removed snapshot %s of %s\n", snap.ID, snap.Repo)
+	}
+	return err
+}
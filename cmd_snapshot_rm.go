@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+	"github.com/lhcb-org/lbpkr/yum"
+)
+
+func lbpkr_make_cmd_snapshot_rm() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_snapshot_rm,
+		UsageLine: "rm [options] <repo-name> <snapshot>...",
+		Short:     "remove snapshots of the metadata of a repository",
+		Long: `
+rm removes the snapshots of the metadata of a repository, given their ID or a
+date (the latest snapshot taken at that date is then removed).
+The snapshot in use can not be removed.
+
+ex:
+ $ lbpkr snapshot rm lhcb 20141020T101530Z
+ $ lbpkr snapshot rm lhcb 2014-10-20
+`,
+		Flag: *flag.NewFlagSet("lbpkr-snapshot-rm", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	return cmd
+}
+
+func lbpkr_run_cmd_snapshot_rm(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+
+	if len(args) < 2 {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n>=2. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+
+	cfg := NewConfig(siteroot)
+	for _, spec := range args[1:] {
+		snap, err := yum.RemoveSnapshot(cfg.Siteroot(), args[0], spec)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed snapshot %s of %s\n", snap.ID, snap.Repo)
+	}
+	return err
+}
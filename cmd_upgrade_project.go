@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+)
+
+func lbpkr_make_cmd_upgrade_project() *commander.Command {
+	cmd := &commander.Command{
+		Run:       lbpkr_run_cmd_upgrade_project,
+		UsageLine: "upgrade-project [options] <project-name>",
+		Short:     "switch a project to a new version on all its installed platforms",
+		Long: `
+upgrade-project installs a new version of a project for all the platforms the
+latest installed version of that project is installed for, and then removes
+the builds of the old version (unless -keep-old is given).
+
+-to selects the new version, with a version constraint as for install-project.
+It defaults to the latest available version.
+Platforms for which the new version is not available are kept at the old version.
+
+ex:
+ $ lbpkr upgrade-project -dry-run LHCB
+ $ lbpkr upgrade-project LHCB
+ $ lbpkr upgrade-project -to=v37r3 LHCB
+ $ lbpkr upgrade-project -to='<v38r0' -keep-old LHCB
+`,
+		Flag: *flag.NewFlagSet("lbpkr-upgrade-project", flag.ExitOnError),
+	}
+	add_default_options(cmd)
+	cmd.Flag.String("to", "latest", "version (constraint) to upgrade to")
+	cmd.Flag.Bool("keep-old", false, "keep the builds of the old version")
+	cmd.Flag.Bool("dry-run", false, "dry run. only print the plan of the upgrade")
+	return cmd
+}
+
+func lbpkr_run_cmd_upgrade_project(cmd *commander.Command, args []string) error {
+	var err error
+
+	siteroot := cmd.Flag.Lookup("siteroot").Value.Get().(string)
+	debug := cmd.Flag.Lookup("v").Value.Get().(bool)
+	to := cmd.Flag.Lookup("to").Value.Get().(string)
+	keep := cmd.Flag.Lookup("keep-old").Value.Get().(bool)
+	dry := cmd.Flag.Lookup("dry-run").Value.Get().(bool)
+
+	if len(args) != 1 {
+		cmd.Usage()
+		return fmt.Errorf("lbpkr: invalid number of arguments. expected n=1. got=%d (%v)",
+			len(args),
+			args,
+		)
+	}
+	projname := args[0]
+
+	cfg := NewConfig(siteroot)
+	ctx, err := New(cfg, Debug(debug), EnableDryRun(dry))
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	ctx.msg.Infof("upgrading project %s to %s\n", projname, to)
+
+	err = ctx.UpgradeProject(projname, to, keep)
+	return err
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -83,10 +86,17 @@ type Context struct {
 		NoDeps  bool // do not install package dependencies
 		JustDb  bool // update the database, but do not modify the filesystem
 		Package Mode // update mode of packages (Install|Update|Upgrade)
+
+		CacheOnly bool   // only use the local metadata cache
+		Refresh   bool   // refresh the metadata of all repositories
+		Snapshot  string // snapshot of the metadata to use (ID or date), if any
+		CacheDir  string // cache of the repositories metadata, if not the siteroot one
 	}
 
 	ndls int // number of concurrent downloads
 
+	repos []*yum.RepoConfig // repositories used instead of the configured ones, if any
+
 	sigch   chan os.Signal
 	submux  sync.RWMutex // mutex on subcommands
 	subcmds []*exec.Cmd  // list of subcommands launched by lbpkr
@@ -136,6 +146,50 @@ func EnableJustDb(justdb bool) func(*Context) {
 	}
 }
 
+// EnableCacheOnly makes lbpkr only use the local metadata cache, never contacting
+// the remote repositories.
+func EnableCacheOnly(cacheonly bool) func(*Context) {
+	return func(ctx *Context) {
+		ctx.options.CacheOnly = cacheonly
+	}
+}
+
+// EnableRefresh forces the refresh of the metadata of all repositories,
+// regardless of their metadata_expire setting.
+func EnableRefresh(refresh bool) func(*Context) {
+	return func(ctx *Context) {
+		ctx.options.Refresh = refresh
+	}
+}
+
+// UseSnapshot makes lbpkr use the snapshots of the repositories metadata
+// selected by spec, a snapshot ID or a date (see 'lbpkr snapshot ls'), instead
+// of the current metadata.
+func UseSnapshot(spec string) func(*Context) {
+	return func(ctx *Context) {
+		ctx.options.Snapshot = spec
+	}
+}
+
+// UseRepository makes the Context only use the repository name located at url.
+// The repositories configured under the siteroot are neither used nor modified,
+// and the metadata of the repository is always checked again.
+func UseRepository(name, url string) func(*Context) {
+	return func(ctx *Context) {
+		ctx.repos = append(ctx.repos, &yum.RepoConfig{Name: name, Url: url})
+		ctx.options.CacheOnly = false
+		ctx.options.Snapshot = ""
+	}
+}
+
+// UseCacheDir makes lbpkr cache the metadata of the repositories under dir,
+// instead of under the siteroot.
+func UseCacheDir(dir string) func(*Context) {
+	return func(ctx *Context) {
+		ctx.options.CacheDir = dir
+	}
+}
+
 func New(cfg Config, options ...func(*Context)) (*Context, error) {
 	var err error
 	siteroot := cfg.Siteroot()
@@ -163,6 +217,8 @@ func New(cfg Config, options ...func(*Context)) (*Context, error) {
 		atexit:    make([]func(), 0),
 	}
 
+	// global -C/-cacheonly and -snapshot flags. may be overridden by the options.
+	options = append([]func(*Context){EnableCacheOnly(g_cacheonly), UseSnapshot(g_snapshot)}, options...)
 	for _, opt := range options {
 		opt(&ctx)
 	}
@@ -198,7 +254,18 @@ func New(cfg Config, options ...func(*Context)) (*Context, error) {
 		return nil, err
 	}
 
-	ctx.yum, err = yum.New(ctx.siteroot)
+	yumopts := []func(*yum.Client){
+		yum.CacheOnly(ctx.options.CacheOnly),
+		yum.Refresh(ctx.options.Refresh),
+		yum.Snapshot(ctx.options.Snapshot),
+	}
+	if len(ctx.repos) > 0 {
+		yumopts = append(yumopts, yum.Repositories(ctx.repos...))
+	}
+	if ctx.options.CacheDir != "" {
+		yumopts = append(yumopts, yum.CacheDir(ctx.options.CacheDir))
+	}
+	ctx.yum, err = yum.New(ctx.siteroot, yumopts...)
 	if err != nil {
 		return nil, err
 	}
@@ -378,6 +445,11 @@ func (ctx *Context) initYum() error {
 		}
 	}
 
+	if len(ctx.repos) > 0 {
+		// do not touch the configured repositories
+		return err
+	}
+
 	err = ctx.cfg.InitYum(ctx)
 	if err != nil {
 		return err
@@ -496,6 +568,12 @@ enabled=1
 		data["name"],
 		data["url"],
 	)
+	if err != nil {
+		return err
+	}
+	if v, ok := data["skip_if_unavailable"]; ok {
+		_, err = fmt.Fprintf(w, "skip_if_unavailable=%s\n", v)
+	}
 	return err
 }
 
@@ -700,7 +778,7 @@ func (ctx *Context) getNotInstalledPackageDeps(pkg Package) ([]Package, error) {
 
 		pkg.Mode = mode
 		if !ctx.isRPMInstalled(pkg.Name(), pkg.Version(), pkg.Release()) {
-			pkgset[pkg.RPMName()] = pkg
+			pkgset[pkg.ID()] = pkg
 		}
 
 		for _, rpkg := range rpkgs {
@@ -712,7 +790,7 @@ func (ctx *Context) getNotInstalledPackageDeps(pkg Package) ([]Package, error) {
 				return nil, err
 			}
 			for _, opkg := range opkgs {
-				pkgset[opkg.RPMName()] = opkg
+				pkgset[opkg.ID()] = opkg
 			}
 		}
 		pkgs := make([]Package, 0, len(pkgset))
@@ -728,7 +806,7 @@ func (ctx *Context) getNotInstalledPackageDeps(pkg Package) ([]Package, error) {
 	}
 
 	for _, p := range pkgs {
-		pkgset[p.RPMName()] = p
+		pkgset[p.ID()] = p
 	}
 
 	pkgs = pkgs[:0]
@@ -789,30 +867,68 @@ func (ctx *Context) InstallRPMs(rpms []string) error {
 
 // InstallProject installs a whole project by name
 func (ctx *Context) InstallProject(name, version, release, platforms string) error {
+	install, archs, err := ctx.findProjectBuilds(name, version, platforms)
+	if err != nil {
+		return err
+	}
+
+	ctx.msg.Infof("installing project name=%q version=%q for archs=%v\n",
+		name, version, archs,
+	)
+
+	if len(install) <= 0 {
+		ctx.msg.Errorf("found NO project matching this description\n")
+		return fmt.Errorf("could not find a project with name=%q version=%q and archs=%v",
+			name, version, archs,
+		)
+	}
+
+	ctx.msg.Infof("found %d project(s) matching this description:\n", len(install))
+	pnames := make([]string, 0, len(install))
+	for _, pkg := range install {
+		pnames = append(pnames, pkg.Name())
+	}
+	sort.Strings(pnames)
+	for _, pkg := range pnames {
+		fmt.Printf("%s\n", pkg)
+	}
+
+	err = ctx.InstallPackages(install)
+	return err
+}
+
+// findProjectBuilds finds the builds of project name available from the
+// repositories, for the versions matching the constraint version and the
+// requested platforms (see selectProjectBuilds).
+func (ctx *Context) findProjectBuilds(name, version, platforms string) ([]Package, []string, error) {
 	var err error
 
-	install := make([]Package, 0, 2)
 	plist := make([]Package, 0, 2)
 	versions := make([]string, 0, 1)
 
+	cons, err := ParseVersionConstraint(version)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// find all available project versions
-	switch version {
-	case "":
+	switch {
+	case cons.Exact():
+		versions = []string{version}
+
+	default:
 		pname := name + `_(?P<ProjectVersion>.*?)_index`
 		projs, err := ctx.yum.ListPackages(pname, "", "")
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		re := regexp.MustCompile(pname)
 		for _, proj := range projs {
 			sub := re.FindStringSubmatch(proj.Name())
-			if len(sub) > 0 {
-				versions = append(versions, sub[1])
+			if len(sub) > 0 && cons.Match(sub[1]) {
+				versions = append(versions, regexp.QuoteMeta(sub[1]))
 			}
 		}
-
-	default:
-		versions = []string{version}
 	}
 
 	// collect available projects+versions
@@ -821,7 +937,7 @@ func (ctx *Context) InstallProject(name, version, release, platforms string) err
 		pname := name + "_(" + vers + `)_(?P<ProjectArch>.*?)`
 		pkgs, err := ctx.yum.ListPackages(pname, "", "")
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		re := regexp.MustCompile(pname)
 		for _, pkg := range pkgs {
@@ -845,7 +961,7 @@ func (ctx *Context) InstallProject(name, version, release, platforms string) err
 		set := make(map[string][]string)
 		pkgs, err := ctx.yum.ListPackages("", "", "")
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		for _, pkg := range pkgs {
 			sub := re.FindStringSubmatch(pkg.Name())
@@ -866,22 +982,48 @@ func (ctx *Context) InstallProject(name, version, release, platforms string) err
 		}
 		w.Flush()
 
-		return fmt.Errorf("could not find a project with name=%q version=%q and archs=%q",
+		return nil, nil, fmt.Errorf("could not find a project with name=%q version=%q and archs=%q",
 			name, version, platforms,
 		)
 	}
 
+	return ctx.selectProjectBuilds(name, cons, platforms, plist)
+}
+
+// selectProjectBuilds selects the builds of project name in plist matching the
+// requested platforms and version constraint.
+// platforms is either a comma-separated list of platforms, "all", "host" or "compatible".
+// It defaults to $CMTCONFIG, or to all platforms if $CMTCONFIG is not defined.
+func (ctx *Context) selectProjectBuilds(name string, cons *VersionConstraint, platforms string, plist []Package) ([]Package, []string, error) {
+	var err error
+	var install []Package
+
 	if platforms == "" {
 		// if no CMTCONFIG defined, we'll default to "ALL"
 		// CMTCONFIG is of the form        'x86_64-slc6-gcc48-opt'
 		// but the RPM-platform names are: 'x86_64_slc6_gcc48_opt'
-		platforms = strings.Replace(os.Getenv("CMTCONFIG"), "-", "_", -1)
+		if cmtconfig := os.Getenv("CMTCONFIG"); cmtconfig != "" {
+			p, err := ParsePlatform(cmtconfig)
+			switch err {
+			case nil:
+				platforms = p.RPMName()
+			default:
+				ctx.msg.Warnf("%v\n", err)
+				platforms = strings.Replace(cmtconfig, "-", "_", -1)
+			}
+		}
 	}
 
 	archs := make([]string, 0, 2)
 	switch platforms {
 	case "", "ALL", "all":
 		archs = nil
+	case "host", "compatible":
+		native := platforms == "host"
+		install, archs, err = ctx.selectProjectPlatforms(name, plist, native)
+		if err != nil {
+			return nil, nil, err
+		}
 	default:
 		for _, v := range strings.Split(platforms, ",") {
 			v = strings.TrimSpace(v)
@@ -891,7 +1033,7 @@ func (ctx *Context) InstallProject(name, version, release, platforms string) err
 		}
 	}
 
-	{
+	if install == nil {
 		archset := make(map[string]struct{})
 		arch := `.*`
 		if len(archs) > 0 {
@@ -908,8 +1050,8 @@ func (ctx *Context) InstallProject(name, version, release, platforms string) err
 		}
 
 		if len(archset) <= 0 {
-			return fmt.Errorf("could not find a project with name=%q version=%q and platforms=%v",
-				name, version, platforms,
+			return nil, nil, fmt.Errorf("could not find a project with name=%q version=%q and platforms=%v",
+				name, cons, platforms,
 			)
 		}
 
@@ -919,29 +1061,114 @@ func (ctx *Context) InstallProject(name, version, release, platforms string) err
 		}
 	}
 
-	ctx.msg.Infof("installing project name=%q version=%q for archs=%v\n",
-		name, version, archs,
-	)
+	if cons.Latest() {
+		install = latestProjectBuilds(name, install, platforms == "host" || platforms == "compatible")
+	}
+
+	return install, archs, err
+}
+
+// selectProjectPlatforms selects, for each version of the project name in plist,
+// the build best suited for the host platform.
+// If native is true, only native builds are considered.
+func (ctx *Context) selectProjectPlatforms(name string, plist []Package, native bool) ([]Package, []string, error) {
+	host, err := HostPlatform()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	builds := make(map[string]map[Platform]Package)
+	for _, pkg := range plist {
+		version, platform := splitProjectPackage(name, pkg.Name())
+		p, err := ParsePlatform(platform)
+		if err != nil {
+			ctx.msg.Debugf("skipping %s: %v\n", pkg.Name(), err)
+			continue
+		}
+		if builds[version] == nil {
+			builds[version] = make(map[Platform]Package)
+		}
+		builds[version][p] = pkg
+	}
+
+	versions := make([]string, 0, len(builds))
+	for v := range builds {
+		versions = append(versions, v)
+	}
+	sort.Sort(projectVersions(versions))
+
+	install := make([]Package, 0, len(versions))
+	archset := make(map[string]struct{})
+	for _, v := range versions {
+		avail := make([]Platform, 0, len(builds[v]))
+		for p := range builds[v] {
+			avail = append(avail, p)
+		}
+		sort.Sort(platformsByName(avail))
+
+		p, reason, ok := host.SelectPlatform(avail, native)
+		if !ok {
+			ctx.msg.Warnf("%s %s: no build suitable for host platform %s (available: %v)\n",
+				name, v, host, avail,
+			)
+			continue
+		}
+		ctx.msg.Infof("%s %s: selected platform %s for host platform %s (%s)\n",
+			name, v, p, host, reason,
+		)
+		install = append(install, builds[v][p])
+		archset[p.RPMName()] = struct{}{}
+	}
 
 	if len(install) <= 0 {
-		ctx.msg.Errorf("found NO project matching this description\n")
-		return fmt.Errorf("could not find a project with name=%q version=%q and archs=%v",
-			name, version, archs,
+		return nil, nil, fmt.Errorf("lbpkr: could not find a build of project %q suitable for host platform %s",
+			name, host,
 		)
 	}
 
-	ctx.msg.Infof("found %d project(s) matching this description:\n", len(install))
-	pnames := make([]string, 0, len(install))
-	for _, pkg := range install {
-		pnames = append(pnames, pkg.Name())
+	archs := make([]string, 0, len(archset))
+	for k := range archset {
+		archs = append(archs, k)
 	}
-	sort.Strings(pnames)
-	for _, pkg := range pnames {
-		fmt.Printf("%s\n", pkg)
+	sort.Strings(archs)
+	return install, archs, nil
+}
+
+// splitProjectPackage splits the name of a package of project name,
+// <NAME>_<VERSION>_<PLATFORM>, into its version and platform.
+func splitProjectPackage(name, pkgname string) (version, platform string) {
+	toks := strings.SplitN(strings.TrimPrefix(pkgname, name+"_"), "_", 2)
+	if len(toks) != 2 {
+		return toks[0], ""
 	}
+	return toks[0], toks[1]
+}
 
-	err = ctx.InstallPackages(install)
-	return err
+// latestProjectBuilds filters the builds of project name, keeping the latest version
+// for each platform. If single is true, only the latest version overall is kept.
+func latestProjectBuilds(name string, pkgs []Package, single bool) []Package {
+	latest := make(map[string]string)
+	for _, pkg := range pkgs {
+		version, platform := splitProjectPackage(name, pkg.Name())
+		if single {
+			platform = ""
+		}
+		if v, ok := latest[platform]; !ok || lessVersion(v, version) {
+			latest[platform] = version
+		}
+	}
+
+	out := make([]Package, 0, len(latest))
+	for _, pkg := range pkgs {
+		version, platform := splitProjectPackage(name, pkg.Name())
+		if single {
+			platform = ""
+		}
+		if latest[platform] == version {
+			out = append(out, pkg)
+		}
+	}
+	return out
 }
 
 // InstallPackage installs a specific RPM, checking if not already installed
@@ -961,7 +1188,7 @@ func (ctx *Context) InstallPackages(packages []Package) error {
 		if ctx.options.NoDeps {
 			dodeps = " (w/o dependencies)"
 		}
-		ctx.msg.Infof("installing %s%s\n", pkg.RPMName(), dodeps)
+		ctx.msg.Infof("installing %s%s\n", pkg.ID(), dodeps)
 		if pkg.Name() == "lbpkr" {
 			pkgs = append(pkgs, pkg)
 			continue
@@ -981,7 +1208,7 @@ func (ctx *Context) InstallPackages(packages []Package) error {
 	}
 
 	for _, p := range pkgs {
-		pkgset[p.RPMName()] = p
+		pkgset[p.ID()] = p
 	}
 	pkgs = pkgs[:0]
 	for _, p := range pkgset {
@@ -992,7 +1219,7 @@ func (ctx *Context) InstallPackages(packages []Package) error {
 	ctx.msg.Infof("found %d RPMs to install:\n", npkgs)
 	pkgnames := make([]string, 0, npkgs)
 	for _, p := range pkgs {
-		pkgnames = append(pkgnames, p.RPMName())
+		pkgnames = append(pkgnames, p.ID())
 	}
 	sort.Strings(pkgnames)
 	for i, rpm := range pkgnames {
@@ -1108,6 +1335,142 @@ func (ctx *Context) ListInstalledPackages(name, version, release string) ([]*yum
 	return pkgs, err
 }
 
+// RepoQuery describes a query over the content of the yum repositories
+type RepoQuery struct {
+	Name    string // regexp on the package name
+	Version string // regexp on the package version
+	Release string // regexp on the package release
+
+	Repo         string // restrict the query to this repository
+	WhatProvides string // select the packages providing this capability
+	WhatRequires string // select the packages requiring this capability
+
+	Requires    bool   // list the requirements of the selected packages
+	Provides    bool   // list the capabilities provided by the selected packages
+	Location    bool   // list the download URLs of the selected packages
+	QueryFormat string // format of the selected packages (e.g. "%{name}-%{version}")
+}
+
+// RepoQuery runs a query over the yum repositories and prints the result
+func (ctx *Context) RepoQuery(q RepoQuery) ([]*yum.Package, error) {
+	var err error
+
+	var repo *yum.Repository
+	if q.Repo != "" {
+		repo = ctx.yum.Repository(q.Repo)
+		if repo == nil {
+			return nil, fmt.Errorf("lbpkr: no such repository %q", q.Repo)
+		}
+	}
+
+	var pkgs []*yum.Package
+	switch {
+	case q.WhatProvides != "" || q.WhatRequires != "":
+		var capability *yum.Requires
+		capstr := q.WhatProvides
+		if capstr == "" {
+			capstr = q.WhatRequires
+		}
+		capability, err = yum.ParseCapability(capstr)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case q.WhatProvides != "" && repo != nil:
+			pkgs = repo.WhatProvides(capability)
+		case q.WhatProvides != "":
+			pkgs = ctx.yum.WhatProvides(capability)
+		case repo != nil:
+			pkgs = repo.WhatRequires(capability)
+		default:
+			pkgs = ctx.yum.WhatRequires(capability)
+		}
+
+	case repo != nil:
+		pkgs = repo.GetPackages()
+
+	default:
+		pkgs = ctx.yum.GetPackages()
+	}
+
+	pkgs, err = filterPackages(pkgs, q.Name, q.Version, q.Release)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(yum.Packages(pkgs))
+
+	switch {
+	case q.Requires || q.Provides:
+		caps := make(map[string]struct{})
+		for _, pkg := range pkgs {
+			if q.Requires {
+				for _, req := range pkg.Requires() {
+					caps[yum.FormatCapability(req)] = struct{}{}
+				}
+			}
+			if q.Provides {
+				for _, prov := range pkg.Provides() {
+					caps[yum.FormatCapability(prov)] = struct{}{}
+				}
+			}
+		}
+		lines := make([]string, 0, len(caps))
+		for c := range caps {
+			lines = append(lines, c)
+		}
+		sort.Strings(lines)
+		for _, line := range lines {
+			fmt.Printf("%s\n", line)
+		}
+
+	case q.Location:
+		for _, pkg := range pkgs {
+			fmt.Printf("%s\n", pkg.Url())
+		}
+
+	default:
+		qf := q.QueryFormat
+		if qf == "" {
+			qf = "%{name}-%{version}-%{release}"
+		}
+		for _, pkg := range pkgs {
+			str, err := yum.QueryFormat(qf, pkg)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("%s\n", str)
+		}
+	}
+
+	return pkgs, err
+}
+
+// filterPackages returns the packages matching the name, version and release regexps
+func filterPackages(pkgs []*yum.Package, name, version, release string) ([]*yum.Package, error) {
+	re_name, err := regexp.Compile(name)
+	if err != nil {
+		return nil, err
+	}
+	re_vers, err := regexp.Compile(version)
+	if err != nil {
+		return nil, err
+	}
+	re_rel, err := regexp.Compile(release)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*yum.Package, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		if re_name.MatchString(pkg.Name()) &&
+			re_vers.MatchString(pkg.Version()) &&
+			re_rel.MatchString(pkg.Release()) {
+			out = append(out, pkg)
+		}
+	}
+	return out, err
+}
+
 // Provides lists all installed packages providing filename
 func (ctx *Context) Provides(filename string) ([]*yum.Package, error) {
 	var err error
@@ -1213,78 +1576,274 @@ func (ctx *Context) ListPackageDeps(name, version, release string, depthmax int)
 	return deps, err
 }
 
+// ListHostProvided lists the requirements satisfied by the host system during
+// dependency resolution, together with the host capability satisfying them.
+func (ctx *Context) ListHostProvided() {
+	hcs := ctx.yum.HostProvided()
+	reqs := make([]string, 0, len(hcs))
+	for req := range hcs {
+		reqs = append(reqs, req)
+	}
+	sort.Strings(reqs)
+	for _, req := range reqs {
+		fmt.Printf("%s <- host %v\n", req, hcs[req])
+	}
+}
+
 // RemoveRPM removes a (set of) RPM(s) by name
 func (ctx *Context) RemoveRPM(rpms [][3]string, force bool) error {
 	var err error
 	var required []*yum.Requires
 
-	args := []string{"-e"}
-	if force {
-		args = append(args, "--nodeps")
+	names := make([]string, 0, len(rpms))
+	removed := make(map[string]struct{}, len(rpms))
+	for _, id := range rpms {
+		pkg, err := ctx.yum.FindLatestProvider(id[0], id[1], id[2])
+		if err != nil {
+			return err
+		}
+
+		required = append(required, pkg.Requires()...)
+		names = append(names, pkg.Name())
+		removed[pkg.Name()] = struct{}{}
 	}
 
-	if ctx.options.DryRun {
-		args = append(args, "--test")
+	err = ctx.removePackages(names, force)
+	if err != nil {
+		return err
 	}
 
-	for _, id := range rpms {
-		pkg, err := ctx.yum.FindLatestProvider(id[0], id[1], id[2])
+	orphans, err := ctx.orphanedPackages(required, removed)
+	if err != nil {
+		return err
+	}
+	if len(orphans) > 0 {
+		ctx.msg.Infof("packages no longer required: %v\n", strings.Join(packageIDs(orphans), " "))
+	}
+	return err
+}
+
+// RemoveProject removes the installed builds of a project, together with the
+// index of the versions for which no build is left installed.
+// version and platforms are as for InstallProject.
+// If orphans is true, the packages (externals, ...) no longer required once the
+// project is removed are removed as well.
+func (ctx *Context) RemoveProject(name, version, platforms string, force, orphans bool) error {
+	var err error
+
+	cons, err := ParseVersionConstraint(version)
+	if err != nil {
+		return err
+	}
+
+	installed, err := ctx.listInstalledPackages()
+	if err != nil {
+		return err
+	}
+
+	// collect installed projects+versions
+	plist := make([]Package, 0, 2)
+	index := make(map[string]string) // version -> name of the index package
+	builds := make(map[string]int)   // version -> number of installed builds
+	for _, inst := range installed {
+		if !strings.HasPrefix(inst[0], name+"_") {
+			continue
+		}
+		v, platform := splitProjectPackage(name, inst[0])
+		if platform == "" || !cons.Match(v) {
+			continue
+		}
+		if platform == "index" {
+			index[v] = inst[0]
+			continue
+		}
+		builds[v]++
+		pkg, err := ctx.yum.FindLatestProvider(inst[0], inst[1], inst[2])
 		if err != nil {
-			return err
+			ctx.msg.Warnf("%s-%s-%s is not available from the repositories: %v\n",
+				inst[0], inst[1], inst[2], err,
+			)
+			pkg = yum.NewPackage(inst[0], inst[1], inst[2], "")
+		}
+		plist = append(plist, Package{pkg, InstallMode})
+	}
+
+	if len(plist) <= 0 {
+		return fmt.Errorf("lbpkr: no installed project with name=%q version=%q", name, version)
+	}
+
+	remove, archs, err := ctx.selectProjectBuilds(name, cons, platforms, plist)
+	if err != nil {
+		return err
+	}
+
+	// remove the index of the versions left without any build
+	for _, pkg := range remove {
+		v, _ := splitProjectPackage(name, pkg.Name())
+		builds[v]--
+	}
+	for v, n := range builds {
+		if n > 0 || index[v] == "" {
+			continue
 		}
+		remove = append(remove, Package{yum.NewPackage(index[v], "", "", ""), InstallMode})
+	}
 
+	ctx.msg.Infof("removing project name=%q version=%q for archs=%v\n",
+		name, version, archs,
+	)
+
+	var required []*yum.Requires
+	names := make([]string, 0, len(remove))
+	removed := make(map[string]struct{}, len(remove))
+	for _, pkg := range remove {
 		required = append(required, pkg.Requires()...)
-		args = append(args, pkg.Name())
+		names = append(names, pkg.Name())
+		removed[pkg.Name()] = struct{}{}
+	}
+	sort.Strings(names)
+	ctx.msg.Infof("found %d package(s) matching this description:\n", len(names))
+	for _, pkg := range names {
+		fmt.Printf("%s\n", pkg)
+	}
+
+	err = ctx.removePackages(names, force)
+	if err != nil {
+		return err
+	}
+
+	for {
+		pkgs, err := ctx.orphanedPackages(required, removed)
+		if err != nil {
+			return err
+		}
+		if len(pkgs) <= 0 {
+			break
+		}
+		ids := strings.Join(packageIDs(pkgs), " ")
+		if !orphans {
+			ctx.msg.Infof("packages no longer required: %v\n", ids)
+			ctx.msg.Infof("(use -orphans to remove them as well)\n")
+			break
+		}
+
+		ctx.msg.Infof("removing packages no longer required: %v\n", ids)
+		required = required[:0]
+		names = names[:0]
+		for _, pkg := range pkgs {
+			required = append(required, pkg.Requires()...)
+			names = append(names, pkg.Name())
+			removed[pkg.Name()] = struct{}{}
+		}
+		err = ctx.removePackages(names, force)
+		if err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// removePackages runs rpm to erase the packages by name
+func (ctx *Context) removePackages(names []string, force bool) error {
+	args := []string{"-e"}
+	if force {
+		args = append(args, "--nodeps")
 	}
 
-	_, err = ctx.rpm(true, args...)
+	if ctx.options.DryRun {
+		args = append(args, "--test")
+	}
+
+	args = append(args, names...)
+	_, err := ctx.rpm(true, args...)
 	if err != nil {
 		//ctx.msg.Errorf("could not remove package:\n%v", string(out))
 		return err
 	}
+	return err
+}
 
-	if len(required) > 0 {
-		reqs := make([]*yum.Package, 0, len(required))
-		for _, req := range required {
-			p, err := ctx.yum.FindLatestProvider(req.Name(), req.Version(), req.Release())
-			if err != nil {
+// orphanedPackages returns the installed packages satisfying the required
+// capabilities which are not required anymore by any other installed package.
+// Packages named in removed are considered as not installed.
+func (ctx *Context) orphanedPackages(required []*yum.Requires, removed map[string]struct{}) ([]*yum.Package, error) {
+	if len(required) <= 0 {
+		return nil, nil
+	}
+
+	installed, err := ctx.listInstalledPackages()
+	if err != nil {
+		return nil, err
+	}
+	instset := make(map[string]struct{}, len(installed))
+	for _, pp := range installed {
+		if _, dup := removed[pp[0]]; dup {
+			continue
+		}
+		instset[pp[0]] = struct{}{}
+	}
+
+	reqs := make([]*yum.Package, 0, len(required))
+	seen := make(map[string]struct{}, len(required))
+	for _, req := range required {
+		ps, err := ctx.yum.ResolveRequire(req)
+		if err != nil {
+			continue
+		}
+		for _, p := range ps {
+			if p.Host() != nil {
 				continue
 			}
+			if _, ok := instset[p.Name()]; !ok {
+				continue
+			}
+			if _, dup := seen[p.ID()]; dup {
+				continue
+			}
+			seen[p.ID()] = struct{}{}
 			reqs = append(reqs, p)
 		}
-		sort.Sort(yum.Packages(reqs))
-		installed, err := ctx.listInstalledPackages()
+	}
+	sort.Sort(yum.Packages(reqs))
+
+	still_req := make(map[string]struct{})
+	for _, pp := range installed {
+		if _, dup := removed[pp[0]]; dup {
+			continue
+		}
+		p, err := ctx.yum.FindLatestProvider(pp[0], pp[1], pp[2])
 		if err != nil {
-			return err
+			continue
 		}
-
-		still_req := make(map[string]struct{})
-		for _, pp := range installed {
-			p, err := ctx.yum.FindLatestProvider(pp[0], pp[1], pp[2])
+		for _, r := range p.Requires() {
+			pps, err := ctx.yum.ResolveRequire(r)
 			if err != nil {
 				continue
 			}
-			for _, r := range p.Requires() {
-				pp, err := ctx.yum.FindLatestProvider(r.Name(), r.Version(), r.Release())
-				if err != nil {
-					continue
-				}
+			for _, pp := range pps {
 				still_req[pp.ID()] = struct{}{}
 			}
 		}
-		remove := make([]string, 0, len(reqs))
-		// loop over installed package, if none requires one of the required package, flag it
-		for _, req := range reqs {
-			id := req.ID()
-			if _, dup := still_req[id]; !dup {
-				remove = append(remove, req.ID())
-			}
-		}
-		if len(remove) > 0 {
-			ctx.msg.Infof("packages no longer required: %v\n", strings.Join(remove, " "))
+	}
+
+	orphans := make([]*yum.Package, 0, len(reqs))
+	// loop over installed package, if none requires one of the required package, flag it
+	for _, req := range reqs {
+		if _, dup := still_req[req.ID()]; !dup {
+			orphans = append(orphans, req)
 		}
 	}
-	return err
+	return orphans, err
+}
+
+// packageIDs returns the IDs of a list of packages
+func packageIDs(pkgs []*yum.Package) []string {
+	ids := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		ids = append(ids, pkg.ID())
+	}
+	return ids
 }
 
 // Rpm runs the rpm command.
@@ -1555,7 +2114,7 @@ func (ctx *Context) downloadPackage(pkg Package, dir string) error {
 	}
 	defer f.Close()
 
-	r, err := getRemoteData(pkg.Url())
+	r, err := ctx.yum.OpenURL(pkg.Url())
 	if err != nil {
 		return err
 	}
@@ -1772,4 +2331,158 @@ func (ctx *Context) ListRepositories() error {
 	return err
 }
 
+// Serve runs a caching yum proxy for the repositories, listening on addr.
+// The remote files are cached under cachedir (by default, under the cache
+// directory of the siteroot). If local is true, the RPMs already downloaded
+// under the siteroot are served directly.
+func (ctx *Context) Serve(addr, cachedir string, local bool) error {
+	if cachedir == "" {
+		cachedir = filepath.Join(ctx.siteroot, "var", "cache", "lbpkr-serve")
+	}
+	proxy := yum.NewProxy(ctx.yum, cachedir)
+	proxy.SetLevel(ctx.msg.Level())
+	if local {
+		proxy.AddLocalDir(ctx.tmpdir)
+	}
+
+	for _, repo := range ctx.yum.Repositories() {
+		ctx.msg.Infof("serving [%s] (url=%s) under http://%s/%s/\n", repo.Name, repo.RepoUrl, addr, repo.Name)
+	}
+	return http.ListenAndServe(addr, proxy)
+}
+
+// CheckRepositories checks the consistency of the packages of the
+// repositories, printing the problems found (see yum.Client.CheckRepositories).
+// An error is returned if any problem was found. The requirements only
+// satisfied by the host are printed, but not counted as problems.
+func (ctx *Context) CheckRepositories(locations bool) error {
+	problems := ctx.yum.CheckRepositories(locations)
+	n := 0
+	for _, p := range problems {
+		fmt.Printf("%v\n", p)
+		if p.Kind != yum.ProblemHostOnly {
+			n++
+		}
+	}
+	if n > 0 {
+		return fmt.Errorf("lbpkr: %d problem(s) found in the repositories", n)
+	}
+	ctx.msg.Infof("no problem found\n")
+	return nil
+}
+
+// DiffRepositories prints the differences between the packages of the
+// repositories oldrepo and newrepo, as text or as JSON.
+// Each repository is the name of a configured repository, a URL or a local
+// directory.
+func (ctx *Context) DiffRepositories(oldrepo, newrepo string, asJSON bool) error {
+	var repos [2]*yum.Repository
+	for i, spec := range []string{oldrepo, newrepo} {
+		repo, closeRepo, err := ctx.openRepository(spec)
+		if err != nil {
+			return err
+		}
+		defer closeRepo()
+		repos[i] = repo
+	}
+
+	diffs := yum.DiffRepositories(repos[0], repos[1])
+	if asJSON {
+		if diffs == nil {
+			diffs = []yum.PackageDiff{}
+		}
+		data, err := json.MarshalIndent(diffs, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+
+	nchanged := 0
+	for _, d := range diffs {
+		switch d.Kind {
+		case yum.DiffAdded:
+			fmt.Printf("+ %s\n", d.New)
+		case yum.DiffRemoved:
+			fmt.Printf("- %s\n", d.Old)
+		case yum.DiffUpdated:
+			fmt.Printf("~ %s -> %s\n", d.Old, d.New)
+		case yum.DiffChanged:
+			nchanged++
+			fmt.Printf("! %s\n", d.Old)
+			if d.ChecksumChanged() {
+				fmt.Printf("    checksum %s -> %s\n", d.OldChecksum, d.NewChecksum)
+			}
+		}
+		for _, v := range []struct {
+			prefix string
+			caps   []string
+		}{
+			{"    + requires ", d.AddedRequires},
+			{"    - requires ", d.RemovedRequires},
+			{"    + provides ", d.AddedProvides},
+			{"    - provides ", d.RemovedProvides},
+		} {
+			for _, c := range v.caps {
+				fmt.Printf("%s%s\n", v.prefix, c)
+			}
+		}
+	}
+	if nchanged > 0 {
+		ctx.msg.Warnf("%d package(s) changed without a new version-release\n", nchanged)
+	}
+	return nil
+}
+
+// openRepository returns the repository described by spec: the name of a
+// configured repository, <name>@<snapshot> for a snapshot of its metadata
+// (a snapshot ID or a date, see yum.Snapshot), a URL or a local directory.
+// The returned function releases the resources of the repository.
+func (ctx *Context) openRepository(spec string) (*yum.Repository, func(), error) {
+	for _, repo := range ctx.yum.Repositories() {
+		if repo.Name == spec {
+			return repo, func() {}, nil
+		}
+	}
+
+	if i := strings.LastIndex(spec, "@"); i > 0 && !strings.Contains(spec, "://") && !path_exists(spec) {
+		repo, err := ctx.yum.OpenSnapshot(spec[:i], spec[i+1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return repo, func() { repo.Close() }, nil
+	}
+
+	url := spec
+	if !strings.Contains(url, "://") {
+		if !path_exists(spec) {
+			return nil, nil, fmt.Errorf("lbpkr: no such repository %q (not a configured repository, a URL or a directory)", spec)
+		}
+		abs, err := filepath.Abs(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		url = "file://" + abs
+	}
+
+	err := os.MkdirAll(ctx.tmpdir, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+	cachedir, err := ioutil.TempDir(ctx.tmpdir, "repo-")
+	if err != nil {
+		return nil, nil, err
+	}
+	repo, err := ctx.yum.NewRepository(spec, url, cachedir, yum.DefaultBackends, true, true)
+	if err != nil {
+		os.RemoveAll(cachedir)
+		return nil, nil, err
+	}
+	return repo, func() {
+		repo.Close()
+		os.RemoveAll(cachedir)
+	}, nil
+}
+
 // EOF
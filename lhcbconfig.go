@@ -15,6 +15,9 @@ type Config interface {
 	Debug() bool
 	RpmUpdate() bool
 
+	// Relocations returns the relocations applied to the installed RPMs
+	Relocations() []Relocation
+
 	// RelocateArgs returns the arguments to be passed to RPM for the repositories
 	RelocateArgs() []string
 
@@ -24,6 +27,30 @@ type Config interface {
 	InitYum(*Context) error
 }
 
+// Relocation describes how the files of RPMs under Old are relocated under
+// New, a path relative to the siteroot.
+type Relocation struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// relocateArgs returns the arguments to be passed to RPM to apply relocs under siteroot
+func relocateArgs(siteroot string, relocs []Relocation) []string {
+	args := make([]string, 0, 2*len(relocs)+1)
+	for _, r := range relocs {
+		args = append(args, "--relocate", fmt.Sprintf("%s=%s", r.Old, filepath.Join(siteroot, r.New)))
+	}
+	return append(args, "--badreloc")
+}
+
+// relocateFile returns the path of fname once relocs are applied under siteroot
+func relocateFile(siteroot string, relocs []Relocation, fname string) string {
+	for _, r := range relocs {
+		fname = strings.Replace(fname, r.Old, filepath.Join(siteroot, r.New), 1)
+	}
+	return fname
+}
+
 // lhcbConfig holds the options and defaults for the (LHCb) installer
 type lhcbConfig struct {
 	siteroot  string // where to install software, binaries, ...
@@ -71,22 +98,23 @@ func (cfg *lhcbConfig) DefaultSiteroot() string {
 	return "/opt/LHCbSoft"
 }
 
+// Relocations returns the relocations applied to the installed RPMs
+func (cfg *lhcbConfig) Relocations() []Relocation {
+	return []Relocation{
+		{Old: "/opt/lcg/external", New: filepath.Join("lcg", "external")},
+		{Old: "/opt/lcg", New: filepath.Join("lcg", "releases")},
+		{Old: "/opt/LHCbSoft", New: ""},
+	}
+}
+
 // RelocateArgs returns the arguments to be passed to RPM for the repositories
 func (cfg *lhcbConfig) RelocateArgs() []string {
-	return []string{
-		"--relocate", fmt.Sprintf("%s=%s", "/opt/lcg/external", filepath.Join(cfg.siteroot, "lcg", "external")),
-		"--relocate", fmt.Sprintf("%s=%s", "/opt/lcg", filepath.Join(cfg.siteroot, "lcg", "releases")),
-		"--relocate", fmt.Sprintf("%s=%s", "/opt/LHCbSoft", cfg.siteroot),
-		"--badreloc",
-	}
+	return relocateArgs(cfg.siteroot, cfg.Relocations())
 }
 
 // RelocateFile returns the relocated file path
 func (cfg *lhcbConfig) RelocateFile(fname string) string {
-	fname = strings.Replace(fname, "/opt/lcg/external", filepath.Join(cfg.siteroot, "lcg", "external"), 1)
-	fname = strings.Replace(fname, "/opt/lcg", filepath.Join(cfg.siteroot, "lcg", "releases"), 1)
-	fname = strings.Replace(fname, "/opt/LHCbSoft", cfg.siteroot, 1)
-	return fname
+	return relocateFile(cfg.siteroot, cfg.Relocations(), fname)
 }
 
 func (cfg *lhcbConfig) InitYum(ctx *Context) error {
@@ -197,6 +225,8 @@ func (cfg *lhcbConfig) InitYum(ctx *Context) error {
 		err = ctx.writeYumRepo(f, map[string]string{
 			"name": "lhcbincubator",
 			"url":  repourl + "/incubator",
+			// the incubator is not always maintained: do not fail because of it.
+			"skip_if_unavailable": "1",
 		})
 		if err != nil {
 			return err
@@ -9,31 +9,50 @@ import (
 
 var g_cmd *commander.Command
 var g_ctx *Context
+var g_cacheonly bool  // only use the local metadata cache (-C/-cacheonly)
+var g_snapshot string // snapshot of the metadata to use (-snapshot)
 
 func init() {
 	g_cmd = &commander.Command{
 		UsageLine: "lbpkr",
 		Short:     "installs software in MYSITEROOT directory.",
 		Subcommands: []*commander.Command{
+			lbpkr_make_cmd_bundle(),
 			lbpkr_make_cmd_check(),
+			lbpkr_make_cmd_createrepo(),
 			lbpkr_make_cmd_deps(),
 			lbpkr_make_cmd_dep_graph(),
 			lbpkr_make_cmd_install(),
 			lbpkr_make_cmd_install_project(),
 			lbpkr_make_cmd_installed(),
 			lbpkr_make_cmd_list(),
+			lbpkr_make_cmd_makecache(),
+			lbpkr_make_cmd_pack(),
+			lbpkr_make_cmd_projects(),
 			lbpkr_make_cmd_provides(),
+			lbpkr_make_cmd_publish(),
 			lbpkr_make_cmd_remove(),
+			lbpkr_make_cmd_remove_project(),
 			lbpkr_make_cmd_repo_add(),
+			lbpkr_make_cmd_repo_check(),
+			lbpkr_make_cmd_repo_diff(),
 			lbpkr_make_cmd_repo_ls(),
 			lbpkr_make_cmd_repo_rm(),
+			lbpkr_make_cmd_repoquery(),
+			lbpkr_make_cmd_reposync(),
 			lbpkr_make_cmd_rpm(),
 			lbpkr_make_cmd_self(),
+			lbpkr_make_cmd_serve(),
+			lbpkr_make_cmd_snapshot(),
 			lbpkr_make_cmd_update(),
+			lbpkr_make_cmd_upgrade_project(),
 			lbpkr_make_cmd_version(),
 		},
 		Flag: *flag.NewFlagSet("lbpkr", flag.ContinueOnError),
 	}
+	g_cmd.Flag.Bool("C", false, "run entirely from the local metadata cache (alias for -cacheonly)")
+	g_cmd.Flag.Bool("cacheonly", false, "run entirely from the local metadata cache")
+	g_cmd.Flag.String("snapshot", "", "run from the snapshot of the metadata with this ID, or taken at this date")
 }
 
 func main() {
@@ -44,6 +63,9 @@ func main() {
 		args = []string{"help"}
 	} else {
 		args = g_cmd.Flag.Args()
+		g_cacheonly = g_cmd.Flag.Lookup("C").Value.Get().(bool) ||
+			g_cmd.Flag.Lookup("cacheonly").Value.Get().(bool)
+		g_snapshot = g_cmd.Flag.Lookup("snapshot").Value.Get().(string)
 	}
 
 	err = g_cmd.Dispatch(args)
@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+
+	"github.com/gonuts/logger"
+	"github.com/lhcb-org/lbpkr/yum"
 )
 
 func init() {
@@ -48,17 +52,13 @@ func TestLbpkrSelfBdistRpm(t *testing.T) {
 		t.Skip("skipping test in short mode.")
 	}
 
-	if _, err := exec.LookPath("rpmbuild"); err != nil {
-		t.Skip("no rpmbuild installed")
-	}
-
 	tmpdir, err := ioutil.TempDir("", "test-lbpkr-")
 	if err != nil {
 		t.Fatalf("error creating temporary directory: %v", err)
 	}
 	defer os.RemoveAll(tmpdir)
 
-	cmd := newCommand("lbpkr", "self", "bdist-rpm")
+	cmd := newCommand("lbpkr", "self", "bdist-rpm", "-version=0.1", "-release=2")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Dir = tmpdir
@@ -67,6 +67,23 @@ func TestLbpkrSelfBdistRpm(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error running bdist-rpm: %v", err)
 	}
+
+	rpms, err := filepath.Glob(filepath.Join(tmpdir, "lbpkr-0.1-2.*.rpm"))
+	if err != nil || len(rpms) != 1 {
+		t.Fatalf("expected one RPM. got=%v (err=%v)", rpms, err)
+	}
+	f, err := os.Open(rpms[0])
+	if err != nil {
+		t.Fatalf("error opening RPM: %v", err)
+	}
+	defer f.Close()
+	hdr, err := yum.ReadRPMHeader(f)
+	if err != nil {
+		t.Fatalf("error reading RPM: %v", err)
+	}
+	if files := hdr.Files(); len(files) != 1 || files[0] != "/opt/LHCbSoft/usr/bin/lbpkr" {
+		t.Fatalf("invalid RPM content: %v", files)
+	}
 }
 
 func TestLbpkrInstallLbpkr(t *testing.T) {
@@ -566,6 +583,18 @@ func TestRPMSplit(t *testing.T) {
 			rpm:  "BRUNEL_v45r1_x86_64_slc6_gcc48_opt",
 			want: [3]string{"BRUNEL_v45r1_x86_64_slc6_gcc48_opt", "", ""},
 		},
+		{
+			rpm:  "BRUNEL_v45r1-1.0.0-21.noarch",
+			want: [3]string{"BRUNEL_v45r1.noarch", "1.0.0", "21"},
+		},
+		{
+			rpm:  "gcc_4.8.1_x86_64_slc6-1.0.0.x86_64",
+			want: [3]string{"gcc_4.8.1_x86_64_slc6.x86_64", "1.0.0", ""},
+		},
+		{
+			rpm:  "BRUNEL_v45r1.x86_64",
+			want: [3]string{"BRUNEL_v45r1.x86_64", "", ""},
+		},
 	} {
 		rpm := splitRPM(table.rpm)
 		if rpm != table.want {
@@ -578,3 +607,795 @@ func TestRPMSplit(t *testing.T) {
 		}
 	}
 }
+
+func TestParsePlatform(t *testing.T) {
+	for _, table := range []struct {
+		str  string
+		want Platform
+		err  bool
+	}{
+		{
+			str:  "x86_64-slc6-gcc48-opt",
+			want: Platform{Arch: "x86_64", OS: "slc6", Compiler: "gcc48", Build: "opt"},
+		},
+		{
+			str:  "x86_64_slc6_gcc48_opt",
+			want: Platform{Arch: "x86_64", OS: "slc6", Compiler: "gcc48", Build: "opt"},
+		},
+		{
+			str:  "i686-slc5-gcc43-dbg",
+			want: Platform{Arch: "i686", OS: "slc5", Compiler: "gcc43", Build: "dbg"},
+		},
+		{
+			str:  "x86_64-centos7-gcc62-do0",
+			want: Platform{Arch: "x86_64", OS: "centos7", Compiler: "gcc62", Build: "do0"},
+		},
+		{str: "x86_64-slc6-gcc48", err: true},
+		{str: "slc6-gcc48-opt", err: true},
+		{str: "x86_64-slc6-gcc48-opt-extra", err: true},
+	} {
+		p, err := ParsePlatform(table.str)
+		if table.err {
+			if err == nil {
+				t.Errorf("%s: expected an error. got=%#v\n", table.str, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v\n", table.str, err)
+			continue
+		}
+		if p != table.want {
+			t.Errorf("%s: expected %#v. got=%#v\n", table.str, table.want, p)
+		}
+		if got, want := p.RPMName(), strings.Replace(p.String(), "-", "_", -1); got != want {
+			t.Errorf("%s: expected rpm name %q. got=%q\n", table.str, want, got)
+		}
+	}
+}
+
+func TestSelectPlatform(t *testing.T) {
+	parse := func(strs ...string) []Platform {
+		ps := make([]Platform, 0, len(strs))
+		for _, str := range strs {
+			p, err := ParsePlatform(str)
+			if err != nil {
+				t.Fatalf("could not parse platform %q: %v\n", str, err)
+			}
+			ps = append(ps, p)
+		}
+		return ps
+	}
+
+	for _, table := range []struct {
+		host   Platform
+		avail  []Platform
+		native bool
+		want   string
+	}{
+		{
+			host:  Platform{Arch: "x86_64", OS: "slc6", Compiler: "gcc48", Build: "opt"},
+			avail: parse("x86_64-slc6-gcc48-opt", "x86_64-slc6-gcc48-dbg", "x86_64-slc6-gcc46-opt"),
+			want:  "x86_64-slc6-gcc48-opt",
+		},
+		{
+			// slc6 binaries run on centos7
+			host:  Platform{Arch: "x86_64", OS: "centos7", Build: "opt"},
+			avail: parse("x86_64-slc6-gcc48-opt", "i686-slc6-gcc48-opt", "x86_64-slc5-gcc46-opt"),
+			want:  "x86_64-slc6-gcc48-opt",
+		},
+		{
+			host:   Platform{Arch: "x86_64", OS: "centos7", Build: "opt"},
+			avail:  parse("x86_64-slc6-gcc48-opt"),
+			native: true,
+			want:   "",
+		},
+		{
+			// dbg falls back to opt
+			host:  Platform{Arch: "x86_64", OS: "slc6", Compiler: "gcc48", Build: "dbg"},
+			avail: parse("x86_64-slc6-gcc48-opt", "x86_64-slc6-gcc49-dbg"),
+			want:  "x86_64-slc6-gcc48-opt",
+		},
+		{
+			// prefer the native build, then the newest compiler
+			host:  Platform{Arch: "x86_64", OS: "centos7", Build: "opt"},
+			avail: parse("x86_64-slc6-gcc49-opt", "x86_64-centos7-gcc62-opt", "x86_64-centos7-gcc7-opt", "x86_64-centos7-gcc49-opt"),
+			want:  "x86_64-centos7-gcc7-opt",
+		},
+		{
+			host:  Platform{Arch: "x86_64", OS: "slc6", Build: "opt"},
+			avail: parse("x86_64-centos7-gcc62-opt", "aarch64-slc6-gcc48-opt"),
+			want:  "",
+		},
+	} {
+		p, reason, ok := table.host.SelectPlatform(table.avail, table.native)
+		switch {
+		case !ok && table.want == "":
+			// ok
+		case !ok:
+			t.Errorf("host=%s: expected %s. got none\n", table.host, table.want)
+		case p.String() != table.want:
+			t.Errorf("host=%s: expected %q. got=%q (%s)\n", table.host, table.want, p, reason)
+		}
+	}
+}
+
+func TestHostOS(t *testing.T) {
+	for _, table := range []struct {
+		id      string
+		version string
+		want    string
+	}{
+		{"centos", "7", "centos7"},
+		{"rhel", "6.5", "slc6"},
+		{"scientific", "6", "slc6"},
+		{"almalinux", "9.2", "el9"},
+		{"ubuntu", "22.04", ""},
+	} {
+		if got := osName(table.id, table.version); got != table.want {
+			t.Errorf("id=%q version=%q: expected %q. got=%q\n", table.id, table.version, table.want, got)
+		}
+	}
+
+	for _, table := range []struct {
+		release string
+		want    string
+	}{
+		{"Scientific Linux CERN SLC release 6.7 (Carbon)", "slc6"},
+		{"CentOS Linux release 7.9.2009 (Core)", "centos7"},
+		{"Red Hat Enterprise Linux release 9.1 (Plow)", "el9"},
+	} {
+		if got := redhatOS(table.release); got != table.want {
+			t.Errorf("%q: expected %q. got=%q\n", table.release, table.want, got)
+		}
+	}
+}
+
+func TestProjectVersion(t *testing.T) {
+	sorted := []string{"v9r3", "v25r1", "v25r5", "v25r5p0", "v25r5p2", "v25r10", "v26r0", "v100r0"}
+	for i := range sorted {
+		vi, err := ParseProjectVersion(sorted[i])
+		if err != nil {
+			t.Fatalf("could not parse %q: %v\n", sorted[i], err)
+		}
+		if vi.String() != sorted[i] {
+			t.Errorf("expected %q. got=%q\n", sorted[i], vi.String())
+		}
+		for j := range sorted {
+			vj, _ := ParseProjectVersion(sorted[j])
+			if got, want := vi.Less(vj), i < j; got != want {
+				t.Errorf("%s < %s: expected %v. got=%v\n", vi, vj, want, got)
+			}
+		}
+	}
+
+	for _, str := range []string{"", "v25", "25r5", "v25r5p", "v25r5-1", "HEAD"} {
+		if _, err := ParseProjectVersion(str); err == nil {
+			t.Errorf("%q: expected an error\n", str)
+		}
+	}
+}
+
+func TestVersionConstraint(t *testing.T) {
+	versions := []string{"v25r1", "v25r5", "v25r5p1", "v26r0", "v26r3", "v27r0", "HEAD"}
+	for _, table := range []struct {
+		cons   string
+		want   []string
+		latest bool
+	}{
+		{"", versions, false},
+		{"all", versions, false},
+		{"latest", versions, true},
+		{"v25r5", []string{"v25r5"}, false},
+		{"v25r*", []string{"v25r1", "v25r5", "v25r5p1"}, true},
+		{"v2?r0", []string{"v26r0", "v27r0"}, true},
+		{">=v26r0,<v27r0", []string{"v26r0", "v26r3"}, true},
+		{">v25r5", []string{"v25r5p1", "v26r0", "v26r3", "v27r0"}, true},
+		{"<= v25r5, != v25r1", []string{"v25r5"}, true},
+		{"==v26r3", []string{"v26r3"}, true},
+	} {
+		c, err := ParseVersionConstraint(table.cons)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v\n", table.cons, err)
+			continue
+		}
+		got := []string{}
+		for _, v := range versions {
+			if c.Match(v) {
+				got = append(got, v)
+			}
+		}
+		if !reflect.DeepEqual(got, table.want) {
+			t.Errorf("%q: expected %v. got=%v\n", table.cons, table.want, got)
+		}
+		if c.Latest() != table.latest {
+			t.Errorf("%q: expected latest=%v. got=%v\n", table.cons, table.latest, c.Latest())
+		}
+	}
+
+	for _, cons := range []string{">=v26", "=>v26r0", "<v27r0,"} {
+		if _, err := ParseVersionConstraint(cons); err == nil {
+			t.Errorf("%q: expected an error\n", cons)
+		}
+	}
+}
+
+func TestLatestProjectBuilds(t *testing.T) {
+	var pkgs []Package
+	for _, name := range []string{
+		"GAUDI_v26r0_x86_64_slc6_gcc48_opt",
+		"GAUDI_v26r1_x86_64_slc6_gcc48_opt",
+		"GAUDI_v26r1_x86_64_slc6_gcc48_dbg",
+		"GAUDI_v26r2_x86_64_slc6_gcc49_opt",
+		"GAUDI_v26r2p1_x86_64_slc6_gcc49_opt",
+	} {
+		pkgs = append(pkgs, Package{yum.NewPackage(name, "1.0.0", "1", "0"), InstallMode})
+	}
+
+	names := func(pkgs []Package) []string {
+		out := make([]string, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			out = append(out, pkg.Name())
+		}
+		return out
+	}
+
+	got := names(latestProjectBuilds("GAUDI", pkgs, false))
+	want := []string{
+		"GAUDI_v26r1_x86_64_slc6_gcc48_opt",
+		"GAUDI_v26r1_x86_64_slc6_gcc48_dbg",
+		"GAUDI_v26r2p1_x86_64_slc6_gcc49_opt",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("latest per platform: expected %v. got=%v\n", want, got)
+	}
+
+	got = names(latestProjectBuilds("GAUDI", pkgs, true))
+	want = []string{"GAUDI_v26r2p1_x86_64_slc6_gcc49_opt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("latest overall: expected %v. got=%v\n", want, got)
+	}
+}
+
+func TestCollectProjects(t *testing.T) {
+	avail := []string{
+		"GAUDI_v25r5_index",
+		"GAUDI_v25r5_x86_64_slc6_gcc48_opt",
+		"GAUDI_v25r5_x86_64_slc6_gcc48_dbg",
+		"GAUDI_v26r0_index",
+		"GAUDI_v26r0_x86_64_slc6_gcc48_opt",
+		"GAUDI_v26r0_x86_64_slc6_gcc49_opt",
+		"LHCB_v37r1_index",
+		"LHCB_v37r1_x86_64_slc6_gcc48_opt",
+		"LCG_70_AIDA_3.2.1_x86_64_slc6_gcc48_opt",
+	}
+	installed := []string{
+		"GAUDI_v25r5_index",
+		"GAUDI_v25r5_x86_64_slc6_gcc48_opt",
+		"GAUDI_v24r0_index",
+		"GAUDI_v24r0_x86_64_slc5_gcc46_opt",
+	}
+
+	for _, table := range []struct {
+		filter ProjectFilter
+		want   []Project
+	}{
+		{
+			filter: ProjectFilter{Name: "^GAUDI$", Installed: true},
+			want: []Project{{
+				Name: "GAUDI",
+				Versions: []ProjectRelease{
+					{
+						Version:   "v24r0",
+						Installed: true,
+						Builds:    []ProjectBuild{{Platform: "x86_64_slc5_gcc46_opt", Installed: true}},
+					},
+					{
+						Version:   "v25r5",
+						Installed: true,
+						Builds:    []ProjectBuild{{Platform: "x86_64_slc6_gcc48_opt", Available: true, Installed: true}},
+					},
+				},
+			}},
+		},
+		{
+			filter: ProjectFilter{Version: "latest"},
+			want: []Project{
+				{
+					Name: "GAUDI",
+					Versions: []ProjectRelease{{
+						Version: "v26r0",
+						Builds: []ProjectBuild{
+							{Platform: "x86_64_slc6_gcc48_opt", Available: true},
+							{Platform: "x86_64_slc6_gcc49_opt", Available: true},
+						},
+					}},
+				},
+				{
+					Name: "LHCB",
+					Versions: []ProjectRelease{{
+						Version: "v37r1",
+						Builds:  []ProjectBuild{{Platform: "x86_64_slc6_gcc48_opt", Available: true}},
+					}},
+				},
+			},
+		},
+		{
+			filter: ProjectFilter{Name: "GAUDI", Platforms: "_dbg$"},
+			want: []Project{{
+				Name: "GAUDI",
+				Versions: []ProjectRelease{{
+					Version:   "v25r5",
+					Installed: true,
+					Builds:    []ProjectBuild{{Platform: "x86_64_slc6_gcc48_dbg", Available: true}},
+				}},
+			}},
+		},
+	} {
+		got, err := collectProjects(avail, installed, table.filter)
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v\n", table.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, table.want) {
+			t.Errorf("%#v:\nexpected %#v\ngot=     %#v\n", table.filter, table.want, got)
+		}
+	}
+
+	projects, err := collectProjects(avail, installed, ProjectFilter{Name: "^GAUDI$", Version: "v25r5"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	var buf bytes.Buffer
+	err = writeProjects(&buf, projects, false)
+	if err != nil {
+		t.Fatalf("could not write projects: %v\n", err)
+	}
+	want := "GAUDI v25r5 x86_64_slc6_gcc48_dbg, x86_64_slc6_gcc48_opt (installed)\n"
+	if buf.String() != want {
+		t.Errorf("expected %q. got=%q\n", want, buf.String())
+	}
+}
+
+func TestSelectProjectBuilds(t *testing.T) {
+	ctx := &Context{msg: logger.NewLogger("lbpkr", logger.INFO, ioutil.Discard)}
+
+	var plist []Package
+	for _, name := range []string{
+		"GAUDI_v25r5_x86_64_slc6_gcc48_opt",
+		"GAUDI_v25r5_x86_64_slc6_gcc48_dbg",
+		"GAUDI_v26r0_x86_64_slc6_gcc48_opt",
+	} {
+		plist = append(plist, Package{yum.NewPackage(name, "1.0.0", "1", "0"), InstallMode})
+	}
+
+	names := func(pkgs []Package) []string {
+		out := make([]string, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			out = append(out, pkg.Name())
+		}
+		return out
+	}
+
+	for _, table := range []struct {
+		version   string
+		platforms string
+		want      []string
+	}{
+		{
+			version:   "all",
+			platforms: "all",
+			want: []string{
+				"GAUDI_v25r5_x86_64_slc6_gcc48_opt",
+				"GAUDI_v25r5_x86_64_slc6_gcc48_dbg",
+				"GAUDI_v26r0_x86_64_slc6_gcc48_opt",
+			},
+		},
+		{
+			version:   "all",
+			platforms: "x86_64_slc6_gcc48_dbg",
+			want:      []string{"GAUDI_v25r5_x86_64_slc6_gcc48_dbg"},
+		},
+		{
+			version:   "latest",
+			platforms: "x86_64_slc6_gcc48_opt, x86_64_slc6_gcc48_dbg",
+			want: []string{
+				"GAUDI_v25r5_x86_64_slc6_gcc48_dbg",
+				"GAUDI_v26r0_x86_64_slc6_gcc48_opt",
+			},
+		},
+	} {
+		cons, err := ParseVersionConstraint(table.version)
+		if err != nil {
+			t.Fatalf("%q: %v\n", table.version, err)
+		}
+		pkgs, _, err := ctx.selectProjectBuilds("GAUDI", cons, table.platforms, plist)
+		if err != nil {
+			t.Errorf("%q %q: unexpected error: %v\n", table.version, table.platforms, err)
+			continue
+		}
+		if got := names(pkgs); !reflect.DeepEqual(got, table.want) {
+			t.Errorf("%q %q: expected %v. got=%v\n", table.version, table.platforms, table.want, got)
+		}
+	}
+
+	cons, _ := ParseVersionConstraint("all")
+	_, _, err := ctx.selectProjectBuilds("GAUDI", cons, "x86_64_centos7_gcc62_opt", plist)
+	if err == nil {
+		t.Errorf("expected an error for a platform not in the list\n")
+	}
+}
+
+func TestPlanProjectUpgrade(t *testing.T) {
+	avail := []string{
+		"LHCB_v37r1_index",
+		"LHCB_v37r1_x86_64_slc6_gcc48_opt",
+		"LHCB_v37r1_x86_64_slc6_gcc48_dbg",
+		"LHCB_v37r2_index",
+		"LHCB_v37r2_x86_64_slc6_gcc48_opt",
+		"LHCB_v37r3_index",
+		"LHCB_v37r3_x86_64_slc6_gcc48_opt",
+		"LHCB_v37r3_x86_64_slc6_gcc49_opt",
+	}
+	installed := []string{
+		"LHCB_v37r1_index",
+		"LHCB_v37r1_x86_64_slc6_gcc48_opt",
+		"LHCB_v37r1_x86_64_slc6_gcc48_dbg",
+	}
+
+	for _, table := range []struct {
+		to   string
+		keep bool
+		want ProjectUpgrade
+		plan string
+	}{
+		{
+			to: "",
+			want: ProjectUpgrade{
+				Name:      "LHCB",
+				From:      "v37r1",
+				To:        "v37r3",
+				Platforms: []string{"x86_64_slc6_gcc48_opt"},
+				Missing:   []string{"x86_64_slc6_gcc48_dbg"},
+				Index:     true,
+			},
+			plan: "LHCB: upgrade v37r1 -> v37r3\n" +
+				" + LHCB_v37r3_x86_64_slc6_gcc48_opt\n" +
+				" - LHCB_v37r1_x86_64_slc6_gcc48_opt\n" +
+				" ! LHCB_v37r1_x86_64_slc6_gcc48_dbg: no v37r3 build available, keeping it\n",
+		},
+		{
+			to:   "v37r2",
+			keep: true,
+			want: ProjectUpgrade{
+				Name:      "LHCB",
+				From:      "v37r1",
+				To:        "v37r2",
+				Platforms: []string{"x86_64_slc6_gcc48_opt"},
+				Missing:   []string{"x86_64_slc6_gcc48_dbg"},
+				KeepOld:   true,
+				Index:     true,
+			},
+			plan: "LHCB: upgrade v37r1 -> v37r2\n" +
+				" + LHCB_v37r2_x86_64_slc6_gcc48_opt\n" +
+				" ! LHCB_v37r1_x86_64_slc6_gcc48_dbg: no v37r2 build available, keeping it\n",
+		},
+	} {
+		up, err := planProjectUpgrade("LHCB", avail, installed, table.to, table.keep)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v\n", table.to, err)
+			continue
+		}
+		if !reflect.DeepEqual(*up, table.want) {
+			t.Errorf("%q:\nexpected %#v\ngot=     %#v\n", table.to, table.want, *up)
+		}
+		var buf bytes.Buffer
+		writeUpgradePlan(&buf, up)
+		if buf.String() != table.plan {
+			t.Errorf("%q:\nexpected plan %q\ngot=          %q\n", table.to, table.plan, buf.String())
+		}
+	}
+
+	// no build of the old version left: its index goes too
+	up, err := planProjectUpgrade("LHCB", avail, installed[:2], "v37r3", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	want := []string{"LHCB_v37r1_x86_64_slc6_gcc48_opt", "LHCB_v37r1_index"}
+	if got := up.Remove(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected to remove %v. got=%v\n", want, got)
+	}
+
+	for _, to := range []string{"v36r0", "v38r0"} {
+		_, err := planProjectUpgrade("LHCB", avail, installed, to, false)
+		if err == nil {
+			t.Errorf("%q: expected an error\n", to)
+		}
+	}
+	_, err = planProjectUpgrade("GAUDI", avail, installed, "", false)
+	if err == nil {
+		t.Errorf("expected an error for a project not installed\n")
+	}
+}
+
+func TestParseSyncSpec(t *testing.T) {
+	for _, table := range []struct {
+		spec string
+		want syncSpec
+	}{
+		{"LHCb:v36r1", syncSpec{Project: true, Name: "LHCb", Version: "v36r1"}},
+		{"LHCb:", syncSpec{Project: true, Name: "LHCb", Version: "latest"}},
+		{"GAUDI:>=v25r2", syncSpec{Project: true, Name: "GAUDI", Version: ">=v25r2"}},
+		{"AIDA", syncSpec{Name: "AIDA"}},
+		{"LBSCRIPTS-8.0.1-1", syncSpec{Name: "LBSCRIPTS", Version: "8.0.1", Release: "1"}},
+	} {
+		got := parseSyncSpec(table.spec)
+		if got != table.want {
+			t.Errorf("%q: expected %+v. got=%+v\n", table.spec, table.want, got)
+		}
+	}
+}
+
+func TestReposyncFiles(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-test-reposync-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	for _, fname := range []string{"a-1-1.noarch.rpm", "b-1-1.noarch.rpm", "c-1-1.noarch.rpm", "README"} {
+		err = ioutil.WriteFile(tmpdir+"/"+fname, []byte("lbpkr"), 0644)
+		if err != nil {
+			t.Fatalf("could not create file: %v\n", err)
+		}
+	}
+
+	for _, table := range []struct {
+		typ  string
+		want string
+	}{
+		{"sha256", "e3364c1a9d3ec99d1493943839efae21eb30acf4e3078b54db15df1fa9093f50"},
+		{"sha", "2f7716da0a0f3cde850f33e3a984a9562463a856"},
+	} {
+		got, err := yum.FileChecksum(tmpdir+"/a-1-1.noarch.rpm", table.typ)
+		if err != nil {
+			t.Fatalf("could not compute %s checksum: %v\n", table.typ, err)
+		}
+		if got != table.want {
+			t.Errorf("invalid %s checksum. got=%s want=%s\n", table.typ, got, table.want)
+		}
+	}
+	if _, err := yum.FileChecksum(tmpdir+"/a-1-1.noarch.rpm", "crc32"); err == nil {
+		t.Errorf("expected an error for an unknown checksum type\n")
+	}
+
+	keep := map[string]*yum.Package{
+		"a-1-1.noarch.rpm": yum.NewPackage("a", "1", "1", "0"),
+		"c-1-1.noarch.rpm": yum.NewPackage("c", "1", "1", "0"),
+	}
+	stale, err := staleRPMs(tmpdir, keep)
+	if err != nil {
+		t.Fatalf("could not list stale RPMs: %v\n", err)
+	}
+	if !reflect.DeepEqual(stale, []string{tmpdir + "/b-1-1.noarch.rpm"}) {
+		t.Errorf("invalid stale RPMs: %v\n", stale)
+	}
+}
+
+func TestRelocations(t *testing.T) {
+	cfg := NewConfig("/sw")
+	want := []string{
+		"--relocate", "/opt/lcg/external=/sw/lcg/external",
+		"--relocate", "/opt/lcg=/sw/lcg/releases",
+		"--relocate", "/opt/LHCbSoft=/sw",
+		"--badreloc",
+	}
+	if got := cfg.RelocateArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid relocation args.\ngot= %v\nwant=%v\n", got, want)
+	}
+	if got, want := cfg.RelocateFile("/opt/lcg/ROOT/5.34/lib"), "/sw/lcg/releases/ROOT/5.34/lib"; got != want {
+		t.Errorf("invalid relocated file. got=%q. want=%q\n", got, want)
+	}
+
+	bcfg := &bundleConfig{Config: NewConfig("/data"), relocs: cfg.Relocations()}
+	if got, want := bcfg.RelocateFile("/opt/LHCbSoft/lhcb/LHCB"), "/data/lhcb/LHCB"; got != want {
+		t.Errorf("invalid relocated file. got=%q. want=%q\n", got, want)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-test-bundle-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	src := tmpdir + "/src"
+	err = os.MkdirAll(src+"/repodata", 0755)
+	if err != nil {
+		t.Fatalf("could not create dir: %v\n", err)
+	}
+	err = ioutil.WriteFile(src+"/repodata/repomd.xml", []byte("<repomd/>"), 0644)
+	if err != nil {
+		t.Fatalf("could not create file: %v\n", err)
+	}
+
+	manifest := BundleManifest{
+		Roots:       []BundlePackage{{Name: "a", Version: "1", Release: "1", Arch: "noarch"}},
+		Relocations: NewConfig("/sw").Relocations(),
+	}
+	for _, name := range []string{"a", "b"} {
+		fname := name + "-1-1.noarch.rpm"
+		err = ioutil.WriteFile(src+"/"+fname, []byte("lbpkr"), 0644)
+		if err != nil {
+			t.Fatalf("could not create file: %v\n", err)
+		}
+		manifest.Packages = append(manifest.Packages, BundlePackage{
+			Name: name, Version: "1", Release: "1", Arch: "noarch",
+			File:         fname,
+			ChecksumType: "sha256",
+			Checksum:     "e3364c1a9d3ec99d1493943839efae21eb30acf4e3078b54db15df1fa9093f50",
+		})
+	}
+	if got, want := manifest.Roots[0].NEVRA(), "a-0:1-1.noarch"; got != want {
+		t.Errorf("invalid NEVRA. got=%q. want=%q\n", got, want)
+	}
+
+	fname := tmpdir + "/bundle.tar"
+	err = writeBundle(fname, src, &manifest)
+	if err != nil {
+		t.Fatalf("could not write bundle: %v\n", err)
+	}
+
+	got, err := extractBundle(fname, tmpdir+"/dst")
+	if err != nil {
+		t.Fatalf("could not extract bundle: %v\n", err)
+	}
+	if !reflect.DeepEqual(*got, manifest) {
+		t.Errorf("invalid manifest.\ngot= %+v\nwant=%+v\n", *got, manifest)
+	}
+	for _, name := range []string{"a-1-1.noarch.rpm", "b-1-1.noarch.rpm", "repodata/repomd.xml"} {
+		if !path_exists(tmpdir + "/dst/" + name) {
+			t.Errorf("file %s not extracted\n", name)
+		}
+	}
+
+	// a corrupted RPM is detected
+	err = ioutil.WriteFile(src+"/b-1-1.noarch.rpm", []byte("LBPKR"), 0644)
+	if err != nil {
+		t.Fatalf("could not create file: %v\n", err)
+	}
+	err = writeBundle(fname, src, &manifest)
+	if err != nil {
+		t.Fatalf("could not write bundle: %v\n", err)
+	}
+	_, err = extractBundle(fname, tmpdir+"/corrupted")
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch for b-1-1.noarch.rpm") {
+		t.Errorf("expected a checksum mismatch. got=%v\n", err)
+	}
+}
+
+func TestPack(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test-lbpkr-pack-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dir := filepath.Join(tmpdir, "install")
+	for name, content := range map[string]string{
+		"bin/mytool":        "#!/bin/sh\n",
+		"share/mytool.conf": "debug=0\n",
+	} {
+		fname := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(fname), 0755)
+		if err != nil {
+			t.Fatalf("error creating directory: %v", err)
+		}
+		err = ioutil.WriteFile(fname, []byte(content), 0755)
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	err = os.Symlink("mytool", filepath.Join(dir, "bin", "mt"))
+	if err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+
+	manifest := filepath.Join(tmpdir, "mytool.json")
+	err = ioutil.WriteFile(manifest, []byte(`{
+  "name": "MyTool",
+  "version": "2.0",
+  "release": "3",
+  "summary": "my tool",
+  "requires": ["LHCB >= 38.1-2"],
+  "provides": ["mytool"]
+}`), 0644)
+	if err != nil {
+		t.Fatalf("error creating manifest: %v", err)
+	}
+
+	m, err := LoadPackSpec(manifest)
+	if err != nil {
+		t.Fatalf("error loading manifest: %v", err)
+	}
+	// options override the manifest
+	spec := &PackSpec{Release: "4", Requires: []string{"Python"}, Prefix: "/opt/LHCbSoft/tools"}
+	spec.Merge(m)
+	spec.Merge(&PackSpec{Release: "1", Arch: "noarch", Prefix: "/opt/LHCbSoft"})
+	if got, want := spec.RPMName(), "MyTool-2.0-4.noarch.rpm"; got != want {
+		t.Errorf("invalid RPM name. got=%s, want=%s", got, want)
+	}
+
+	cfg := NewConfig(filepath.Join(tmpdir, "siteroot"))
+	fname := filepath.Join(tmpdir, spec.RPMName())
+	err = Pack(cfg, dir, spec, fname)
+	if err != nil {
+		t.Fatalf("error packing: %v", err)
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatalf("error opening RPM: %v", err)
+	}
+	defer f.Close()
+	hdr, err := yum.ReadRPMHeader(f)
+	if err != nil {
+		t.Fatalf("error reading RPM: %v", err)
+	}
+
+	files := []string{
+		"/opt/LHCbSoft/tools/bin",
+		"/opt/LHCbSoft/tools/bin/mt",
+		"/opt/LHCbSoft/tools/bin/mytool",
+		"/opt/LHCbSoft/tools/share",
+		"/opt/LHCbSoft/tools/share/mytool.conf",
+	}
+	if got := hdr.Files(); !reflect.DeepEqual(got, files) {
+		t.Errorf("invalid files.\ngot= %v\nwant=%v", got, files)
+	}
+	if got, want := cfg.RelocateFile(files[2]), filepath.Join(tmpdir, "siteroot", "tools", "bin", "mytool"); got != want {
+		t.Errorf("invalid relocated file. got=%s, want=%s", got, want)
+	}
+
+	// the RPM can be served and resolved as any other one
+	rc := yum.NewRepoCreator(tmpdir, false)
+	rc.SetLevel(logger.ERROR)
+	err = rc.Create()
+	if err != nil {
+		t.Fatalf("error creating repository: %v", err)
+	}
+	repo, err := yum.NewRepository("packed", "file://"+tmpdir, filepath.Join(tmpdir, "cache"),
+		[]string{"RepositorySQLiteBackend"}, true, true,
+	)
+	if err != nil {
+		t.Fatalf("error loading repository: %v", err)
+	}
+	defer repo.Close()
+	repo.Arches = nil
+	pkgs := repo.GetPackages()
+	if len(pkgs) != 1 {
+		t.Fatalf("expected 1 package. got=%d", len(pkgs))
+	}
+	pkg := pkgs[0]
+	var reqs, provs []string
+	for _, req := range pkg.Requires() {
+		reqs = append(reqs, req.String())
+	}
+	for _, prov := range pkg.Provides() {
+		provs = append(provs, yum.FormatCapability(prov))
+	}
+	if want := []string{"Python", "LHCB >= 38.1-2"}; !reflect.DeepEqual(reqs, want) {
+		t.Errorf("invalid requires. got=%v, want=%v", reqs, want)
+	}
+	if want := []string{"MyTool = 2.0-4", "mytool"}; !reflect.DeepEqual(provs, want) {
+		t.Errorf("invalid provides. got=%v, want=%v", provs, want)
+	}
+
+	// the files must end up under the siteroot
+	spec.Prefix = "/usr/local"
+	err = Pack(cfg, dir, spec, fname)
+	if err == nil || !strings.Contains(err.Error(), "not relocated") {
+		t.Errorf("expected a relocation error. got=%v", err)
+	}
+}
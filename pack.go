@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lhcb-org/lbpkr/yum"
+)
+
+// PackSpec describes a RPM created by Pack from a directory tree.
+// It is the declarative manifest read by 'lbpkr pack -manifest'.
+type PackSpec struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Release     string   `json:"release"`
+	Arch        string   `json:"arch"`
+	Prefix      string   `json:"prefix"` // installation directory of the tree
+	Summary     string   `json:"summary"`
+	Description string   `json:"description"`
+	License     string   `json:"license"`
+	Group       string   `json:"group"`
+	URL         string   `json:"url"`
+	Requires    []string `json:"requires"` // capabilities, e.g. "LHCB_v38r1 >= 1.0.0"
+	Provides    []string `json:"provides"`
+}
+
+// LoadPackSpec reads the JSON manifest fname
+func LoadPackSpec(fname string) (*PackSpec, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var spec PackSpec
+	err = json.Unmarshal(data, &spec)
+	if err != nil {
+		return nil, fmt.Errorf("lbpkr: invalid manifest %s: %v", fname, err)
+	}
+	return &spec, nil
+}
+
+// Merge fills the empty fields of spec with the ones of o, and appends the
+// capabilities of o to the ones of spec.
+func (spec *PackSpec) Merge(o *PackSpec) {
+	for _, v := range []struct {
+		dst *string
+		src string
+	}{
+		{&spec.Name, o.Name},
+		{&spec.Version, o.Version},
+		{&spec.Release, o.Release},
+		{&spec.Arch, o.Arch},
+		{&spec.Prefix, o.Prefix},
+		{&spec.Summary, o.Summary},
+		{&spec.Description, o.Description},
+		{&spec.License, o.License},
+		{&spec.Group, o.Group},
+		{&spec.URL, o.URL},
+	} {
+		if *v.dst == "" {
+			*v.dst = v.src
+		}
+	}
+	spec.Requires = append(spec.Requires, o.Requires...)
+	spec.Provides = append(spec.Provides, o.Provides...)
+}
+
+// RPMName returns the name of the RPM file described by spec
+func (spec *PackSpec) RPMName() string {
+	return fmt.Sprintf("%s-%s-%s.%s.rpm", spec.Name, spec.Version, spec.Release, spec.Arch)
+}
+
+// Pack writes into fname a relocatable RPM installing the files under dir
+// below the prefix of spec.
+// The prefix must be relocated by cfg, so the RPM installs under the siteroot.
+func Pack(cfg Config, dir string, spec *PackSpec, fname string) error {
+	var err error
+
+	if spec.Name == "" || spec.Version == "" || spec.Release == "" || spec.Arch == "" {
+		return fmt.Errorf("lbpkr: name, version, release and arch of the RPM are required")
+	}
+	prefix := path.Clean(spec.Prefix)
+	if !path.IsAbs(prefix) {
+		return fmt.Errorf("lbpkr: invalid prefix %q (not an absolute path)", spec.Prefix)
+	}
+	relocated := false
+	for _, r := range cfg.Relocations() {
+		if prefix == r.Old || strings.HasPrefix(prefix, r.Old+"/") {
+			relocated = true
+			break
+		}
+	}
+	if !relocated {
+		return fmt.Errorf("lbpkr: prefix %s is not relocated under the siteroot", prefix)
+	}
+
+	rpm := yum.RPMSpec{
+		Name:        spec.Name,
+		Version:     spec.Version,
+		Release:     spec.Release,
+		Arch:        spec.Arch,
+		Summary:     spec.Summary,
+		Description: spec.Description,
+		License:     spec.License,
+		Group:       spec.Group,
+		URL:         spec.URL,
+		Prefixes:    []string{prefix},
+	}
+	if rpm.Summary == "" {
+		rpm.Summary = spec.Name
+	}
+	if rpm.Description == "" {
+		rpm.Description = rpm.Summary
+	}
+	for _, v := range []struct {
+		caps []string
+		deps *[]yum.RPMDep
+	}{
+		{spec.Requires, &rpm.Requires},
+		{spec.Provides, &rpm.Provides},
+	} {
+		for _, str := range v.caps {
+			dep, err := capabilityDep(str)
+			if err != nil {
+				return err
+			}
+			*v.deps = append(*v.deps, dep)
+		}
+	}
+
+	rpm.Files, err = packFiles(dir, prefix)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(fname + ".part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = yum.WriteRPM(f, &rpm)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fname)
+}
+
+// capabilityDep converts a capability, as parsed by yum.ParseCapability, into
+// a RPM dependency.
+func capabilityDep(str string) (yum.RPMDep, error) {
+	req, err := yum.ParseCapability(str)
+	if err != nil {
+		return yum.RPMDep{}, err
+	}
+	dep := yum.RPMDep{Name: req.Name(), Flags: req.Flags(), Version: req.Version()}
+	if dep.Version == "" {
+		return dep, nil
+	}
+	if epoch := req.Epoch(); epoch != "" {
+		dep.Version = epoch + ":" + dep.Version
+	}
+	if release := req.Release(); release != "" {
+		dep.Version += "-" + release
+	}
+	return dep, nil
+}
+
+// packFiles returns the files and directories under dir, installed under prefix
+func packFiles(dir, prefix string) ([]yum.RPMFile, error) {
+	var files []yum.RPMFile
+	err := filepath.Walk(dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		file := yum.RPMFile{
+			Name:  path.Join(prefix, filepath.ToSlash(name)),
+			Mode:  fi.Mode(),
+			MTime: fi.ModTime(),
+		}
+		switch {
+		case fi.IsDir():
+		case fi.Mode()&os.ModeSymlink != 0:
+			file.Link, err = os.Readlink(fpath)
+		case fi.Mode().IsRegular():
+			file.Path = fpath
+		default:
+			err = fmt.Errorf("lbpkr: can not pack %s (unsupported file type)", fpath)
+		}
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) <= 0 {
+		return nil, fmt.Errorf("lbpkr: no file to pack under %s", dir)
+	}
+	return files, nil
+}
+
+// EOF
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lhcb-org/lbpkr/yum"
+)
+
+// Platform describes a LHCb binary platform, such as "x86_64-slc6-gcc48-opt"
+type Platform struct {
+	Arch     string // architecture (x86_64, i686, ...)
+	OS       string // operating system (slc6, centos7, ...)
+	Compiler string // compiler (gcc48, clang35, ...)
+	Build    string // build type (opt, dbg, ...)
+}
+
+var platformRe = regexp.MustCompile(`^(x86_64|i[3-6]86|aarch64|armv7hl|ppc64le|ppc64|s390x)[-_]([^-_]+)[-_]([^-_]+)[-_]([^-_]+)$`)
+
+// ParsePlatform parses a platform, either in the CMTCONFIG form ("x86_64-slc6-gcc48-opt")
+// or in the RPM form ("x86_64_slc6_gcc48_opt").
+func ParsePlatform(str string) (Platform, error) {
+	m := platformRe.FindStringSubmatch(str)
+	if m == nil {
+		return Platform{}, fmt.Errorf("lbpkr: invalid platform %q", str)
+	}
+	return Platform{Arch: m[1], OS: m[2], Compiler: m[3], Build: m[4]}, nil
+}
+
+// String returns the CMTCONFIG form of the platform (x86_64-slc6-gcc48-opt)
+func (p Platform) String() string {
+	return strings.Join([]string{p.Arch, field(p.OS), field(p.Compiler), field(p.Build)}, "-")
+}
+
+// RPMName returns the form of the platform used in RPM names (x86_64_slc6_gcc48_opt)
+func (p Platform) RPMName() string {
+	return strings.Join([]string{p.Arch, field(p.OS), field(p.Compiler), field(p.Build)}, "_")
+}
+
+func field(v string) string {
+	if v == "" {
+		return "*"
+	}
+	return v
+}
+
+type platformsByName []Platform
+
+func (p platformsByName) Len() int           { return len(p) }
+func (p platformsByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p platformsByName) Less(i, j int) bool { return p[i].String() < p[j].String() }
+
+// compatOS lists, for a host operating system, the operating systems whose
+// binaries run on that host, from the most to the least preferred.
+var compatOS = map[string][]string{
+	"slc5":    {"slc5"},
+	"slc6":    {"slc6", "slc5"},
+	"centos7": {"centos7", "slc6"},
+	"centos8": {"centos8", "centos7"},
+	"el9":     {"el9", "centos8"},
+}
+
+// compatBuild lists, for a requested build type, the build types which may be
+// installed instead, from the most to the least preferred.
+var compatBuild = map[string][]string{
+	"opt": {"opt"},
+	"dbg": {"dbg", "opt"},
+	"do0": {"do0", "dbg", "opt"},
+}
+
+func rank(v string, values []string) int {
+	for i, vv := range values {
+		if v == vv {
+			return i
+		}
+	}
+	return -1
+}
+
+// Score returns how well binaries for platform bin suit the host platform p,
+// together with the reason why. Lower is better, 0 being a native build.
+// Score returns -1 if bin is not compatible with p.
+// Empty fields of p match anything.
+func (p Platform) Score(bin Platform) (int, string) {
+	if p.Arch != "" && p.Arch != bin.Arch {
+		return -1, fmt.Sprintf("arch %s does not run on %s", bin.Arch, p.Arch)
+	}
+	if p.Compiler != "" && p.Compiler != bin.Compiler {
+		return -1, fmt.Sprintf("compiler %s is not %s", bin.Compiler, p.Compiler)
+	}
+
+	reasons := make([]string, 0, 2)
+
+	orank := 0
+	if p.OS != "" {
+		oses, ok := compatOS[p.OS]
+		if !ok {
+			oses = []string{p.OS}
+		}
+		orank = rank(bin.OS, oses)
+		if orank < 0 {
+			return -1, fmt.Sprintf("%s binaries do not run on %s", bin.OS, p.OS)
+		}
+		if orank > 0 {
+			reasons = append(reasons, fmt.Sprintf("%s binaries are compatible with %s", bin.OS, p.OS))
+		}
+	}
+
+	brank := 0
+	if p.Build != "" {
+		builds, ok := compatBuild[p.Build]
+		if !ok {
+			builds = []string{p.Build}
+		}
+		brank = rank(bin.Build, builds)
+		if brank < 0 {
+			return -1, fmt.Sprintf("build type %s can not replace %s", bin.Build, p.Build)
+		}
+		if brank > 0 {
+			reasons = append(reasons, fmt.Sprintf("no %s build, falling back to %s", p.Build, bin.Build))
+		}
+	}
+
+	if len(reasons) == 0 {
+		reasons = append(reasons, "native build")
+	}
+	return brank*10 + orank, strings.Join(reasons, ", ")
+}
+
+// HostPlatform returns the platform of the host.
+// $CMTCONFIG (or $BINARY_TAG) is used when defined. Otherwise, the platform is
+// detected from the system. LHCb projects ship with their own compiler, so the
+// compiler of a detected platform is left empty (i.e. any compiler).
+func HostPlatform() (Platform, error) {
+	for _, env := range []string{"CMTCONFIG", "BINARY_TAG"} {
+		if v := os.Getenv(env); v != "" {
+			p, err := ParsePlatform(v)
+			if err != nil {
+				return p, fmt.Errorf("lbpkr: invalid $%s: %v", env, err)
+			}
+			return p, nil
+		}
+	}
+
+	p := Platform{
+		Arch:  yum.HostArch(),
+		OS:    hostOS(),
+		Build: "opt",
+	}
+	if p.OS == "" {
+		return p, fmt.Errorf("lbpkr: could not detect the operating system of the host")
+	}
+	return p, nil
+}
+
+// hostOS detects the operating system of the host, in the LHCb nomenclature.
+func hostOS() string {
+	if f, err := os.Open("/etc/os-release"); err == nil {
+		defer f.Close()
+		vars := make(map[string]string)
+		scan := bufio.NewScanner(f)
+		for scan.Scan() {
+			toks := strings.SplitN(scan.Text(), "=", 2)
+			if len(toks) != 2 {
+				continue
+			}
+			vars[toks[0]] = strings.Trim(toks[1], `"'`)
+		}
+		if name := osName(vars["ID"], vars["VERSION_ID"]); name != "" {
+			return name
+		}
+	}
+
+	buf, err := ioutil.ReadFile("/etc/redhat-release")
+	if err != nil {
+		return ""
+	}
+	return redhatOS(string(buf))
+}
+
+// osName returns the LHCb name of the operating system id (as in /etc/os-release) and its version
+func osName(id, version string) string {
+	major := strings.SplitN(version, ".", 2)[0]
+	switch id {
+	case "centos":
+		return "centos" + major
+	case "rhel", "almalinux", "rocky", "scientific":
+		switch major {
+		case "6":
+			return "slc6"
+		case "7":
+			return "centos7"
+		case "8":
+			return "centos8"
+		case "":
+			return ""
+		}
+		return "el" + major
+	}
+	return ""
+}
+
+var redhatRe = regexp.MustCompile(`release (\d+)`)
+
+// redhatOS returns the LHCb name of the operating system described by /etc/redhat-release
+func redhatOS(release string) string {
+	m := redhatRe.FindStringSubmatch(release)
+	if m == nil {
+		return ""
+	}
+	switch {
+	case strings.Contains(release, "CERN"):
+		return "slc" + m[1]
+	case strings.Contains(release, "CentOS"):
+		return "centos" + m[1]
+	}
+	return osName("rhel", m[1])
+}
+
+// compilerVersion returns the family and the version of a compiler
+// (gcc, 4.8 for gcc48, gcc, 6.2 for gcc62, gcc, 9 for gcc9, clang, 3.5 for clang35)
+func compilerVersion(compiler string) (string, float64) {
+	i := strings.IndexAny(compiler, "0123456789")
+	if i < 0 {
+		return compiler, 0
+	}
+	family, digits := compiler[:i], compiler[i:]
+	if len(digits) == 2 && digits[0] >= '2' && digits[0] <= '6' {
+		digits = digits[:1] + "." + digits[1:]
+	}
+	v, err := strconv.ParseFloat(digits, 64)
+	if err != nil {
+		return compiler, 0
+	}
+	return family, v
+}
+
+// newerCompiler returns whether compiler a is newer than compiler b
+func newerCompiler(a, b string) bool {
+	af, av := compilerVersion(a)
+	bf, bv := compilerVersion(b)
+	if af != bf {
+		// prefer gcc over other compiler families, as LHCb does
+		switch {
+		case af == "gcc":
+			return true
+		case bf == "gcc":
+			return false
+		}
+		return af < bf
+	}
+	return av > bv
+}
+
+// SelectPlatform returns the platform among avail best suited for the host
+// platform p, together with the reason for that choice.
+// If native is true, only native builds are considered.
+// The newest compiler is selected when the one of the host is not specified.
+func (p Platform) SelectPlatform(avail []Platform, native bool) (Platform, string, bool) {
+	var (
+		best   Platform
+		reason string
+		score  = -1
+	)
+	for _, bin := range avail {
+		s, why := p.Score(bin)
+		if s < 0 || (native && s > 0) {
+			continue
+		}
+		if score < 0 || s < score || (s == score && newerCompiler(bin.Compiler, best.Compiler)) {
+			best, reason, score = bin, why, s
+		}
+	}
+	return best, reason, score >= 0
+}
+
+// EOF
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Project describes the versions of a LHCb project, as available from the
+// repositories or installed in the siteroot.
+type Project struct {
+	Name     string           `json:"name"`
+	Versions []ProjectRelease `json:"versions"`
+}
+
+// ProjectRelease describes the builds of a version of a LHCb project.
+type ProjectRelease struct {
+	Version   string         `json:"version"`
+	Builds    []ProjectBuild `json:"builds"`
+	Installed bool           `json:"installed"` // whether the version index is installed
+}
+
+// ProjectBuild describes the build of a version of a LHCb project for a platform.
+type ProjectBuild struct {
+	Platform  string `json:"platform"`
+	Available bool   `json:"available"` // whether the build is available from the repositories
+	Installed bool   `json:"installed"` // whether the build is installed
+}
+
+// ProjectFilter selects the projects listed by Context.Projects
+type ProjectFilter struct {
+	Name      string // regexp matching the project names
+	Version   string // version constraint (see ParseVersionConstraint)
+	Platforms string // regexp matching the platforms
+	Installed bool   // only list installed builds
+}
+
+// Projects lists the LHCb projects available from the repositories or
+// installed in the siteroot, sorted by name and version.
+func (ctx *Context) Projects(filter ProjectFilter) ([]Project, error) {
+	pkgs, err := ctx.yum.ListPackages("", "", "")
+	if err != nil {
+		return nil, err
+	}
+	avail := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		avail = append(avail, pkg.Name())
+	}
+
+	list, err := ctx.listInstalledPackages()
+	if err != nil {
+		return nil, err
+	}
+	installed := make([]string, 0, len(list))
+	for _, pkg := range list {
+		installed = append(installed, pkg[0])
+	}
+
+	return collectProjects(avail, installed, filter)
+}
+
+// collectProjects builds the list of projects from the names of the available
+// and installed packages.
+func collectProjects(avail, installed []string, filter ProjectFilter) ([]Project, error) {
+	reName, err := regexp.Compile(filter.Name)
+	if err != nil {
+		return nil, err
+	}
+	rePlatform, err := regexp.Compile(filter.Platforms)
+	if err != nil {
+		return nil, err
+	}
+	cons, err := ParseVersionConstraint(filter.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	type release struct {
+		index  bool // whether the version index is installed
+		builds map[string]*ProjectBuild
+	}
+	projects := make(map[string]map[string]*release)
+
+	// a project is made of <NAME>_<VERSION>_index packages, listing its versions...
+	reIndex := regexp.MustCompile(`^(.*?)_(.*?)_index$`)
+	index := func(name string, inst bool) {
+		sub := reIndex.FindStringSubmatch(name)
+		if sub == nil || !reName.MatchString(sub[1]) || !cons.Match(sub[2]) {
+			return
+		}
+		if projects[sub[1]] == nil {
+			projects[sub[1]] = make(map[string]*release)
+		}
+		rel := projects[sub[1]][sub[2]]
+		if rel == nil {
+			rel = &release{builds: make(map[string]*ProjectBuild)}
+			projects[sub[1]][sub[2]] = rel
+		}
+		rel.index = rel.index || inst
+	}
+	for _, name := range avail {
+		index(name, false)
+	}
+	for _, name := range installed {
+		index(name, true)
+	}
+
+	// ...and of <NAME>_<VERSION>_<PLATFORM> packages, one per platform
+	build := func(name string, inst bool) {
+		i := strings.Index(name, "_")
+		if i < 0 || strings.HasSuffix(name, "_index") {
+			return
+		}
+		proj := name[:i]
+		version, platform := splitProjectPackage(proj, name)
+		rel := projects[proj][version]
+		if rel == nil || platform == "" || !rePlatform.MatchString(platform) {
+			return
+		}
+		if _, err := ParsePlatform(platform); err != nil {
+			return
+		}
+		b := rel.builds[platform]
+		if b == nil {
+			b = &ProjectBuild{Platform: platform}
+			rel.builds[platform] = b
+		}
+		b.Available = b.Available || !inst
+		b.Installed = b.Installed || inst
+	}
+	for _, name := range avail {
+		build(name, false)
+	}
+	for _, name := range installed {
+		build(name, true)
+	}
+
+	names := make([]string, 0, len(projects))
+	for name := range projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]Project, 0, len(names))
+	for _, name := range names {
+		versions := make([]string, 0, len(projects[name]))
+		for v := range projects[name] {
+			versions = append(versions, v)
+		}
+		sort.Sort(projectVersions(versions))
+
+		proj := Project{Name: name}
+		for _, v := range versions {
+			rel := projects[name][v]
+			pr := ProjectRelease{Version: v, Installed: rel.index}
+			platforms := make([]string, 0, len(rel.builds))
+			for p := range rel.builds {
+				platforms = append(platforms, p)
+			}
+			sort.Strings(platforms)
+			for _, p := range platforms {
+				b := rel.builds[p]
+				if filter.Installed && !b.Installed {
+					continue
+				}
+				pr.Builds = append(pr.Builds, *b)
+			}
+			if filter.Installed && len(pr.Builds) == 0 && !pr.Installed {
+				continue
+			}
+			if filter.Platforms != "" && len(pr.Builds) == 0 {
+				continue
+			}
+			proj.Versions = append(proj.Versions, pr)
+		}
+
+		if cons.Latest() && len(proj.Versions) > 0 {
+			proj.Versions = proj.Versions[len(proj.Versions)-1:]
+		}
+		if len(proj.Versions) == 0 {
+			continue
+		}
+		out = append(out, proj)
+	}
+	return out, nil
+}
+
+// writeProjects writes the list of projects to w, as JSON or as a table.
+func writeProjects(w io.Writer, projects []Project, asJSON bool) error {
+	if asJSON {
+		buf, err := json.MarshalIndent(projects, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", buf)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	for _, proj := range projects {
+		for _, rel := range proj.Versions {
+			builds := make([]string, 0, len(rel.Builds))
+			for _, b := range rel.Builds {
+				str := b.Platform
+				switch {
+				case b.Installed && !b.Available:
+					str += " (installed, not available)"
+				case b.Installed:
+					str += " (installed)"
+				}
+				builds = append(builds, str)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", proj.Name, rel.Version, strings.Join(builds, ", "))
+		}
+	}
+	return tw.Flush()
+}
+
+// ProjectUpgrade describes the switch of a project to a new version on all its installed platforms.
+type ProjectUpgrade struct {
+	Name      string
+	From      string   // installed version
+	To        string   // version to install
+	Platforms []string // installed platforms of From available for To
+	Missing   []string // installed platforms of From not available for To
+	KeepOld   bool     // whether the builds of From are kept
+	Index     bool     // whether the index package of From is installed
+}
+
+// Install returns the names of the packages to install
+func (up *ProjectUpgrade) Install() []string {
+	return up.packages(up.To, up.Platforms)
+}
+
+// Remove returns the names of the packages to remove.
+// The index package of From is removed with its last installed build.
+func (up *ProjectUpgrade) Remove() []string {
+	if up.KeepOld {
+		return nil
+	}
+	names := up.packages(up.From, up.Platforms)
+	if up.Index && len(up.Missing) == 0 {
+		names = append(names, up.Name+"_"+up.From+"_index")
+	}
+	return names
+}
+
+func (up *ProjectUpgrade) packages(version string, platforms []string) []string {
+	names := make([]string, 0, len(platforms))
+	for _, p := range platforms {
+		names = append(names, up.Name+"_"+version+"_"+p)
+	}
+	return names
+}
+
+// planProjectUpgrade plans the upgrade of project name from its latest installed
+// version to the latest version matching the constraint to.
+func planProjectUpgrade(name string, avail, installed []string, to string, keepOld bool) (*ProjectUpgrade, error) {
+	if to == "" {
+		to = "latest"
+	}
+	cons, err := ParseVersionConstraint(to)
+	if err != nil {
+		return nil, err
+	}
+
+	projects, err := collectProjects(avail, installed, ProjectFilter{Name: "^" + regexp.QuoteMeta(name) + "$"})
+	if err != nil {
+		return nil, err
+	}
+	if len(projects) != 1 {
+		return nil, fmt.Errorf("lbpkr: no project with name=%q", name)
+	}
+	proj := projects[0]
+
+	var from, target *ProjectRelease
+	for i := range proj.Versions {
+		rel := &proj.Versions[i]
+		for _, b := range rel.Builds {
+			if b.Installed {
+				from = rel
+			}
+			if b.Available && cons.Match(rel.Version) {
+				target = rel
+			}
+		}
+	}
+	if from == nil {
+		return nil, fmt.Errorf("lbpkr: project %q is not installed", name)
+	}
+	if target == nil {
+		return nil, fmt.Errorf("lbpkr: no version of project %q matching %q", name, to)
+	}
+	if lessVersion(target.Version, from.Version) {
+		return nil, fmt.Errorf("lbpkr: %s %s is older than the installed version %s",
+			name, target.Version, from.Version,
+		)
+	}
+
+	up := &ProjectUpgrade{
+		Name:    name,
+		From:    from.Version,
+		To:      target.Version,
+		KeepOld: keepOld,
+	}
+	avails := make(map[string]bool, len(target.Builds))
+	for _, b := range target.Builds {
+		avails[b.Platform] = b.Available
+	}
+	for _, pkg := range installed {
+		if pkg == name+"_"+from.Version+"_index" {
+			up.Index = true
+		}
+	}
+	for _, b := range from.Builds {
+		if !b.Installed {
+			continue
+		}
+		if avails[b.Platform] {
+			up.Platforms = append(up.Platforms, b.Platform)
+		} else {
+			up.Missing = append(up.Missing, b.Platform)
+		}
+	}
+	if len(up.Platforms) <= 0 {
+		return nil, fmt.Errorf("lbpkr: no build of %s %s for the installed platforms %v of %s",
+			name, up.To, up.Missing, up.From,
+		)
+	}
+	return up, nil
+}
+
+// writeUpgradePlan writes the plan of a project upgrade to w.
+func writeUpgradePlan(w io.Writer, up *ProjectUpgrade) {
+	fmt.Fprintf(w, "%s: upgrade %s -> %s\n", up.Name, up.From, up.To)
+	for _, pkg := range up.Install() {
+		fmt.Fprintf(w, " + %s\n", pkg)
+	}
+	for _, pkg := range up.Remove() {
+		fmt.Fprintf(w, " - %s\n", pkg)
+	}
+	for _, pkg := range up.packages(up.From, up.Missing) {
+		fmt.Fprintf(w, " ! %s: no %s build available, keeping it\n", pkg, up.To)
+	}
+}
+
+// UpgradeProject switches project name to a new version on all the platforms
+// its latest installed version is installed for.
+// to is a version constraint (see ParseVersionConstraint), defaulting to the
+// latest version. The builds of the old version are removed unless keepOld is true.
+// In dry-run mode, only the plan of the upgrade is printed.
+func (ctx *Context) UpgradeProject(name, to string, keepOld bool) error {
+	pkgs, err := ctx.yum.ListPackages("^"+regexp.QuoteMeta(name)+"_", "", "")
+	if err != nil {
+		return err
+	}
+	avail := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		avail = append(avail, pkg.Name())
+	}
+
+	list, err := ctx.listInstalledPackages()
+	if err != nil {
+		return err
+	}
+	installed := make([]string, 0, len(list))
+	for _, pkg := range list {
+		installed = append(installed, pkg[0])
+	}
+
+	up, err := planProjectUpgrade(name, avail, installed, to, keepOld)
+	if err != nil {
+		return err
+	}
+
+	if up.From == up.To {
+		ctx.msg.Infof("project %s is already at version %s\n", name, up.To)
+		return nil
+	}
+
+	writeUpgradePlan(os.Stdout, up)
+	if ctx.options.DryRun {
+		return nil
+	}
+
+	platforms := strings.Join(up.Platforms, ",")
+	err = ctx.InstallProject(name, up.To, "", platforms)
+	if err != nil {
+		return err
+	}
+
+	if up.KeepOld {
+		return nil
+	}
+	// also removes the index of From, once none of its builds is left (see ProjectUpgrade.Remove)
+	return ctx.RemoveProject(name, up.From, platforms, false, false)
+}
+
+// EOF
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ProjectVersion is the version of a LHCb project: vXrY[pZ] (e.g. v25r5, v37r1p2)
+type ProjectVersion struct {
+	Major int
+	Minor int
+	Patch int // -1 if there is no patch number
+}
+
+var projVersionRe = regexp.MustCompile(`^v(\d+)r(\d+)(?:p(\d+))?$`)
+
+// ParseProjectVersion parses a LHCb project version (vXrY[pZ])
+func ParseProjectVersion(str string) (ProjectVersion, error) {
+	m := projVersionRe.FindStringSubmatch(str)
+	if m == nil {
+		return ProjectVersion{}, fmt.Errorf("lbpkr: invalid project version %q", str)
+	}
+	v := ProjectVersion{Patch: -1}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		v.Patch, _ = strconv.Atoi(m[3])
+	}
+	return v, nil
+}
+
+func (v ProjectVersion) String() string {
+	if v.Patch < 0 {
+		return fmt.Sprintf("v%dr%d", v.Major, v.Minor)
+	}
+	return fmt.Sprintf("v%dr%dp%d", v.Major, v.Minor, v.Patch)
+}
+
+// Compare returns -1, 0 or +1 depending on whether v is older, the same or newer than o.
+// A version without a patch number is older than all its patched versions (v25r5 < v25r5p0).
+func (v ProjectVersion) Compare(o ProjectVersion) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		switch {
+		case d < 0:
+			return -1
+		case d > 0:
+			return +1
+		}
+	}
+	return 0
+}
+
+// Less returns whether v is older than o
+func (v ProjectVersion) Less(o ProjectVersion) bool {
+	return v.Compare(o) < 0
+}
+
+// VersionConstraint selects versions of a project.
+//
+// A constraint is one of:
+//   - "" or "all": all versions,
+//   - "latest": the latest version,
+//   - a glob pattern ("v25r*"): the latest version matching the pattern,
+//   - a comma-separated list of ranges (">=v26r0,<v27r0"): the latest version in all ranges,
+//   - anything else: that exact version.
+type VersionConstraint struct {
+	str    string
+	exact  bool
+	latest bool
+	glob   *regexp.Regexp
+	ranges []versionRange
+}
+
+type versionRange struct {
+	op string
+	v  ProjectVersion
+}
+
+func (r versionRange) match(v ProjectVersion) bool {
+	c := v.Compare(r.v)
+	switch r.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "!=":
+		return c != 0
+	default:
+		return c == 0
+	}
+}
+
+// ParseVersionConstraint parses a version constraint.
+func ParseVersionConstraint(str string) (*VersionConstraint, error) {
+	str = strings.TrimSpace(str)
+	c := &VersionConstraint{str: str}
+	switch {
+	case str == "" || str == "all":
+		// all versions
+
+	case str == "latest":
+		c.latest = true
+
+	case strings.ContainsAny(str, "*?"):
+		c.latest = true
+		pattern := regexp.QuoteMeta(str)
+		pattern = strings.Replace(pattern, `\*`, `.*`, -1)
+		pattern = strings.Replace(pattern, `\?`, `.`, -1)
+		c.glob = regexp.MustCompile("^" + pattern + "$")
+
+	case strings.ContainsAny(str[:1], "<>=!"):
+		c.latest = true
+		for _, tok := range strings.Split(str, ",") {
+			tok = strings.TrimSpace(tok)
+			i := strings.IndexFunc(tok, func(r rune) bool { return !strings.ContainsRune("<>=!", r) })
+			if i <= 0 {
+				return nil, fmt.Errorf("lbpkr: invalid version range %q in %q", tok, str)
+			}
+			op := tok[:i]
+			switch op {
+			case "<", "<=", ">", ">=", "=", "==", "!=":
+			default:
+				return nil, fmt.Errorf("lbpkr: invalid operator %q in %q", op, str)
+			}
+			v, err := ParseProjectVersion(strings.TrimSpace(tok[i:]))
+			if err != nil {
+				return nil, err
+			}
+			c.ranges = append(c.ranges, versionRange{op: op, v: v})
+		}
+
+	default:
+		c.exact = true
+	}
+	return c, nil
+}
+
+func (c *VersionConstraint) String() string {
+	return c.str
+}
+
+// Exact returns whether the constraint names a single version
+func (c *VersionConstraint) Exact() bool {
+	return c.exact
+}
+
+// Latest returns whether only the latest matching version should be selected
+func (c *VersionConstraint) Latest() bool {
+	return c.latest
+}
+
+// Match returns whether the version str satisfies the constraint.
+func (c *VersionConstraint) Match(str string) bool {
+	switch {
+	case c.exact:
+		return str == c.str
+	case c.glob != nil:
+		return c.glob.MatchString(str)
+	case len(c.ranges) > 0:
+		v, err := ParseProjectVersion(str)
+		if err != nil {
+			return false
+		}
+		for _, r := range c.ranges {
+			if !r.match(v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lessVersion orders project versions, LHCb versions being newer than any
+// other (e.g. "HEAD") version string.
+func lessVersion(a, b string) bool {
+	va, erra := ParseProjectVersion(a)
+	vb, errb := ParseProjectVersion(b)
+	switch {
+	case erra == nil && errb == nil:
+		return va.Less(vb)
+	case erra == nil:
+		return false
+	case errb == nil:
+		return true
+	}
+	return a < b
+}
+
+type projectVersions []string
+
+func (p projectVersions) Len() int           { return len(p) }
+func (p projectVersions) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p projectVersions) Less(i, j int) bool { return lessVersion(p[i], p[j]) }
+
+// EOF
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lhcb-org/lbpkr/yum"
+)
+
+// syncSpec describes what to mirror: a RPM or the builds of a project
+type syncSpec struct {
+	Project bool
+	Name    string
+	Version string // version (constraint, for projects)
+	Release string
+}
+
+// parseSyncSpec parses spec, either a RPM (name[-version[-release]]) or a
+// project (NAME:VERSION, where VERSION is a version constraint defaulting to
+// the latest version).
+func parseSyncSpec(spec string) syncSpec {
+	if i := strings.Index(spec, ":"); i >= 0 {
+		version := spec[i+1:]
+		if version == "" {
+			version = "latest"
+		}
+		return syncSpec{Project: true, Name: spec[:i], Version: version}
+	}
+	args := splitRPM(spec)
+	return syncSpec{Name: args[0], Version: args[1], Release: args[2]}
+}
+
+// staleRPMs returns the RPM files directly under dir which are not in keep.
+func staleRPMs(dir string, keep map[string]*yum.Package) ([]string, error) {
+	fnames, err := filepath.Glob(filepath.Join(dir, "*.rpm"))
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for _, fname := range fnames {
+		if _, ok := keep[filepath.Base(fname)]; !ok {
+			stale = append(stale, fname)
+		}
+	}
+	sort.Strings(stale)
+	return stale, nil
+}
+
+// SyncRepository mirrors the packages described by specs, together with all
+// their dependencies, into a self-contained yum repository under dest.
+// specs are RPMs (name[-version[-release]]) or projects (NAME:VERSION, see
+// parseSyncSpec); the builds of projects are selected for platforms (see
+// InstallProject).
+// RPM files already under dest are only downloaded again if they do not match
+// the checksum advertised by the repositories. If prune is true, the RPM files
+// under dest outside of the dependency closure are removed.
+// Requirements no repository provides are an error, unless allowMissing is true.
+// In dry-run mode, the changes are only listed.
+func (ctx *Context) SyncRepository(dest string, specs []string, platforms string, prune, allowMissing bool) error {
+	_, closure, err := ctx.resolveSpecs(specs, platforms, allowMissing)
+	if err != nil {
+		return err
+	}
+
+	var todo []*yum.Package
+	for _, fname := range sortedPackageNames(closure) {
+		pkg := closure[fname]
+		ok, err := ctx.isSynced(pkg, filepath.Join(dest, fname))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			todo = append(todo, pkg)
+		}
+	}
+
+	var stale []string
+	if prune {
+		stale, err = staleRPMs(dest, closure)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctx.options.DryRun {
+		for _, pkg := range todo {
+			fmt.Printf("+ %s\n", pkg.RPMFileName())
+		}
+		for _, fname := range stale {
+			fmt.Printf("- %s\n", filepath.Base(fname))
+		}
+		return nil
+	}
+
+	err = os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.syncPackages(todo, dest)
+	if err != nil {
+		return err
+	}
+
+	for _, fname := range stale {
+		ctx.msg.Infof("pruning %s\n", filepath.Base(fname))
+		err = os.Remove(fname)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx.msg.Infof("generating the repository metadata...\n")
+	rc := yum.NewRepoCreator(dest, true)
+	rc.SetLevel(ctx.msg.Level())
+	err = rc.Create()
+	if err != nil {
+		return err
+	}
+
+	ctx.msg.Infof("%d package(s) synchronized into %s (%d downloaded, %d pruned)\n",
+		len(closure), dest, len(todo), len(stale),
+	)
+	return nil
+}
+
+// resolveSpecs returns the packages described by specs (see SyncRepository)
+// and their dependency closure, keyed by RPM file name.
+// The closure does not depend on the host running lbpkr: only the builtin and
+// declared (conf) host capabilities are used, and the files and shared
+// libraries no repository provides are left to the hosts the packages get
+// installed on. Any other requirement no repository provides is reported, and
+// is an error unless allowMissing is true.
+func (ctx *Context) resolveSpecs(specs []string, platforms string, allowMissing bool) ([]*yum.Package, map[string]*yum.Package, error) {
+	sources := ctx.yum.SystemSources()
+	ctx.yum.SetSystemSources(yum.SysBuiltin, yum.SysConf, yum.SysAssumed)
+	defer ctx.yum.SetSystemSources(sources...)
+
+	var roots []*yum.Package
+	for _, spec := range specs {
+		s := parseSyncSpec(spec)
+		if !s.Project {
+			pkg, err := ctx.yum.FindLatestProvider(s.Name, s.Version, s.Release)
+			if err != nil {
+				return nil, nil, err
+			}
+			roots = append(roots, pkg)
+			continue
+		}
+		builds, _, err := ctx.findProjectBuilds(s.Name, s.Version, platforms)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, pkg := range builds {
+			roots = append(roots, pkg.Package)
+		}
+	}
+
+	closure := make(map[string]*yum.Package)
+	var rerr error
+	for _, root := range roots {
+		pkgs, err := ctx.yum.PackageDeps(root, -1)
+		if err != nil {
+			rerr = fmt.Errorf("lbpkr: could not resolve the dependencies of %s: %v", root.ID(), err)
+		}
+		for _, pkg := range append(pkgs, root) {
+			closure[pkg.RPMFileName()] = pkg
+		}
+	}
+
+	unresolved := ctx.yum.Unresolved()
+	missing := make([]string, 0, len(unresolved))
+	for req := range unresolved {
+		missing = append(missing, req)
+	}
+	sort.Strings(missing)
+	for _, req := range missing {
+		ctx.msg.Warnf("%s: provided by no repository (required by %s)\n",
+			req, strings.Join(unresolved[req], ", "),
+		)
+	}
+	switch {
+	case len(missing) > 0 && !allowMissing:
+		return nil, nil, fmt.Errorf(
+			"lbpkr: %d requirement(s) provided by no repository (use -allow-missing to ignore them)",
+			len(missing),
+		)
+	case len(missing) == 0 && rerr != nil:
+		return nil, nil, rerr
+	}
+	ctx.msg.Infof("dependency closure: %d package(s)\n", len(closure))
+
+	var assumed []string
+	for req, hc := range ctx.yum.HostProvided() {
+		if hc.Source == yum.SysAssumed {
+			assumed = append(assumed, req)
+		}
+	}
+	sort.Strings(assumed)
+	for _, req := range assumed {
+		ctx.msg.Debugf("left to the target hosts: %s\n", req)
+	}
+	return roots, closure, nil
+}
+
+func sortedPackageNames(pkgs map[string]*yum.Package) []string {
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isSynced returns whether fname is an up-to-date copy of the RPM file of pkg.
+// Without a checksum from the repository, any existing file is deemed up to date.
+func (ctx *Context) isSynced(pkg *yum.Package, fname string) (bool, error) {
+	if !path_exists(fname) {
+		return false, nil
+	}
+	typ, sum := pkg.Checksum()
+	if sum == "" {
+		return true, nil
+	}
+	got, err := yum.FileChecksum(fname, typ)
+	if err != nil {
+		return false, err
+	}
+	if got != sum {
+		ctx.msg.Infof("%s: checksum mismatch, downloading it again\n", filepath.Base(fname))
+		return false, nil
+	}
+	return true, nil
+}
+
+// syncPackages downloads the RPM files of pkgs under dest, ctx.ndls at a time.
+func (ctx *Context) syncPackages(pkgs []*yum.Package, dest string) error {
+	work := make(chan *yum.Package)
+	errch := make(chan error, len(pkgs))
+	quit := make(chan struct{})
+
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	done := 0
+	for i := 0; i < ctx.ndls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pkg := range work {
+				err := ctx.syncPackage(pkg, dest)
+				if err == nil {
+					mux.Lock()
+					done++
+					ctx.msg.Infof("[%03d/%03d] downloaded %s\n", done, len(pkgs), pkg.Url())
+					mux.Unlock()
+				}
+				errch <- err
+			}
+		}()
+	}
+
+	go func() {
+		defer close(work)
+		for _, pkg := range pkgs {
+			select {
+			case work <- pkg:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var err error
+	for range pkgs {
+		err = <-errch
+		if err != nil {
+			ctx.msg.Errorf("error downloading a RPM: %v\n", err)
+			break
+		}
+	}
+	close(quit)
+	wg.Wait()
+	return err
+}
+
+// syncPackage downloads the RPM file of pkg under dest, and verifies its checksum.
+func (ctx *Context) syncPackage(pkg *yum.Package, dest string) error {
+	fname := filepath.Join(dest, pkg.RPMFileName())
+	f, err := os.Create(fname + ".part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	r, err := ctx.yum.OpenURL(pkg.Url())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	if typ, sum := pkg.Checksum(); sum != "" {
+		got, err := yum.FileChecksum(f.Name(), typ)
+		if err != nil {
+			return err
+		}
+		if got != sum {
+			return fmt.Errorf("lbpkr: checksum mismatch for %s (%s: got=%s, want=%s)",
+				pkg.Url(), typ, got, sum,
+			)
+		}
+	}
+	return os.Rename(f.Name(), fname)
+}
+
+// EOF
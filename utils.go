@@ -5,14 +5,14 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"syscall"
+
+	"github.com/lhcb-org/lbpkr/yum"
 )
 
 // newCommand is like os/exec.Command but ensures the subprocess is part of a process-group
@@ -176,29 +176,6 @@ func sanitizePathOrURL(path string) (string, error) {
 	return p, nil
 }
 
-func getRemoteData(rpath string) (io.ReadCloser, error) {
-	url, err := url.Parse(rpath)
-	if err != nil {
-		return nil, err
-	}
-
-	switch url.Scheme {
-	case "file":
-		f, err := os.Open(url.Path)
-		if err != nil {
-			return nil, err
-		}
-		return f, nil
-
-	default:
-		resp, err := http.Get(rpath)
-		if err != nil {
-			return nil, err
-		}
-		return resp.Body, nil
-	}
-}
-
 var (
 	rpmRe1 = regexp.MustCompile(`(.*?)-([\d\.]+)$`)
 	rpmRe2 = regexp.MustCompile(`(.*?)-([\d\.]+)-(\d*)$`)
@@ -206,6 +183,13 @@ var (
 
 // splitRPM splits a RPM package name into name-version-release
 func splitRPM(rpm string) [3]string {
+	// "name-version-release.arch" is split into "name.arch", version and release
+	if name, arch := yum.SplitArch(rpm); arch != "" {
+		args := splitRPM(name)
+		args[0] += "." + arch
+		return args
+	}
+
 	switch strings.Count(rpm, "-") {
 	case 0:
 		return [3]string{rpm, "", ""}
@@ -0,0 +1,134 @@
+package yum
+
+import (
+	"runtime"
+	"strings"
+)
+
+// compatArches lists, for a host architecture, the architectures of the
+// packages which can be installed on that host, from the most to the least preferred.
+var compatArches = map[string][]string{
+	"x86_64":  {"x86_64", "amd64", "noarch"},
+	"i686":    {"i686", "i586", "i486", "i386", "noarch"},
+	"i586":    {"i586", "i486", "i386", "noarch"},
+	"i486":    {"i486", "i386", "noarch"},
+	"i386":    {"i386", "noarch"},
+	"aarch64": {"aarch64", "noarch"},
+	"armv7hl": {"armv7hl", "armv7l", "armv6l", "noarch"},
+	"ppc64le": {"ppc64le", "noarch"},
+	"ppc64":   {"ppc64", "noarch"},
+	"s390x":   {"s390x", "noarch"},
+}
+
+// HostArch returns the architecture of the host, as named by rpm.
+func HostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i686"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		return "armv7hl"
+	}
+	return runtime.GOARCH
+}
+
+// CompatArches returns the architectures of the packages which can be
+// installed on a host of architecture arch, from the most to the least preferred.
+func CompatArches(arch string) []string {
+	arches, ok := compatArches[arch]
+	if !ok {
+		return []string{arch, "noarch"}
+	}
+	out := make([]string, len(arches))
+	copy(out, arches)
+	return out
+}
+
+// isArch returns whether arch is the name of a known package architecture.
+func isArch(arch string) bool {
+	switch arch {
+	case "noarch", "src", "nosrc":
+		return true
+	}
+	for _, arches := range compatArches {
+		if str_in_slice(arch, arches) {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitArch splits a package specification of the form "name.arch" into its
+// name and architecture. arch is empty if spec does not name an architecture.
+func SplitArch(spec string) (name, arch string) {
+	i := strings.LastIndex(spec, ".")
+	if i > 0 && isArch(spec[i+1:]) {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// archScore returns the rank of arch in arches (lower is preferred) or -1 if
+// arch is not one of arches. An empty arches does not restrict the architecture.
+// Packages with no architecture are compatible with anything, but least preferred.
+func archScore(arch string, arches []string) int {
+	if len(arches) == 0 {
+		return 0
+	}
+	if arch == "" {
+		return len(arches)
+	}
+	for i, v := range arches {
+		if v == arch {
+			return i
+		}
+	}
+	return -1
+}
+
+// latestPackage returns the latest of the packages built for one of arches.
+// Among packages with the same version, the one with the preferred architecture is returned.
+func latestPackage(pkgs []*Package, arches []string) *Package {
+	var best *Package
+	rank := 0
+	for _, pkg := range pkgs {
+		score := archScore(pkg.Arch(), arches)
+		if score < 0 {
+			continue
+		}
+		switch {
+		case best == nil, RPMLessThan(best, pkg):
+		case RPMLessThan(pkg, best), score >= rank:
+			continue
+		}
+		best, rank = pkg, score
+	}
+	return best
+}
+
+// latestProvider returns the latest of the provides of packages built for one of arches.
+func latestProvider(provs []*Provides, arches []string) *Provides {
+	var best *Provides
+	for _, prov := range provs {
+		if archScore(prov.Package.Arch(), arches) < 0 {
+			continue
+		}
+		switch {
+		case best == nil, RPMLessThan(best, prov):
+		case RPMLessThan(prov, best):
+			continue
+		default:
+			pkg := latestPackage([]*Package{best.Package, prov.Package}, arches)
+			if pkg != prov.Package {
+				continue
+			}
+		}
+		best = prov
+	}
+	return best
+}
+
+// EOF
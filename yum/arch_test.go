@@ -0,0 +1,133 @@
+package yum
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSplitArch(t *testing.T) {
+	for _, table := range []struct {
+		spec string
+		name string
+		arch string
+	}{
+		{"GAUDI_v25r5", "GAUDI_v25r5", ""},
+		{"GAUDI_v25r5.x86_64", "GAUDI_v25r5", "x86_64"},
+		{"GAUDI_v25r5.noarch", "GAUDI_v25r5", "noarch"},
+		{"gcc_4.8.1_x86_64_slc6", "gcc_4.8.1_x86_64_slc6", ""},
+		{"gcc_4.8.1_x86_64_slc6.i686", "gcc_4.8.1_x86_64_slc6", "i686"},
+		{"python2.7", "python2.7", ""},
+		{".x86_64", ".x86_64", ""},
+	} {
+		name, arch := SplitArch(table.spec)
+		if name != table.name || arch != table.arch {
+			t.Errorf("%q: expected (%q, %q). got=(%q, %q)\n",
+				table.spec, table.name, table.arch, name, arch,
+			)
+		}
+	}
+}
+
+func TestCompatArches(t *testing.T) {
+	for _, table := range []struct {
+		arch string
+		pkg  string
+		ok   bool
+	}{
+		{"x86_64", "x86_64", true},
+		{"x86_64", "noarch", true},
+		{"x86_64", "", true},
+		{"x86_64", "i686", false},
+		{"x86_64", "src", false},
+		{"x86_64", "aarch64", false},
+		{"i686", "i386", true},
+		{"i686", "x86_64", false},
+		{"aarch64", "aarch64", true},
+		{"aarch64", "noarch", true},
+		{"aarch64", "x86_64", false},
+		{"riscv64", "riscv64", true},
+		{"riscv64", "noarch", true},
+	} {
+		ok := archScore(table.pkg, CompatArches(table.arch)) >= 0
+		if ok != table.ok {
+			t.Errorf("arch=%q pkg=%q: expected compatible=%v. got=%v\n", table.arch, table.pkg, table.ok, ok)
+		}
+	}
+}
+
+func TestMultiArchResolution(t *testing.T) {
+	backend, err := newTestXMLBackend("testdata/multiarch.xml")
+	if err != nil {
+		t.Fatalf("could not create backend: %v\n", err)
+	}
+	err = backend.LoadDB()
+	if err != nil {
+		t.Fatalf("could not load DB: %v\n", err)
+	}
+
+	yum, err := newClient("testdata/mysiteroot", []string{"RepositoryXMLBackend"}, true, true, Arch("x86_64"))
+	if err != nil {
+		t.Fatalf("could not create client: %v\n", err)
+	}
+	yum.msg = backend.msg
+	backend.Repository.Arches = CompatArches("x86_64")
+	yum.repos[backend.Repository.Name] = backend.Repository
+
+	for _, table := range []struct {
+		spec string
+		id   string
+	}{
+		// newer i686 and src packages are not installable on x86_64
+		{"Foo", "Foo-1.0.0-1.x86_64"},
+		{"Foo.i686", "Foo-1.1.0-1.i686"},
+		{"Foo.src", "Foo-1.2.0-1.src"},
+		// same version: prefer the native architecture over noarch
+		{"Bar", "Bar-1.0.0-1.x86_64"},
+		{"Bar.noarch", "Bar-1.0.0-1.noarch"},
+		{"Baz", ""},
+		{"Baz.aarch64", "Baz-1.0.0-1.aarch64"},
+	} {
+		pkg, err := yum.FindLatestProvider(table.spec, "", "")
+		if table.id == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error. got=%s\n", table.spec, pkg.ID())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: could not find package: %v\n", table.spec, err)
+			continue
+		}
+		if pkg.ID() != table.id {
+			t.Errorf("%s: expected %s. got=%s\n", table.spec, table.id, pkg.ID())
+		}
+	}
+
+	pkg, err := yum.FindLatestMatchingRequire(NewRequires("libfoo.so.1", "", "", "", "", ""))
+	if err == nil {
+		t.Errorf("libfoo.so.1: expected an error. got=%s\n", pkg.ID())
+	}
+
+	app, err := yum.FindLatestMatchingName("App", "", "")
+	if err != nil {
+		t.Fatalf("could not find App: %v\n", err)
+	}
+	if got, want := app.RPMFileName(), "App-1.0.0-1.x86_64.rpm"; got != want {
+		t.Errorf("expected rpm file name %q. got=%q\n", want, got)
+	}
+
+	deps, err := yum.PackageDeps(app, -1)
+	if err != nil {
+		t.Fatalf("could not resolve deps: %v\n", err)
+	}
+	ids := make([]string, 0, len(deps))
+	for _, dep := range deps {
+		ids = append(ids, dep.ID())
+	}
+	sort.Strings(ids)
+	want := []string{"Bar-1.0.0-1.x86_64", "Foo-1.0.0-1.x86_64"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("App: expected deps %v. got=%v\n", want, ids)
+	}
+}
@@ -0,0 +1,438 @@
+package yum
+
+import (
+	"bufio"
+	"io"
+)
+
+// bzip2Writer compresses data to the bzip2 format.
+// The standard library only provides a bzip2 decompressor, while yum
+// repositories conventionally ship their SQLite databases bzip2-compressed.
+//
+// The encoder favours simplicity over compression ratio: each block is
+// encoded with a single Huffman table.
+type bzip2Writer struct {
+	w    *bufio.Writer
+	bits uint64 // pending bits, MSB first
+	nbit uint   // number of pending bits
+
+	header   bool   // whether the stream header has been written
+	block    []byte // run-length encoded content of the current block
+	crc      uint32 // CRC of the current block
+	combined uint32 // CRC of the stream
+
+	last int // value of the current run of bytes, -1 if none
+	run  int // length of the current run of bytes
+	err  error
+}
+
+const (
+	bzip2Level    = 9
+	bzip2MaxBlock = bzip2Level*100000 - 19 // as bzip2 does
+	bzip2MaxLen   = 17                     // maximum length of a Huffman code
+	bzip2Groups   = 2                      // minimum number of Huffman tables
+	bzip2GroupLen = 50                     // number of symbols coded by a selector
+)
+
+var bzip2CRCTable = func() [256]uint32 {
+	var tbl [256]uint32
+	for i := range tbl {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+		tbl[i] = c
+	}
+	return tbl
+}()
+
+// newBzip2Writer returns a writer compressing to w.
+// Close must be called to flush the compressed stream.
+func newBzip2Writer(w io.Writer) *bzip2Writer {
+	return &bzip2Writer{
+		w:    bufio.NewWriter(w),
+		crc:  0xffffffff,
+		last: -1,
+	}
+}
+
+func (bz *bzip2Writer) Write(p []byte) (int, error) {
+	if bz.err != nil {
+		return 0, bz.err
+	}
+	for _, c := range p {
+		// runs are capped to 4 bytes + a 1-byte count
+		if int(c) == bz.last && bz.run < 255+4 {
+			bz.run++
+			continue
+		}
+		bz.flushRun()
+		bz.last = int(c)
+		bz.run = 1
+	}
+	return len(p), bz.err
+}
+
+// Close flushes the compressed stream. It does not close the underlying writer.
+func (bz *bzip2Writer) Close() error {
+	if bz.err != nil {
+		return bz.err
+	}
+	bz.flushRun()
+	if len(bz.block) > 0 {
+		bz.writeBlock()
+	}
+	bz.writeHeader()
+	bz.writeBits(24, 0x177245)
+	bz.writeBits(24, 0x385090)
+	bz.writeBits(32, uint64(bz.combined))
+	if bz.nbit > 0 {
+		bz.writeBits(8-bz.nbit, 0)
+	}
+	if bz.err != nil {
+		return bz.err
+	}
+	return bz.w.Flush()
+}
+
+// flushRun appends the current run of bytes to the block, applying the
+// initial run-length encoding of bzip2.
+func (bz *bzip2Writer) flushRun() {
+	if bz.run == 0 {
+		return
+	}
+	if len(bz.block)+5 > bzip2MaxBlock {
+		bz.writeBlock()
+	}
+	c := byte(bz.last)
+	for i := 0; i < bz.run; i++ {
+		bz.crc = bz.crc<<8 ^ bzip2CRCTable[byte(bz.crc>>24)^c]
+		if i < 4 {
+			bz.block = append(bz.block, c)
+		}
+	}
+	if bz.run >= 4 {
+		bz.block = append(bz.block, byte(bz.run-4))
+	}
+	bz.run = 0
+}
+
+func (bz *bzip2Writer) writeHeader() {
+	if bz.header {
+		return
+	}
+	bz.header = true
+	bz.writeBits(8, 'B')
+	bz.writeBits(8, 'Z')
+	bz.writeBits(8, 'h')
+	bz.writeBits(8, '0'+bzip2Level)
+}
+
+func (bz *bzip2Writer) writeBlock() {
+	bz.writeHeader()
+
+	crc := ^bz.crc
+	bz.combined = (bz.combined<<1 | bz.combined>>31) ^ crc
+	bz.crc = 0xffffffff
+
+	block := bz.block
+	bz.block = bz.block[:0]
+
+	ptr, last := bwt(block)
+
+	// move-to-front and run-length encoding of the zeros (RUNA, RUNB)
+	var (
+		inuse [256]bool
+		seq   [256]byte
+		nseq  = 0
+	)
+	for _, c := range block {
+		inuse[c] = true
+	}
+	for i, ok := range inuse {
+		if ok {
+			seq[i] = byte(nseq)
+			nseq++
+		}
+	}
+	mtf := make([]byte, nseq)
+	for i := range mtf {
+		mtf[i] = byte(i)
+	}
+	syms := make([]uint16, 0, len(last)+1)
+	zeros := 0
+	runs := func() {
+		// bijective base-2 encoding of the number of zeros
+		for zeros > 0 {
+			if zeros&1 == 1 {
+				syms = append(syms, 0) // RUNA
+				zeros = (zeros - 1) / 2
+			} else {
+				syms = append(syms, 1) // RUNB
+				zeros = (zeros - 2) / 2
+			}
+		}
+	}
+	for _, c := range last {
+		s := seq[c]
+		j := 0
+		for mtf[j] != s {
+			j++
+		}
+		if j == 0 {
+			zeros++
+			continue
+		}
+		runs()
+		copy(mtf[1:j+1], mtf[:j])
+		mtf[0] = s
+		syms = append(syms, uint16(j+1))
+	}
+	runs()
+	eob := uint16(nseq + 1)
+	syms = append(syms, eob)
+
+	nsyms := nseq + 2
+	freqs := make([]int, nsyms)
+	for _, s := range syms {
+		freqs[s]++
+	}
+	lens := huffmanLengths(freqs, bzip2MaxLen)
+	codes := canonicalCodes(lens)
+
+	// block header
+	bz.writeBits(24, 0x314159)
+	bz.writeBits(24, 0x265359)
+	bz.writeBits(32, uint64(crc))
+	bz.writeBits(1, 0) // not randomized
+	bz.writeBits(24, uint64(ptr))
+
+	// map of the bytes in use
+	var used uint64
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			if inuse[i*16+j] {
+				used |= 1 << uint(15-i)
+				break
+			}
+		}
+	}
+	bz.writeBits(16, used)
+	for i := 0; i < 16; i++ {
+		if used&(1<<uint(15-i)) == 0 {
+			continue
+		}
+		var bits uint64
+		for j := 0; j < 16; j++ {
+			if inuse[i*16+j] {
+				bits |= 1 << uint(15-j)
+			}
+		}
+		bz.writeBits(16, bits)
+	}
+
+	// all the groups of symbols use the first Huffman table.
+	nsel := (len(syms) + bzip2GroupLen - 1) / bzip2GroupLen
+	bz.writeBits(3, bzip2Groups)
+	bz.writeBits(15, uint64(nsel))
+	for i := 0; i < nsel; i++ {
+		bz.writeBits(1, 0)
+	}
+
+	// Huffman tables, with delta-encoded code lengths
+	for i := 0; i < bzip2Groups; i++ {
+		cur := lens[0]
+		bz.writeBits(5, uint64(cur))
+		for _, n := range lens {
+			for ; cur < n; cur++ {
+				bz.writeBits(2, 2)
+			}
+			for ; cur > n; cur-- {
+				bz.writeBits(2, 3)
+			}
+			bz.writeBits(1, 0)
+		}
+	}
+
+	for _, s := range syms {
+		bz.writeBits(uint(lens[s]), uint64(codes[s]))
+	}
+}
+
+func (bz *bzip2Writer) writeBits(n uint, v uint64) {
+	bz.bits = bz.bits<<n | v&(1<<n-1)
+	bz.nbit += n
+	for bz.nbit >= 8 {
+		bz.nbit -= 8
+		err := bz.w.WriteByte(byte(bz.bits >> bz.nbit))
+		if err != nil && bz.err == nil {
+			bz.err = err
+		}
+	}
+}
+
+// bwt returns the Burrows-Wheeler transform of data: the last column of the
+// sorted cyclic rotations of data, and the index of data itself among them.
+// Rotations are sorted by prefix doubling, in O(n log n).
+func bwt(data []byte) (int, []byte) {
+	n := len(data)
+	p := make([]int, n)  // rotations, sorted by their first k bytes
+	c := make([]int, n)  // equivalence class of each rotation
+	pn := make([]int, n) // scratch
+	cn := make([]int, n) // scratch
+	cnt := make([]int, n+256)
+
+	for _, b := range data {
+		cnt[b]++
+	}
+	for i := 1; i < 256; i++ {
+		cnt[i] += cnt[i-1]
+	}
+	for i := n - 1; i >= 0; i-- {
+		cnt[data[i]]--
+		p[cnt[data[i]]] = i
+	}
+	classes := 0
+	for i := range p {
+		if i > 0 && data[p[i]] != data[p[i-1]] {
+			classes++
+		}
+		c[p[i]] = classes
+	}
+	classes++
+
+	for k := 1; k < n && classes < n; k <<= 1 {
+		// sort by the class of the second half, then (stably) by the first one
+		for i := range p {
+			pn[i] = (p[i] - k + n) % n
+		}
+		for i := 0; i < classes; i++ {
+			cnt[i] = 0
+		}
+		for _, v := range pn {
+			cnt[c[v]]++
+		}
+		for i := 1; i < classes; i++ {
+			cnt[i] += cnt[i-1]
+		}
+		for i := n - 1; i >= 0; i-- {
+			cnt[c[pn[i]]]--
+			p[cnt[c[pn[i]]]] = pn[i]
+		}
+		classes = 0
+		cn[p[0]] = 0
+		for i := 1; i < n; i++ {
+			if c[p[i]] != c[p[i-1]] || c[(p[i]+k)%n] != c[(p[i-1]+k)%n] {
+				classes++
+			}
+			cn[p[i]] = classes
+		}
+		classes++
+		c, cn = cn, c
+	}
+
+	ptr := 0
+	last := make([]byte, n)
+	for i, v := range p {
+		if v == 0 {
+			ptr = i
+		}
+		last[i] = data[(v+n-1)%n]
+	}
+	return ptr, last
+}
+
+// huffmanLengths returns the lengths of the Huffman codes of symbols with
+// frequencies freqs, limited to maxlen bits. All symbols get a code.
+func huffmanLengths(freqs []int, maxlen int) []int {
+	n := len(freqs)
+	weights := make([]int, n)
+	for i, f := range freqs {
+		weights[i] = f
+		if f < 1 {
+			weights[i] = 1
+		}
+	}
+	lens := make([]int, n)
+	for {
+		// nodes: leaves first, then internal nodes
+		weight := append(make([]int, 0, 2*n), weights...)
+		parent := make([]int, n, 2*n)
+		alive := make([]bool, n, 2*n)
+		for i := range alive {
+			alive[i] = true
+		}
+		smallest := func() int {
+			best := -1
+			for i, ok := range alive {
+				if ok && (best < 0 || weight[i] < weight[best]) {
+					best = i
+				}
+			}
+			alive[best] = false
+			return best
+		}
+		for nalive := n; nalive > 1; nalive-- {
+			a := smallest()
+			b := smallest()
+			node := len(weight)
+			weight = append(weight, weight[a]+weight[b])
+			parent = append(parent, -1)
+			alive = append(alive, true)
+			parent[a] = node
+			parent[b] = node
+		}
+
+		ok := true
+		for i := 0; i < n; i++ {
+			depth := 0
+			for j := i; parent[j] >= 0; j = parent[j] {
+				depth++
+			}
+			lens[i] = depth
+			if depth > maxlen {
+				ok = false
+			}
+		}
+		if ok {
+			return lens
+		}
+
+		// flatten the distribution and try again
+		for i := range weights {
+			weights[i] = 1 + weights[i]/2
+		}
+	}
+}
+
+// canonicalCodes assigns Huffman codes from their lengths, shortest codes
+// first and in symbol order for codes of the same length, as bzip2 does.
+func canonicalCodes(lens []int) []uint32 {
+	codes := make([]uint32, len(lens))
+	minlen, maxlen := 32, 0
+	for _, n := range lens {
+		if n < minlen {
+			minlen = n
+		}
+		if n > maxlen {
+			maxlen = n
+		}
+	}
+	code := uint32(0)
+	for n := minlen; n <= maxlen; n++ {
+		for i, l := range lens {
+			if l == n {
+				codes[i] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// EOF
@@ -0,0 +1,298 @@
+package yum
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// kinds of problems reported by CheckRepositories
+const (
+	ProblemUnresolved = "unresolved" // a requirement no package satisfies
+	ProblemHostOnly   = "host"       // a requirement only the capabilities detected on the host satisfy
+	ProblemDuplicate  = "duplicate"  // a package provided by several repositories
+	ProblemMissing    = "missing"    // a package whose RPM file is not on the server
+	ProblemCycle      = "cycle"      // packages requiring each other
+)
+
+// RepoProblem is an inconsistency found in the repositories of a Client.
+type RepoProblem struct {
+	Kind    string
+	Repo    string // name of the repository (or repositories) of the package
+	Package string // ID of the package
+	Detail  string
+}
+
+func (p RepoProblem) String() string {
+	return fmt.Sprintf("%-10s %s [%s]: %s", p.Kind, p.Package, p.Repo, p.Detail)
+}
+
+type repoProblems []RepoProblem
+
+func (p repoProblems) Len() int      { return len(p) }
+func (p repoProblems) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p repoProblems) Less(i, j int) bool {
+	if p[i].Kind != p[j].Kind {
+		return p[i].Kind < p[j].Kind
+	}
+	if p[i].Package != p[j].Package {
+		return p[i].Package < p[j].Package
+	}
+	if p[i].Repo != p[j].Repo {
+		return p[i].Repo < p[j].Repo
+	}
+	return p[i].Detail < p[j].Detail
+}
+
+// CheckRepositories checks the consistency of all the packages of the
+// repositories of the Client, and returns the problems found, sorted by kind:
+//   - requirements which can not be satisfied,
+//   - requirements only satisfied by the capabilities detected on the host
+//     (files, libs or rpmdb sources), which other hosts may lack,
+//   - packages (name-version-release.arch) found in several repositories,
+//   - packages whose RPM file is missing, if locations is true,
+//   - dependency cycles.
+//
+// Requirements are resolved against the repositories and the builtin and
+// declared (conf) host capabilities only, so the result does not depend on the
+// host running the check. Each copy of a package found in several
+// repositories is checked.
+func (yum *Client) CheckRepositories(locations bool) []RepoProblem {
+	var problems []RepoProblem
+
+	type entry struct {
+		copies []*Package
+		repos  []string
+	}
+	pkgs := make(map[string]*entry)
+	var ids []string
+	for _, repo := range yum.Repositories() {
+		for _, pkg := range repo.GetPackages() {
+			id := pkg.ID()
+			e, ok := pkgs[id]
+			if !ok {
+				e = &entry{}
+				pkgs[id] = e
+				ids = append(ids, id)
+			}
+			e.copies = append(e.copies, pkg)
+			e.repos = append(e.repos, repo.Name)
+		}
+	}
+	sort.Strings(ids)
+	yum.msg.Infof("checking %d package(s)...\n", len(ids))
+
+	host := yum.sysprov
+	sources := yum.SystemSources()
+	var declared []string
+	for _, src := range declaredSysSources {
+		if str_in_slice(src, sources) {
+			declared = append(declared, src)
+		}
+	}
+	yum.SetSystemSources(declared...)
+	defer yum.SetSystemSources(sources...)
+
+	for _, id := range ids {
+		if e := pkgs[id]; len(e.repos) > 1 {
+			problems = append(problems, RepoProblem{
+				Kind:    ProblemDuplicate,
+				Repo:    strings.Join(e.repos, ","),
+				Package: id,
+				Detail:  fmt.Sprintf("found in %d repositories", len(e.repos)),
+			})
+		}
+	}
+
+	// requirements are shared by many packages: resolve them once.
+	resolved := make(map[string][]*Package)
+	unresolved := make(map[string]error)
+	deps := make(map[string][]string, len(ids))
+	var all []*Package
+	for _, id := range ids {
+		for _, pkg := range pkgs[id].copies {
+			all = append(all, pkg)
+			for _, req := range pkg.Requires() {
+				rid := req.ID()
+				providers, ok := resolved[rid]
+				if !ok {
+					if _, bad := unresolved[rid]; !bad {
+						var err error
+						providers, err = yum.ResolveRequire(req)
+						if err != nil {
+							unresolved[rid] = err
+						} else {
+							resolved[rid] = providers
+						}
+					}
+				}
+				if err, bad := unresolved[rid]; bad {
+					yum.msg.Debugf("%s: unresolved requirement %s: %v\n", id, rid, err)
+					problem := RepoProblem{
+						Kind:    ProblemUnresolved,
+						Repo:    pkg.Repository().Name,
+						Package: id,
+						Detail:  "requires " + FormatCapability(req),
+					}
+					if hc := host.Match(req); hc != nil {
+						problem.Kind = ProblemHostOnly
+						problem.Detail += " (host: " + hc.String() + ")"
+					}
+					problems = append(problems, problem)
+					continue
+				}
+				for _, p := range providers {
+					if p.Host() == nil && p.ID() != id {
+						deps[id] = append(deps[id], p.ID())
+					}
+				}
+			}
+		}
+	}
+
+	if locations {
+		problems = append(problems, yum.checkLocations(all)...)
+	}
+
+	for _, cycle := range dependencyCycles(ids, deps) {
+		problems = append(problems, RepoProblem{
+			Kind:    ProblemCycle,
+			Repo:    pkgs[cycle[0]].copies[0].Repository().Name,
+			Package: cycle[0],
+			Detail:  "requires itself through " + strings.Join(append(cycle[1:], cycle[0]), " -> "),
+		})
+	}
+
+	sort.Stable(repoProblems(problems))
+	return problems
+}
+
+// checkLocations checks the RPM files of pkgs exist, at most yum.njobs at a time.
+func (yum *Client) checkLocations(pkgs []*Package) []RepoProblem {
+	njobs := yum.njobs
+	if njobs <= 0 {
+		njobs = 1
+	}
+	throttle := make(chan struct{}, njobs)
+
+	var (
+		mux      sync.Mutex
+		wg       sync.WaitGroup
+		problems []RepoProblem
+	)
+	for _, pkg := range pkgs {
+		wg.Add(1)
+		go func(p *Package) {
+			defer wg.Done()
+			throttle <- struct{}{}
+			defer func() { <-throttle }()
+			err := statURL(yum.httpc, p.Url())
+			if err == nil {
+				return
+			}
+			mux.Lock()
+			problems = append(problems, RepoProblem{
+				Kind:    ProblemMissing,
+				Repo:    p.Repository().Name,
+				Package: p.ID(),
+				Detail:  fmt.Sprintf("%s: %v", p.Location(), err),
+			})
+			mux.Unlock()
+		}(pkg)
+	}
+	wg.Wait()
+	return problems
+}
+
+// dependencyCycles returns the cycles of the dependency graph deps, one per
+// strongly connected component, each cycle starting with its smallest node.
+func dependencyCycles(nodes []string, deps map[string][]string) [][]string {
+	// Tarjan's algorithm
+	var (
+		index   = make(map[string]int, len(nodes))
+		lowlink = make(map[string]int, len(nodes))
+		onstack = make(map[string]bool)
+		stack   []string
+		sccs    [][]string
+	)
+	var visit func(n string)
+	visit = func(n string) {
+		index[n] = len(index)
+		lowlink[n] = index[n]
+		stack = append(stack, n)
+		onstack[n] = true
+		for _, d := range deps[n] {
+			if _, ok := index[d]; !ok {
+				visit(d)
+				if lowlink[d] < lowlink[n] {
+					lowlink[n] = lowlink[d]
+				}
+			} else if onstack[d] && index[d] < lowlink[n] {
+				lowlink[n] = index[d]
+			}
+		}
+		if lowlink[n] != index[n] {
+			return
+		}
+		var scc []string
+		for {
+			m := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onstack[m] = false
+			scc = append(scc, m)
+			if m == n {
+				break
+			}
+		}
+		if len(scc) > 1 {
+			sccs = append(sccs, scc)
+		}
+	}
+	for _, n := range nodes {
+		if _, ok := index[n]; !ok {
+			visit(n)
+		}
+	}
+
+	cycles := make([][]string, 0, len(sccs))
+	for _, scc := range sccs {
+		sort.Strings(scc)
+		cycles = append(cycles, findCycle(scc[0], scc, deps))
+	}
+	return cycles
+}
+
+// findCycle returns a shortest path from start back to itself, within the
+// strongly connected component scc.
+func findCycle(start string, scc []string, deps map[string][]string) []string {
+	in := make(map[string]bool, len(scc))
+	for _, n := range scc {
+		in[n] = true
+	}
+	prev := map[string]string{start: ""}
+	queue := []string{start}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, d := range deps[n] {
+			if d == start {
+				path := []string{n}
+				for p := prev[n]; p != ""; p = prev[p] {
+					path = append(path, p)
+				}
+				for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+					path[i], path[j] = path[j], path[i]
+				}
+				return path
+			}
+			if _, seen := prev[d]; !seen && in[d] {
+				prev[d] = n
+				queue = append(queue, d)
+			}
+		}
+	}
+	return scc
+}
+
+// EOF
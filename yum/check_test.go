@@ -0,0 +1,118 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gonuts/logger"
+)
+
+func TestCheckRepositories(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-check-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	repos := map[string][]testRPM{
+		"main": append([]testRPM{
+			{
+				name: "TestC", version: "1", release: "1", arch: "noarch",
+				provides: [][3]string{{"TestC", "EQ", "1-1"}},
+				requires: [][3]string{{"TestE", "", ""}, {"NoSuch", "GE", "1"}},
+			},
+			{
+				name: "TestE", version: "1", release: "1", arch: "noarch",
+				provides: [][3]string{{"TestE", "EQ", "1-1"}},
+				requires: [][3]string{{"TestC", "", ""}, {"HostOnly", "", ""}},
+			},
+		}, testRPMs...),
+	}
+	// another build of TestB, with the same name-version-release.arch
+	testB := testRPMs[1]
+	testB.requires = [][3]string{{"NoSuchExtra", "", ""}}
+	repos["extra"] = []testRPM{testB}
+
+	var cfgs []*RepoConfig
+	for _, name := range []string{"extra", "main"} {
+		dir := writeTestRepo(t, filepath.Join(tmpdir, name), repos[name]...)
+		cfgs = append(cfgs, &RepoConfig{Name: name, Url: "file://" + dir})
+	}
+
+	// the RPM files of TestA and of the extra TestB vanished from the server
+	for _, fname := range []string{
+		filepath.Join(tmpdir, "main", "TestA-1.0.0-1.x86_64.rpm"),
+		filepath.Join(tmpdir, "extra", "TestB-2.1-3.noarch.rpm"),
+	} {
+		err = os.Remove(fname)
+		if err != nil {
+			t.Fatalf("could not remove RPM: %v\n", err)
+		}
+	}
+
+	client, err := newClient(filepath.Join(tmpdir, "siteroot"), []string{"RepositoryXMLBackend"}, true, false,
+		Repositories(cfgs...),
+	)
+	if err != nil {
+		t.Fatalf("could not create client: %v\n", err)
+	}
+	defer client.Close()
+	client.SetLevel(logger.ERROR)
+
+	// HostOnly is only found in the rpmdb of the host
+	sources := []string{SysBuiltin, SysConf, SysRpmDB}
+	client.syssources = sources
+	sys := NewSystemProvides(sources, "")
+	sys.once.Do(func() {})
+	err = sys.addCapability("HostOnly", SysRpmDB, "test")
+	if err != nil {
+		t.Fatalf("could not add capability: %v\n", err)
+	}
+	client.sysprov = sys
+
+	var got []string
+	for _, p := range client.CheckRepositories(true) {
+		got = append(got, p.Kind+" "+p.Package+" "+p.Repo+" "+p.Detail)
+	}
+	want := []string{
+		"cycle TestC-1-1.noarch main requires itself through TestE-1-1.noarch -> TestC-1-1.noarch",
+		"duplicate TestB-2.1-3.noarch extra,main found in 2 repositories",
+		"host TestE-1-1.noarch main requires HostOnly (host: HostOnly [rpmdb: test])",
+		"missing TestA-1.0.0-1.x86_64 main TestA-1.0.0-1.x86_64.rpm: " +
+			"stat " + filepath.Join(tmpdir, "main", "TestA-1.0.0-1.x86_64.rpm") + ": no such file or directory",
+		"missing TestB-2.1-3.noarch extra TestB-2.1-3.noarch.rpm: " +
+			"stat " + filepath.Join(tmpdir, "extra", "TestB-2.1-3.noarch.rpm") + ": no such file or directory",
+		"unresolved TestB-2.1-3.noarch extra requires NoSuchExtra",
+		"unresolved TestC-1-1.noarch main requires NoSuch >= 1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid problems.\ngot= %q\nwant=%q\n", got, want)
+	}
+	if got := client.SystemSources(); !reflect.DeepEqual(got, sources) {
+		t.Errorf("host capabilities not restored. got=%v\n", got)
+	}
+
+	// without location checks
+	if n := len(client.CheckRepositories(false)); n != len(want)-2 {
+		t.Errorf("expected %d problems. got=%d\n", len(want)-2, n)
+	}
+}
+
+func TestDependencyCycles(t *testing.T) {
+	deps := map[string][]string{
+		"a": {"b"},
+		"b": {"c", "d"},
+		"c": {"a"},
+		"d": {"e"},
+		"e": {"d"},
+		"f": {"a"},
+	}
+	got := dependencyCycles([]string{"a", "b", "c", "d", "e", "f"}, deps)
+	want := [][]string{{"d", "e"}, {"a", "b", "c"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid cycles.\ngot= %v\nwant=%v\n", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+package yum
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// ChecksumHash returns the hash for the checksum type typ, as named in yum
+// repositories (sha256, sha, md5, ...).
+func ChecksumHash(typ string) (hash.Hash, error) {
+	switch typ {
+	case "md5":
+		return md5.New(), nil
+	case "sha", "sha1":
+		return sha1.New(), nil
+	case "sha224":
+		return sha256.New224(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("yum: unsupported checksum type %q", typ)
+}
+
+// FileChecksum returns the (hex-encoded) checksum of type typ of the file fname
+func FileChecksum(fname, typ string) (string, error) {
+	h, err := ChecksumHash(typ)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// EOF
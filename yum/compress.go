@@ -0,0 +1,98 @@
+package yum
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// list of suffixes of compressed repodata files, in order of preference
+var compressionSuffixes = []string{".zst", ".xz", ".bz2", ".gz"}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressionSuffix returns the compression suffix of a repodata location (e.g. ".xz")
+// or "" if the location does not name a compressed file.
+func compressionSuffix(href string) string {
+	ext := path.Ext(href)
+	if str_in_slice(ext, compressionSuffixes) {
+		return ext
+	}
+	return ""
+}
+
+// findCompressedDB returns the path of the first file base+suffix which exists,
+// trying all known compression suffixes.
+// If none exists, base+defsuffix is returned.
+func findCompressedDB(base, defsuffix string) string {
+	for _, suffix := range compressionSuffixes {
+		fname := base + suffix
+		if path_exists(fname) {
+			return fname
+		}
+	}
+	return base + defsuffix
+}
+
+// removeCompressedDBs removes all the base+suffix files but keep.
+func removeCompressedDBs(base, keep string) error {
+	for _, suffix := range compressionSuffixes {
+		fname := base + suffix
+		if fname == keep || !path_exists(fname) {
+			continue
+		}
+		err := os.Remove(fname)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newDecompressor returns a reader decompressing the content of r.
+// The compression format (gzip, bzip2, xz or zstd) is detected from the magic bytes
+// of the stream. Streams with no known magic bytes are returned as-is.
+func newDecompressor(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+
+	case bytes.HasPrefix(magic, xzMagic):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+
+	return ioutil.NopCloser(br), nil
+}
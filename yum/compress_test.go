@@ -0,0 +1,285 @@
+package yum
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gonuts/logger"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compressFile compresses src into dst using the compression format
+// inferred from the suffix of dst.
+func compressFile(dst, src string) error {
+	in, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	// bzip2 streams can not be written with the standard library.
+	// use the test repository files, which are already bzip2-compressed.
+	if filepath.Ext(src) == ".bz2" {
+		return ioutil.WriteFile(dst, in, 0644)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var w io.WriteCloser
+	switch filepath.Ext(dst) {
+	case ".gz":
+		w = gzip.NewWriter(out)
+	case ".xz":
+		w, err = xz.NewWriter(out)
+	case ".zst":
+		w, err = zstd.NewWriter(out)
+	default:
+		_, err = out.Write(in)
+		if err != nil {
+			return err
+		}
+		return out.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(in)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func TestDecompressor(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-compress-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	want, err := ioutil.ReadFile("testdata/repo.xml")
+	if err != nil {
+		t.Fatalf("could not read test file: %v\n", err)
+	}
+
+	for _, suffix := range []string{"", ".gz", ".xz", ".zst"} {
+		fname := filepath.Join(tmpdir, "repo.xml"+suffix)
+		err = compressFile(fname, "testdata/repo.xml")
+		if err != nil {
+			t.Fatalf("could not create %s: %v\n", fname, err)
+		}
+
+		f, err := os.Open(fname)
+		if err != nil {
+			t.Fatalf("could not open %s: %v\n", fname, err)
+		}
+		defer f.Close()
+
+		r, err := newDecompressor(f)
+		if err != nil {
+			t.Fatalf("could not create decompressor for %s: %v\n", fname, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("could not decompress %s: %v\n", fname, err)
+		}
+		r.Close()
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: decompressed content differ\n", fname)
+		}
+	}
+}
+
+func TestCompressionSuffix(t *testing.T) {
+	for _, table := range []struct {
+		href string
+		want string
+	}{
+		{"repodata/primary.sqlite.bz2", ".bz2"},
+		{"repodata/abcdef-primary.xml.gz", ".gz"},
+		{"repodata/abcdef-primary.sqlite.xz", ".xz"},
+		{"repodata/abcdef-primary.xml.zst", ".zst"},
+		{"repodata/primary.xml", ""},
+	} {
+		got := compressionSuffix(table.href)
+		if got != table.want {
+			t.Errorf("%s: expected %q. got=%q\n", table.href, table.want, got)
+		}
+	}
+}
+
+func TestBackendsCompression(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-compress-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	const (
+		xmldb = "testdata/testconfig-xml/var/cache/lbyum/lhcbold/primary.xml.gz"
+		sqldb = "testdata/testconfig-sqlite/var/cache/lbyum/lhcbold/primary.sqlite.bz2"
+	)
+
+	// decompress the reference DBs once
+	raw := make(map[string]string)
+	for _, src := range []string{xmldb, sqldb} {
+		name := filepath.Base(src)
+		name = name[:len(name)-len(filepath.Ext(name))]
+		dst := filepath.Join(tmpdir, name)
+
+		in, err := os.Open(src)
+		if err != nil {
+			t.Fatalf("could not open %s: %v\n", src, err)
+		}
+		defer in.Close()
+
+		r, err := newDecompressor(in)
+		if err != nil {
+			t.Fatalf("could not create decompressor for %s: %v\n", src, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("could not decompress %s: %v\n", src, err)
+		}
+		err = ioutil.WriteFile(dst, data, 0644)
+		if err != nil {
+			t.Fatalf("could not write %s: %v\n", dst, err)
+		}
+		raw[src] = dst
+	}
+
+	for _, suffix := range []string{".gz", ".bz2", ".xz", ".zst"} {
+		for _, table := range []struct {
+			backend string
+			db      string
+			href    string
+		}{
+			{"RepositoryXMLBackend", xmldb, "repodata/0123-primary.xml" + suffix},
+			{"RepositorySQLiteBackend", sqldb, "repodata/0123-primary.sqlite" + suffix},
+		} {
+			src := raw[table.db]
+			if suffix == ".bz2" {
+				if filepath.Ext(table.db) != ".bz2" {
+					continue
+				}
+				src = table.db
+			}
+
+			srvdir := filepath.Join(tmpdir, "srv"+suffix, table.backend)
+			err = os.MkdirAll(filepath.Join(srvdir, "repodata"), 0755)
+			if err != nil {
+				t.Fatalf("could not create server dir: %v\n", err)
+			}
+			err = compressFile(filepath.Join(srvdir, table.href), src)
+			if err != nil {
+				t.Fatalf("could not compress %s: %v\n", src, err)
+			}
+
+			cachedir := filepath.Join(tmpdir, "cache"+suffix, table.backend)
+			repo, err := NewRepository(
+				"lhcbold", "file://"+srvdir, cachedir,
+				[]string{table.backend},
+				false, false,
+			)
+			if err != nil {
+				t.Fatalf("could not create repository: %v\n", err)
+			}
+			repo.msg = logger.NewLogger("repo", logger.INFO, ioutil.Discard)
+
+			backend, err := NewBackend(table.backend, repo)
+			if err != nil {
+				t.Fatalf("could not create backend %s: %v\n", table.backend, err)
+			}
+			repo.Backend = backend
+
+			err = backend.GetLatestDB(repo.RepoUrl + "/" + table.href)
+			if err != nil {
+				t.Fatalf("%s%s: could not download DB: %v\n", table.backend, suffix, err)
+			}
+
+			if !backend.HasDB() {
+				t.Fatalf("%s%s: DB not found after download\n", table.backend, suffix)
+			}
+
+			// reload from the local cache, as would be done in offline mode.
+			backend.Close()
+			backend, err = NewBackend(table.backend, repo)
+			if err != nil {
+				t.Fatalf("could not create backend %s: %v\n", table.backend, err)
+			}
+			repo.Backend = backend
+
+			err = backend.LoadDB()
+			if err != nil {
+				t.Fatalf("%s%s: could not load DB: %v\n", table.backend, suffix, err)
+			}
+
+			pkg, err := repo.FindLatestMatchingName("ROOT_5.32.02_x86_64_slc5_gcc46_opt", "1.0.0", "1")
+			if err != nil {
+				t.Fatalf("%s%s: could not find package: %v\n", table.backend, suffix, err)
+			}
+			if pkg == nil || pkg.Version() != "1.0.0" {
+				t.Fatalf("%s%s: invalid package: %v\n", table.backend, suffix, pkg)
+			}
+			repo.Close()
+		}
+	}
+}
+
+func TestBzip2Writer(t *testing.T) {
+	random := make([]byte, 300000)
+	seed := uint32(42)
+	for i := range random {
+		seed = seed*1664525 + 1013904223
+		random[i] = byte(seed >> 24)
+	}
+	for _, table := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"byte", []byte("a")},
+		{"runs", bytes.Repeat([]byte("aaaaaaaaaabbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"), 1000)},
+		{"text", bytes.Repeat([]byte("<package type=\"rpm\"><name>LHCb</name></package>\n"), 5000)},
+		{"random", random},
+		{"blocks", bytes.Repeat(random, 4)},
+	} {
+		var buf bytes.Buffer
+		w := newBzip2Writer(&buf)
+		_, err := w.Write(table.data)
+		if err != nil {
+			t.Fatalf("%s: could not compress: %v\n", table.name, err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatalf("%s: could not close compressor: %v\n", table.name, err)
+		}
+
+		r, err := newDecompressor(&buf)
+		if err != nil {
+			t.Fatalf("%s: could not create decompressor: %v\n", table.name, err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: could not decompress: %v\n", table.name, err)
+		}
+		if !bytes.Equal(out, table.data) {
+			t.Errorf("%s: round trip mismatch (got %d bytes, want %d)\n", table.name, len(out), len(table.data))
+		}
+	}
+}
@@ -0,0 +1,955 @@
+package yum
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gonuts/logger"
+)
+
+// XML namespaces of the yum metadata
+const (
+	xmlnsCommon    = "http://linux.duke.edu/metadata/common"
+	xmlnsRPM       = "http://linux.duke.edu/metadata/rpm"
+	xmlnsFilelists = "http://linux.duke.edu/metadata/filelists"
+	xmlnsRepo      = "http://linux.duke.edu/metadata/repo"
+)
+
+// version of the schema of the SQLite databases
+const primaryDBVersion = 10
+
+// mdPackage describes a package in the primary.xml (and filelists.xml) metadata
+type mdPackage struct {
+	Name        string     `xml:"name"`
+	Arch        string     `xml:"arch"`
+	Version     mdVersion  `xml:"version"`
+	Checksum    mdChecksum `xml:"checksum"`
+	Summary     string     `xml:"summary"`
+	Description string     `xml:"description"`
+	Packager    string     `xml:"packager"`
+	URL         string     `xml:"url"`
+	Time        mdTime     `xml:"time"`
+	Size        mdSize     `xml:"size"`
+	Location    mdLocation `xml:"location"`
+	Format      mdFormat   `xml:"format"`
+
+	files []mdFile // all the files of the package (filelists.xml)
+}
+
+type mdVersion struct {
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+}
+
+type mdChecksum struct {
+	Type  string `xml:"type,attr"`
+	PkgID string `xml:"pkgid,attr"`
+	Value string `xml:",chardata"`
+}
+
+type mdTime struct {
+	File  int64 `xml:"file,attr"`
+	Build int64 `xml:"build,attr"`
+}
+
+type mdSize struct {
+	Package   int64 `xml:"package,attr"`
+	Installed int64 `xml:"installed,attr"`
+	Archive   int64 `xml:"archive,attr"`
+}
+
+type mdLocation struct {
+	Href string `xml:"href,attr"`
+}
+
+type mdFormat struct {
+	License     string        `xml:"http://linux.duke.edu/metadata/rpm license"`
+	Vendor      string        `xml:"http://linux.duke.edu/metadata/rpm vendor"`
+	Group       string        `xml:"http://linux.duke.edu/metadata/rpm group"`
+	BuildHost   string        `xml:"http://linux.duke.edu/metadata/rpm buildhost"`
+	SourceRPM   string        `xml:"http://linux.duke.edu/metadata/rpm sourcerpm"`
+	HeaderRange mdHeaderRange `xml:"http://linux.duke.edu/metadata/rpm header-range"`
+	Provides    mdEntries     `xml:"http://linux.duke.edu/metadata/rpm provides"`
+	Requires    mdEntries     `xml:"http://linux.duke.edu/metadata/rpm requires"`
+	Conflicts   mdEntries     `xml:"http://linux.duke.edu/metadata/rpm conflicts"`
+	Obsoletes   mdEntries     `xml:"http://linux.duke.edu/metadata/rpm obsoletes"`
+	Files       []mdFile      `xml:"file"` // files of interest for dependency resolution
+}
+
+type mdHeaderRange struct {
+	Start int64 `xml:"start,attr"`
+	End   int64 `xml:"end,attr"`
+}
+
+type mdEntries struct {
+	Entries []mdEntry `xml:"http://linux.duke.edu/metadata/rpm entry"`
+}
+
+type mdEntry struct {
+	Name  string `xml:"name,attr"`
+	Flags string `xml:"flags,attr"`
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+	Pre   string `xml:"pre,attr"`
+}
+
+type mdFile struct {
+	Type string `xml:"type,attr"` // "" (file), "dir" or "ghost"
+	Path string `xml:",chardata"`
+}
+
+// mdRecord describes a metadata file in repomd.xml
+type mdRecord struct {
+	Type         string
+	Href         string
+	Checksum     string
+	OpenChecksum string
+	Size         int64
+	OpenSize     int64
+	Timestamp    int64
+	DBVersion    int
+
+	raw string // content of a record copied as is from an existing repomd.xml
+}
+
+// RepoCreator generates the metadata (repodata) of a yum repository from
+// a directory of RPM files.
+type RepoCreator struct {
+	msg    *logger.Logger
+	dir    string // directory holding the RPM files
+	update bool   // reuse the metadata of unchanged RPM files
+	merge  bool   // keep the metadata of packages without RPM file in dir
+	unique bool   // prefix the names of the metadata files with their checksum
+}
+
+// NewRepoCreator returns a RepoCreator for the RPM files under dir.
+// If update is true, the metadata of RPM files unchanged since the last run
+// (same location, size and modification time) are reused.
+func NewRepoCreator(dir string, update bool) *RepoCreator {
+	return &RepoCreator{
+		msg:    logger.NewLogger("createrepo", logger.INFO, stdout),
+		dir:    dir,
+		update: update,
+	}
+}
+
+// SetLevel sets the verbosity level of the RepoCreator
+func (rc *RepoCreator) SetLevel(lvl logger.Level) {
+	rc.msg.SetLevel(lvl)
+}
+
+// SetMerge makes Create keep the metadata of the packages whose RPM file is
+// not under the repository directory, as when only the new RPM files of a
+// remote repository are staged locally. It implies update.
+// The records of repomd.xml for the metadata Create does not generate (group,
+// other, updateinfo, ...) are kept unchanged.
+func (rc *RepoCreator) SetMerge(merge bool) {
+	rc.merge = merge
+}
+
+// SetUniqueNames makes Create prefix the names of the metadata files with
+// their checksum, so a new set of metadata files can be uploaded next to the
+// one in use before repomd.xml is replaced.
+func (rc *RepoCreator) SetUniqueNames(unique bool) {
+	rc.unique = unique
+}
+
+// Create generates repodata/repomd.xml, primary.xml.gz, filelists.xml.gz and
+// primary.sqlite.bz2.
+func (rc *RepoCreator) Create() error {
+	var err error
+
+	hrefs, err := rc.findRPMs()
+	if err != nil {
+		return err
+	}
+
+	var old map[string]*mdPackage
+	var kept []mdRecord
+	switch {
+	case rc.merge:
+		// dropping the packages of the existing metadata is not an option
+		old, err = rc.loadMetadata()
+		if err != nil {
+			return fmt.Errorf("yum: could not load existing metadata: %v", err)
+		}
+		kept, err = rc.loadOtherRecords()
+		if err != nil {
+			return fmt.Errorf("yum: could not load existing metadata: %v", err)
+		}
+	case rc.update:
+		old, err = rc.loadMetadata()
+		if err != nil {
+			rc.msg.Warnf("could not load existing metadata (%v). regenerating all of it\n", err)
+			old = nil
+		}
+	}
+
+	pkgs := make([]*mdPackage, 0, len(hrefs)+len(old))
+	reused := 0
+	if rc.merge {
+		found := make(map[string]bool, len(hrefs))
+		for _, href := range hrefs {
+			found[href] = true
+		}
+		for href, pkg := range old {
+			if !found[href] {
+				pkgs = append(pkgs, pkg)
+				reused++
+			}
+		}
+	}
+	for _, href := range hrefs {
+		fname := filepath.Join(rc.dir, filepath.FromSlash(href))
+		fi, err := os.Stat(fname)
+		if err != nil {
+			return err
+		}
+		if pkg, ok := old[href]; ok && pkg.Size.Package == fi.Size() && pkg.Time.File == fi.ModTime().Unix() {
+			rc.msg.Debugf("reusing metadata of %s\n", href)
+			pkgs = append(pkgs, pkg)
+			reused++
+			continue
+		}
+		rc.msg.Debugf("reading %s\n", href)
+		pkg, err := readMDPackage(fname, href, fi)
+		if err != nil {
+			return fmt.Errorf("yum: %s: %v", href, err)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	rc.msg.Infof("%d package(s) (%d unchanged)\n", len(pkgs), reused)
+	sort.Sort(mdPackagesByHref(pkgs))
+
+	mddir := filepath.Join(rc.dir, "repodata")
+	err = os.MkdirAll(mddir, 0755)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+
+	primary, err := writeMDFile(mddir, "primary", "primary.xml.gz", rc.unique, now, newGzipWriter, func(w io.Writer) error {
+		return writePrimaryXML(w, pkgs)
+	})
+	if err != nil {
+		return err
+	}
+
+	filelists, err := writeMDFile(mddir, "filelists", "filelists.xml.gz", rc.unique, now, newGzipWriter, func(w io.Writer) error {
+		return writeFilelistsXML(w, pkgs)
+	})
+	if err != nil {
+		return err
+	}
+
+	db, err := ioutil.TempFile("", "lbpkr-createrepo-")
+	if err != nil {
+		return err
+	}
+	db.Close()
+	defer os.Remove(db.Name())
+	err = writePrimaryDB(db.Name(), pkgs, primary.Checksum)
+	if err != nil {
+		return err
+	}
+	primarydb, err := writeMDFile(mddir, "primary_db", "primary.sqlite.bz2", rc.unique, now, newBzip2WriteCloser, func(w io.Writer) error {
+		f, err := os.Open(db.Name())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	primarydb.DBVersion = primaryDBVersion
+
+	// repomd.xml is written last, so clients never see it refer to missing files
+	_, err = writeMDFile(mddir, "", "repomd.xml", false, now, nil, func(w io.Writer) error {
+		return writeRepoMDXML(w, now, append([]mdRecord{*primary, *filelists, *primarydb}, kept...))
+	})
+	return err
+}
+
+// findRPMs returns the locations of the RPM files under the repository directory,
+// relative to that directory.
+func (rc *RepoCreator) findRPMs() ([]string, error) {
+	var hrefs []string
+	err := filepath.Walk(rc.dir, func(fname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == "repodata" {
+			return filepath.SkipDir
+		}
+		if fi.IsDir() || !strings.HasSuffix(fname, ".rpm") {
+			return nil
+		}
+		rel, err := filepath.Rel(rc.dir, fname)
+		if err != nil {
+			return err
+		}
+		hrefs = append(hrefs, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(hrefs)
+	return hrefs, err
+}
+
+// loadMetadata loads the packages described by the existing metadata of the
+// repository, indexed by location.
+func (rc *RepoCreator) loadMetadata() (map[string]*mdPackage, error) {
+	mddir := filepath.Join(rc.dir, "repodata")
+	data, err := ioutil.ReadFile(filepath.Join(mddir, "repomd.xml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	md, err := parseRepoMD(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var primary struct {
+		Packages []*mdPackage `xml:"package"`
+	}
+	var filelists struct {
+		Packages []struct {
+			PkgID string   `xml:"pkgid,attr"`
+			Files []mdFile `xml:"file"`
+		} `xml:"package"`
+	}
+	for _, v := range []struct {
+		typ string
+		ptr interface{}
+	}{
+		{"primary", &primary},
+		{"filelists", &filelists},
+	} {
+		rec, ok := md[v.typ]
+		if !ok {
+			return nil, fmt.Errorf("yum: no %s metadata", v.typ)
+		}
+		err = decodeMDFile(filepath.Join(rc.dir, filepath.FromSlash(rec.Location)), v.ptr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files := make(map[string][]mdFile, len(filelists.Packages))
+	for _, pkg := range filelists.Packages {
+		files[pkg.PkgID] = pkg.Files
+	}
+	pkgs := make(map[string]*mdPackage, len(primary.Packages))
+	for _, pkg := range primary.Packages {
+		fs, ok := files[pkg.Checksum.Value]
+		if !ok {
+			if rc.merge {
+				// the RPM file may not be there to be read again
+				return nil, fmt.Errorf("yum: no filelists entry for package %s", pkg.Location.Href)
+			}
+			// metadata are inconsistent: re-read the RPM
+			continue
+		}
+		pkg.files = fs
+		pkgs[pkg.Location.Href] = pkg
+	}
+	return pkgs, nil
+}
+
+// generatedTypes are the types of metadata generated by RepoCreator.Create
+var generatedTypes = []string{"primary", "filelists", "primary_db"}
+
+// loadOtherRecords returns the records of the existing repomd.xml of the
+// repository for the metadata Create does not generate, as they are.
+func (rc *RepoCreator) loadOtherRecords() ([]mdRecord, error) {
+	data, err := ioutil.ReadFile(filepath.Join(rc.dir, "repodata", "repomd.xml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var tree struct {
+		XMLName xml.Name `xml:"repomd"`
+		Data    []struct {
+			Type  string `xml:"type,attr"`
+			Inner string `xml:",innerxml"`
+		} `xml:"data"`
+	}
+	err = xml.Unmarshal(data, &tree)
+	if err != nil {
+		return nil, err
+	}
+	var recs []mdRecord
+	for _, data := range tree.Data {
+		if str_in_slice(data.Type, generatedTypes) {
+			continue
+		}
+		recs = append(recs, mdRecord{Type: data.Type, raw: data.Inner})
+	}
+	return recs, nil
+}
+
+type mdPackagesByHref []*mdPackage
+
+func (p mdPackagesByHref) Len() int           { return len(p) }
+func (p mdPackagesByHref) Less(i, j int) bool { return p[i].Location.Href < p[j].Location.Href }
+func (p mdPackagesByHref) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// decodeMDFile decodes the (compressed) XML metadata file fname into ptr.
+func decodeMDFile(fname string, ptr interface{}) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := newDecompressor(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return xml.NewDecoder(r).Decode(ptr)
+}
+
+// readMDPackage reads the metadata of the RPM file fname.
+func readMDPackage(fname, href string, fi os.FileInfo) (*mdPackage, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sha := sha256.New()
+	hdr, err := ReadRPMHeader(io.TeeReader(f, sha))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(sha, f)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := newMDPackage(hdr)
+	pkg.Checksum = mdChecksum{Type: "sha256", PkgID: "YES", Value: hex.EncodeToString(sha.Sum(nil))}
+	pkg.Time.File = fi.ModTime().Unix()
+	pkg.Size.Package = fi.Size()
+	pkg.Location.Href = href
+	return pkg, nil
+}
+
+// newMDPackage describes the package with RPM header hdr
+func newMDPackage(hdr *RPMHeader) *mdPackage {
+	pkg := &mdPackage{
+		Name: hdr.String(rpmTagName),
+		Arch: hdr.String(rpmTagArch),
+		Version: mdVersion{
+			Epoch: "0",
+			Ver:   hdr.String(rpmTagVersion),
+			Rel:   hdr.String(rpmTagRelease),
+		},
+		Summary:     hdr.String(rpmTagSummary),
+		Description: hdr.String(rpmTagDescription),
+		Packager:    hdr.String(rpmTagPackager),
+		URL:         hdr.String(rpmTagURL),
+		Time:        mdTime{Build: hdr.Int(rpmTagBuildTime)},
+		Size: mdSize{
+			Installed: hdr.Int(rpmTagSize),
+			Archive:   hdr.Int(rpmTagArchiveSize),
+		},
+		Format: mdFormat{
+			License:     hdr.String(rpmTagLicense),
+			Vendor:      hdr.String(rpmTagVendor),
+			Group:       hdr.String(rpmTagGroup),
+			BuildHost:   hdr.String(rpmTagBuildHost),
+			SourceRPM:   hdr.String(rpmTagSourceRPM),
+			HeaderRange: mdHeaderRange{Start: hdr.Start, End: hdr.End},
+			Provides:    rpmDeps(hdr, rpmTagProvideName, rpmTagProvideFlags, rpmTagProvideVersion),
+			Requires:    rpmDeps(hdr, rpmTagRequireName, rpmTagRequireFlags, rpmTagRequireVersion),
+			Conflicts:   rpmDeps(hdr, rpmTagConflictName, rpmTagConflictFlags, rpmTagConflictVersion),
+			Obsoletes:   rpmDeps(hdr, rpmTagObsoleteName, rpmTagObsoleteFlags, rpmTagObsoleteVersion),
+		},
+	}
+	if hdr.Has(rpmTagEpoch) {
+		pkg.Version.Epoch = fmt.Sprintf("%d", hdr.Int(rpmTagEpoch))
+	}
+	if !hdr.Has(rpmTagSourceRPM) {
+		pkg.Arch = "src"
+	}
+
+	modes := hdr.Ints(rpmTagFileModes)
+	for i, fname := range hdr.Files() {
+		file := mdFile{Path: fname}
+		if i < len(modes) && modes[i]&0170000 == 0040000 {
+			file.Type = "dir"
+		}
+		pkg.files = append(pkg.files, file)
+		if isPrimaryFile(fname) {
+			pkg.Format.Files = append(pkg.Format.Files, file)
+		}
+	}
+	return pkg
+}
+
+// rpmDeps returns the dependencies described by the name, flags and version tags of hdr.
+func rpmDeps(hdr *RPMHeader, nameTag, flagsTag, versionTag int) mdEntries {
+	names := hdr.Strings(nameTag)
+	flags := hdr.Ints(flagsTag)
+	versions := hdr.Strings(versionTag)
+
+	var deps mdEntries
+	seen := make(map[mdEntry]bool, len(names))
+	for i, name := range names {
+		if strings.HasPrefix(name, "rpmlib(") {
+			// provided by rpm itself
+			continue
+		}
+		dep := mdEntry{Name: name}
+		var flag int64
+		if i < len(flags) {
+			flag = flags[i]
+		}
+		if i < len(versions) && versions[i] != "" {
+			dep.Flags = rpmSenseFlags(flag)
+			dep.Epoch, dep.Ver, dep.Rel = splitEVR(versions[i])
+		}
+		if nameTag == rpmTagRequireName && flag&(rpmSensePrereq|rpmSenseScriptPre|rpmSenseScriptPost) != 0 {
+			dep.Pre = "1"
+		}
+		if seen[dep] {
+			continue
+		}
+		seen[dep] = true
+		deps.Entries = append(deps.Entries, dep)
+	}
+	return deps
+}
+
+// rpmSenseFlags returns the comparison operator of RPM dependency flags
+func rpmSenseFlags(flags int64) string {
+	switch flags & (rpmSenseLess | rpmSenseGreater | rpmSenseEqual) {
+	case rpmSenseLess:
+		return "LT"
+	case rpmSenseGreater:
+		return "GT"
+	case rpmSenseEqual:
+		return "EQ"
+	case rpmSenseLess | rpmSenseEqual:
+		return "LE"
+	case rpmSenseGreater | rpmSenseEqual:
+		return "GE"
+	}
+	return ""
+}
+
+// splitEVR splits a [epoch:]version[-release] string
+func splitEVR(evr string) (epoch, version, release string) {
+	epoch = "0"
+	if i := strings.Index(evr, ":"); i >= 0 {
+		epoch = evr[:i]
+		evr = evr[i+1:]
+	}
+	if i := strings.LastIndex(evr, "-"); i >= 0 {
+		release = evr[i+1:]
+		evr = evr[:i]
+	}
+	return epoch, evr, release
+}
+
+// isPrimaryFile returns whether a file is listed in primary.xml, as createrepo does:
+// files people commonly depend on (/etc/*, binaries and /usr/lib/sendmail).
+func isPrimaryFile(fname string) bool {
+	return strings.HasPrefix(fname, "/etc/") ||
+		strings.Contains(fname, "bin/") ||
+		fname == "/usr/lib/sendmail"
+}
+
+// xmlEscape escapes s for use in XML text and attributes
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// mdWriter writes XML metadata, recording the first error
+type mdWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *mdWriter) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+func (w *mdWriter) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// writePrimaryXML writes the primary.xml metadata of pkgs
+func writePrimaryXML(out io.Writer, pkgs []*mdPackage) error {
+	w := &mdWriter{w: bufio.NewWriter(out)}
+	w.printf("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	w.printf("<metadata xmlns=%q xmlns:rpm=%q packages=\"%d\">\n", xmlnsCommon, xmlnsRPM, len(pkgs))
+	for _, pkg := range pkgs {
+		w.printf("<package type=\"rpm\">\n")
+		w.printf("  <name>%s</name>\n", xmlEscape(pkg.Name))
+		w.printf("  <arch>%s</arch>\n", xmlEscape(pkg.Arch))
+		writeMDVersion(w, pkg.Version)
+		w.printf("  <checksum type=\"%s\" pkgid=\"%s\">%s</checksum>\n",
+			pkg.Checksum.Type, pkg.Checksum.PkgID, pkg.Checksum.Value,
+		)
+		w.printf("  <summary>%s</summary>\n", xmlEscape(pkg.Summary))
+		w.printf("  <description>%s</description>\n", xmlEscape(pkg.Description))
+		w.printf("  <packager>%s</packager>\n", xmlEscape(pkg.Packager))
+		w.printf("  <url>%s</url>\n", xmlEscape(pkg.URL))
+		w.printf("  <time file=\"%d\" build=\"%d\"/>\n", pkg.Time.File, pkg.Time.Build)
+		w.printf("  <size package=\"%d\" installed=\"%d\" archive=\"%d\"/>\n",
+			pkg.Size.Package, pkg.Size.Installed, pkg.Size.Archive,
+		)
+		w.printf("  <location href=\"%s\"/>\n", xmlEscape(pkg.Location.Href))
+		w.printf("  <format>\n")
+		w.printf("    <rpm:license>%s</rpm:license>\n", xmlEscape(pkg.Format.License))
+		w.printf("    <rpm:vendor>%s</rpm:vendor>\n", xmlEscape(pkg.Format.Vendor))
+		w.printf("    <rpm:group>%s</rpm:group>\n", xmlEscape(pkg.Format.Group))
+		w.printf("    <rpm:buildhost>%s</rpm:buildhost>\n", xmlEscape(pkg.Format.BuildHost))
+		w.printf("    <rpm:sourcerpm>%s</rpm:sourcerpm>\n", xmlEscape(pkg.Format.SourceRPM))
+		w.printf("    <rpm:header-range start=\"%d\" end=\"%d\"/>\n",
+			pkg.Format.HeaderRange.Start, pkg.Format.HeaderRange.End,
+		)
+		for _, deps := range []struct {
+			name string
+			deps mdEntries
+		}{
+			{"provides", pkg.Format.Provides},
+			{"requires", pkg.Format.Requires},
+			{"conflicts", pkg.Format.Conflicts},
+			{"obsoletes", pkg.Format.Obsoletes},
+		} {
+			if len(deps.deps.Entries) == 0 {
+				continue
+			}
+			w.printf("    <rpm:%s>\n", deps.name)
+			for _, e := range deps.deps.Entries {
+				w.printf("      <rpm:entry name=\"%s\"", xmlEscape(e.Name))
+				for _, attr := range [][2]string{
+					{"flags", e.Flags},
+					{"epoch", e.Epoch},
+					{"ver", e.Ver},
+					{"rel", e.Rel},
+					{"pre", e.Pre},
+				} {
+					if attr[1] != "" {
+						w.printf(" %s=\"%s\"", attr[0], xmlEscape(attr[1]))
+					}
+				}
+				w.printf("/>\n")
+			}
+			w.printf("    </rpm:%s>\n", deps.name)
+		}
+		writeMDFiles(w, "    ", pkg.Format.Files)
+		w.printf("  </format>\n")
+		w.printf("</package>\n")
+	}
+	w.printf("</metadata>\n")
+	return w.flush()
+}
+
+// writeFilelistsXML writes the filelists.xml metadata of pkgs
+func writeFilelistsXML(out io.Writer, pkgs []*mdPackage) error {
+	w := &mdWriter{w: bufio.NewWriter(out)}
+	w.printf("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	w.printf("<filelists xmlns=%q packages=\"%d\">\n", xmlnsFilelists, len(pkgs))
+	for _, pkg := range pkgs {
+		w.printf("<package pkgid=\"%s\" name=\"%s\" arch=\"%s\">\n",
+			pkg.Checksum.Value, xmlEscape(pkg.Name), xmlEscape(pkg.Arch),
+		)
+		writeMDVersion(w, pkg.Version)
+		writeMDFiles(w, "  ", pkg.files)
+		w.printf("</package>\n")
+	}
+	w.printf("</filelists>\n")
+	return w.flush()
+}
+
+func writeMDVersion(w *mdWriter, v mdVersion) {
+	w.printf("  <version epoch=\"%s\" ver=\"%s\" rel=\"%s\"/>\n",
+		xmlEscape(v.Epoch), xmlEscape(v.Ver), xmlEscape(v.Rel),
+	)
+}
+
+func writeMDFiles(w *mdWriter, indent string, files []mdFile) {
+	for _, f := range files {
+		if f.Type != "" {
+			w.printf("%s<file type=\"%s\">%s</file>\n", indent, f.Type, xmlEscape(f.Path))
+			continue
+		}
+		w.printf("%s<file>%s</file>\n", indent, xmlEscape(f.Path))
+	}
+}
+
+// writeRepoMDXML writes the repomd.xml index of the metadata files
+func writeRepoMDXML(out io.Writer, revision int64, recs []mdRecord) error {
+	w := &mdWriter{w: bufio.NewWriter(out)}
+	w.printf("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	w.printf("<repomd xmlns=%q xmlns:rpm=%q>\n", xmlnsRepo, xmlnsRPM)
+	w.printf("  <revision>%d</revision>\n", revision)
+	for _, rec := range recs {
+		if rec.raw != "" {
+			w.printf("  <data type=\"%s\">%s</data>\n", xmlEscape(rec.Type), rec.raw)
+			continue
+		}
+		w.printf("  <data type=\"%s\">\n", rec.Type)
+		w.printf("    <checksum type=\"sha256\">%s</checksum>\n", rec.Checksum)
+		w.printf("    <open-checksum type=\"sha256\">%s</open-checksum>\n", rec.OpenChecksum)
+		w.printf("    <location href=\"%s\"/>\n", xmlEscape(rec.Href))
+		w.printf("    <timestamp>%d</timestamp>\n", rec.Timestamp)
+		w.printf("    <size>%d</size>\n", rec.Size)
+		w.printf("    <open-size>%d</open-size>\n", rec.OpenSize)
+		if rec.DBVersion > 0 {
+			w.printf("    <database_version>%d</database_version>\n", rec.DBVersion)
+		}
+		w.printf("  </data>\n")
+	}
+	w.printf("</repomd>\n")
+	return w.flush()
+}
+
+// countingHash hashes and counts the bytes written to it
+type countingHash struct {
+	hash.Hash
+	n int64
+}
+
+func (h *countingHash) Write(p []byte) (int, error) {
+	h.n += int64(len(p))
+	return h.Hash.Write(p)
+}
+
+func (h *countingHash) sum() string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newGzipWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+func newBzip2WriteCloser(w io.Writer) io.WriteCloser {
+	return newBzip2Writer(w)
+}
+
+// writeMDFile writes the metadata file mddir/name, compressed with compress
+// (if not nil), with the content generated by fct.
+// If unique is true, name is prefixed with the checksum of the file.
+// The file is written to a temporary file first, and then renamed.
+func writeMDFile(mddir, typ, name string, unique bool, timestamp int64, compress func(io.Writer) io.WriteCloser, fct func(w io.Writer) error) (*mdRecord, error) {
+	f, err := ioutil.TempFile(mddir, "."+name+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zsum := &countingHash{Hash: sha256.New()}
+	sum := &countingHash{Hash: sha256.New()}
+
+	out := io.MultiWriter(f, zsum)
+	var zw io.WriteCloser
+	if compress != nil {
+		zw = compress(out)
+		out = zw
+	}
+	err = fct(io.MultiWriter(out, sum))
+	if err != nil {
+		return nil, err
+	}
+	if zw != nil {
+		err = zw.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return nil, err
+	}
+	if unique {
+		name = zsum.sum() + "-" + name
+	}
+	err = os.Rename(f.Name(), filepath.Join(mddir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &mdRecord{
+		Type:         typ,
+		Href:         path.Join("repodata", name),
+		Checksum:     zsum.sum(),
+		OpenChecksum: sum.sum(),
+		Size:         zsum.n,
+		OpenSize:     sum.n,
+		Timestamp:    timestamp,
+	}, nil
+}
+
+// schema of the primary.sqlite database, as created by createrepo
+var primaryDBSchema = []string{
+	`CREATE TABLE db_info (dbversion INTEGER, checksum TEXT)`,
+	`CREATE TABLE packages (
+		pkgKey INTEGER PRIMARY KEY, pkgId TEXT, name TEXT, arch TEXT,
+		version TEXT, epoch TEXT, release TEXT, summary TEXT, description TEXT, url TEXT,
+		time_file INTEGER, time_build INTEGER,
+		rpm_license TEXT, rpm_vendor TEXT, rpm_group TEXT, rpm_buildhost TEXT, rpm_sourcerpm TEXT,
+		rpm_header_start INTEGER, rpm_header_end INTEGER, rpm_packager TEXT,
+		size_package INTEGER, size_installed INTEGER, size_archive INTEGER,
+		location_href TEXT, location_base TEXT, checksum_type TEXT)`,
+	`CREATE TABLE files (name TEXT, type TEXT, pkgKey INTEGER)`,
+	`CREATE TABLE requires (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER, pre BOOLEAN DEFAULT FALSE)`,
+	`CREATE TABLE provides (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER)`,
+	`CREATE TABLE conflicts (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER)`,
+	`CREATE TABLE obsoletes (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER)`,
+	`CREATE INDEX packagename ON packages (name)`,
+	`CREATE INDEX packageId ON packages (pkgId)`,
+	`CREATE INDEX filenames ON files (name)`,
+	`CREATE INDEX pkgfiles ON files (pkgKey)`,
+	`CREATE INDEX pkgprovides ON provides (pkgKey)`,
+	`CREATE INDEX providesname ON provides (name)`,
+	`CREATE INDEX pkgrequires ON requires (pkgKey)`,
+	`CREATE INDEX requiresname ON requires (name)`,
+	`CREATE INDEX pkgconflicts ON conflicts (pkgKey)`,
+	`CREATE INDEX pkgobsoletes ON obsoletes (pkgKey)`,
+}
+
+// writePrimaryDB writes the primary.sqlite database of pkgs to fname.
+// checksum is the checksum of the corresponding primary.xml metadata.
+func writePrimaryDB(fname string, pkgs []*mdPackage, checksum string) error {
+	err := os.RemoveAll(fname)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", fname)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range primaryDBSchema {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("insert into db_info (dbversion, checksum) values (?, ?)", primaryDBVersion, checksum)
+	if err != nil {
+		return err
+	}
+
+	for i, pkg := range pkgs {
+		key := i + 1
+		_, err = tx.Exec(
+			"insert into packages values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+			key, pkg.Checksum.Value, pkg.Name, pkg.Arch,
+			pkg.Version.Ver, pkg.Version.Epoch, pkg.Version.Rel,
+			pkg.Summary, pkg.Description, pkg.URL,
+			pkg.Time.File, pkg.Time.Build,
+			pkg.Format.License, pkg.Format.Vendor, pkg.Format.Group,
+			pkg.Format.BuildHost, pkg.Format.SourceRPM,
+			pkg.Format.HeaderRange.Start, pkg.Format.HeaderRange.End, pkg.Packager,
+			pkg.Size.Package, pkg.Size.Installed, pkg.Size.Archive,
+			pkg.Location.Href, nil, pkg.Checksum.Type,
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range pkg.Format.Files {
+			typ := f.Type
+			if typ == "" {
+				typ = "file"
+			}
+			_, err = tx.Exec("insert into files values (?,?,?)", f.Path, typ, key)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, e := range pkg.Format.Requires.Entries {
+			pre := 0
+			if e.Pre == "1" {
+				pre = 1
+			}
+			_, err = tx.Exec(
+				"insert into requires values (?,?,?,?,?,?,?)",
+				e.Name, e.Flags, e.Epoch, e.Ver, e.Rel, key, pre,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, deps := range []struct {
+			table string
+			deps  mdEntries
+		}{
+			{"provides", pkg.Format.Provides},
+			{"conflicts", pkg.Format.Conflicts},
+			{"obsoletes", pkg.Format.Obsoletes},
+		} {
+			for _, e := range deps.deps.Entries {
+				_, err = tx.Exec(
+					"insert into "+deps.table+" values (?,?,?,?,?,?)",
+					e.Name, e.Flags, e.Epoch, e.Ver, e.Rel, key,
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// EOF
@@ -0,0 +1,457 @@
+package yum
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gonuts/logger"
+)
+
+// testRPM describes a RPM file for tests
+type testRPM struct {
+	name, version, release, arch string
+
+	provides [][3]string // name, flags, version
+	requires [][3]string // name, flags, version
+	files    []string    // directories end with a "/"
+}
+
+// write writes the RPM file to fname, the content of each regular file being
+// "dummy payload".
+func (rpm testRPM) write(fname string) error {
+	spec := RPMSpec{
+		Name:      rpm.name,
+		Version:   rpm.version,
+		Release:   rpm.release,
+		Arch:      rpm.arch,
+		Summary:   "the " + rpm.name + " package",
+		License:   "GPL",
+		Group:     "LHCb",
+		BuildHost: "localhost",
+		BuildTime: time.Unix(1400000000, 0),
+	}
+	for _, dep := range rpm.provides {
+		if dep[0] == rpm.name {
+			// WriteRPM makes the package provide itself
+			continue
+		}
+		spec.Provides = append(spec.Provides, RPMDep{Name: dep[0], Flags: dep[1], Version: dep[2]})
+	}
+	for _, dep := range rpm.requires {
+		spec.Requires = append(spec.Requires, RPMDep{Name: dep[0], Flags: dep[1], Version: dep[2]})
+	}
+	for _, name := range rpm.files {
+		if strings.HasSuffix(name, "/") {
+			spec.Files = append(spec.Files, RPMFile{Name: path.Clean(name), Mode: os.ModeDir | 0755})
+			continue
+		}
+		spec.Files = append(spec.Files, RPMFile{Name: name, Mode: 0644, Data: []byte("dummy payload")})
+	}
+
+	var out bytes.Buffer
+	err := WriteRPM(&out, &spec)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, out.Bytes(), 0644)
+}
+
+var testRPMs = []testRPM{
+	{
+		name: "TestA", version: "1.0.0", release: "1", arch: "x86_64",
+		provides: [][3]string{{"TestA", "EQ", "1.0.0-1"}},
+		requires: [][3]string{{"TestB", "GE", "2.0"}, {"/bin/sh", "", ""}},
+		files:    []string{"/opt/a/", "/opt/a/README", "/opt/a/bin/a"},
+	},
+	{
+		name: "TestB", version: "2.1", release: "3", arch: "noarch",
+		provides: [][3]string{{"TestB", "EQ", "2.1-3"}, {"libB.so", "", ""}},
+		files:    []string{"/etc/b.conf"},
+	},
+}
+
+// writeTestRepo writes rpms under dir, creates the repository metadata and
+// returns dir.
+func writeTestRepo(t *testing.T, dir string, rpms ...testRPM) string {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatalf("could not create repo dir: %v\n", err)
+	}
+	for _, rpm := range rpms {
+		err = rpm.write(filepath.Join(dir, rpm.name+"-"+rpm.version+"-"+rpm.release+"."+rpm.arch+".rpm"))
+		if err != nil {
+			t.Fatalf("could not write RPM: %v\n", err)
+		}
+	}
+	rc := NewRepoCreator(dir, false)
+	rc.msg = logger.NewLogger("createrepo", logger.INFO, ioutil.Discard)
+	err = rc.Create()
+	if err != nil {
+		t.Fatalf("could not create repo: %v\n", err)
+	}
+	return dir
+}
+
+func TestReadRPMHeader(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-rpmheader-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fname := filepath.Join(tmpdir, "TestA.rpm")
+	err = testRPMs[0].write(fname)
+	if err != nil {
+		t.Fatalf("could not write RPM: %v\n", err)
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatalf("could not open RPM: %v\n", err)
+	}
+	defer f.Close()
+
+	hdr, err := ReadRPMHeader(f)
+	if err != nil {
+		t.Fatalf("could not read RPM header: %v\n", err)
+	}
+
+	if hdr.Start <= rpmLeadSize || hdr.Start%8 != 0 {
+		t.Errorf("invalid header start %d\n", hdr.Start)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("could not open payload: %v\n", err)
+	}
+	payload, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("could not read payload: %v\n", err)
+	}
+	if got := readCpio(t, payload)["./opt/a/README"]; got != "dummy payload" {
+		t.Errorf("invalid payload %q\n", got)
+	}
+
+	for _, table := range []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"name", hdr.String(rpmTagName), "TestA"},
+		{"arch", hdr.String(rpmTagArch), "x86_64"},
+		{"size", hdr.Int(rpmTagSize), int64(2 * len("dummy payload"))},
+		{"requires", len(hdr.Strings(rpmTagRequireName)), 4},
+		{"files", len(hdr.Files()), 3},
+		{"file", hdr.Files()[2], "/opt/a/bin/a"},
+	} {
+		if table.got != table.want {
+			t.Errorf("expected %s=%v. got=%v\n", table.name, table.want, table.got)
+		}
+	}
+}
+
+func TestReadRPMHeaderInvalid(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-rpmheader-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fname := filepath.Join(tmpdir, "TestA-1.0.0-1.x86_64.rpm")
+	err = testRPMs[0].write(fname)
+	if err != nil {
+		t.Fatalf("could not write RPM: %v\n", err)
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatalf("could not open RPM: %v\n", err)
+	}
+	hdr, err := ReadRPMHeader(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("could not read RPM header: %v\n", err)
+	}
+
+	// corrupt the count of the first tag of the header
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("could not read RPM: %v\n", err)
+	}
+	binary.BigEndian.PutUint32(data[hdr.Start+16+12:], 0x7fffffff)
+	err = ioutil.WriteFile(fname, data, 0644)
+	if err != nil {
+		t.Fatalf("could not write RPM: %v\n", err)
+	}
+
+	_, err = ReadRPMHeader(bytes.NewReader(data))
+	if err == nil {
+		t.Fatalf("expected an error for an invalid tag count\n")
+	}
+
+	rc := NewRepoCreator(tmpdir, false)
+	rc.msg = logger.NewLogger("createrepo", logger.INFO, ioutil.Discard)
+	err = rc.Create()
+	if err == nil || !strings.HasPrefix(err.Error(), "yum: TestA-1.0.0-1.x86_64.rpm: ") {
+		t.Fatalf("expected an error for the invalid RPM. got=%v\n", err)
+	}
+}
+
+// checkTestRepo checks the packages of a repository generated from testRPMs,
+// with the RPM files of the x86_64 architecture under dir.
+func checkTestRepo(t *testing.T, backend Backend, dir string) {
+	pkg, err := backend.FindLatestMatchingName("TestA", "", "")
+	if err != nil {
+		t.Fatalf("could not find TestA: %v\n", err)
+	}
+	for _, table := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"id", pkg.ID(), "TestA-1.0.0-1.x86_64"},
+		{"group", pkg.Group(), "LHCb"},
+		{"location", pkg.Location(), path.Join(dir, "TestA-1.0.0-1.x86_64.rpm")},
+	} {
+		if table.got != table.want {
+			t.Errorf("expected %s=%q. got=%q\n", table.name, table.want, table.got)
+		}
+	}
+
+	if typ, sum := pkg.Checksum(); typ != "sha256" || len(sum) != 64 {
+		t.Errorf("invalid checksum: %s:%s\n", typ, sum)
+	}
+
+	if n := len(pkg.Requires()); n != 2 {
+		t.Fatalf("expected 2 requires (rpmlib ones being dropped). got=%d\n", n)
+	}
+	req := pkg.Requires()[0]
+	if req.Name() != "TestB" || req.Flags() != "GE" || req.Version() != "2.0" {
+		t.Errorf("invalid requires: %v\n", req)
+	}
+
+	dep, err := backend.FindLatestMatchingRequire(req)
+	if err != nil {
+		t.Fatalf("could not resolve %v: %v\n", req, err)
+	}
+	if dep.ID() != "TestB-2.1-3.noarch" {
+		t.Errorf("expected TestB-2.1-3.noarch. got=%v\n", dep.ID())
+	}
+
+	dep, err = backend.FindLatestMatchingRequire(NewRequires("libB.so", "", "", "", "", ""))
+	if err != nil {
+		t.Fatalf("could not resolve libB.so: %v\n", err)
+	}
+	if dep.Name() != "TestB" {
+		t.Errorf("expected TestB to provide libB.so. got=%v\n", dep.ID())
+	}
+}
+
+func TestCreateRepo(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-createrepo-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	rpmdir := filepath.Join(tmpdir, "rpms")
+	for _, rpm := range testRPMs {
+		dir := filepath.Join(rpmdir, rpm.arch)
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatalf("could not create rpm dir: %v\n", err)
+		}
+		err = rpm.write(filepath.Join(dir, rpm.name+"-"+rpm.version+"-"+rpm.release+"."+rpm.arch+".rpm"))
+		if err != nil {
+			t.Fatalf("could not write RPM: %v\n", err)
+		}
+	}
+
+	rc := NewRepoCreator(rpmdir, false)
+	rc.msg = logger.NewLogger("createrepo", logger.INFO, ioutil.Discard)
+	err = rc.Create()
+	if err != nil {
+		t.Fatalf("could not create repo: %v\n", err)
+	}
+
+	for _, fname := range []string{"repomd.xml", "primary.xml.gz", "filelists.xml.gz", "primary.sqlite.bz2"} {
+		if !path_exists(filepath.Join(rpmdir, "repodata", fname)) {
+			t.Errorf("missing %s\n", fname)
+		}
+	}
+
+	// load the repository back, as clients do, with each backend
+	for i, backend := range []string{"RepositoryXMLBackend", "RepositorySQLiteBackend"} {
+		cachedir := filepath.Join(tmpdir, "cache", backend)
+		repo, err := NewRepository("test", "file://"+rpmdir, cachedir, []string{backend}, true, true)
+		if err != nil {
+			t.Fatalf("%s: could not load repository: %v\n", backend, err)
+		}
+		repo.msg.SetLevel(logger.ERROR)
+		repo.Arches = nil
+		if n := len(repo.GetPackages()); n != len(testRPMs) {
+			t.Errorf("%s: expected %d packages. got=%d\n", backend, len(testRPMs), n)
+		}
+		checkTestRepo(t, repo.Backend, "x86_64")
+		repo.Close()
+
+		if i == 0 {
+			continue
+		}
+		// the filelists of the packages are complete
+		var filelists struct {
+			Packages []struct {
+				Name  string   `xml:"name,attr"`
+				Files []mdFile `xml:"file"`
+			} `xml:"package"`
+		}
+		err = decodeMDFile(filepath.Join(rpmdir, "repodata", "filelists.xml.gz"), &filelists)
+		if err != nil {
+			t.Fatalf("could not decode filelists: %v\n", err)
+		}
+		if len(filelists.Packages) != 2 {
+			t.Fatalf("expected 2 packages in filelists. got=%d\n", len(filelists.Packages))
+		}
+		for _, pkg := range filelists.Packages {
+			if pkg.Name != "TestA" {
+				continue
+			}
+			if len(pkg.Files) != 3 {
+				t.Fatalf("expected 3 files for TestA. got=%v\n", pkg.Files)
+			}
+			if f := pkg.Files[0]; f.Type != "dir" || f.Path != "/opt/a" {
+				t.Errorf("expected /opt/a directory. got=%#v\n", f)
+			}
+		}
+	}
+}
+
+func TestCreateRepoUpdate(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-createrepo-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fnames := make([]string, 0, len(testRPMs))
+	for _, rpm := range testRPMs {
+		fname := filepath.Join(tmpdir, rpm.name+".rpm")
+		err = rpm.write(fname)
+		if err != nil {
+			t.Fatalf("could not write RPM: %v\n", err)
+		}
+		fnames = append(fnames, fname)
+	}
+
+	rc := NewRepoCreator(tmpdir, true)
+	rc.msg = logger.NewLogger("createrepo", logger.INFO, ioutil.Discard)
+	err = rc.Create()
+	if err != nil {
+		t.Fatalf("could not create repo: %v\n", err)
+	}
+
+	// unchanged RPMs (same size and modification time) are not read again:
+	// make TestA unreadable, and check its metadata are still there.
+	fi, err := os.Stat(fnames[0])
+	if err != nil {
+		t.Fatalf("could not stat RPM: %v\n", err)
+	}
+	err = ioutil.WriteFile(fnames[0], make([]byte, fi.Size()), 0644)
+	if err != nil {
+		t.Fatalf("could not overwrite RPM: %v\n", err)
+	}
+	err = os.Chtimes(fnames[0], fi.ModTime(), fi.ModTime())
+	if err != nil {
+		t.Fatalf("could not reset RPM mtime: %v\n", err)
+	}
+
+	// a new version of TestB replaces the old one
+	newB := testRPMs[1]
+	newB.version = "2.2"
+	newB.provides = [][3]string{{"TestB", "EQ", "2.2-3"}}
+	err = newB.write(fnames[1])
+	if err != nil {
+		t.Fatalf("could not write RPM: %v\n", err)
+	}
+	err = os.Chtimes(fnames[1], time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("could not update RPM mtime: %v\n", err)
+	}
+
+	err = rc.Create()
+	if err != nil {
+		t.Fatalf("could not update repo: %v\n", err)
+	}
+
+	backend, err := newTestXMLBackend(filepath.Join(tmpdir, "repodata", "primary.xml.gz"))
+	if err != nil {
+		t.Fatalf("could not create backend: %v\n", err)
+	}
+	err = backend.LoadDB()
+	if err != nil {
+		t.Fatalf("could not load DB: %v\n", err)
+	}
+	if _, err := backend.FindLatestMatchingName("TestA", "1.0.0", "1"); err != nil {
+		t.Errorf("metadata of unchanged TestA were not reused: %v\n", err)
+	}
+	if pkg, err := backend.FindLatestMatchingName("TestB", "", ""); err != nil || pkg.Version() != "2.2" {
+		t.Errorf("metadata of TestB were not updated: pkg=%v err=%v\n", pkg, err)
+	}
+
+	// without -update, all RPMs are read again
+	rc = NewRepoCreator(tmpdir, false)
+	rc.msg = logger.NewLogger("createrepo", logger.INFO, ioutil.Discard)
+	err = rc.Create()
+	if err == nil {
+		t.Errorf("expected an error reading the corrupted RPM\n")
+	}
+}
+
+func TestCreateRepoMergeInconsistent(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-createrepo-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	for _, rpm := range testRPMs {
+		err = rpm.write(filepath.Join(tmpdir, rpm.name+".rpm"))
+		if err != nil {
+			t.Fatalf("could not write RPM: %v\n", err)
+		}
+	}
+	rc := NewRepoCreator(tmpdir, false)
+	rc.msg = logger.NewLogger("createrepo", logger.INFO, ioutil.Discard)
+	err = rc.Create()
+	if err != nil {
+		t.Fatalf("could not create repo: %v\n", err)
+	}
+
+	// filelists without the entry of TestA, whose RPM file is not staged
+	err = os.Remove(filepath.Join(tmpdir, "TestA.rpm"))
+	if err != nil {
+		t.Fatalf("could not remove RPM: %v\n", err)
+	}
+	_, err = writeMDFile(filepath.Join(tmpdir, "repodata"), "filelists", "filelists.xml.gz", false, 0, newGzipWriter, func(w io.Writer) error {
+		return writeFilelistsXML(w, nil)
+	})
+	if err != nil {
+		t.Fatalf("could not write filelists: %v\n", err)
+	}
+
+	rc = NewRepoCreator(tmpdir, true)
+	rc.msg = logger.NewLogger("createrepo", logger.INFO, ioutil.Discard)
+	rc.SetMerge(true)
+	err = rc.Create()
+	if err == nil {
+		t.Fatalf("expected an error merging inconsistent metadata\n")
+	}
+}
@@ -0,0 +1,193 @@
+package yum
+
+import (
+	"sort"
+)
+
+// kinds of package differences reported by DiffRepositories
+const (
+	DiffAdded   = "added"   // package only in the new repository
+	DiffRemoved = "removed" // package only in the old repository
+	DiffUpdated = "updated" // package whose version changed
+	DiffChanged = "changed" // package republished with the same NEVRA
+)
+
+// PackageDiff describes how a package differs between two repositories.
+type PackageDiff struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"` // name.arch of the package
+
+	Old string `json:"old,omitempty"` // ID of the package in the old repository
+	New string `json:"new,omitempty"` // ID of the package in the new repository
+
+	// OldChecksum and NewChecksum are set, as "type:sum", when the RPM file
+	// of a package with the same NEVRA changed, or was checksummed with
+	// another type.
+	OldChecksum string `json:"old_checksum,omitempty"`
+	NewChecksum string `json:"new_checksum,omitempty"`
+
+	AddedRequires   []string `json:"added_requires,omitempty"`
+	RemovedRequires []string `json:"removed_requires,omitempty"`
+	AddedProvides   []string `json:"added_provides,omitempty"`
+	RemovedProvides []string `json:"removed_provides,omitempty"`
+}
+
+// ChecksumChanged returns whether the RPM file of the package changed while
+// its NEVRA did not.
+func (d *PackageDiff) ChecksumChanged() bool {
+	return d.OldChecksum != d.NewChecksum
+}
+
+// DiffRepositories returns the differences between the packages of the
+// repositories a (old) and b (new), sorted by name.arch.
+//
+// Packages are matched by name.arch: when versions of a package were both
+// removed and added, the latest ones are reported as an update, with the
+// changes of their requires and provides.
+// Packages with the same NEVRA are reported as changed if their checksum (or
+// its type, as sums of different types can not be compared) or their requires
+// and provides differ.
+func DiffRepositories(a, b *Repository) []PackageDiff {
+	olds := packagesByNameArch(a.GetPackages())
+	news := packagesByNameArch(b.GetPackages())
+
+	names := make([]string, 0, len(olds)+len(news))
+	for name := range olds {
+		names = append(names, name)
+	}
+	for name := range news {
+		if _, dup := olds[name]; !dup {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []PackageDiff
+	for _, name := range names {
+		oldids := olds[name]
+		newids := news[name]
+
+		var removed, added Packages
+		for id, old := range oldids {
+			p, ok := newids[id]
+			if !ok {
+				removed = append(removed, old)
+				continue
+			}
+			d := diffPackages(name, old, p)
+			d.Kind = DiffChanged
+			if otyp, osum := old.Checksum(); osum != "" {
+				if ntyp, nsum := p.Checksum(); nsum != "" && (ntyp != otyp || nsum != osum) {
+					d.OldChecksum = otyp + ":" + osum
+					d.NewChecksum = ntyp + ":" + nsum
+				}
+			}
+			if d.ChecksumChanged() || d.depsChanged() {
+				diffs = append(diffs, d)
+			}
+		}
+		for id, p := range newids {
+			if _, ok := oldids[id]; !ok {
+				added = append(added, p)
+			}
+		}
+		sort.Sort(removed)
+		sort.Sort(added)
+
+		if len(removed) > 0 && len(added) > 0 {
+			old := removed[len(removed)-1]
+			p := added[len(added)-1]
+			removed = removed[:len(removed)-1]
+			added = added[:len(added)-1]
+			d := diffPackages(name, old, p)
+			d.Kind = DiffUpdated
+			diffs = append(diffs, d)
+		}
+		for _, p := range removed {
+			diffs = append(diffs, PackageDiff{Kind: DiffRemoved, Name: name, Old: p.ID()})
+		}
+		for _, p := range added {
+			diffs = append(diffs, PackageDiff{Kind: DiffAdded, Name: name, New: p.ID()})
+		}
+	}
+	sort.Stable(packageDiffs(diffs))
+	return diffs
+}
+
+func (d *PackageDiff) depsChanged() bool {
+	return len(d.AddedRequires)+len(d.RemovedRequires)+len(d.AddedProvides)+len(d.RemovedProvides) > 0
+}
+
+type packageDiffs []PackageDiff
+
+func (p packageDiffs) Len() int      { return len(p) }
+func (p packageDiffs) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p packageDiffs) Less(i, j int) bool {
+	if p[i].Name != p[j].Name {
+		return p[i].Name < p[j].Name
+	}
+	return p[i].Old+p[i].New < p[j].Old+p[j].New
+}
+
+// packagesByNameArch indexes pkgs by name.arch and by ID
+func packagesByNameArch(pkgs []*Package) map[string]map[string]*Package {
+	index := make(map[string]map[string]*Package)
+	for _, p := range pkgs {
+		name := p.Name() + "." + p.Arch()
+		if index[name] == nil {
+			index[name] = make(map[string]*Package)
+		}
+		index[name][p.ID()] = p
+	}
+	return index
+}
+
+// diffPackages returns the changes of the requires and provides from old to p
+func diffPackages(name string, old, p *Package) PackageDiff {
+	d := PackageDiff{Name: name, Old: old.ID(), New: p.ID()}
+
+	var oreqs, nreqs, oprovs, nprovs []string
+	for _, req := range old.Requires() {
+		oreqs = append(oreqs, FormatCapability(req))
+	}
+	for _, req := range p.Requires() {
+		nreqs = append(nreqs, FormatCapability(req))
+	}
+	for _, prov := range old.Provides() {
+		oprovs = append(oprovs, FormatCapability(prov))
+	}
+	for _, prov := range p.Provides() {
+		nprovs = append(nprovs, FormatCapability(prov))
+	}
+	d.AddedRequires, d.RemovedRequires = diffStrings(oreqs, nreqs)
+	d.AddedProvides, d.RemovedProvides = diffStrings(oprovs, nprovs)
+	return d
+}
+
+// diffStrings returns the sorted strings only in b, and the ones only in a
+func diffStrings(a, b []string) (added, removed []string) {
+	ina := make(map[string]bool, len(a))
+	for _, v := range a {
+		ina[v] = true
+	}
+	inb := make(map[string]bool, len(b))
+	for _, v := range b {
+		if inb[v] {
+			continue
+		}
+		inb[v] = true
+		if !ina[v] {
+			added = append(added, v)
+		}
+	}
+	for v := range ina {
+		if !inb[v] {
+			removed = append(removed, v)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// EOF
@@ -0,0 +1,114 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffRepositories(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-diff-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	testA := testRPMs[0]
+	testA.version = "1.1.0"
+	testA.provides = [][3]string{{"TestA", "EQ", "1.1.0-1"}}
+	testA.requires = [][3]string{{"TestB", "GE", "2.0"}, {"TestD", "", ""}}
+
+	// same NEVRA, different content
+	testB := testRPMs[1]
+	testB.files = []string{"/etc/b.conf", "/etc/b2.conf"}
+
+	testC := testRPM{name: "TestC", version: "1", release: "1", arch: "noarch"}
+	testD := testRPM{name: "TestD", version: "1", release: "1", arch: "noarch"}
+
+	var repos []*Repository
+	for _, v := range []struct {
+		name string
+		rpms []testRPM
+	}{
+		{"old", append([]testRPM{testC}, testRPMs...)},
+		{"new", []testRPM{testA, testB, testD}},
+	} {
+		dir := writeTestRepo(t, filepath.Join(tmpdir, v.name), v.rpms...)
+		repo, err := NewRepository(v.name, "file://"+dir, filepath.Join(tmpdir, "cache", v.name),
+			DefaultBackends, true, true,
+		)
+		if err != nil {
+			t.Fatalf("could not load repository: %v\n", err)
+		}
+		defer repo.Close()
+		repos = append(repos, repo)
+	}
+
+	diffs := DiffRepositories(repos[0], repos[1])
+	if len(diffs) != 4 {
+		t.Fatalf("expected 4 differences. got=%d (%#v)\n", len(diffs), diffs)
+	}
+
+	want := []PackageDiff{
+		{
+			Kind: DiffUpdated, Name: "TestA.x86_64",
+			Old: "TestA-1.0.0-1.x86_64", New: "TestA-1.1.0-1.x86_64",
+			AddedRequires:   []string{"TestD"},
+			RemovedRequires: []string{"/bin/sh"},
+			AddedProvides:   []string{"TestA = 1.1.0-1"},
+			RemovedProvides: []string{"TestA = 1.0.0-1"},
+		},
+		{
+			Kind: DiffChanged, Name: "TestB.noarch",
+			Old: "TestB-2.1-3.noarch", New: "TestB-2.1-3.noarch",
+		},
+		{Kind: DiffRemoved, Name: "TestC.noarch", Old: "TestC-1-1.noarch"},
+		{Kind: DiffAdded, Name: "TestD.noarch", New: "TestD-1-1.noarch"},
+	}
+
+	// checksums are only known once the RPMs are written
+	if !diffs[1].ChecksumChanged() || !strings.HasPrefix(diffs[1].OldChecksum, "sha256:") {
+		t.Errorf("expected the checksum of TestB to change. got=%q -> %q\n",
+			diffs[1].OldChecksum, diffs[1].NewChecksum,
+		)
+	}
+	diffs[1].OldChecksum = ""
+	diffs[1].NewChecksum = ""
+
+	for i := range want {
+		if !reflect.DeepEqual(diffs[i], want[i]) {
+			t.Errorf("diff #%d:\ngot= %#v\nwant=%#v\n", i, diffs[i], want[i])
+		}
+	}
+
+	if diffs := DiffRepositories(repos[0], repos[0]); len(diffs) != 0 {
+		t.Errorf("expected no difference. got=%#v\n", diffs)
+	}
+
+	// sums of different types can not be compared: the change is reported
+	repos = repos[:0]
+	for _, typ := range []string{"sha", "sha256"} {
+		backend, err := newTestXMLBackend(filepath.Join(tmpdir, typ, "primary.xml"))
+		if err != nil {
+			t.Fatalf("could not create backend: %v\n", err)
+		}
+		pkg := NewPackage("TestB", "2.1", "3", "")
+		pkg.arch = "noarch"
+		pkg.sumtype = typ
+		pkg.checksum = "0123"
+		backend.addPackage(pkg)
+		repos = append(repos, backend.Repository)
+	}
+	diffs = DiffRepositories(repos[0], repos[1])
+	want = []PackageDiff{{
+		Kind: DiffChanged, Name: "TestB.noarch",
+		Old: "TestB-2.1-3.noarch", New: "TestB-2.1-3.noarch",
+		OldChecksum: "sha:0123", NewChecksum: "sha256:0123",
+	}}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("checksum type change:\ngot= %#v\nwant=%#v\n", diffs, want)
+	}
+}
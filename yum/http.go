@@ -0,0 +1,194 @@
+package yum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// DefaultHTTPTimeout is the default delay after which establishing a connection
+// to a remote server, or waiting for its response headers, is given up.
+const DefaultHTTPTimeout = 30 * time.Second
+
+// HTTPClient is the default HTTP client used to retrieve remote data.
+// Clients configured with another timeout use their own HTTP client.
+var HTTPClient = NewHTTPClient(DefaultHTTPTimeout)
+
+// ErrNotModified is returned when a conditional request found the remote
+// resource unchanged.
+var ErrNotModified = errors.New("yum: remote resource not modified")
+
+// HTTPError is returned when a remote server answers with an unexpected status code.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("yum: could not retrieve [%s]: %s", e.URL, e.Status)
+}
+
+// NewHTTPClient returns an HTTP client which gives up on unresponsive servers
+// after timeout. The transfer of a response body is not bounded in time, as
+// RPMs and repository DBs may be large.
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			ExpectContinueTimeout: 1 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   4,
+		},
+	}
+}
+
+// OpenURL returns a reader over the content of rpath, a file:// or http(s):// URL.
+// HTTP responses other than 200 are reported as *HTTPError.
+func OpenURL(rpath string) (io.ReadCloser, error) {
+	r, _, err := fetch(HTTPClient, rpath, nil)
+	return r, err
+}
+
+// httpValidators holds the HTTP cache validators of a remote resource.
+type httpValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last-modified,omitempty"`
+}
+
+// fetch retrieves rpath, with the HTTP client httpc.
+// If cond is not nil, the request is made conditional on the remote resource
+// having changed since cond was recorded, and ErrNotModified is returned otherwise.
+// fetch returns the validators of the retrieved resource, if any.
+func fetch(httpc *http.Client, rpath string, cond *httpValidators) (io.ReadCloser, *httpValidators, error) {
+	url, err := url.Parse(rpath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch url.Scheme {
+	case "file":
+		f, err := os.Open(url.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, nil, nil
+
+	default:
+		req, err := http.NewRequest("GET", rpath, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cond != nil {
+			if cond.ETag != "" {
+				req.Header.Set("If-None-Match", cond.ETag)
+			}
+			if cond.LastModified != "" {
+				req.Header.Set("If-Modified-Since", cond.LastModified)
+			}
+		}
+
+		resp, err := httpc.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			info := &httpValidators{
+				ETag:         resp.Header.Get("ETag"),
+				LastModified: resp.Header.Get("Last-Modified"),
+			}
+			return resp.Body, info, nil
+
+		case http.StatusNotModified:
+			resp.Body.Close()
+			return nil, cond, ErrNotModified
+
+		default:
+			resp.Body.Close()
+			return nil, nil, &HTTPError{
+				URL:        rpath,
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+			}
+		}
+	}
+}
+
+// statURL checks rpath, a file:// or http(s):// URL, exists, without
+// retrieving its content.
+func statURL(httpc *http.Client, rpath string) error {
+	url, err := url.Parse(rpath)
+	if err != nil {
+		return err
+	}
+
+	switch url.Scheme {
+	case "file":
+		_, err = os.Stat(url.Path)
+		return err
+
+	default:
+		resp, err := httpc.Head(rpath)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return &HTTPError{
+				URL:        rpath,
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+			}
+		}
+		return nil
+	}
+}
+
+// loadValidators loads the HTTP cache validators stored in fname.
+// It returns nil if there are none.
+func loadValidators(fname string) *httpValidators {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil
+	}
+	var info httpValidators
+	err = json.Unmarshal(buf, &info)
+	if err != nil || (info.ETag == "" && info.LastModified == "") {
+		return nil
+	}
+	return &info
+}
+
+// saveValidators stores the HTTP cache validators info into fname.
+// A nil info removes fname.
+func saveValidators(fname string, info *httpValidators) error {
+	if info == nil || (info.ETag == "" && info.LastModified == "") {
+		err := os.Remove(fname)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, buf, 0644)
+}
+
+// EOF
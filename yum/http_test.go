@@ -0,0 +1,220 @@
+package yum
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gonuts/logger"
+)
+
+func TestFetch(t *testing.T) {
+	const etag = `"0123456789"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repomd.xml":
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			fmt.Fprintf(w, "<repomd/>")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	r, info, err := fetch(HTTPClient, srv.URL+"/repomd.xml", nil)
+	if err != nil {
+		t.Fatalf("could not fetch repomd.xml: %v\n", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("could not read repomd.xml: %v\n", err)
+	}
+	if string(data) != "<repomd/>" {
+		t.Fatalf("invalid content: %q\n", string(data))
+	}
+	if info == nil || info.ETag != etag {
+		t.Fatalf("invalid validators: %#v\n", info)
+	}
+
+	_, _, err = fetch(HTTPClient, srv.URL+"/repomd.xml", info)
+	if err != ErrNotModified {
+		t.Fatalf("expected ErrNotModified. got=%v\n", err)
+	}
+
+	_, err = OpenURL(srv.URL + "/not-there.xml")
+	herr, ok := err.(*HTTPError)
+	if !ok {
+		t.Fatalf("expected an *HTTPError. got=%T (%v)\n", err, err)
+	}
+	if herr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status code %d. got=%d\n", http.StatusNotFound, herr.StatusCode)
+	}
+}
+
+func TestConditionalRepoMD(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-http-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	_, srvdir, err := newTestSiteroot(tmpdir, "0")
+	if err != nil {
+		t.Fatalf("could not create test repository: %v\n", err)
+	}
+
+	var mux sync.Mutex
+	hits := make(map[string]int)
+	modtime := time.Now()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		hits[r.URL.Path]++
+		if r.Header.Get("If-Modified-Since") != "" {
+			hits["conditional"]++
+		}
+		mux.Unlock()
+		f, err := os.Open(filepath.Join(srvdir, r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, r.URL.Path, modtime, f)
+	}))
+	defer srv.Close()
+
+	cachedir := filepath.Join(tmpdir, "cache")
+	for i := 0; i < 3; i++ {
+		repo, err := NewRepository(
+			"testrepo", srv.URL, cachedir,
+			[]string{"RepositoryXMLBackend"},
+			true, true,
+		)
+		if err != nil {
+			t.Fatalf("could not create repository: %v\n", err)
+		}
+		repo.msg = logger.NewLogger("repo", logger.INFO, ioutil.Discard)
+
+		pkg, err := repo.FindLatestMatchingName("TestPackage", "1.0.0", "1")
+		if err != nil || pkg == nil {
+			t.Fatalf("could not find TestPackage: %v\n", err)
+		}
+		repo.Close()
+	}
+
+	if n := hits["/repodata/repomd.xml"]; n != 3 {
+		t.Errorf("expected 3 requests for repomd.xml. got=%d\n", n)
+	}
+	if n := hits["conditional"]; n != 2 {
+		t.Errorf("expected 2 conditional requests. got=%d\n", n)
+	}
+	if n := hits["/repodata/primary.xml.gz"]; n != 1 {
+		t.Errorf("expected 1 request for primary.xml.gz. got=%d\n", n)
+	}
+	if info := loadValidators(filepath.Join(cachedir, repomdValidators)); info == nil {
+		t.Errorf("expected HTTP validators to be stored\n")
+	}
+
+	// a new repomd.xml, with the same primary DB
+	repomd := filepath.Join(srvdir, "repodata", "repomd.xml")
+	data, err := ioutil.ReadFile(repomd)
+	if err != nil {
+		t.Fatalf("could not read repomd.xml: %v\n", err)
+	}
+	data = append(data, []byte("<!-- republished -->\n")...)
+	err = ioutil.WriteFile(repomd, data, 0644)
+	if err != nil {
+		t.Fatalf("could not write repomd.xml: %v\n", err)
+	}
+	modtime = modtime.Add(time.Hour)
+
+	repo, err := NewRepository("testrepo", srv.URL, cachedir, []string{"RepositoryXMLBackend"}, true, true)
+	if err != nil {
+		t.Fatalf("could not create repository: %v\n", err)
+	}
+	repo.Close()
+
+	local, err := ioutil.ReadFile(filepath.Join(cachedir, "repomd.xml"))
+	if err != nil || !bytes.Equal(local, data) {
+		t.Errorf("expected the new repomd.xml to be cached (err=%v)\n", err)
+	}
+	info := loadValidators(filepath.Join(cachedir, repomdValidators))
+	if want := modtime.UTC().Format(http.TimeFormat); info == nil || info.LastModified != want {
+		t.Errorf("expected HTTP validators to be updated to %q. got=%#v\n", want, info)
+	}
+	if n := hits["/repodata/primary.xml.gz"]; n != 1 {
+		t.Errorf("expected 1 request for primary.xml.gz. got=%d\n", n)
+	}
+}
+
+// countingTransport counts the requests it sends
+type countingTransport struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.n++
+	c.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClientHTTPClient(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-http-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	_, srvdir, err := newTestSiteroot(tmpdir, "0")
+	if err != nil {
+		t.Fatalf("could not create test repository: %v\n", err)
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(srvdir)))
+	defer srv.Close()
+
+	client, err := newClient(filepath.Join(tmpdir, "siteroot"), []string{"RepositoryXMLBackend"}, false, true)
+	if err != nil {
+		t.Fatalf("could not create client: %v\n", err)
+	}
+	defer client.Close()
+	client.SetLevel(logger.ERROR)
+	transport := &countingTransport{}
+	client.httpc = &http.Client{Transport: transport}
+
+	repo, err := client.NewRepository(
+		"testrepo", srv.URL, filepath.Join(tmpdir, "cache"),
+		[]string{"RepositoryXMLBackend"},
+		true, true,
+	)
+	if err != nil {
+		t.Fatalf("could not create repository: %v\n", err)
+	}
+	repo.Close()
+	n := transport.n
+	if n == 0 {
+		t.Fatalf("repository not retrieved with the HTTP client of the Client\n")
+	}
+
+	r, err := client.OpenURL(srv.URL + "/repodata/repomd.xml")
+	if err != nil {
+		t.Fatalf("could not open repomd.xml: %v\n", err)
+	}
+	r.Close()
+	if transport.n != n+1 {
+		t.Errorf("URL not opened with the HTTP client of the Client\n")
+	}
+}
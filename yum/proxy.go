@@ -0,0 +1,466 @@
+package yum
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gonuts/logger"
+)
+
+// Proxy is a pull-through caching yum proxy for the repositories of a Client.
+// Each repository is served under /<name>/:
+//   - repomd.xml is checked against the remote repository on each request,
+//     the cached copy being served when the remote one is unavailable,
+//   - the metadata files referenced by repomd.xml and the RPM files listed in
+//     its primary metadata are downloaded on first request, checked against
+//     their checksum and cached,
+//   - all the other files are passed through, without caching.
+//
+// RPM files found under the local directories of the Proxy (e.g. the download
+// directory of a siteroot) are served directly, if their checksum matches.
+type Proxy struct {
+	msg       *logger.Logger
+	client    *Client
+	cachedir  string
+	localdirs []string
+
+	mux      sync.Mutex
+	index    map[string]proxyIndex   // packages of each repository
+	verified map[string]verifiedFile // files known to be valid
+	fetching map[string]*proxyFetch  // downloads in flight, by cached file name
+}
+
+// proxyIndex holds the packages of a repository, by location, as listed by
+// the primary metadata with the checksum sum.
+type proxyIndex struct {
+	sum  string
+	pkgs map[string]*Package
+}
+
+// proxyFetch is a download in flight, shared by all the requests of a file
+type proxyFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// verifiedFile records the checksum of a file, as long as it is not modified
+type verifiedFile struct {
+	sum   string
+	size  int64
+	mtime time.Time
+}
+
+// NewProxy returns a Proxy for the repositories of client, caching the remote
+// files under cachedir.
+func NewProxy(client *Client, cachedir string) *Proxy {
+	return &Proxy{
+		msg:      logger.NewLogger("proxy", logger.INFO, stdout),
+		client:   client,
+		cachedir: cachedir,
+		index:    make(map[string]proxyIndex),
+		verified: make(map[string]verifiedFile),
+		fetching: make(map[string]*proxyFetch),
+	}
+}
+
+// SetLevel sets the verbosity level of the Proxy
+func (p *Proxy) SetLevel(lvl logger.Level) {
+	p.msg.SetLevel(lvl)
+}
+
+// AddLocalDir makes the Proxy serve the RPM files found directly under dir,
+// instead of downloading them.
+func (p *Proxy) AddLocalDir(dir string) {
+	p.localdirs = append(p.localdirs, dir)
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upath := path.Clean("/" + r.URL.Path)
+	if upath == "/" {
+		p.serveIndex(w)
+		return
+	}
+	parts := strings.SplitN(upath[1:], "/", 2)
+	repo := p.repository(parts[0])
+	if repo == nil || len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name := parts[1]
+
+	var fname string
+	var err error
+	switch {
+	case name == "repodata/repomd.xml":
+		fname, err = p.repomd(repo)
+	case strings.HasPrefix(name, "repodata/"):
+		fname, err = p.metadata(repo, name)
+	case strings.HasSuffix(name, ".rpm"):
+		fname, err = p.rpm(repo, name)
+	}
+	if err == nil && fname == "" {
+		p.msg.Debugf("passing [%s] through\n", upath)
+		var sent bool
+		sent, err = p.passThrough(w, r, repo, name)
+		switch {
+		case err == nil:
+			return
+		case sent:
+			// the response is already under way: only the connection can
+			// tell the client it is truncated.
+			p.msg.Errorf("could not serve [%s]: %v\n", upath, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err != nil {
+		p.msg.Errorf("could not serve [%s]: %v\n", upath, err)
+		switch {
+		case os.IsNotExist(err), isHTTPNotFound(err):
+			http.NotFound(w, r)
+		default:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	p.msg.Debugf("serving [%s] from [%s]\n", upath, fname)
+	http.ServeFile(w, r, fname)
+}
+
+func isHTTPNotFound(err error) bool {
+	herr, ok := err.(*HTTPError)
+	return ok && herr.StatusCode == http.StatusNotFound
+}
+
+// serveIndex lists the served repositories
+func (p *Proxy) serveIndex(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, repo := range p.client.Repositories() {
+		fmt.Fprintf(w, "%s/\n", repo.Name)
+	}
+}
+
+func (p *Proxy) repository(name string) *Repository {
+	for _, repo := range p.client.Repositories() {
+		if repo.Name == name {
+			return repo
+		}
+	}
+	return nil
+}
+
+// cached returns the path of the cached copy of the file name of repo
+func (p *Proxy) cached(repo *Repository, name string) string {
+	return filepath.Join(p.cachedir, repo.Name, filepath.FromSlash(name))
+}
+
+// repomd returns the path of an up-to-date copy of the repomd.xml file of repo
+func (p *Proxy) repomd(repo *Repository) (string, error) {
+	fname := p.cached(repo, "repodata/repomd.xml")
+	vname := fname + ".http"
+
+	var cond *httpValidators
+	if path_exists(fname) {
+		cond = loadValidators(vname)
+	}
+	r, validators, err := fetch(repo.httpc, repo.RepoMdUrl, cond)
+	switch {
+	case err == ErrNotModified:
+		return fname, nil
+	case err != nil:
+		if path_exists(fname) {
+			p.msg.Warnf("repository [%s] unavailable (%v), serving cached repomd.xml\n", repo.Name, err)
+			return fname, nil
+		}
+		return "", err
+	}
+	defer r.Close()
+
+	err = p.download(r, fname, "", "")
+	if err != nil {
+		return "", err
+	}
+	err = saveValidators(vname, validators)
+	return fname, err
+}
+
+// cachedRepoMD returns the records of the cached repomd.xml file of repo,
+// fetching it first if it is not cached yet.
+func (p *Proxy) cachedRepoMD(repo *Repository) (map[string]RepoMD, error) {
+	mdname := p.cached(repo, "repodata/repomd.xml")
+	if !path_exists(mdname) {
+		_, err := p.repomd(repo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := ioutil.ReadFile(mdname)
+	if err != nil {
+		return nil, err
+	}
+	return parseRepoMD(data)
+}
+
+// metadata returns the path of a cached copy of the metadata file name of repo,
+// or an empty path if name is not referenced by the repomd.xml file.
+func (p *Proxy) metadata(repo *Repository, name string) (string, error) {
+	md, err := p.cachedRepoMD(repo)
+	if err != nil {
+		return "", err
+	}
+	for _, v := range md {
+		if v.Location == name {
+			return p.fetchFile(repo, name, v.ChecksumType, v.Checksum)
+		}
+	}
+	return "", nil
+}
+
+// rpm returns the path of a valid copy of the RPM file name of repo, or an
+// empty path if the package is not listed by the primary metadata of repo.
+func (p *Proxy) rpm(repo *Repository, name string) (string, error) {
+	pkg, err := p.lookup(repo, name)
+	if err != nil || pkg == nil {
+		return "", err
+	}
+	typ, sum := pkg.Checksum()
+	if sum != "" {
+		for _, dir := range p.localdirs {
+			fname := filepath.Join(dir, path.Base(name))
+			if p.isValid(fname, typ, sum) {
+				return fname, nil
+			}
+		}
+	}
+	return p.fetchFile(repo, name, typ, sum)
+}
+
+// lookup returns the package of repo located at name, if any.
+// The packages are indexed from the primary metadata referenced by the cached
+// repomd.xml file, so the index follows the repomd.xml served to the clients.
+func (p *Proxy) lookup(repo *Repository, name string) (*Package, error) {
+	md, err := p.cachedRepoMD(repo)
+	if err != nil {
+		return nil, err
+	}
+	primary, ok := md["primary"]
+	if !ok {
+		return nil, fmt.Errorf("yum: no primary metadata in repomd.xml of repository [%s]", repo.Name)
+	}
+
+	p.mux.Lock()
+	index, ok := p.index[repo.Name]
+	p.mux.Unlock()
+	if !ok || index.sum != primary.Checksum {
+		index, err = p.loadIndex(repo, primary)
+		if err != nil {
+			return nil, err
+		}
+		p.mux.Lock()
+		p.index[repo.Name] = index
+		p.mux.Unlock()
+	}
+	return index.pkgs[name], nil
+}
+
+// loadIndex indexes the packages listed by the primary metadata of repo
+func (p *Proxy) loadIndex(repo *Repository, primary RepoMD) (proxyIndex, error) {
+	fname, err := p.fetchFile(repo, primary.Location, primary.ChecksumType, primary.Checksum)
+	if err != nil {
+		return proxyIndex{}, err
+	}
+	p.msg.Debugf("indexing packages of repository [%s] from [%s]\n", repo.Name, primary.Location)
+
+	backend := &RepositoryXMLBackend{
+		Name:       "RepositoryXMLBackend",
+		Packages:   make(map[string][]*Package),
+		Provides:   make(map[string][]*Provides),
+		DBName:     filepath.Base(fname),
+		Primary:    fname,
+		Repository: repo,
+		msg:        p.msg,
+	}
+	err = backend.LoadDB()
+	if err != nil {
+		return proxyIndex{}, err
+	}
+
+	index := proxyIndex{sum: primary.Checksum, pkgs: make(map[string]*Package)}
+	for _, pkg := range backend.GetPackages() {
+		index.pkgs[pkg.Location()] = pkg
+	}
+	return index, nil
+}
+
+// isValid returns whether fname exists and has the checksum sum of type typ.
+func (p *Proxy) isValid(fname, typ, sum string) bool {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return false
+	}
+	p.mux.Lock()
+	v, ok := p.verified[fname]
+	p.mux.Unlock()
+	if ok && v.sum == sum && v.size == fi.Size() && v.mtime.Equal(fi.ModTime()) {
+		return true
+	}
+
+	got, err := FileChecksum(fname, typ)
+	if err != nil || got != sum {
+		return false
+	}
+	p.setVerified(fname, sum)
+	return true
+}
+
+// setVerified records that fname has the checksum sum
+func (p *Proxy) setVerified(fname, sum string) {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return
+	}
+	p.mux.Lock()
+	p.verified[fname] = verifiedFile{sum: sum, size: fi.Size(), mtime: fi.ModTime()}
+	p.mux.Unlock()
+}
+
+// fetchFile returns the path of the cached copy of the file name of repo,
+// downloading it first if it is not cached yet or does not have the checksum
+// sum of type typ.
+// Without a checksum, any cached copy is deemed valid.
+// Concurrent requests of a file wait for a single download.
+func (p *Proxy) fetchFile(repo *Repository, name, typ, sum string) (string, error) {
+	fname := p.cached(repo, name)
+	var fetch *proxyFetch
+	for fetch == nil {
+		if sum == "" && path_exists(fname) {
+			return fname, nil
+		}
+		if sum != "" && p.isValid(fname, typ, sum) {
+			return fname, nil
+		}
+
+		p.mux.Lock()
+		inflight, ok := p.fetching[fname]
+		if !ok {
+			fetch = &proxyFetch{done: make(chan struct{})}
+			p.fetching[fname] = fetch
+		}
+		p.mux.Unlock()
+
+		if ok {
+			<-inflight.done
+			if inflight.err != nil {
+				return "", inflight.err
+			}
+		}
+	}
+
+	fetch.err = p.downloadFile(repo, name, fname, typ, sum)
+	p.mux.Lock()
+	delete(p.fetching, fname)
+	p.mux.Unlock()
+	close(fetch.done)
+
+	if fetch.err != nil {
+		return "", fetch.err
+	}
+	return fname, nil
+}
+
+// downloadFile downloads the file name of repo into fname, checking it has
+// the checksum sum of type typ (if any).
+func (p *Proxy) downloadFile(repo *Repository, name, fname, typ, sum string) error {
+	p.msg.Infof("downloading [%s/%s]...\n", repo.Name, name)
+	r, err := repo.openURL(repo.RepoUrl + "/" + name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	err = p.download(r, fname, typ, sum)
+	if err != nil {
+		return err
+	}
+	if sum != "" {
+		p.setVerified(fname, sum)
+	}
+	return nil
+}
+
+// download atomically writes the content of r into fname, checking it has the
+// checksum sum of type typ (if any).
+func (p *Proxy) download(r io.Reader, fname, typ, sum string) error {
+	err := os.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fname), ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var w io.Writer = f
+	var h hash.Hash
+	if sum != "" {
+		h, err = ChecksumHash(typ)
+		if err != nil {
+			return err
+		}
+		w = io.MultiWriter(f, h)
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if h != nil {
+		if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+			return fmt.Errorf("yum: checksum mismatch for %s (%s: got=%s, want=%s)",
+				filepath.Base(fname), typ, got, sum,
+			)
+		}
+	}
+	err = f.Chmod(0644)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fname)
+}
+
+// passThrough serves the file name of repo straight from the remote repository.
+// It returns whether some of the response was sent.
+func (p *Proxy) passThrough(w http.ResponseWriter, req *http.Request, repo *Repository, name string) (bool, error) {
+	r, err := repo.openURL(repo.RepoUrl + "/" + name)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	if req.Method == "HEAD" {
+		return false, nil
+	}
+	n, err := io.Copy(w, r)
+	return n > 0, err
+}
+
+// EOF
@@ -0,0 +1,246 @@
+package yum
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gonuts/logger"
+)
+
+// countingHandler counts the requests for each path
+type countingHandler struct {
+	mu    sync.Mutex
+	hits  map[string]int
+	delay time.Duration // delay before serving RPM files
+	h     http.Handler
+}
+
+func (c *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	c.hits[r.URL.Path]++
+	delay := c.delay
+	c.mu.Unlock()
+	if strings.HasSuffix(r.URL.Path, ".rpm") {
+		time.Sleep(delay)
+	}
+	c.h.ServeHTTP(w, r)
+}
+
+func (c *countingHandler) count(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits[name]
+}
+
+func TestProxy(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-proxy-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	srvdir := writeTestRepo(t, filepath.Join(tmpdir, "srv"), testRPMs...)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir(srvdir)))
+	mux.HandleFunc("/truncated", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("0123456789"))
+	})
+	upstream := &countingHandler{hits: make(map[string]int), h: mux}
+	upstreamSrv := httptest.NewServer(upstream)
+	defer upstreamSrv.Close()
+
+	client, err := newClient(filepath.Join(tmpdir, "siteroot"), []string{"RepositoryXMLBackend"}, true, false,
+		Repositories(&RepoConfig{Name: "test", Url: upstreamSrv.URL}),
+	)
+	if err != nil {
+		t.Fatalf("could not create client: %v\n", err)
+	}
+	defer client.Close()
+	client.SetLevel(logger.ERROR)
+
+	proxy := NewProxy(client, filepath.Join(tmpdir, "cache"))
+	proxy.msg = logger.NewLogger("proxy", logger.INFO, ioutil.Discard)
+	localdir := filepath.Join(tmpdir, "local")
+	proxy.AddLocalDir(localdir)
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+
+	// the proxied repository can be used as any other repository
+	repo, err := NewRepository("proxied", proxySrv.URL+"/test", filepath.Join(tmpdir, "client"),
+		[]string{"RepositorySQLiteBackend"}, true, true,
+	)
+	if err != nil {
+		t.Fatalf("could not load proxied repository: %v\n", err)
+	}
+	repo.msg.SetLevel(logger.ERROR)
+	repo.Arches = nil
+	if n := len(repo.GetPackages()); n != len(testRPMs) {
+		t.Errorf("expected %d packages. got=%d\n", len(testRPMs), n)
+	}
+	checkTestRepo(t, repo.Backend, "")
+	repo.Close()
+
+	get := func(name string) ([]byte, int) {
+		resp, err := http.Get(proxySrv.URL + name)
+		if err != nil {
+			t.Fatalf("could not get %s: %v\n", name, err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read %s: %v\n", name, err)
+		}
+		return data, resp.StatusCode
+	}
+
+	// RPMs are cached on first request
+	const rpmA = "/TestA-1.0.0-1.x86_64.rpm"
+	want, err := ioutil.ReadFile(filepath.Join(srvdir, rpmA))
+	if err != nil {
+		t.Fatalf("could not read RPM: %v\n", err)
+	}
+	for i := 0; i < 3; i++ {
+		data, status := get("/test" + rpmA)
+		if status != http.StatusOK || !bytes.Equal(data, want) {
+			t.Fatalf("invalid RPM served (status=%d)\n", status)
+		}
+	}
+	if n := upstream.count(rpmA); n != 1 {
+		t.Errorf("expected 1 upstream request for the RPM. got=%d\n", n)
+	}
+
+	// RPMs are checked against the repository metadata
+	const rpmB = "/TestB-2.1-3.noarch.rpm"
+	good, err := ioutil.ReadFile(filepath.Join(srvdir, rpmB))
+	if err != nil {
+		t.Fatalf("could not read RPM: %v\n", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(srvdir, rpmB), []byte("corrupted"), 0644)
+	if err != nil {
+		t.Fatalf("could not corrupt RPM: %v\n", err)
+	}
+	if _, status := get("/test" + rpmB); status != http.StatusBadGateway {
+		t.Errorf("expected a corrupted RPM to be rejected. got status=%d\n", status)
+	}
+
+	// valid RPMs of the local directories are served directly
+	err = os.MkdirAll(localdir, 0755)
+	if err != nil {
+		t.Fatalf("could not create local dir: %v\n", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(localdir, rpmB), good, 0644)
+	if err != nil {
+		t.Fatalf("could not create local RPM: %v\n", err)
+	}
+	if data, status := get("/test" + rpmB); status != http.StatusOK || !bytes.Equal(data, good) {
+		t.Errorf("expected the local RPM to be served. got status=%d\n", status)
+	}
+	if n := upstream.count(rpmB); n != 1 {
+		t.Errorf("expected 1 upstream request for the local RPM. got=%d\n", n)
+	}
+
+	if _, status := get("/test/NoSuch-1.0-1.noarch.rpm"); status != http.StatusNotFound {
+		t.Errorf("expected a 404 for an unknown RPM. got status=%d\n", status)
+	}
+	if _, status := get("/nosuchrepo/repodata/repomd.xml"); status != http.StatusNotFound {
+		t.Errorf("expected a 404 for an unknown repository. got status=%d\n", status)
+	}
+
+	// the packages added upstream are served once the new repomd.xml was served
+	err = ioutil.WriteFile(filepath.Join(srvdir, rpmB), good, 0644)
+	if err != nil {
+		t.Fatalf("could not restore RPM: %v\n", err)
+	}
+	testD := testRPM{
+		name: "TestD", version: "1", release: "1", arch: "noarch",
+		provides: [][3]string{{"TestD", "EQ", "1-1"}},
+	}
+	writeTestRepo(t, srvdir, testD)
+	mtime := time.Now().Add(2 * time.Second)
+	err = os.Chtimes(filepath.Join(srvdir, "repodata", "repomd.xml"), mtime, mtime)
+	if err != nil {
+		t.Fatalf("could not touch repomd.xml: %v\n", err)
+	}
+	if _, status := get("/test/repodata/repomd.xml"); status != http.StatusOK {
+		t.Fatalf("could not get repomd.xml. got status=%d\n", status)
+	}
+
+	// concurrent requests of an RPM wait for a single download
+	const rpmD = "/TestD-1-1.noarch.rpm"
+	upstream.mu.Lock()
+	upstream.delay = 100 * time.Millisecond
+	upstream.mu.Unlock()
+	var wg sync.WaitGroup
+	status := make([]int, 4)
+	for i := range status {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(proxySrv.URL + "/test" + rpmD)
+			if err != nil {
+				t.Errorf("could not get %s: %v\n", rpmD, err)
+				return
+			}
+			resp.Body.Close()
+			status[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	for i, v := range status {
+		if v != http.StatusOK {
+			t.Errorf("request #%d: expected the new RPM to be served. got status=%d\n", i, v)
+		}
+	}
+	if n := upstream.count(rpmD); n != 1 {
+		t.Errorf("expected 1 upstream request for the new RPM. got=%d\n", n)
+	}
+
+	// other files are passed through
+	err = ioutil.WriteFile(filepath.Join(srvdir, "GPG-KEY"), []byte("key"), 0644)
+	if err != nil {
+		t.Fatalf("could not create file: %v\n", err)
+	}
+	if data, status := get("/test/GPG-KEY"); status != http.StatusOK || string(data) != "key" {
+		t.Errorf("expected the file to be passed through. got status=%d data=%q\n", status, data)
+	}
+	resp, err := http.Head(proxySrv.URL + "/test/GPG-KEY")
+	if err != nil {
+		t.Fatalf("could not get the head of GPG-KEY: %v\n", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected HEAD to succeed. got status=%d\n", resp.StatusCode)
+	}
+	if _, status := get("/test/NoSuchFile"); status != http.StatusNotFound {
+		t.Errorf("expected a 404 for an unknown file. got status=%d\n", status)
+	}
+
+	// a truncated pass-through response is not served as a complete one
+	resp, err = http.Get(proxySrv.URL + "/test/truncated")
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("expected the truncated response to fail\n")
+	}
+
+	// the cached metadata is served when the upstream repository is unavailable
+	upstreamSrv.Close()
+	if _, status := get("/test/repodata/repomd.xml"); status != http.StatusOK {
+		t.Errorf("expected the cached repomd.xml to be served. got status=%d\n", status)
+	}
+	if data, status := get("/test" + rpmA); status != http.StatusOK || !bytes.Equal(data, want) {
+		t.Errorf("expected the cached RPM to be served. got status=%d\n", status)
+	}
+}
@@ -0,0 +1,710 @@
+package yum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gonuts/logger"
+)
+
+// PublishTarget is a location yum repositories are published to.
+// Paths are slash-separated and relative to the root of the repository.
+type PublishTarget interface {
+	// Get downloads the file at path name into the local file fname.
+	// It returns an error satisfying os.IsNotExist if there is no such file.
+	Get(name, fname string) error
+
+	// Put uploads the local file fname to path name.
+	Put(name, fname string) error
+
+	// Revision returns a token identifying the content of the file at path
+	// name (e.g. its ETag), or "" if there is no such file.
+	Revision(name string) (string, error)
+
+	// Replace atomically replaces the file at path name with the local file
+	// fname: readers see either the old or the new content, never a mix.
+	// The file is only replaced if its revision is still rev ("" meaning there
+	// must be no such file), ErrConflict being returned otherwise.
+	Replace(name, fname, rev string) error
+
+	// Delete removes the file at path name.
+	Delete(name string) error
+}
+
+// ErrConflict is returned when replacing a file modified since its revision was read.
+var ErrConflict = errors.New("yum: remote file modified concurrently")
+
+// NewPublishTarget returns the PublishTarget for rawurl, which is either:
+//   - a local directory: /path/to/repo or file:///path/to/repo
+//   - a HTTP server accepting PUT (and WebDAV MOVE): http(s)://[user:pass@]host/path/to/repo
+//   - an S3-compatible object store: s3://bucket/path/to/repo (see newS3Target)
+func NewPublishTarget(rawurl string) (PublishTarget, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "":
+		return &localTarget{dir: rawurl}, nil
+	case "file":
+		return &localTarget{dir: u.Path}, nil
+	case "http", "https":
+		return newWebDAVTarget(u), nil
+	case "s3":
+		return newS3Target(u)
+	}
+	return nil, fmt.Errorf("yum: unknown publish target scheme [%s] (url=%s)", u.Scheme, rawurl)
+}
+
+// errNotExist returns an error satisfying os.IsNotExist for the remote file name
+func errNotExist(name string) error {
+	return &os.PathError{Op: "get", Path: name, Err: os.ErrNotExist}
+}
+
+// copyFile copies src to dst. dst is written to a temporary file first, and
+// then renamed.
+func copyFile(dst, src string) error {
+	fsrc, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fsrc.Close()
+	return writeFile(dst, fsrc)
+}
+
+// writeFile writes the content of r to fname, through a temporary file which
+// is renamed once complete.
+func writeFile(fname string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fname), "."+filepath.Base(fname)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fname)
+}
+
+// newFileRequest returns a request to rawurl, with the content of the local
+// file fname as body (if not empty).
+func newFileRequest(method, rawurl, fname string) (*http.Request, error) {
+	if fname == "" {
+		return http.NewRequest(method, rawurl, nil)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	req, err := http.NewRequest(method, rawurl, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	req.ContentLength = fi.Size()
+	return req, nil
+}
+
+// sendRequest sends req with the shared HTTPClient.
+// The response is closed, unless the status is http.StatusOK.
+func sendRequest(req *http.Request) (*http.Response, error) {
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return resp, nil
+}
+
+// localTarget publishes to a local (or network mounted) directory
+type localTarget struct {
+	dir string
+}
+
+func (t *localTarget) path(name string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(name))
+}
+
+func (t *localTarget) Get(name, fname string) error {
+	return copyFile(fname, t.path(name))
+}
+
+func (t *localTarget) Put(name, fname string) error {
+	return copyFile(t.path(name), fname)
+}
+
+func (t *localTarget) Revision(name string) (string, error) {
+	sum, err := FileChecksum(t.path(name), "sha256")
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return sum, err
+}
+
+// localLockTimeout is how long Replace waits for the lock of a file held by
+// another publication.
+const localLockTimeout = 10 * time.Second
+
+func (t *localTarget) Replace(name, fname, rev string) error {
+	// the revision check and the replacement are serialized by a lock file
+	lock := t.path(name) + ".lock"
+	err := os.MkdirAll(filepath.Dir(lock), 0755)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if time.Since(start) > localLockTimeout {
+			return fmt.Errorf("yum: [%s] is locked by another publication (remove [%s] if stale)", name, lock)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer os.Remove(lock)
+
+	cur, err := t.Revision(name)
+	if err != nil {
+		return err
+	}
+	if cur != rev {
+		return ErrConflict
+	}
+	// Put already renames a complete file into place
+	return t.Put(name, fname)
+}
+
+func (t *localTarget) Delete(name string) error {
+	return os.Remove(t.path(name))
+}
+
+// webdavTarget publishes to a HTTP server accepting PUT requests.
+// WebDAV servers also get their collections created (MKCOL) and files
+// atomically replaced (MOVE).
+type webdavTarget struct {
+	url  url.URL // without credentials
+	user *url.Userinfo
+}
+
+func newWebDAVTarget(u *url.URL) *webdavTarget {
+	t := &webdavTarget{url: *u, user: u.User}
+	t.url.User = nil
+	t.url.Path = strings.TrimRight(t.url.Path, "/")
+	return t
+}
+
+func (t *webdavTarget) urlOf(name string) string {
+	u := t.url
+	u.Path = t.url.Path + "/" + name
+	return u.String()
+}
+
+// do sends a request to rawurl, with the content of the local file fname as body
+// (if not empty). The response is closed, unless the status is http.StatusOK.
+func (t *webdavTarget) do(method, rawurl, fname string, hdr http.Header) (*http.Response, error) {
+	req, err := newFileRequest(method, rawurl, fname)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	if t.user != nil {
+		pass, _ := t.user.Password()
+		req.SetBasicAuth(t.user.Username(), pass)
+	}
+	return sendRequest(req)
+}
+
+func (t *webdavTarget) error(method, name string, resp *http.Response) error {
+	return fmt.Errorf("yum: %s [%s] failed: %s", method, t.urlOf(name), resp.Status)
+}
+
+func (t *webdavTarget) Get(name, fname string) error {
+	resp, err := t.do("GET", t.urlOf(name), "", nil)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		defer resp.Body.Close()
+		return writeFile(fname, resp.Body)
+	case http.StatusNotFound, http.StatusGone:
+		return errNotExist(name)
+	}
+	return t.error("GET", name, resp)
+}
+
+func (t *webdavTarget) Put(name, fname string) error {
+	return t.put(name, fname, nil)
+}
+
+// put uploads the local file fname to path name, with the extra headers hdr.
+func (t *webdavTarget) put(name, fname string, hdr http.Header) error {
+	resp, err := t.do("PUT", t.urlOf(name), fname, hdr)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		// a WebDAV server with missing collections
+		err = t.mkcol(path.Dir(t.url.Path + "/" + name))
+		if err != nil {
+			return err
+		}
+		resp, err = t.do("PUT", t.urlOf(name), fname, hdr)
+		if err != nil {
+			return err
+		}
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil
+	case http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusPreconditionFailed:
+		return ErrConflict
+	}
+	return t.error("PUT", name, resp)
+}
+
+func (t *webdavTarget) Revision(name string) (string, error) {
+	resp, err := t.do("HEAD", t.urlOf(name), "", nil)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			return "", fmt.Errorf("yum: no ETag for [%s]: concurrent publications can not be detected", t.urlOf(name))
+		}
+		return etag, nil
+	case http.StatusNotFound, http.StatusGone:
+		return "", nil
+	}
+	return "", t.error("HEAD", name, resp)
+}
+
+// mkcol creates the collection at the absolute path dir of the server, and
+// its parents.
+func (t *webdavTarget) mkcol(dir string) error {
+	if dir == "/" || dir == "." {
+		return nil
+	}
+	err := t.mkcol(path.Dir(dir))
+	if err != nil {
+		return err
+	}
+	u := t.url
+	u.Path = dir + "/"
+	resp, err := t.do("MKCOL", u.String(), "", nil)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil
+	case http.StatusCreated, http.StatusMethodNotAllowed: // 405: already exists
+		return nil
+	}
+	return fmt.Errorf("yum: MKCOL [%s] failed: %s", u.String(), resp.Status)
+}
+
+func (t *webdavTarget) Replace(name, fname, rev string) error {
+	tmp := path.Join(path.Dir(name), fmt.Sprintf(".%s-%d", path.Base(name), time.Now().UnixNano()))
+	err := t.Put(tmp, fname)
+	if err != nil {
+		return err
+	}
+
+	// the destination is only overwritten if it still has the revision rev
+	hdr := http.Header{"Destination": {t.urlOf(name)}}
+	if rev == "" {
+		hdr["Overwrite"] = []string{"F"}
+	} else {
+		hdr["Overwrite"] = []string{"T"}
+		hdr["If"] = []string{fmt.Sprintf("<%s> ([%s])", t.urlOf(name), rev)}
+	}
+	resp, err := t.do("MOVE", t.urlOf(tmp), "", hdr)
+	if err != nil {
+		t.Delete(tmp)
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil
+	case http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusPreconditionFailed:
+		t.Delete(tmp)
+		return ErrConflict
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		// not a WebDAV server: a conditional PUT replaces the file in one go
+		t.Delete(tmp)
+		return t.put(name, fname, conditionalHeader(rev))
+	}
+	t.Delete(tmp)
+	return t.error("MOVE", tmp, resp)
+}
+
+// conditionalHeader returns the headers making a PUT request fail if the
+// target does not have the revision (ETag) rev, "" meaning it must not exist.
+func conditionalHeader(rev string) http.Header {
+	if rev == "" {
+		return http.Header{"If-None-Match": {"*"}}
+	}
+	return http.Header{"If-Match": {rev}}
+}
+
+func (t *webdavTarget) Delete(name string) error {
+	resp, err := t.do("DELETE", t.urlOf(name), "", nil)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil
+	case http.StatusAccepted, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return t.error("DELETE", name, resp)
+}
+
+// DefaultPublishRetention is the default delay during which the metadata files
+// superseded by a publication are kept, for the clients which fetched the
+// previous repomd.xml.
+const DefaultPublishRetention = 6 * time.Hour
+
+// path of the list of the superseded metadata files of a repository, waiting
+// for their retention delay to expire
+const staleHref = "repodata/stale.json"
+
+// staleFile is a metadata file superseded by a publication
+type staleFile struct {
+	Href  string    `json:"href"`
+	Since time.Time `json:"since"` // when the file was superseded
+}
+
+// Publisher publishes RPM files to a yum repository, keeping its metadata up
+// to date.
+type Publisher struct {
+	msg       *logger.Logger
+	target    PublishTarget
+	retention time.Duration // delay during which superseded metadata files are kept
+}
+
+// NewPublisher returns a Publisher to the repository at target.
+func NewPublisher(target PublishTarget) *Publisher {
+	return &Publisher{
+		msg:       logger.NewLogger("publish", logger.INFO, stdout),
+		target:    target,
+		retention: DefaultPublishRetention,
+	}
+}
+
+// SetLevel sets the verbosity level of the Publisher
+func (p *Publisher) SetLevel(lvl logger.Level) {
+	p.msg.SetLevel(lvl)
+}
+
+// SetRetention sets the delay during which the metadata files superseded by a
+// publication are kept, before being removed by a later publication.
+func (p *Publisher) SetRetention(retention time.Duration) {
+	p.retention = retention
+}
+
+// Publish uploads the RPM files rpms at the root of the repository, and
+// regenerates its metadata.
+// The metadata of the packages already published are reused from the current
+// metadata of the repository. The new metadata files get unique names, and are
+// uploaded next to the current ones: repomd.xml is replaced last, so clients
+// always see a consistent repository.
+// The metadata files which are not regenerated (group, other, updateinfo, ...)
+// are kept as they are. The superseded ones are removed by the first
+// publication after the retention delay (see SetRetention).
+// repomd.xml is only replaced if no other publication modified it meanwhile:
+// the publication is attempted again otherwise, up to maxPublishAttempts times.
+func (p *Publisher) Publish(rpms ...string) error {
+	for i := 1; ; i++ {
+		err := p.publish(rpms)
+		if err != ErrConflict {
+			return err
+		}
+		if i >= maxPublishAttempts {
+			return fmt.Errorf("yum: repository modified by other publications %d times in a row", i)
+		}
+		p.msg.Warnf("repository modified by another publication, publishing again...\n")
+	}
+}
+
+// maxPublishAttempts is the number of times a publication is attempted while
+// the repository is modified by other ones.
+const maxPublishAttempts = 3
+
+// publish runs a publication (see Publish). It returns ErrConflict if the
+// repository was modified by another publication meanwhile.
+func (p *Publisher) publish(rpms []string) error {
+	staging, err := ioutil.TempDir("", "lbpkr-publish-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	// fetch the current metadata of the repository.
+	// the revision is read first: a later modification is always detected.
+	const repomdHref = "repodata/repomd.xml"
+	repomd := filepath.Join(staging, filepath.FromSlash(repomdHref))
+	rev, err := p.target.Revision(repomdHref)
+	if err != nil {
+		return err
+	}
+	var superseded []string
+	err = p.target.Get(repomdHref, repomd)
+	switch {
+	case err == nil:
+		md, err := loadRepoMDFile(repomd)
+		if err != nil {
+			return err
+		}
+		for _, typ := range sortedRepoMDTypes(md) {
+			if !str_in_slice(typ, generatedTypes) {
+				continue
+			}
+			href := md[typ].Location
+			superseded = append(superseded, href)
+			if typ != "primary" && typ != "filelists" {
+				continue
+			}
+			p.msg.Debugf("fetching %s...\n", href)
+			err = p.target.Get(href, filepath.Join(staging, filepath.FromSlash(href)))
+			if err != nil {
+				return fmt.Errorf("yum: could not fetch %s metadata: %v", typ, err)
+			}
+		}
+	case os.IsNotExist(err):
+		p.msg.Infof("no repository metadata found. creating a new repository\n")
+	default:
+		return err
+	}
+
+	hrefs := make([]string, 0, len(rpms))
+	for _, rpm := range rpms {
+		href := filepath.Base(rpm)
+		err = copyFile(filepath.Join(staging, href), rpm)
+		if err != nil {
+			return err
+		}
+		hrefs = append(hrefs, href)
+	}
+
+	rc := NewRepoCreator(staging, true)
+	rc.msg = p.msg
+	rc.SetMerge(true)
+	rc.SetUniqueNames(true)
+	err = rc.Create()
+	if err != nil {
+		return err
+	}
+
+	for i, href := range hrefs {
+		p.msg.Infof("uploading %s...\n", href)
+		err = p.target.Put(href, rpms[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	md, err := loadRepoMDFile(repomd)
+	if err != nil {
+		return err
+	}
+	fresh := make(map[string]bool, len(md))
+	var uploaded []string
+	for _, typ := range sortedRepoMDTypes(md) {
+		href := md[typ].Location
+		fresh[href] = true
+		if !str_in_slice(typ, generatedTypes) {
+			// kept as is
+			continue
+		}
+		p.msg.Debugf("uploading %s...\n", href)
+		err = p.target.Put(href, filepath.Join(staging, filepath.FromSlash(href)))
+		if err != nil {
+			return err
+		}
+		if !str_in_slice(href, superseded) {
+			uploaded = append(uploaded, href)
+		}
+	}
+
+	p.msg.Debugf("replacing %s...\n", repomdHref)
+	err = p.target.Replace(repomdHref, repomd, rev)
+	if err == ErrConflict {
+		// nobody refers to the metadata files of this publication
+		for _, href := range uploaded {
+			derr := p.target.Delete(href)
+			if derr != nil {
+				p.msg.Warnf("could not remove metadata file %s: %v\n", href, derr)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return p.removeStale(staging, superseded, fresh)
+}
+
+// removeStale records the metadata files superseded by a publication, and
+// removes the ones superseded for longer than the retention delay.
+func (p *Publisher) removeStale(staging string, superseded []string, fresh map[string]bool) error {
+	fname := filepath.Join(staging, filepath.FromSlash(staleHref))
+	rev, err := p.target.Revision(staleHref)
+	if err != nil {
+		return err
+	}
+	var stale []staleFile
+	err = p.target.Get(staleHref, fname)
+	switch {
+	case err == nil:
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &stale)
+		if err != nil {
+			p.msg.Warnf("invalid list of stale metadata files %s: %v\n", staleHref, err)
+			stale = nil
+		}
+	case os.IsNotExist(err):
+		// no stale metadata files
+	default:
+		return err
+	}
+
+	now := time.Now()
+	for _, href := range superseded {
+		if !fresh[href] {
+			stale = append(stale, staleFile{Href: href, Since: now})
+		}
+	}
+
+	var kept []staleFile
+	for _, f := range stale {
+		switch {
+		case fresh[f.Href]:
+			// in use again
+		case now.Sub(f.Since) < p.retention:
+			kept = append(kept, f)
+		default:
+			p.msg.Debugf("removing stale %s...\n", f.Href)
+			err = p.target.Delete(f.Href)
+			if err != nil && !os.IsNotExist(err) {
+				p.msg.Warnf("could not remove stale metadata file %s: %v\n", f.Href, err)
+				kept = append(kept, f)
+			}
+		}
+	}
+
+	if len(kept) == 0 {
+		if len(stale) == 0 {
+			return nil
+		}
+		err = p.target.Delete(staleHref)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(fname, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = p.target.Replace(staleHref, fname, rev)
+	if err == ErrConflict {
+		// the files superseded by this publication are left in place
+		p.msg.Warnf("%s modified by another publication, not updated\n", staleHref)
+		return nil
+	}
+	return err
+}
+
+// loadRepoMDFile parses the repomd.xml file fname, making sure the metadata
+// files it refers to are within the repository.
+func loadRepoMDFile(fname string) (map[string]RepoMD, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	md, err := parseRepoMD(data)
+	if err != nil {
+		return nil, err
+	}
+	for typ, rec := range md {
+		href := rec.Location
+		if href == "" || path.IsAbs(href) || path.Clean(href) != href || strings.HasPrefix(href, "../") {
+			return nil, fmt.Errorf("yum: invalid location [%s] for %s metadata", href, typ)
+		}
+	}
+	return md, nil
+}
+
+func sortedRepoMDTypes(md map[string]RepoMD) []string {
+	types := make([]string, 0, len(md))
+	for typ := range md {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// EOF
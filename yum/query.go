@@ -0,0 +1,251 @@
+package yum
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Repository returns the repository named name, or nil if there is none.
+func (yum *Client) Repository(name string) *Repository {
+	yum.mux.RLock()
+	defer yum.mux.RUnlock()
+	return yum.repos[name]
+}
+
+// GetPackages returns all the packages of all repositories.
+func (yum *Client) GetPackages() []*Package {
+	var pkgs []*Package
+	for _, repo := range yum.Repositories() {
+		pkgs = append(pkgs, repo.GetPackages()...)
+	}
+	return pkgs
+}
+
+// WhatProvides returns all the packages, from all repositories, providing the capability req.
+func (yum *Client) WhatProvides(req *Requires) []*Package {
+	var pkgs []*Package
+	for _, repo := range yum.Repositories() {
+		pkgs = append(pkgs, repo.WhatProvides(req)...)
+	}
+	sort.Sort(Packages(pkgs))
+	return pkgs
+}
+
+// WhatRequires returns all the packages, from all repositories, requiring the capability prov.
+func (yum *Client) WhatRequires(prov *Requires) []*Package {
+	var pkgs []*Package
+	for _, repo := range yum.Repositories() {
+		pkgs = append(pkgs, repo.WhatRequires(prov)...)
+	}
+	sort.Sort(Packages(pkgs))
+	return pkgs
+}
+
+// WhatProvides returns all the packages of the repository providing the capability req.
+func (repo *Repository) WhatProvides(req *Requires) []*Package {
+	var pkgs []*Package
+	for _, pkg := range repo.GetPackages() {
+		for _, p := range pkg.Provides() {
+			if req.ProvideMatches(p) {
+				pkgs = append(pkgs, pkg)
+				break
+			}
+		}
+	}
+	sort.Sort(Packages(pkgs))
+	return pkgs
+}
+
+// WhatRequires returns all the packages of the repository requiring the capability prov.
+// An unversioned prov matches all the requirements on its name.
+func (repo *Repository) WhatRequires(prov *Requires) []*Package {
+	var pkgs []*Package
+	for _, pkg := range repo.GetPackages() {
+		for _, req := range pkg.Requires() {
+			if req.Name() != prov.Name() {
+				continue
+			}
+			if prov.Version() == "" || req.ProvideMatches(prov) {
+				pkgs = append(pkgs, pkg)
+				break
+			}
+		}
+	}
+	sort.Sort(Packages(pkgs))
+	return pkgs
+}
+
+// ParseCapability parses a capability of the form "name [op [epoch:]version[-release]]",
+// where op is one of =, ==, <, <=, > or >=.
+func ParseCapability(str string) (*Requires, error) {
+	toks := strings.Fields(str)
+	switch len(toks) {
+	case 1:
+		return NewRequires(toks[0], "", "", "", "", ""), nil
+	case 3:
+		// ok
+	default:
+		return nil, fmt.Errorf("yum: invalid capability %q", str)
+	}
+
+	name, op, evr := toks[0], toks[1], toks[2]
+	var flags string
+	switch op {
+	case "=", "==":
+		flags = "EQ"
+	case "<":
+		flags = "LT"
+	case "<=":
+		flags = "LE"
+	case ">":
+		flags = "GT"
+	case ">=":
+		flags = "GE"
+	default:
+		return nil, fmt.Errorf("yum: invalid operator %q in capability %q", op, str)
+	}
+
+	epoch := ""
+	if i := strings.Index(evr, ":"); i >= 0 {
+		epoch = evr[:i]
+		evr = evr[i+1:]
+	}
+	version, release := evr, ""
+	if i := strings.LastIndex(evr, "-"); i >= 0 {
+		version = evr[:i]
+		release = evr[i+1:]
+	}
+	if version == "" {
+		return nil, fmt.Errorf("yum: invalid version in capability %q", str)
+	}
+	return NewRequires(name, version, release, epoch, flags, ""), nil
+}
+
+// FormatCapability returns the textual form of a capability, as parsed by ParseCapability.
+// Rich dependencies are returned in their normalized form.
+func FormatCapability(rpm RPM) string {
+	if req, ok := rpm.(*Requires); ok && req.rich != nil {
+		return req.rich.String()
+	}
+	if rpm.Version() == "" {
+		return rpm.Name()
+	}
+
+	op := rpm.Flags()
+	switch op {
+	case "EQ":
+		op = "="
+	case "LT":
+		op = "<"
+	case "LE":
+		op = "<="
+	case "GT":
+		op = ">"
+	case "GE":
+		op = ">="
+	}
+
+	evr := rpm.Version()
+	if epoch := rpm.Epoch(); epoch != "" && epoch != "0" {
+		evr = epoch + ":" + evr
+	}
+	if rpm.Release() != "" {
+		evr += "-" + rpm.Release()
+	}
+	return rpm.Name() + " " + op + " " + evr
+}
+
+// QueryFormat formats a package according to a rpm-like query format,
+// e.g. "%{name}-%{version}-%{release} %{repo}\n".
+// Tags are case-insensitive and may be given a field width, as in "%-30{name}".
+// The supported tags are: name, version, release, epoch, arch, group, repo (or repoid),
+// location (or relativepath) and url.
+func QueryFormat(format string, pkg *Package) (string, error) {
+	var out bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		switch c {
+		case '\\':
+			if i+1 >= len(format) {
+				out.WriteByte(c)
+				continue
+			}
+			i++
+			switch format[i] {
+			case 'n':
+				out.WriteByte('\n')
+			case 't':
+				out.WriteByte('\t')
+			default:
+				out.WriteByte(format[i])
+			}
+
+		case '%':
+			if i+1 < len(format) && format[i+1] == '%' {
+				out.WriteByte('%')
+				i++
+				continue
+			}
+			beg := strings.Index(format[i:], "{")
+			end := strings.Index(format[i:], "}")
+			if beg < 0 || end < beg {
+				return "", fmt.Errorf("yum: invalid query format %q (missing tag at offset %d)", format, i)
+			}
+			width := 0
+			if w := format[i+1 : i+beg]; w != "" {
+				var err error
+				width, err = strconv.Atoi(w)
+				if err != nil {
+					return "", fmt.Errorf("yum: invalid field width %q in query format %q", w, format)
+				}
+			}
+			tag := strings.ToLower(format[i+beg+1 : i+end])
+			v, err := queryTag(tag, pkg)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&out, "%*s", width, v)
+			i += end
+
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), nil
+}
+
+// queryTag returns the value of a query format tag for pkg.
+func queryTag(tag string, pkg *Package) (string, error) {
+	switch tag {
+	case "name":
+		return pkg.Name(), nil
+	case "version":
+		return pkg.Version(), nil
+	case "release":
+		return pkg.Release(), nil
+	case "epoch":
+		return pkg.Epoch(), nil
+	case "arch":
+		return pkg.Arch(), nil
+	case "group":
+		return pkg.Group(), nil
+	case "repo", "repoid":
+		if pkg.Repository() == nil {
+			return "", nil
+		}
+		return pkg.Repository().Name, nil
+	case "location", "relativepath":
+		return pkg.Location(), nil
+	case "url":
+		if pkg.Repository() == nil {
+			return pkg.Location(), nil
+		}
+		return pkg.Url(), nil
+	}
+	return "", fmt.Errorf("yum: unknown query format tag %q", tag)
+}
+
+// EOF
@@ -0,0 +1,188 @@
+package yum
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseCapability(t *testing.T) {
+	for _, table := range []struct {
+		str  string
+		want [5]string // name, version, release, epoch, flags
+		err  bool
+	}{
+		{"TestPackage", [5]string{"TestPackage", "", "", "", ""}, false},
+		{"TestPackage = 1.0.0", [5]string{"TestPackage", "1.0.0", "", "", "EQ"}, false},
+		{"TestPackage >= 1.0.0-2", [5]string{"TestPackage", "1.0.0", "2", "", "GE"}, false},
+		{"TestPackage < 1:1.0.0-2", [5]string{"TestPackage", "1.0.0", "2", "1", "LT"}, false},
+		{"TestPackage ~ 1.0.0", [5]string{}, true},
+		{"TestPackage >=", [5]string{}, true},
+		{"", [5]string{}, true},
+	} {
+		req, err := ParseCapability(table.str)
+		if table.err {
+			if err == nil {
+				t.Errorf("%q: expected an error\n", table.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v\n", table.str, err)
+			continue
+		}
+		got := [5]string{req.Name(), req.Version(), req.Release(), req.Epoch(), req.Flags()}
+		if got != table.want {
+			t.Errorf("%q: expected %v. got=%v\n", table.str, table.want, got)
+		}
+		if str := FormatCapability(req); str != table.str {
+			t.Errorf("%q: round-trip failed. got=%q\n", table.str, str)
+		}
+	}
+}
+
+func TestQueryFormat(t *testing.T) {
+	yum, err := getTestClient(t)
+	if err != nil {
+		t.Fatalf("could not create test repo: %v\n", err)
+	}
+	defer yum.Close()
+
+	pkg, err := yum.FindLatestMatchingName("TestPackage", "1.0.0", "1")
+	if err != nil {
+		t.Fatalf("could not find TestPackage: %v\n", err)
+	}
+
+	for _, table := range []struct {
+		format string
+		want   string
+		err    bool
+	}{
+		{"%{name}-%{version}-%{release}", "TestPackage-1.0.0-1", false},
+		{"%{NAME}.%{arch} %{repo}", "TestPackage.noarch testrepo", false},
+		{"%-14{name}|%5{epoch}|", "TestPackage   |    0|", false},
+		{`%{group}\t%{location}\n`, "LHCb\tTestPackage-1.0.0-1.noarch.rpm\n", false},
+		{"%{url}", "http://dummy-url.org/TestPackage-1.0.0-1.noarch.rpm", false},
+		{"100%% %{name}", "100% TestPackage", false},
+		{"%{nosuchtag}", "", true},
+		{"%{name", "", true},
+		{"%x{name}", "", true},
+	} {
+		got, err := QueryFormat(table.format, pkg)
+		if table.err {
+			if err == nil {
+				t.Errorf("%q: expected an error\n", table.format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v\n", table.format, err)
+			continue
+		}
+		if got != table.want {
+			t.Errorf("%q: expected %q. got=%q\n", table.format, table.want, got)
+		}
+	}
+}
+
+func TestWhatProvidesRequires(t *testing.T) {
+	yum, err := getTestClient(t)
+	if err != nil {
+		t.Fatalf("could not create test repo: %v\n", err)
+	}
+	defer yum.Close()
+
+	ids := func(pkgs []*Package) []string {
+		out := make([]string, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			out = append(out, pkg.ID())
+		}
+		return out
+	}
+
+	for _, table := range []struct {
+		cap      string
+		provides []string
+		requires []string
+	}{
+		{
+			cap:      "TestPackage",
+			provides: []string{"TestPackage-1.0.0-1.noarch", "TestPackage-1.2.5-1.noarch", "TestPackage-1.3.7-1.noarch"},
+			requires: []string{"TP2-1.2.5-2.noarch", "TP3-1.18.22-2.noarch"},
+		},
+		{
+			cap:      "TestPackage >= 1.2.5",
+			provides: []string{"TestPackage-1.2.5-1.noarch", "TestPackage-1.3.7-1.noarch"},
+			requires: []string{"TP2-1.2.5-2.noarch", "TP3-1.18.22-2.noarch"},
+		},
+		{
+			cap:      "TestPackage = 1.3.7",
+			provides: []string{"TestPackage-1.3.7-1.noarch"},
+			requires: []string{"TP2-1.2.5-2.noarch"},
+		},
+		{
+			cap:      "NoSuchPackage",
+			provides: []string{},
+			requires: []string{},
+		},
+	} {
+		req, err := ParseCapability(table.cap)
+		if err != nil {
+			t.Fatalf("could not parse %q: %v\n", table.cap, err)
+		}
+
+		got := ids(yum.WhatProvides(req))
+		if !reflect.DeepEqual(got, table.provides) {
+			t.Errorf("whatprovides %q: expected %v. got=%v\n", table.cap, table.provides, got)
+		}
+
+		got = ids(yum.WhatRequires(req))
+		if !reflect.DeepEqual(got, table.requires) {
+			t.Errorf("whatrequires %q: expected %v. got=%v\n", table.cap, table.requires, got)
+		}
+	}
+
+	if repo := yum.Repository("testrepo"); repo == nil {
+		t.Errorf("could not find repository [testrepo]\n")
+	}
+	if repo := yum.Repository("nosuchrepo"); repo != nil {
+		t.Errorf("unexpected repository: %v\n", repo)
+	}
+}
+
+func TestListPackages(t *testing.T) {
+	yum, err := getTestClient(t)
+	if err != nil {
+		t.Fatalf("could not create test repo: %v\n", err)
+	}
+	defer yum.Close()
+
+	for _, table := range []struct {
+		name, version, release string
+		want                   []string
+	}{
+		{"^TP2$", "", "", []string{"TP2-1.2.5-1.noarch", "TP2-1.2.5-2.noarch"}},
+		{"^TP2$", "", "^2$", []string{"TP2-1.2.5-2.noarch"}},
+		{"^TP2$", "", "^3$", []string{}},
+		{"^TestPackage$", "^1\\.3", "1", []string{"TestPackage-1.3.7-1.noarch"}},
+	} {
+		pkgs, err := yum.ListPackages(table.name, table.version, table.release)
+		if err != nil {
+			t.Errorf("%v: %v\n", table, err)
+			continue
+		}
+		sort.Sort(Packages(pkgs))
+		got := make([]string, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			got = append(got, pkg.ID())
+		}
+		if !reflect.DeepEqual(got, table.want) {
+			t.Errorf("%v: expected %v. got=%v\n", table, table.want, got)
+		}
+	}
+
+	_, err = yum.ListPackages("TP2(", "", "")
+	if err == nil {
+		t.Errorf("expected an error for an invalid pattern\n")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
+	"net/http"
 	"os"
 	"path/filepath"
 	"time"
@@ -14,11 +15,13 @@ import (
 	"github.com/gonuts/logger"
 )
 
-// List of packages to ignore for our case
-var IGNORED_PACKAGES = []string{
-	"rpmlib(CompressedFileNames)", "/bin/sh", "rpmlib(PayloadFilesHavePrefix)",
-	"rpmlib(PartialHardlinkSets)",
-}
+// name of the file, in a repository cache directory, recording when the
+// remote metadata was last checked
+const cacheCookie = "cachecookie"
+
+// name of the file, in a repository cache directory, holding the HTTP cache
+// validators (ETag, Last-Modified) of the local repomd.xml file
+const repomdValidators = "repomd.xml.http"
 
 // Repository represents a YUM repository with all associated metadata.
 type Repository struct {
@@ -30,19 +33,31 @@ type Repository struct {
 	CacheDir       string
 	Backends       []string
 	Backend        Backend
+
+	httpc *http.Client // HTTP client retrieving the remote data
+
+	// Arches lists the architectures of the packages to consider, from the most preferred.
+	Arches []string
 }
 
 // NewRepository create a new Repository with name and from url.
 func NewRepository(name, url, cachedir string, backends []string, setupBackend, checkForUpdates bool) (*Repository, error) {
+	return newRepository(name, url, cachedir, backends, setupBackend, checkForUpdates, HTTPClient)
+}
+
+// newRepository creates a new Repository retrieving its remote data with httpc.
+func newRepository(name, url, cachedir string, backends []string, setupBackend, checkForUpdates bool, httpc *http.Client) (*Repository, error) {
 
 	repo := Repository{
-		msg:            logger.NewLogger("repo", logger.INFO, os.Stdout),
+		msg:            logger.NewLogger("repo", logger.INFO, stdout),
 		Name:           name,
 		RepoUrl:        url,
 		RepoMdUrl:      url + "/repodata/repomd.xml",
 		LocalRepoMdXml: filepath.Join(cachedir, "repomd.xml"),
 		CacheDir:       cachedir,
 		Backends:       make([]string, len(backends)),
+		Arches:         CompatArches(HostArch()),
+		httpc:          httpc,
 	}
 	copy(repo.Backends, backends)
 
@@ -73,7 +88,18 @@ func (repo *Repository) Close() error {
 	return repo.Backend.Close()
 }
 
+// archesFor returns the name of the package specified by spec ("name" or "name.arch")
+// and the architectures it may be built for.
+func (repo *Repository) archesFor(spec string) (string, []string) {
+	name, arch := SplitArch(spec)
+	if arch != "" {
+		return name, []string{arch}
+	}
+	return name, repo.Arches
+}
+
 // FindLatestMatchingName locats a package by name, returns the latest available version.
+// name may be suffixed with the requested architecture (e.g. "name.x86_64").
 func (repo *Repository) FindLatestMatchingName(name, version, release string) (*Package, error) {
 	return repo.Backend.FindLatestMatchingName(name, version, release)
 }
@@ -95,7 +121,7 @@ func (repo *Repository) setupBackendFromRemote() error {
 	var backend Backend
 
 	// get repo metadata with list of available files
-	remotedata, err := repo.remoteMetadata()
+	remotedata, validators, fetched, err := repo.remoteMetadata()
 	if err != nil {
 		return err
 	}
@@ -150,15 +176,6 @@ func (repo *Repository) setupBackendFromRemote() error {
 				repo.Backend = nil
 				continue
 			}
-			// save metadata to local repomd file
-			err = ioutil.WriteFile(repo.LocalRepoMdXml, remotedata, 0644)
-			if err != nil {
-				repo.msg.Warnf("problem updating local repomd.xml file for backend [%s]: %v\n", bname, err)
-				err = nil
-				backend = nil
-				repo.Backend = nil
-				continue
-			}
 		}
 
 		// load data necessary for the backend
@@ -181,6 +198,35 @@ func (repo *Repository) setupBackendFromRemote() error {
 	}
 
 	repo.msg.Debugf("repository [%s] - chosen backend [%T]\n", repo.Name, repo.Backend)
+
+	// save metadata to local repomd file, even when the DB did not change, so
+	// the next conditional requests are made against the current validators
+	if fetched {
+		err = ioutil.WriteFile(repo.LocalRepoMdXml, remotedata, 0644)
+		if err != nil {
+			repo.msg.Warnf("problem updating local repomd.xml file of repository [%s]: %v\n", repo.Name, err)
+			validators = nil
+		}
+		err = saveValidators(filepath.Join(repo.CacheDir, repomdValidators), validators)
+		if err != nil {
+			repo.msg.Warnf("problem saving HTTP validators of repomd.xml file: %v\n", err)
+			err = nil
+		}
+	}
+
+	// keep the metadata, so it can be used again once superseded
+	err = repo.saveSnapshot(remotedata)
+	if err != nil {
+		repo.msg.Warnf("could not save snapshot of repository [%s]: %v\n", repo.Name, err)
+		err = nil
+	}
+
+	// record when we last synchronized with the remote repository
+	err = touchFile(filepath.Join(repo.CacheDir, cacheCookie))
+	if err != nil {
+		repo.msg.Warnf("could not update cache cookie for repository [%s]: %v\n", repo.Name, err)
+		err = nil
+	}
 	return err
 }
 
@@ -191,6 +237,9 @@ func (repo *Repository) setupBackendFromLocal() error {
 	if err != nil {
 		return err
 	}
+	if data == nil {
+		return fmt.Errorf("yum: no cached metadata for repository [%s] (run 'lbpkr makecache')", repo.Name)
+	}
 
 	md, err := repo.checkRepoMD(data)
 	if err != nil {
@@ -237,20 +286,70 @@ func (repo *Repository) setupBackendFromLocal() error {
 	return err
 }
 
-// remoteMetadata retrieves the repo metadata file content
-func (repo *Repository) remoteMetadata() ([]byte, error) {
-	r, err := getRemoteData(repo.RepoMdUrl)
+// metadataExpired returns whether the cached metadata in cachedir is older
+// than expire and should be checked against the remote repository.
+// A negative expire means the cached metadata never expires.
+func metadataExpired(cachedir string, expire time.Duration) bool {
+	if !path_exists(filepath.Join(cachedir, "repomd.xml")) {
+		return true
+	}
+	fi, err := os.Stat(filepath.Join(cachedir, cacheCookie))
 	if err != nil {
-		return nil, err
+		return true
+	}
+	if expire < 0 {
+		return false
+	}
+	return time.Since(fi.ModTime()) >= expire
+}
+
+// touchFile creates fname or updates its modification time.
+func touchFile(fname string) error {
+	now := time.Now()
+	err := os.Chtimes(fname, now, now)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// openURL returns a reader over the content of rpath, retrieved with the
+// HTTP client of the repository.
+func (repo *Repository) openURL(rpath string) (io.ReadCloser, error) {
+	r, _, err := fetch(repo.httpc, rpath, nil)
+	return r, err
+}
+
+// remoteMetadata retrieves the repo metadata file content, together with its
+// HTTP validators and whether it was actually retrieved.
+// The local repo metadata is returned when the remote one has not been modified since.
+func (repo *Repository) remoteMetadata() ([]byte, *httpValidators, bool, error) {
+	var cond *httpValidators
+	if path_exists(repo.LocalRepoMdXml) {
+		cond = loadValidators(filepath.Join(repo.CacheDir, repomdValidators))
+	}
+
+	r, validators, err := fetch(repo.httpc, repo.RepoMdUrl, cond)
+	if err == ErrNotModified {
+		repo.msg.Debugf("repomd.xml of repository [%s] not modified\n", repo.Name)
+		data, err := repo.localMetadata()
+		return data, validators, false, err
+	}
+	if err != nil {
+		return nil, nil, false, err
 	}
 	defer r.Close()
 
 	buf := new(bytes.Buffer)
 	_, err = io.Copy(buf, r)
 	if err != nil && err != io.EOF {
-		return nil, err
+		return nil, nil, false, err
 	}
-	return buf.Bytes(), err
+	return buf.Bytes(), validators, true, err
 }
 
 // localMetadata retrieves the repo metadata from the repomd file
@@ -279,12 +378,19 @@ func (repo *Repository) checkRepoMD(data []byte) (map[string]RepoMD, error) {
 		repo.msg.Debugf("checkRepoMD: no data\n")
 		return nil, nil
 	}
+	return parseRepoMD(data)
+}
 
+// parseRepoMD parses the content of a repomd.xml file
+func parseRepoMD(data []byte) (map[string]RepoMD, error) {
 	type xmlTree struct {
 		XMLName xml.Name `xml:"repomd"`
 		Data    []struct {
 			Type     string `xml:"type,attr"`
-			Checksum string `xml:"checksum"`
+			Checksum struct {
+				Type  string `xml:"type,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"checksum"`
 			Location struct {
 				Href string `xml:"href,attr"`
 			} `xml:"location"`
@@ -303,18 +409,20 @@ func (repo *Repository) checkRepoMD(data []byte) (map[string]RepoMD, error) {
 		sec := int64(math.Floor(data.Timestamp))
 		nsec := int64((data.Timestamp - float64(sec)) * 1e9)
 		db[data.Type] = RepoMD{
-			Checksum:  data.Checksum,
-			Timestamp: time.Unix(sec, nsec),
-			Location:  data.Location.Href,
+			Checksum:     data.Checksum.Value,
+			ChecksumType: data.Checksum.Type,
+			Timestamp:    time.Unix(sec, nsec),
+			Location:     data.Location.Href,
 		}
 	}
 	return db, err
 }
 
 type RepoMD struct {
-	Checksum  string
-	Timestamp time.Time
-	Location  string
+	Checksum     string
+	ChecksumType string
+	Timestamp    time.Time
+	Location     string
 }
 
 // EOF
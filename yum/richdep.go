@@ -0,0 +1,362 @@
+package yum
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RichDep is a node of a rich (boolean) dependency, as introduced by rpm-4.13.
+// e.g. "(A or B)", "(A if B else C)", "(A with B)".
+type RichDep struct {
+	Op   string     // operator: "" (simple dependency), "and", "or", "if", "unless", "with" or "without"
+	Req  *Requires  // simple dependency (only if Op == "")
+	Args []*RichDep // operands. for if/unless: then, condition and (optionally) else
+}
+
+// String returns the rpm textual form of the dependency.
+func (dep *RichDep) String() string {
+	if dep.Op == "" {
+		return FormatCapability(dep.Req)
+	}
+
+	strs := make([]string, len(dep.Args))
+	for i, arg := range dep.Args {
+		strs[i] = arg.String()
+	}
+
+	switch dep.Op {
+	case "if", "unless":
+		str := strs[0] + " " + dep.Op + " " + strs[1]
+		if len(strs) > 2 {
+			str += " else " + strs[2]
+		}
+		return "(" + str + ")"
+	}
+	return "(" + strings.Join(strs, " "+dep.Op+" ") + ")"
+}
+
+// isRichDep returns whether str is a rich dependency
+func isRichDep(str string) bool {
+	return strings.HasPrefix(str, "(")
+}
+
+// ParseRichDep parses a rich dependency, e.g. "(A >= 1.0 or (B and C))".
+func ParseRichDep(str string) (*RichDep, error) {
+	p := richParser{toks: richTokens(str)}
+	if p.peek() != "(" {
+		return nil, fmt.Errorf("yum: invalid rich dependency %q (missing opening parenthesis)", str)
+	}
+	dep, err := p.parseTerm()
+	if err != nil {
+		return nil, fmt.Errorf("yum: invalid rich dependency %q: %v", str, err)
+	}
+	if p.peek() != "" {
+		return nil, fmt.Errorf("yum: invalid rich dependency %q: unexpected %q", str, p.peek())
+	}
+	return dep, nil
+}
+
+// richTokens splits a rich dependency into parentheses and words.
+// Parentheses within a word (e.g. "perl(Foo)") are part of that word.
+func richTokens(str string) []string {
+	var toks []string
+	beg := -1
+	depth := 0 // parentheses depth within the current word
+	for i, c := range str {
+		switch {
+		case beg >= 0 && c == '(':
+			depth++
+		case beg >= 0 && c == ')' && depth > 0:
+			depth--
+		case c == '(' || c == ')' || c == ' ' || c == '\t' || c == '\n':
+			if beg >= 0 {
+				toks = append(toks, str[beg:i])
+				beg = -1
+			}
+			if c == '(' || c == ')' {
+				toks = append(toks, string(c))
+			}
+		case beg < 0:
+			beg = i
+			depth = 0
+		}
+	}
+	if beg >= 0 {
+		toks = append(toks, str[beg:])
+	}
+	return toks
+}
+
+type richParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *richParser) peek() string {
+	if p.pos >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos]
+}
+
+func (p *richParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+// parseTerm parses a parenthesized expression or a simple dependency.
+func (p *richParser) parseTerm() (*RichDep, error) {
+	switch tok := p.next(); tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of dependency")
+	case ")":
+		return nil, fmt.Errorf("unexpected closing parenthesis")
+	case "(":
+		dep, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok != ")" {
+			return nil, fmt.Errorf("expected closing parenthesis. got=%q", tok)
+		}
+		return dep, nil
+	default:
+		if isRichOp(tok) {
+			return nil, fmt.Errorf("unexpected operator %q", tok)
+		}
+		str := tok
+		switch p.peek() {
+		case "=", "==", "<", "<=", ">", ">=":
+			str += " " + p.next()
+			evr := p.next()
+			if evr == "" || evr == "(" || evr == ")" {
+				return nil, fmt.Errorf("missing version for %q", tok)
+			}
+			str += " " + evr
+		}
+		req, err := ParseCapability(str)
+		if err != nil {
+			return nil, err
+		}
+		return &RichDep{Req: req}, nil
+	}
+}
+
+// parseExpr parses the content of a parenthesized expression.
+func (p *richParser) parseExpr() (*RichDep, error) {
+	first, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == ")" {
+		return first, nil
+	}
+
+	op := p.next()
+	dep := &RichDep{Op: op, Args: []*RichDep{first}}
+	switch op {
+	case "and", "or", "with":
+		// chains of the same operator
+		for {
+			arg, err := p.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			dep.Args = append(dep.Args, arg)
+			if p.peek() != op {
+				break
+			}
+			p.next()
+		}
+
+	case "without":
+		arg, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		dep.Args = append(dep.Args, arg)
+
+	case "if", "unless":
+		arg, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		dep.Args = append(dep.Args, arg)
+		if p.peek() == "else" {
+			p.next()
+			arg, err = p.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			dep.Args = append(dep.Args, arg)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown operator %q", op)
+	}
+
+	if tok := p.peek(); tok != ")" {
+		return nil, fmt.Errorf("unexpected %q after %q operand (operators can not be mixed without parentheses)", tok, op)
+	}
+	return dep, nil
+}
+
+func isRichOp(tok string) bool {
+	switch tok {
+	case "and", "or", "if", "unless", "else", "with", "without":
+		return true
+	}
+	return false
+}
+
+// Satisfied evaluates the dependency, given whether each of its simple
+// dependencies is satisfied.
+func (dep *RichDep) Satisfied(satisfied func(req *Requires) bool) bool {
+	switch dep.Op {
+	case "":
+		return satisfied(dep.Req)
+	case "and", "with":
+		for _, arg := range dep.Args {
+			if !arg.Satisfied(satisfied) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, arg := range dep.Args {
+			if arg.Satisfied(satisfied) {
+				return true
+			}
+		}
+		return false
+	case "without":
+		return dep.Args[0].Satisfied(satisfied) && !dep.Args[1].Satisfied(satisfied)
+	case "if", "unless":
+		cond := dep.Args[1].Satisfied(satisfied)
+		if dep.Op == "unless" {
+			cond = !cond
+		}
+		switch {
+		case cond:
+			return dep.Args[0].Satisfied(satisfied)
+		case len(dep.Args) > 2:
+			return dep.Args[2].Satisfied(satisfied)
+		}
+		return true
+	}
+	return false
+}
+
+// ResolveRequire returns the packages needed to satisfy the requirement req.
+// Conditional rich dependencies (if/unless) are resolved assuming none of
+// their conditions is satisfied.
+func (yum *Client) ResolveRequire(req *Requires) ([]*Package, error) {
+	return yum.resolveRequire(req, func(*Requires) bool { return false })
+}
+
+// resolveRequire returns the packages needed to satisfy the requirement req.
+// selected reports whether a simple dependency is already satisfied by the
+// packages being installed.
+func (yum *Client) resolveRequire(req *Requires, selected func(*Requires) bool) ([]*Package, error) {
+	if !req.IsRich() {
+		p, err := yum.FindLatestMatchingRequire(req)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			return nil, fmt.Errorf("package %s not found", req.ID())
+		}
+		return []*Package{p}, nil
+	}
+
+	dep, err := req.Rich()
+	if err != nil {
+		return nil, err
+	}
+	return yum.resolveRich(dep, selected)
+}
+
+func (yum *Client) resolveRich(dep *RichDep, selected func(*Requires) bool) ([]*Package, error) {
+	switch dep.Op {
+	case "":
+		return yum.resolveRequire(dep.Req, selected)
+
+	case "and":
+		var pkgs []*Package
+		for _, arg := range dep.Args {
+			ps, err := yum.resolveRich(arg, selected)
+			if err != nil {
+				return nil, err
+			}
+			pkgs = append(pkgs, ps...)
+		}
+		return pkgs, nil
+
+	case "or":
+		// prefer an alternative which is already satisfied
+		for _, arg := range dep.Args {
+			if arg.Satisfied(selected) {
+				return nil, nil
+			}
+		}
+		var err error
+		for _, arg := range dep.Args {
+			var pkgs []*Package
+			pkgs, err = yum.resolveRich(arg, selected)
+			if err == nil {
+				return pkgs, nil
+			}
+		}
+		return nil, fmt.Errorf("no alternative of %s could be resolved (%v)", dep, err)
+
+	case "if", "unless":
+		cond := dep.Args[1].Satisfied(selected)
+		if dep.Op == "unless" {
+			cond = !cond
+		}
+		switch {
+		case cond:
+			return yum.resolveRich(dep.Args[0], selected)
+		case len(dep.Args) > 2:
+			return yum.resolveRich(dep.Args[2], selected)
+		}
+		return nil, nil
+
+	case "with", "without":
+		// a single package must provide all the "with" operands (and none of the "without" one)
+		for _, arg := range dep.Args {
+			if arg.Op != "" {
+				return nil, fmt.Errorf("unsupported nested dependency in %s", dep)
+			}
+		}
+		want := dep.Op == "with"
+		var found Packages
+	loop:
+		for _, pkg := range yum.WhatProvides(dep.Args[0].Req) {
+			for _, arg := range dep.Args[1:] {
+				provided := false
+				for _, prov := range pkg.Provides() {
+					if arg.Req.ProvideMatches(prov) {
+						provided = true
+						break
+					}
+				}
+				if provided != want {
+					continue loop
+				}
+			}
+			found = append(found, pkg)
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("no package providing %s", dep)
+		}
+		return []*Package{found[len(found)-1]}, nil
+	}
+
+	return nil, fmt.Errorf("unknown operator %q in %s", dep.Op, dep)
+}
+
+// EOF
@@ -0,0 +1,160 @@
+package yum
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseRichDep(t *testing.T) {
+	for _, table := range []struct {
+		str  string
+		want string
+		err  bool
+	}{
+		{"(A or B)", "(A or B)", false},
+		{"(A  or B or C)", "(A or B or C)", false},
+		{"(A >= 1.0 and (B or C < 2:3.0-1))", "(A >= 1.0 and (B or C < 2:3.0-1))", false},
+		{"(A if B)", "(A if B)", false},
+		{"(A if B else C)", "(A if B else C)", false},
+		{"((A or B) unless C else D)", "((A or B) unless C else D)", false},
+		{"(A with B)", "(A with B)", false},
+		{"(A without B)", "(A without B)", false},
+		{"(lib(x) = 1.0)", "lib(x) = 1.0", false},
+		{"(A)", "A", false},
+		{"(A or B and C)", "", true},
+		{"(A or B", "", true},
+		{"(A or)", "", true},
+		{"(A xor B)", "", true},
+		{"(A >= )", "", true},
+		{"(A without B without C)", "", true},
+		{"(A or B))", "", true},
+		{"A or B", "", true},
+	} {
+		dep, err := ParseRichDep(table.str)
+		if table.err {
+			if err == nil {
+				t.Errorf("%q: expected an error. got=%v\n", table.str, dep)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v\n", table.str, err)
+			continue
+		}
+		if got := dep.String(); got != table.want {
+			t.Errorf("%q: expected %q. got=%q\n", table.str, table.want, got)
+		}
+	}
+}
+
+func TestRichDepSatisfied(t *testing.T) {
+	installed := map[string]bool{"A": true, "B": true}
+	satisfied := func(req *Requires) bool { return installed[req.Name()] }
+
+	for _, table := range []struct {
+		str  string
+		want bool
+	}{
+		{"(A or C)", true},
+		{"(C or D)", false},
+		{"(A and B)", true},
+		{"(A and C)", false},
+		{"(C if A)", false},
+		{"(C if D)", true},
+		{"(C if D else A)", true},
+		{"(C unless A)", true},
+		{"(C unless D)", false},
+		{"(A with B)", true},
+		{"(A without B)", false},
+		{"(A without C)", true},
+	} {
+		dep, err := ParseRichDep(table.str)
+		if err != nil {
+			t.Fatalf("%q: could not parse: %v\n", table.str, err)
+		}
+		if got := dep.Satisfied(satisfied); got != table.want {
+			t.Errorf("%q: expected %v. got=%v\n", table.str, table.want, got)
+		}
+	}
+}
+
+func TestRichDepResolution(t *testing.T) {
+	backend, err := newTestXMLBackend("testdata/richdeps.xml")
+	if err != nil {
+		t.Fatalf("could not create backend: %v\n", err)
+	}
+	err = backend.LoadDB()
+	if err != nil {
+		t.Fatalf("could not load DB: %v\n", err)
+	}
+
+	yum, err := newClient("testdata/mysiteroot", []string{"RepositoryXMLBackend"}, true, true)
+	if err != nil {
+		t.Fatalf("could not create client: %v\n", err)
+	}
+	yum.msg = backend.msg
+	yum.repos[backend.Repository.Name] = backend.Repository
+
+	top, err := yum.FindLatestMatchingName("Top", "", "")
+	if err != nil {
+		t.Fatalf("could not find Top: %v\n", err)
+	}
+
+	var rich []string
+	for _, req := range top.Requires() {
+		if req.IsRich() {
+			rich = append(rich, req.ID())
+		}
+	}
+	want := []string{
+		"(LibA or LibB)",
+		"(LibB >= 2.0.0 and Compiler)",
+		"(Compiler with feature(x))",
+		"(Plugin if LibA else NoSuchPackage)",
+	}
+	if !reflect.DeepEqual(rich, want) {
+		t.Fatalf("invalid rich deps.\nexpected %v\ngot=     %v\n", want, rich)
+	}
+
+	for _, table := range []struct {
+		name string
+		deps []string
+		err  bool
+	}{
+		{
+			name: "Top",
+			deps: []string{
+				"Compiler-1.0.0-1.noarch", "Compiler-2.0.0-1.noarch",
+				"LibA-1.0.0-1.noarch", "LibB-2.0.0-1.noarch",
+				"Plugin-1.0.0-1.noarch",
+			},
+		},
+		{
+			name: "Alt",
+			deps: []string{"Compiler-2.0.0-1.noarch", "LibB-2.0.0-1.noarch"},
+		},
+		{
+			name: "Broken",
+			deps: []string{},
+			err:  true,
+		},
+	} {
+		pkg, err := yum.FindLatestMatchingName(table.name, "", "")
+		if err != nil {
+			t.Fatalf("could not find %s: %v\n", table.name, err)
+		}
+		deps, err := yum.PackageDeps(pkg, -1)
+		if table.err != (err != nil) {
+			t.Errorf("%s: unexpected error value: %v\n", table.name, err)
+		}
+		ids := make([]string, 0, len(deps))
+		for _, dep := range deps {
+			ids = append(ids, dep.ID())
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, table.deps) {
+			t.Errorf("%s: expected deps %v. got=%v\n", table.name, table.deps, ids)
+		}
+	}
+}
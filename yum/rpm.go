@@ -96,10 +96,9 @@ func (rpm *rpmBase) ProvideMatches(p RPM) bool {
 	case "GE", "ge", ">=":
 		return !RPMLessThan(p, rpm)
 	default:
-		panic(fmt.Errorf("invalid Flags %q (package=%v %T)", rpm.Flags(), rpm.Name(), rpm))
+		// unknown flags (e.g. from a newer rpm) can not be honored.
+		return false
 	}
-
-	return false
 }
 
 func RPMEqual(i, j RPM) bool {
@@ -176,10 +175,13 @@ func NewProvides(name, version, release, epoch, flags string, pkg *Package) *Pro
 type Requires struct {
 	rpmBase
 	pre string // pre is the prequisite required by a RPM package
+
+	rich    *RichDep // rich (boolean) dependency, if any
+	richErr error    // error parsing the rich dependency, if any
 }
 
 func NewRequires(name, version, release, epoch, flags string, pre string) *Requires {
-	return &Requires{
+	req := &Requires{
 		rpmBase: rpmBase{
 			name:    name,
 			version: version,
@@ -189,6 +191,36 @@ func NewRequires(name, version, release, epoch, flags string, pre string) *Requi
 		},
 		pre: pre,
 	}
+	if isRichDep(name) {
+		req.rich, req.richErr = ParseRichDep(name)
+	}
+	return req
+}
+
+// IsRich returns whether req is a rich (boolean) dependency, e.g. "(A or B)"
+func (req *Requires) IsRich() bool {
+	return isRichDep(req.name)
+}
+
+// Rich returns the parsed rich dependency.
+func (req *Requires) Rich() (*RichDep, error) {
+	if !req.IsRich() {
+		return nil, fmt.Errorf("yum: %q is not a rich dependency", req.name)
+	}
+	return req.rich, req.richErr
+}
+
+// String returns the textual form of the requirement
+func (req *Requires) String() string {
+	return FormatCapability(req)
+}
+
+// ID returns the unique identifier of this requirement
+func (req *Requires) ID() string {
+	if req.rich != nil {
+		return req.rich.String()
+	}
+	return req.rpmBase.ID()
 }
 
 // Package represents a RPM package in a YUM repository
@@ -198,9 +230,12 @@ type Package struct {
 	group      string
 	arch       string
 	location   string
+	sumtype    string // type of the checksum of the RPM file (sha256, sha, ...)
+	checksum   string // checksum of the RPM file, hex-encoded
 	requires   []*Requires
 	provides   []*Provides
 	repository *Repository
+	host       *HostCapability // capability provided by the host, for virtual packages
 }
 
 // NewPackage creates a new RPM package
@@ -240,6 +275,10 @@ func (pkg *Package) String() string {
 	if len(pkg.requires) > 0 {
 		str = append(str, "Requires:")
 		for _, p := range pkg.requires {
+			if p.IsRich() {
+				str = append(str, fmt.Sprintf("\t%s", p.ID()))
+				continue
+			}
 			str = append(str, fmt.Sprintf("\t%s-%s-%s\t%s", p.Name(), p.Version(), p.Release(), p.Flags()))
 		}
 	}
@@ -247,6 +286,22 @@ func (pkg *Package) String() string {
 	return strings.Join(str, "\n")
 }
 
+// ID returns the unique identifier of this package: name-version-release.arch
+func (pkg *Package) ID() string {
+	if pkg.arch == "" {
+		return pkg.rpmBase.ID()
+	}
+	return pkg.rpmBase.ID() + "." + pkg.arch
+}
+
+// RPMFileName returns the file name of this package: name-version-release.arch.rpm
+func (pkg *Package) RPMFileName() string {
+	if pkg.arch == "" {
+		return pkg.rpmBase.RPMFileName()
+	}
+	return fmt.Sprintf("%s-%s-%s.%s.rpm", pkg.name, pkg.version, pkg.release, pkg.arch)
+}
+
 func (pkg *Package) Group() string {
 	return pkg.group
 }
@@ -259,6 +314,13 @@ func (pkg *Package) Location() string {
 	return pkg.location
 }
 
+// Checksum returns the checksum of the RPM file of the package, as
+// advertised by the repository, and its type (sha256, sha, md5, ...).
+// Both are empty if the repository does not provide it.
+func (pkg *Package) Checksum() (typ, sum string) {
+	return pkg.sumtype, pkg.checksum
+}
+
 func (pkg *Package) Requires() []*Requires {
 	return pkg.requires
 }
@@ -267,6 +329,21 @@ func (pkg *Package) Provides() []*Provides {
 	return pkg.provides
 }
 
+// newHostPackage returns a virtual package standing for a capability provided by the host
+func newHostPackage(hc *HostCapability) *Package {
+	pkg := NewPackage(hc.Name, "", "", "")
+	pkg.group = "host/" + hc.Source
+	pkg.location = hc.Origin
+	pkg.host = hc
+	return pkg
+}
+
+// Host returns the host capability a virtual package stands for, or nil for
+// packages from a repository.
+func (pkg *Package) Host() *HostCapability {
+	return pkg.host
+}
+
 func (pkg *Package) Repository() *Repository {
 	return pkg.repository
 }
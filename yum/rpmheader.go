@@ -0,0 +1,348 @@
+package yum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// tags of the RPM header describing its structure
+const (
+	rpmTagHeaderSignatures = 62  // region of the signature header
+	rpmTagHeaderImmutable  = 63  // region of the header
+	rpmTagHeaderI18NTable  = 100 // locales of the i18n strings
+)
+
+// tags of the RPM header used to describe packages
+const (
+	rpmTagName            = 1000
+	rpmTagVersion         = 1001
+	rpmTagRelease         = 1002
+	rpmTagEpoch           = 1003
+	rpmTagSummary         = 1004
+	rpmTagDescription     = 1005
+	rpmTagBuildTime       = 1006
+	rpmTagBuildHost       = 1007
+	rpmTagSize            = 1009
+	rpmTagVendor          = 1011
+	rpmTagLicense         = 1014
+	rpmTagPackager        = 1015
+	rpmTagGroup           = 1016
+	rpmTagURL             = 1020
+	rpmTagOS              = 1021
+	rpmTagArch            = 1022
+	rpmTagOldFilenames    = 1027
+	rpmTagFileSizes       = 1028
+	rpmTagFileModes       = 1030
+	rpmTagFileRDevs       = 1033
+	rpmTagFileMTimes      = 1034
+	rpmTagFileDigests     = 1035
+	rpmTagFileLinkTos     = 1036
+	rpmTagFileFlags       = 1037
+	rpmTagFileUserName    = 1039
+	rpmTagFileGroupName   = 1040
+	rpmTagSourceRPM       = 1044
+	rpmTagArchiveSize     = 1046
+	rpmTagProvideName     = 1047
+	rpmTagRequireFlags    = 1048
+	rpmTagRequireName     = 1049
+	rpmTagRequireVersion  = 1050
+	rpmTagConflictFlags   = 1053
+	rpmTagConflictName    = 1054
+	rpmTagConflictVersion = 1055
+	rpmTagObsoleteName    = 1090
+	rpmTagFileDevices     = 1095
+	rpmTagFileInodes      = 1096
+	rpmTagFileLangs       = 1097
+	rpmTagPrefixes        = 1098
+	rpmTagProvideFlags    = 1112
+	rpmTagProvideVersion  = 1113
+	rpmTagObsoleteFlags   = 1114
+	rpmTagObsoleteVersion = 1115
+	rpmTagDirIndexes      = 1116
+	rpmTagBaseNames       = 1117
+	rpmTagDirNames        = 1118
+	rpmTagPayloadFormat   = 1124
+	rpmTagPayloadCompr    = 1125
+	rpmTagPayloadFlags    = 1126
+)
+
+// tags of the RPM signature header
+const (
+	rpmSigTagSHA1        = 269
+	rpmSigTagSHA256      = 273
+	rpmSigTagSize        = 1000
+	rpmSigTagMD5         = 1004
+	rpmSigTagPayloadSize = 1007
+)
+
+// types of the values of RPM header tags
+const (
+	rpmTypeNull        = 0
+	rpmTypeChar        = 1
+	rpmTypeInt8        = 2
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeInt64       = 5
+	rpmTypeString      = 6
+	rpmTypeBin         = 7
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// flags of RPM dependencies
+const (
+	rpmSenseLess       = 1 << 1
+	rpmSenseGreater    = 1 << 2
+	rpmSenseEqual      = 1 << 3
+	rpmSensePrereq     = 1 << 6
+	rpmSenseScriptPre  = 1 << 9
+	rpmSenseScriptPost = 1 << 10
+	rpmSenseRPMLib     = 1 << 24
+)
+
+var (
+	rpmLeadMagic   = []byte{0xed, 0xab, 0xee, 0xdb}
+	rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01}
+)
+
+const rpmLeadSize = 96
+
+// RPMHeader is the (main) header of a RPM file, describing the package.
+type RPMHeader struct {
+	Start int64 // offset of the header in the RPM file
+	End   int64 // offset of the end of the header in the RPM file
+
+	tags map[int]rpmTag
+}
+
+type rpmTag struct {
+	typ   int
+	count int
+	data  []byte // from the offset of the value to the end of the data store
+}
+
+// ReadRPMHeader reads the header of the RPM file read from r.
+// r is left positioned at the start of the payload.
+func ReadRPMHeader(r io.Reader) (*RPMHeader, error) {
+	lead := make([]byte, rpmLeadSize)
+	_, err := io.ReadFull(r, lead)
+	if err != nil {
+		return nil, fmt.Errorf("yum: could not read RPM lead: %v", err)
+	}
+	if !bytes.Equal(lead[:4], rpmLeadMagic) {
+		return nil, fmt.Errorf("yum: not a RPM file")
+	}
+
+	// the signature header is padded to a multiple of 8 bytes
+	pos := int64(rpmLeadSize)
+	sig, err := readRPMHeaderSection(r, pos)
+	if err != nil {
+		return nil, fmt.Errorf("yum: could not read RPM signature: %v", err)
+	}
+	pos = sig.End
+	if pad := (8 - pos%8) % 8; pad > 0 {
+		_, err = io.CopyN(ioutil.Discard, r, pad)
+		if err != nil {
+			return nil, fmt.Errorf("yum: could not read RPM signature: %v", err)
+		}
+		pos += pad
+	}
+
+	hdr, err := readRPMHeaderSection(r, pos)
+	if err != nil {
+		return nil, fmt.Errorf("yum: could not read RPM header: %v", err)
+	}
+	return hdr, nil
+}
+
+// readRPMHeaderSection reads a header structure starting at offset pos.
+func readRPMHeaderSection(r io.Reader, pos int64) (*RPMHeader, error) {
+	var intro [16]byte
+	_, err := io.ReadFull(r, intro[:])
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(intro[:4], rpmHeaderMagic) {
+		return nil, fmt.Errorf("invalid header magic")
+	}
+	nindex := binary.BigEndian.Uint32(intro[8:12])
+	hsize := binary.BigEndian.Uint32(intro[12:16])
+	if nindex > 1<<16 || hsize > 1<<28 {
+		return nil, fmt.Errorf("invalid header size (entries=%d, size=%d)", nindex, hsize)
+	}
+
+	index := make([]byte, 16*nindex)
+	_, err = io.ReadFull(r, index)
+	if err != nil {
+		return nil, err
+	}
+	store := make([]byte, hsize)
+	_, err = io.ReadFull(r, store)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := &RPMHeader{
+		Start: pos,
+		End:   pos + 16 + int64(len(index)) + int64(hsize),
+		tags:  make(map[int]rpmTag, nindex),
+	}
+	for i := 0; i < int(nindex); i++ {
+		e := index[16*i : 16*(i+1)]
+		tag := int(binary.BigEndian.Uint32(e[0:4]))
+		typ := int(binary.BigEndian.Uint32(e[4:8]))
+		off := binary.BigEndian.Uint32(e[8:12])
+		count := int(binary.BigEndian.Uint32(e[12:16]))
+		if off > hsize {
+			return nil, fmt.Errorf("invalid offset for tag %d", tag)
+		}
+		t := rpmTag{typ: typ, count: count, data: store[off:]}
+		err = t.check()
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %d: %v", tag, err)
+		}
+		hdr.tags[tag] = t
+	}
+	return hdr, nil
+}
+
+// check checks the values of the tag fit in its data.
+func (t rpmTag) check() error {
+	size := 0
+	switch t.typ {
+	case rpmTypeChar, rpmTypeInt8, rpmTypeBin:
+		size = 1
+	case rpmTypeInt16:
+		size = 2
+	case rpmTypeInt32:
+		size = 4
+	case rpmTypeInt64:
+		size = 8
+	case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+		// each string takes at least its NUL terminator
+		size = 1
+	default:
+		return nil
+	}
+	if t.count < 0 || t.count > len(t.data)/size {
+		return fmt.Errorf("%d value(s) of type %d do not fit in %d bytes", t.count, t.typ, len(t.data))
+	}
+	return nil
+}
+
+// Has returns whether the header holds tag.
+func (hdr *RPMHeader) Has(tag int) bool {
+	_, ok := hdr.tags[tag]
+	return ok
+}
+
+// String returns the value of a string tag.
+func (hdr *RPMHeader) String(tag int) string {
+	strs := hdr.Strings(tag)
+	if len(strs) == 0 {
+		return ""
+	}
+	return strs[0]
+}
+
+// Strings returns the values of a string array tag.
+func (hdr *RPMHeader) Strings(tag int) []string {
+	t, ok := hdr.tags[tag]
+	if !ok {
+		return nil
+	}
+	switch t.typ {
+	case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+	default:
+		return nil
+	}
+	count := t.count
+	if t.typ == rpmTypeString {
+		count = 1
+	}
+	if count > len(t.data) {
+		count = len(t.data)
+	}
+	strs := make([]string, 0, count)
+	data := t.data
+	for i := 0; i < count; i++ {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			break
+		}
+		strs = append(strs, string(data[:end]))
+		data = data[end+1:]
+	}
+	return strs
+}
+
+// Int returns the value of an integer tag.
+func (hdr *RPMHeader) Int(tag int) int64 {
+	vs := hdr.Ints(tag)
+	if len(vs) == 0 {
+		return 0
+	}
+	return vs[0]
+}
+
+// Ints returns the values of an integer array tag.
+func (hdr *RPMHeader) Ints(tag int) []int64 {
+	t, ok := hdr.tags[tag]
+	if !ok {
+		return nil
+	}
+	size := 0
+	switch t.typ {
+	case rpmTypeChar, rpmTypeInt8:
+		size = 1
+	case rpmTypeInt16:
+		size = 2
+	case rpmTypeInt32:
+		size = 4
+	case rpmTypeInt64:
+		size = 8
+	default:
+		return nil
+	}
+	if t.count < 0 || len(t.data)/size < t.count {
+		return nil
+	}
+	vs := make([]int64, t.count)
+	for i := range vs {
+		b := t.data[i*size : (i+1)*size]
+		switch size {
+		case 1:
+			vs[i] = int64(b[0])
+		case 2:
+			vs[i] = int64(binary.BigEndian.Uint16(b))
+		case 4:
+			vs[i] = int64(binary.BigEndian.Uint32(b))
+		case 8:
+			vs[i] = int64(binary.BigEndian.Uint64(b))
+		}
+	}
+	return vs
+}
+
+// Files returns the paths of the files held by the package.
+func (hdr *RPMHeader) Files() []string {
+	if !hdr.Has(rpmTagBaseNames) {
+		return hdr.Strings(rpmTagOldFilenames)
+	}
+	names := hdr.Strings(rpmTagBaseNames)
+	dirs := hdr.Strings(rpmTagDirNames)
+	idx := hdr.Ints(rpmTagDirIndexes)
+	files := make([]string, 0, len(names))
+	for i, name := range names {
+		if i >= len(idx) || int(idx[i]) >= len(dirs) {
+			break
+		}
+		files = append(files, dirs[idx[i]]+name)
+	}
+	return files
+}
+
+// EOF
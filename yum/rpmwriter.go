@@ -0,0 +1,664 @@
+package yum
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RPMSpec describes a binary RPM package, as written by WriteRPM.
+type RPMSpec struct {
+	Name        string
+	Version     string
+	Release     string
+	Arch        string
+	Summary     string
+	Description string
+	License     string
+	Group       string
+	URL         string
+	BuildHost   string    // defaults to the name of the host
+	BuildTime   time.Time // defaults to now
+
+	// Prefixes lists the directories under which the package may be
+	// relocated. All the files must be under one of them.
+	Prefixes []string
+
+	Provides []RPMDep // the package always provides itself
+	Requires []RPMDep
+	Files    []RPMFile
+}
+
+// RPMDep is a dependency of a RPM package.
+type RPMDep struct {
+	Name    string
+	Flags   string // comparison operator: "", EQ, LT, LE, GT or GE
+	Version string // [epoch:]version[-release]
+}
+
+// RPMFile is a file of a RPM package: a regular file, a directory or a
+// symbolic link, depending on its Mode.
+type RPMFile struct {
+	Name  string // absolute path of the installed file
+	Mode  os.FileMode
+	MTime time.Time // defaults to the build time
+	Data  []byte    // content of a regular file
+	Path  string    // file holding the content of a regular file, instead of Data
+	Link  string    // target of a symbolic link
+}
+
+// rpmMaxSize is the maximum size of a file, and of the whole archive, the
+// 32-bit tags of a RPM header can describe.
+const rpmMaxSize = 1<<32 - 1
+
+// rpmSenseOps maps comparison operators to RPM dependency flags
+var rpmSenseOps = map[string]int{
+	"":   0,
+	"EQ": rpmSenseEqual,
+	"LT": rpmSenseLess,
+	"LE": rpmSenseLess | rpmSenseEqual,
+	"GT": rpmSenseGreater,
+	"GE": rpmSenseGreater | rpmSenseEqual,
+}
+
+// features of rpm the packages written by WriteRPM rely on
+var rpmLibRequires = []RPMDep{
+	{Name: "rpmlib(CompressedFileNames)", Flags: "LE", Version: "3.0.4-1"},
+	{Name: "rpmlib(PayloadFilesHavePrefix)", Flags: "LE", Version: "4.0-1"},
+}
+
+// WriteRPM writes to w the RPM file of the package described by spec, with a
+// gzip-compressed cpio payload.
+// The payload is staged in a temporary file, so the content of the files read
+// from their Path is never held in memory. Files and archives larger than
+// 4 GiB are rejected.
+func WriteRPM(w io.Writer, spec *RPMSpec) error {
+	defaults := *spec
+	spec = &defaults
+	if spec.BuildTime.IsZero() {
+		spec.BuildTime = time.Now()
+	}
+	if spec.BuildHost == "" {
+		spec.BuildHost, _ = os.Hostname()
+	}
+
+	files, err := spec.sortedFiles()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile("", "lbpkr-rpm-payload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	payload, err := writeRPMPayload(tmp, files)
+	if err != nil {
+		return err
+	}
+	if payload.archiveSize > rpmMaxSize || payload.size > rpmMaxSize {
+		return fmt.Errorf("yum: payload of RPM %s too large (%d bytes, max 4 GiB)", spec.Name, payload.archiveSize)
+	}
+
+	hdr, err := spec.header(files, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	sig, err := spec.signature(hdr, tmp, payload)
+	if err != nil {
+		return err
+	}
+
+	var lead [rpmLeadSize]byte
+	copy(lead[:], rpmLeadMagic)
+	lead[4] = 3                             // major version of the format
+	binary.BigEndian.PutUint16(lead[6:], 0) // binary package
+	binary.BigEndian.PutUint16(lead[8:], 1) // architecture
+	nvr := []byte(spec.Name + "-" + spec.Version + "-" + spec.Release)
+	if len(nvr) > 65 {
+		nvr = nvr[:65]
+	}
+	copy(lead[10:76], nvr)
+	binary.BigEndian.PutUint16(lead[76:], 1) // operating system
+	binary.BigEndian.PutUint16(lead[78:], 5) // header-style signature
+
+	for _, data := range [][]byte{lead[:], sig, hdr} {
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, tmp)
+	return err
+}
+
+// sortedFiles returns the files of the package, sorted by path as rpm
+// expects, once checked.
+func (spec *RPMSpec) sortedFiles() ([]RPMFile, error) {
+	files := make([]RPMFile, len(spec.Files))
+	copy(files, spec.Files)
+	sort.Sort(rpmFilesByName(files))
+
+	var total int64
+	for i, f := range files {
+		if f.MTime.IsZero() {
+			files[i].MTime = spec.BuildTime
+		}
+		if !path.IsAbs(f.Name) || path.Clean(f.Name) != f.Name {
+			return nil, fmt.Errorf("yum: invalid file name %q in RPM %s", f.Name, spec.Name)
+		}
+		if i > 0 && files[i-1].Name == f.Name {
+			return nil, fmt.Errorf("yum: duplicate file %q in RPM %s", f.Name, spec.Name)
+		}
+		switch {
+		case f.Mode.IsDir(), f.Mode.IsRegular(), f.Mode&os.ModeSymlink != 0:
+		default:
+			return nil, fmt.Errorf("yum: unsupported type of file %q in RPM %s", f.Name, spec.Name)
+		}
+		size, err := f.size()
+		if err != nil {
+			return nil, err
+		}
+		if size > rpmMaxSize {
+			return nil, fmt.Errorf("yum: file %q of RPM %s too large (%d bytes, max 4 GiB)", f.Name, spec.Name, size)
+		}
+		total += size
+		if total > rpmMaxSize {
+			return nil, fmt.Errorf("yum: files of RPM %s too large (more than 4 GiB)", spec.Name)
+		}
+		if len(spec.Prefixes) == 0 {
+			continue
+		}
+		relocatable := false
+		for _, prefix := range spec.Prefixes {
+			if f.Name == prefix || strings.HasPrefix(f.Name, strings.TrimRight(prefix, "/")+"/") {
+				relocatable = true
+				break
+			}
+		}
+		if !relocatable {
+			return nil, fmt.Errorf("yum: file %q of RPM %s is not under the prefixes %v",
+				f.Name, spec.Name, spec.Prefixes,
+			)
+		}
+	}
+	return files, nil
+}
+
+type rpmFilesByName []RPMFile
+
+func (p rpmFilesByName) Len() int           { return len(p) }
+func (p rpmFilesByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p rpmFilesByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// size returns the size of the content of f
+func (f *RPMFile) size() (int64, error) {
+	switch {
+	case f.Mode.IsRegular() && f.Path != "":
+		fi, err := os.Stat(f.Path)
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	case f.Mode.IsRegular():
+		return int64(len(f.Data)), nil
+	case f.Mode&os.ModeSymlink != 0:
+		return int64(len(f.Link)), nil
+	}
+	return 0, nil
+}
+
+// open returns the content of f, as stored in the payload, and its size
+func (f *RPMFile) open() (io.ReadCloser, int64, error) {
+	switch {
+	case f.Mode.IsRegular() && f.Path != "":
+		r, err := os.Open(f.Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		fi, err := r.Stat()
+		if err != nil {
+			r.Close()
+			return nil, 0, err
+		}
+		return r, fi.Size(), nil
+	case f.Mode.IsRegular():
+		return ioutil.NopCloser(bytes.NewReader(f.Data)), int64(len(f.Data)), nil
+	case f.Mode&os.ModeSymlink != 0:
+		return ioutil.NopCloser(strings.NewReader(f.Link)), int64(len(f.Link)), nil
+	}
+	return ioutil.NopCloser(strings.NewReader("")), 0, nil
+}
+
+// unixMode returns the mode of f, as stat(2) does
+func (f *RPMFile) unixMode() int {
+	mode := int(f.Mode.Perm())
+	switch {
+	case f.Mode.IsDir():
+		mode |= 040000
+	case f.Mode&os.ModeSymlink != 0:
+		mode |= 0120000
+	default:
+		mode |= 0100000
+	}
+	if f.Mode&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if f.Mode&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if f.Mode&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// rpmPayload describes a payload written by writeRPMPayload
+type rpmPayload struct {
+	size        int64    // size of the compressed payload
+	archiveSize int64    // size of the uncompressed cpio archive
+	sizes       []int64  // size of the content of each file
+	digests     []string // MD5 digest of each regular file
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// writeRPMPayload writes to w the gzip-compressed cpio archive ("newc" format)
+// of files, streaming the content of each file.
+func writeRPMPayload(w io.Writer, files []RPMFile) (*rpmPayload, error) {
+	payload := &rpmPayload{
+		sizes:   make([]int64, len(files)),
+		digests: make([]string, len(files)),
+	}
+	compressed := &countingWriter{w: w}
+	zw, err := gzip.NewWriterLevel(compressed, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	archive := &countingWriter{w: zw}
+
+	pad := func() error {
+		_, err := archive.Write(make([]byte, (4-archive.n%4)%4))
+		return err
+	}
+	entry := func(ino int, name string, mode, nlink int, mtime time.Time, size int64) error {
+		_, err := fmt.Fprintf(archive, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			ino, mode, 0, 0, nlink, mtime.Unix(), size, 0, 0, 0, 0, len(name)+1, 0,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(archive, name+"\x00")
+		if err != nil {
+			return err
+		}
+		return pad()
+	}
+
+	for i := range files {
+		f := &files[i]
+		r, size, err := f.open()
+		if err != nil {
+			return nil, err
+		}
+		if size > rpmMaxSize {
+			r.Close()
+			return nil, fmt.Errorf("yum: file %q too large (%d bytes, max 4 GiB)", f.Name, size)
+		}
+		nlink := 1
+		if f.Mode.IsDir() {
+			nlink = 2
+		}
+		err = entry(i+1, "."+f.Name, f.unixMode(), nlink, f.MTime, size)
+		if err == nil {
+			h := md5.New()
+			_, err = io.CopyN(io.MultiWriter(archive, h), r, size)
+			if f.Mode.IsRegular() {
+				payload.digests[i] = hex.EncodeToString(h.Sum(nil))
+			}
+		}
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("yum: could not archive %q: %v", f.Name, err)
+		}
+		err = pad()
+		if err != nil {
+			return nil, err
+		}
+		payload.sizes[i] = size
+	}
+	err = entry(0, "TRAILER!!!", 0, 1, time.Unix(0, 0), 0)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	payload.size = compressed.n
+	payload.archiveSize = archive.n
+	return payload, nil
+}
+
+// header returns the (main) header of the package
+func (spec *RPMSpec) header(files []RPMFile, payload *rpmPayload) ([]byte, error) {
+	var hdr rpmHeaderWriter
+	hdr.addStrings(rpmTagHeaderI18NTable, []string{"C"})
+	hdr.addString(rpmTagName, spec.Name)
+	hdr.addString(rpmTagVersion, spec.Version)
+	hdr.addString(rpmTagRelease, spec.Release)
+	hdr.addI18NString(rpmTagSummary, spec.Summary)
+	hdr.addI18NString(rpmTagDescription, spec.Description)
+	hdr.addInt32s(rpmTagBuildTime, []int{int(spec.BuildTime.Unix())})
+	hdr.addString(rpmTagBuildHost, spec.BuildHost)
+	size := 0
+	for _, n := range payload.sizes {
+		size += int(n)
+	}
+	hdr.addInt32s(rpmTagSize, []int{size})
+	hdr.addString(rpmTagLicense, spec.License)
+	hdr.addI18NString(rpmTagGroup, spec.Group)
+	if spec.URL != "" {
+		hdr.addString(rpmTagURL, spec.URL)
+	}
+	hdr.addString(rpmTagOS, "linux")
+	hdr.addString(rpmTagArch, spec.Arch)
+	hdr.addString(rpmTagSourceRPM, spec.Name+"-"+spec.Version+"-"+spec.Release+".src.rpm")
+	hdr.addInt32s(rpmTagArchiveSize, []int{int(payload.archiveSize)})
+	hdr.addString(rpmTagPayloadFormat, "cpio")
+	hdr.addString(rpmTagPayloadCompr, "gzip")
+	hdr.addString(rpmTagPayloadFlags, "9")
+	if len(spec.Prefixes) > 0 {
+		hdr.addStrings(rpmTagPrefixes, spec.Prefixes)
+	}
+
+	provides := append([]RPMDep{{Name: spec.Name, Flags: "EQ", Version: spec.Version + "-" + spec.Release}}, spec.Provides...)
+	err := hdr.addDeps(rpmTagProvideName, rpmTagProvideFlags, rpmTagProvideVersion, provides, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = hdr.addDeps(rpmTagRequireName, rpmTagRequireFlags, rpmTagRequireVersion, rpmLibRequires, rpmSenseRPMLib)
+	if err != nil {
+		return nil, err
+	}
+	err = hdr.addDeps(rpmTagRequireName, rpmTagRequireFlags, rpmTagRequireVersion, spec.Requires, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) > 0 {
+		n := len(files)
+		var (
+			sizes    = make([]int, n)
+			modes    = make([]int, n)
+			zeros    = make([]int, n)
+			mtimes   = make([]int, n)
+			digests  = make([]string, n)
+			links    = make([]string, n)
+			owners   = make([]string, n)
+			devices  = make([]int, n)
+			inodes   = make([]int, n)
+			langs    = make([]string, n)
+			bases    = make([]string, n)
+			dindex   = make([]int, n)
+			dirs     []string
+			dirIndex = make(map[string]int)
+		)
+		for i, f := range files {
+			sizes[i] = int(payload.sizes[i])
+			modes[i] = f.unixMode()
+			mtimes[i] = int(f.MTime.Unix())
+			digests[i] = payload.digests[i]
+			links[i] = f.Link
+			owners[i] = "root"
+			devices[i] = 1
+			inodes[i] = i + 1
+
+			dir := path.Dir(f.Name)
+			if dir != "/" {
+				dir += "/"
+			}
+			j, ok := dirIndex[dir]
+			if !ok {
+				j = len(dirs)
+				dirIndex[dir] = j
+				dirs = append(dirs, dir)
+			}
+			dindex[i] = j
+			bases[i] = path.Base(f.Name)
+		}
+
+		hdr.addInt32s(rpmTagFileSizes, sizes)
+		hdr.addInt16s(rpmTagFileModes, modes)
+		hdr.addInt16s(rpmTagFileRDevs, zeros)
+		hdr.addInt32s(rpmTagFileMTimes, mtimes)
+		hdr.addStrings(rpmTagFileDigests, digests)
+		hdr.addStrings(rpmTagFileLinkTos, links)
+		hdr.addInt32s(rpmTagFileFlags, zeros)
+		hdr.addStrings(rpmTagFileUserName, owners)
+		hdr.addStrings(rpmTagFileGroupName, owners)
+		hdr.addInt32s(rpmTagFileDevices, devices)
+		hdr.addInt32s(rpmTagFileInodes, inodes)
+		hdr.addStrings(rpmTagFileLangs, langs)
+		hdr.addInt32s(rpmTagDirIndexes, dindex)
+		hdr.addStrings(rpmTagBaseNames, bases)
+		hdr.addStrings(rpmTagDirNames, dirs)
+	}
+
+	return hdr.bytes(rpmTagHeaderImmutable), nil
+}
+
+// signature returns the signature header of the package, padded to a multiple
+// of 8 bytes: the digests of the header and of the payload read from r.
+func (spec *RPMSpec) signature(hdr []byte, r io.Reader, payload *rpmPayload) ([]byte, error) {
+	size := int64(len(hdr)) + payload.size
+	if size > rpmMaxSize {
+		return nil, fmt.Errorf("yum: RPM %s too large (%d bytes, max 4 GiB)", spec.Name, size)
+	}
+
+	sha1sum := sha1.Sum(hdr)
+	sha256sum := sha256.Sum256(hdr)
+	md5sum := md5.New()
+	md5sum.Write(hdr)
+	_, err := io.Copy(md5sum, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig rpmHeaderWriter
+	sig.addString(rpmSigTagSHA1, hex.EncodeToString(sha1sum[:]))
+	sig.addString(rpmSigTagSHA256, hex.EncodeToString(sha256sum[:]))
+	sig.addInt32s(rpmSigTagSize, []int{int(size)})
+	sig.add(rpmSigTagMD5, rpmTypeBin, md5.Size, md5sum.Sum(nil))
+	sig.addInt32s(rpmSigTagPayloadSize, []int{int(payload.archiveSize)})
+
+	data := sig.bytes(rpmTagHeaderSignatures)
+	for len(data)%8 != 0 {
+		data = append(data, 0)
+	}
+	return data, nil
+}
+
+// rpmHeaderWriter builds the binary form of a RPM header
+type rpmHeaderWriter struct {
+	entries []rpmHeaderEntry
+}
+
+type rpmHeaderEntry struct {
+	tag   int
+	typ   int
+	count int
+	data  []byte
+}
+
+func (h *rpmHeaderWriter) add(tag, typ, count int, data []byte) {
+	h.entries = append(h.entries, rpmHeaderEntry{tag: tag, typ: typ, count: count, data: data})
+}
+
+func (h *rpmHeaderWriter) addString(tag int, v string) {
+	h.add(tag, rpmTypeString, 1, append([]byte(v), 0))
+}
+
+func (h *rpmHeaderWriter) addI18NString(tag int, v string) {
+	h.add(tag, rpmTypeI18NString, 1, append([]byte(v), 0))
+}
+
+// addStrings adds the string array vs to tag, or appends it to its values if tag
+// was already added.
+func (h *rpmHeaderWriter) addStrings(tag int, vs []string) {
+	var data []byte
+	for _, v := range vs {
+		data = append(data, v...)
+		data = append(data, 0)
+	}
+	h.merge(tag, rpmTypeStringArray, len(vs), data)
+}
+
+// addInt32s adds the values vs to tag, or appends them to its values if tag
+// was already added.
+func (h *rpmHeaderWriter) addInt32s(tag int, vs []int) {
+	data := make([]byte, 4*len(vs))
+	for i, v := range vs {
+		binary.BigEndian.PutUint32(data[4*i:], uint32(v))
+	}
+	h.merge(tag, rpmTypeInt32, len(vs), data)
+}
+
+func (h *rpmHeaderWriter) addInt16s(tag int, vs []int) {
+	data := make([]byte, 2*len(vs))
+	for i, v := range vs {
+		binary.BigEndian.PutUint16(data[2*i:], uint16(v))
+	}
+	h.merge(tag, rpmTypeInt16, len(vs), data)
+}
+
+func (h *rpmHeaderWriter) merge(tag, typ, count int, data []byte) {
+	for i := range h.entries {
+		e := &h.entries[i]
+		if e.tag == tag {
+			e.count += count
+			e.data = append(e.data, data...)
+			return
+		}
+	}
+	h.add(tag, typ, count, data)
+}
+
+// addDeps adds the dependencies deps, with the extra flags, to the name, flags
+// and version tags.
+func (h *rpmHeaderWriter) addDeps(nameTag, flagsTag, versionTag int, deps []RPMDep, flags int) error {
+	if len(deps) == 0 {
+		return nil
+	}
+	names := make([]string, len(deps))
+	versions := make([]string, len(deps))
+	vflags := make([]int, len(deps))
+	for i, dep := range deps {
+		op, ok := rpmSenseOps[dep.Flags]
+		if !ok {
+			return fmt.Errorf("yum: invalid flags %q for dependency %s", dep.Flags, dep.Name)
+		}
+		names[i] = dep.Name
+		versions[i] = dep.Version
+		vflags[i] = op | flags
+	}
+	h.addStrings(nameTag, names)
+	h.addInt32s(flagsTag, vflags)
+	h.addStrings(versionTag, versions)
+	return nil
+}
+
+// bytes returns the binary form of the header, with all the entries in the
+// region tagged with region.
+func (h *rpmHeaderWriter) bytes(region int) []byte {
+	entries := make([]rpmHeaderEntry, len(h.entries))
+	copy(entries, h.entries)
+	sort.Stable(rpmHeaderEntriesByTag(entries))
+
+	nindex := len(entries) + 1
+	var index, store bytes.Buffer
+	putEntry := func(tag, typ, offset, count int) {
+		for _, v := range []int{tag, typ, offset, count} {
+			binary.Write(&index, binary.BigEndian, uint32(v))
+		}
+	}
+
+	offsets := make([]int, len(entries))
+	for i, e := range entries {
+		align := 1
+		switch e.typ {
+		case rpmTypeInt16:
+			align = 2
+		case rpmTypeInt32:
+			align = 4
+		case rpmTypeInt64:
+			align = 8
+		}
+		for store.Len()%align != 0 {
+			store.WriteByte(0)
+		}
+		offsets[i] = store.Len()
+		store.Write(e.data)
+	}
+
+	// the region trailer refers back to the whole index
+	trailer := store.Len()
+	for _, v := range []int32{int32(region), rpmTypeBin, int32(-16 * nindex), 16} {
+		binary.Write(&store, binary.BigEndian, v)
+	}
+
+	putEntry(region, rpmTypeBin, trailer, 16)
+	for i, e := range entries {
+		putEntry(e.tag, e.typ, offsets[i], e.count)
+	}
+
+	var out bytes.Buffer
+	out.Write(rpmHeaderMagic)
+	out.Write(make([]byte, 4))
+	binary.Write(&out, binary.BigEndian, uint32(nindex))
+	binary.Write(&out, binary.BigEndian, uint32(store.Len()))
+	out.Write(index.Bytes())
+	out.Write(store.Bytes())
+	return out.Bytes()
+}
+
+type rpmHeaderEntriesByTag []rpmHeaderEntry
+
+func (p rpmHeaderEntriesByTag) Len() int           { return len(p) }
+func (p rpmHeaderEntriesByTag) Less(i, j int) bool { return p[i].tag < p[j].tag }
+func (p rpmHeaderEntriesByTag) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// EOF
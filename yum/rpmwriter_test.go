@@ -0,0 +1,262 @@
+package yum
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testRPMSpec = RPMSpec{
+	Name:        "TestW",
+	Version:     "1.2",
+	Release:     "3",
+	Arch:        "x86_64",
+	Summary:     "a test package",
+	Description: "a package written by WriteRPM",
+	License:     "GPL",
+	Group:       "LHCb",
+	BuildHost:   "localhost",
+	BuildTime:   time.Unix(1400000000, 0),
+	Prefixes:    []string{"/opt/w"},
+	Provides:    []RPMDep{{Name: "w-tools"}},
+	Requires:    []RPMDep{{Name: "TestA", Flags: "GE", Version: "1.0.0"}},
+	Files: []RPMFile{
+		{Name: "/opt/w/bin/w", Mode: 0755, Data: []byte("#!/bin/sh\necho w\n")},
+		{Name: "/opt/w/bin", Mode: os.ModeDir | 0755},
+		{Name: "/opt/w/share/w.txt", Mode: 0644, Data: []byte("hello")},
+		{Name: "/opt/w/bin/ww", Mode: os.ModeSymlink | 0777, Link: "w"},
+	},
+}
+
+// readCpio returns the content of the files of a "newc" cpio archive
+func readCpio(t *testing.T, data []byte) map[string]string {
+	files := make(map[string]string)
+	align := func(n int) int { return (n + 3) &^ 3 }
+	pos := 0
+	for {
+		if pos+110 > len(data) || string(data[pos:pos+6]) != "070701" {
+			t.Fatalf("invalid cpio entry at %d\n", pos)
+		}
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(data[pos+6+8*i:pos+14+8*i]), 16, 32)
+			if err != nil {
+				t.Fatalf("invalid cpio field: %v\n", err)
+			}
+			return int(v)
+		}
+		size, namesize := field(6), field(11)
+		name := string(data[pos+110 : pos+110+namesize-1])
+		pos = align(pos + 110 + namesize)
+		if name == "TRAILER!!!" {
+			return files
+		}
+		files[name] = string(data[pos : pos+size])
+		pos = align(pos + size)
+	}
+}
+
+func TestWriteRPM(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteRPM(&buf, &testRPMSpec)
+	if err != nil {
+		t.Fatalf("could not write RPM: %v\n", err)
+	}
+	data := buf.Bytes()
+
+	r := bytes.NewReader(data)
+	hdr, err := ReadRPMHeader(r)
+	if err != nil {
+		t.Fatalf("could not read RPM header: %v\n", err)
+	}
+
+	for _, table := range []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"name", hdr.String(rpmTagName), "TestW"},
+		{"version", hdr.String(rpmTagVersion), "1.2"},
+		{"release", hdr.String(rpmTagRelease), "3"},
+		{"arch", hdr.String(rpmTagArch), "x86_64"},
+		{"summary", hdr.String(rpmTagSummary), "a test package"},
+		{"buildtime", hdr.Int(rpmTagBuildTime), int64(1400000000)},
+		{"size", hdr.Int(rpmTagSize), int64(17 + 5 + 1)},
+		{"prefixes", hdr.Strings(rpmTagPrefixes), []string{"/opt/w"}},
+		{"files", hdr.Files(), []string{"/opt/w/bin", "/opt/w/bin/w", "/opt/w/bin/ww", "/opt/w/share/w.txt"}},
+		{"modes", hdr.Ints(rpmTagFileModes), []int64{040755, 0100755, 0120777, 0100644}},
+		{"links", hdr.Strings(rpmTagFileLinkTos), []string{"", "", "w", ""}},
+		{"provides", hdr.Strings(rpmTagProvideName), []string{"TestW", "w-tools"}},
+		{"provide-versions", hdr.Strings(rpmTagProvideVersion), []string{"1.2-3", ""}},
+		{"requires", hdr.Strings(rpmTagRequireName), []string{
+			"rpmlib(CompressedFileNames)", "rpmlib(PayloadFilesHavePrefix)", "TestA",
+		}},
+		{"require-flags", hdr.Ints(rpmTagRequireFlags), []int64{
+			rpmSenseLess | rpmSenseEqual | rpmSenseRPMLib,
+			rpmSenseLess | rpmSenseEqual | rpmSenseRPMLib,
+			rpmSenseGreater | rpmSenseEqual,
+		}},
+	} {
+		if !reflect.DeepEqual(table.got, table.want) {
+			t.Errorf("expected %s=%v. got=%v\n", table.name, table.want, table.got)
+		}
+	}
+
+	// the signature holds the digests of the header and of the payload
+	sig, err := readRPMHeaderSection(bytes.NewReader(data[rpmLeadSize:]), rpmLeadSize)
+	if err != nil {
+		t.Fatalf("could not read RPM signature: %v\n", err)
+	}
+	sha1sum := sha1.Sum(data[hdr.Start:hdr.End])
+	if got, want := sig.String(rpmSigTagSHA1), hex.EncodeToString(sha1sum[:]); got != want {
+		t.Errorf("invalid header SHA1. got=%s, want=%s\n", got, want)
+	}
+	if got, want := sig.Int(rpmSigTagSize), int64(len(data))-hdr.Start; got != want {
+		t.Errorf("invalid signature size. got=%d, want=%d\n", got, want)
+	}
+	md5sum := md5.Sum(data[hdr.Start:])
+	if got := sig.tags[rpmSigTagMD5].data[:md5.Size]; !bytes.Equal(got, md5sum[:]) {
+		t.Errorf("invalid MD5. got=%x, want=%x\n", got, md5sum)
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("could not open payload: %v\n", err)
+	}
+	archive, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("could not read payload: %v\n", err)
+	}
+	if got, want := hdr.Int(rpmTagArchiveSize), int64(len(archive)); got != want {
+		t.Errorf("invalid archive size. got=%d, want=%d\n", got, want)
+	}
+	files := readCpio(t, archive)
+	want := map[string]string{
+		"./opt/w/bin":         "",
+		"./opt/w/bin/w":       "#!/bin/sh\necho w\n",
+		"./opt/w/bin/ww":      "w",
+		"./opt/w/share/w.txt": "hello",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("invalid payload.\ngot= %v\nwant=%v\n", files, want)
+	}
+	digest := md5.Sum([]byte("hello"))
+	if got := hdr.Strings(rpmTagFileDigests)[3]; got != hex.EncodeToString(digest[:]) {
+		t.Errorf("invalid digest for w.txt: %s\n", got)
+	}
+
+	// validate with rpm itself, when available
+	if _, err := exec.LookPath("rpm"); err != nil {
+		return
+	}
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-rpmwriter-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	fname := filepath.Join(tmpdir, "TestW-1.2-3.x86_64.rpm")
+	err = ioutil.WriteFile(fname, data, 0644)
+	if err != nil {
+		t.Fatalf("could not write RPM: %v\n", err)
+	}
+	for _, args := range [][]string{{"-qip", fname}, {"-qlp", fname}, {"-K", "--nosignature", fname}} {
+		out, err := exec.Command("rpm", args...).CombinedOutput()
+		if err != nil {
+			t.Errorf("rpm %v failed: %v\n%s\n", args, err, out)
+		}
+	}
+}
+
+func TestWriteRPMInvalid(t *testing.T) {
+	for _, files := range [][]RPMFile{
+		{{Name: "opt/w/a", Mode: 0644}},
+		{{Name: "/opt/w/a/../b", Mode: 0644}},
+		{{Name: "/opt/w/a", Mode: 0644}, {Name: "/opt/w/a", Mode: 0644}},
+		{{Name: "/usr/bin/a", Mode: 0644}},
+		{{Name: "/opt/w/fifo", Mode: os.ModeNamedPipe | 0644}},
+	} {
+		spec := testRPMSpec
+		spec.Files = files
+		err := WriteRPM(ioutil.Discard, &spec)
+		if err == nil {
+			t.Errorf("expected an error for files %v\n", files)
+		}
+	}
+
+	spec := testRPMSpec
+	spec.Requires = []RPMDep{{Name: "TestA", Flags: "GTE", Version: "1"}}
+	if err := WriteRPM(ioutil.Discard, &spec); err == nil {
+		t.Errorf("expected an error for invalid dependency flags\n")
+	}
+}
+
+func TestWriteRPMPath(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-rpmwriter-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	small := filepath.Join(tmpdir, "small")
+	err = ioutil.WriteFile(small, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatalf("could not create file: %v\n", err)
+	}
+
+	spec := testRPMSpec
+	spec.Files = []RPMFile{{Name: "/opt/w/small", Mode: 0644, Path: small}}
+	var buf bytes.Buffer
+	err = WriteRPM(&buf, &spec)
+	if err != nil {
+		t.Fatalf("could not write RPM: %v\n", err)
+	}
+	r := bytes.NewReader(buf.Bytes())
+	hdr, err := ReadRPMHeader(r)
+	if err != nil {
+		t.Fatalf("could not read RPM header: %v\n", err)
+	}
+	digest := md5.Sum([]byte("hello"))
+	if got, want := hdr.Strings(rpmTagFileDigests), []string{hex.EncodeToString(digest[:])}; !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid digests. got=%v, want=%v\n", got, want)
+	}
+	if got := hdr.Ints(rpmTagFileSizes); !reflect.DeepEqual(got, []int64{5}) {
+		t.Errorf("invalid sizes. got=%v\n", got)
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("could not open payload: %v\n", err)
+	}
+	archive, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("could not read payload: %v\n", err)
+	}
+	if got := readCpio(t, archive)["./opt/w/small"]; got != "hello" {
+		t.Errorf("invalid payload %q\n", got)
+	}
+
+	// files larger than what the 32-bit tags can describe are rejected
+	large := filepath.Join(tmpdir, "large")
+	err = ioutil.WriteFile(large, nil, 0644)
+	if err != nil {
+		t.Fatalf("could not create file: %v\n", err)
+	}
+	err = os.Truncate(large, 1<<32)
+	if err != nil {
+		t.Skipf("could not create a sparse file: %v\n", err)
+	}
+	spec.Files = []RPMFile{{Name: "/opt/w/large", Mode: 0644, Path: large}}
+	err = WriteRPM(ioutil.Discard, &spec)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected an error for a file larger than 4 GiB. got=%v\n", err)
+	}
+}
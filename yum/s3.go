@@ -0,0 +1,266 @@
+package yum
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sha256 of an empty payload
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Target publishes to a bucket of an S3-compatible object store, with
+// path-style requests signed with the AWS signature version 4.
+type s3Target struct {
+	endpoint url.URL
+	bucket   string
+	prefix   string // key prefix of the repository in the bucket
+	region   string
+
+	key    string // access key ID
+	secret string // secret access key
+	token  string // session token, if any
+
+	now func() time.Time
+}
+
+// newS3Target returns the target for u, a s3://bucket/prefix URL.
+// The endpoint and the region of the object store are taken from the
+// endpoint= and region= query parameters, and default to $AWS_ENDPOINT_URL
+// (or https://s3.amazonaws.com) and $AWS_REGION (or us-east-1).
+// The credentials are taken from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY
+// and $AWS_SESSION_TOKEN.
+func newS3Target(u *url.URL) (*s3Target, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("yum: no bucket in S3 target [%s]", u)
+	}
+	query := u.Query()
+	getenv := func(key, env, def string) string {
+		if v := query.Get(key); v != "" {
+			return v
+		}
+		if v := os.Getenv(env); v != "" {
+			return v
+		}
+		return def
+	}
+
+	endpoint, err := url.Parse(getenv("endpoint", "AWS_ENDPOINT_URL", "https://s3.amazonaws.com"))
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("yum: invalid S3 endpoint [%s]", endpoint)
+	}
+	endpoint.Path = strings.TrimRight(endpoint.Path, "/")
+
+	t := &s3Target{
+		endpoint: *endpoint,
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		region:   getenv("region", "AWS_REGION", "us-east-1"),
+		key:      os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret:   os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:    os.Getenv("AWS_SESSION_TOKEN"),
+		now:      time.Now,
+	}
+	if t.key == "" || t.secret == "" {
+		return nil, fmt.Errorf("yum: no S3 credentials (set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+	}
+	return t, nil
+}
+
+// urlOf returns the URL of the object for name
+func (t *s3Target) urlOf(name string) string {
+	key := name
+	if t.prefix != "" {
+		key = t.prefix + "/" + name
+	}
+	u := t.endpoint
+	u.Path = ""
+	return u.String() + s3Escape(t.endpoint.Path+"/"+t.bucket+"/"+key)
+}
+
+// s3Escape escapes p as S3 expects in canonical requests: all the bytes but the
+// unreserved characters of RFC 3986 and the slashes are percent-encoded.
+func s3Escape(p string) string {
+	const hexdigits = "0123456789ABCDEF"
+	out := make([]byte, 0, len(p))
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			out = append(out, c)
+		default:
+			out = append(out, '%', hexdigits[c>>4], hexdigits[c&15])
+		}
+	}
+	return string(out)
+}
+
+// do sends a signed request for name, with the content of the local file fname
+// as body (if not empty) and the extra headers hdr.
+// The response is closed, unless the status is http.StatusOK.
+func (t *s3Target) do(method, name, fname string, hdr http.Header) (*http.Response, error) {
+	hash := emptyPayloadHash
+	if fname != "" {
+		f, err := os.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+		sha := sha256.New()
+		_, err = io.Copy(sha, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		hash = hex.EncodeToString(sha.Sum(nil))
+	}
+
+	req, err := newFileRequest(method, t.urlOf(name), fname)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	t.sign(req, hash, t.now())
+	return sendRequest(req)
+}
+
+// sign signs req, with a payload of sha256 hash, at time now.
+// All the headers of req are signed, along with the host.
+func (t *s3Target) sign(req *http.Request, hash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", hash)
+	if t.token != "" {
+		req.Header.Set("X-Amz-Security-Token", t.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonical []string
+	canonical = append(canonical, req.Method, req.URL.EscapedPath(), req.URL.RawQuery)
+	for _, k := range names {
+		canonical = append(canonical, k+":"+headers[k])
+	}
+	signed := strings.Join(names, ";")
+	canonical = append(canonical, "", signed, hash)
+	creq := sha256.Sum256([]byte(strings.Join(canonical, "\n")))
+
+	scope := day + "/" + t.region + "/s3/aws4_request"
+	tosign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(creq[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+t.secret), day)
+	key = mac(key, t.region)
+	key = mac(key, "s3")
+	key = mac(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.key, scope, signed, hex.EncodeToString(mac(key, tosign)),
+	))
+}
+
+func (t *s3Target) error(method, name string, resp *http.Response) error {
+	return fmt.Errorf("yum: %s [%s] failed: %s", method, t.urlOf(name), resp.Status)
+}
+
+func (t *s3Target) Get(name, fname string) error {
+	resp, err := t.do("GET", name, "", nil)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		defer resp.Body.Close()
+		return writeFile(fname, resp.Body)
+	case http.StatusNotFound:
+		return errNotExist(name)
+	}
+	return t.error("GET", name, resp)
+}
+
+func (t *s3Target) Put(name, fname string) error {
+	return t.put(name, fname, nil)
+}
+
+// put uploads the local file fname to name, with the extra headers hdr.
+func (t *s3Target) put(name, fname string, hdr http.Header) error {
+	resp, err := t.do("PUT", name, fname, hdr)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// 409: a concurrent conditional write of the same object
+		return ErrConflict
+	}
+	return t.error("PUT", name, resp)
+}
+
+func (t *s3Target) Revision(name string) (string, error) {
+	resp, err := t.do("HEAD", name, "", nil)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return resp.Header.Get("ETag"), nil
+	case http.StatusNotFound:
+		return "", nil
+	}
+	return "", t.error("HEAD", name, resp)
+}
+
+func (t *s3Target) Replace(name, fname, rev string) error {
+	// objects are replaced atomically by S3, and conditional writes only
+	// succeed if the object still has the revision rev
+	return t.put(name, fname, conditionalHeader(rev))
+}
+
+func (t *s3Target) Delete(name string) error {
+	resp, err := t.do("DELETE", name, "", nil)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil
+	case http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return t.error("DELETE", name, resp)
+}
+
+// EOF
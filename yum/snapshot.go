@@ -0,0 +1,396 @@
+package yum
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// name of the directory, in a repository cache directory, holding the
+// snapshots of the metadata of the repository
+const snapshotsDir = "snapshots"
+
+// format of the IDs of the snapshots: the (UTC) time of the repository metadata
+const snapshotIDFormat = "20060102T150405Z"
+
+// layouts of the dates accepted to select a snapshot, besides snapshot IDs
+var snapshotDateLayouts = []string{
+	snapshotIDFormat,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// revisions usable as snapshot IDs
+var reSnapshotID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// RepoSnapshot is a copy of the metadata of a repository, as it was at a
+// given time. Snapshots are taken each time new metadata is downloaded, and
+// only the latest ones (snapshot_keep in yum.conf) are kept.
+type RepoSnapshot struct {
+	Repo      string    // name of the repository
+	ID        string    // identifier of the snapshot, derived from Timestamp
+	Revision  string    // revision of the repository metadata, if any
+	Timestamp time.Time // time the repository metadata was generated
+	Current   bool      // whether the snapshot is the metadata in use
+	Dir       string    // directory holding the snapshot
+}
+
+type repoSnapshots []RepoSnapshot
+
+func (p repoSnapshots) Len() int      { return len(p) }
+func (p repoSnapshots) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p repoSnapshots) Less(i, j int) bool {
+	if p[i].Repo != p[j].Repo {
+		return p[i].Repo < p[j].Repo
+	}
+	if !p[i].Timestamp.Equal(p[j].Timestamp) {
+		return p[i].Timestamp.Before(p[j].Timestamp)
+	}
+	return p[i].ID < p[j].ID
+}
+
+// Snapshot makes the Client use the snapshots of the repositories selected by
+// spec, a snapshot ID or a date, instead of their current metadata.
+// For a date, the latest snapshot taken at that date is used. Dates without a
+// time zone are in local time.
+// The remote repositories are not contacted for their metadata.
+func Snapshot(spec string) func(*Client) {
+	return func(yum *Client) {
+		yum.snapshot = spec
+	}
+}
+
+// SnapshotKeep sets the number of snapshots kept for each repository, besides
+// the one in use. All of them are kept if n <= 0.
+func SnapshotKeep(n int) func(*Client) {
+	return func(yum *Client) {
+		yum.snapkeep = n
+	}
+}
+
+// dbFiler is implemented by the backends keeping their DB in a file of the
+// repository cache directory.
+type dbFiler interface {
+	dbFile() string
+}
+
+func (repo *RepositorySQLiteBackend) dbFile() string {
+	return repo.PrimaryCompr
+}
+
+func (repo *RepositoryXMLBackend) dbFile() string {
+	return repo.Primary
+}
+
+// parseRepoMDInfo returns the revision and the time of the repository
+// metadata data: the latest timestamp of its files or, if none, the revision
+// if it is a UNIX time.
+func parseRepoMDInfo(data []byte) (string, time.Time, error) {
+	type xmlTree struct {
+		XMLName  xml.Name `xml:"repomd"`
+		Revision string   `xml:"revision"`
+		Data     []struct {
+			Timestamp float64 `xml:"timestamp"`
+		} `xml:"data"`
+	}
+
+	var tree xmlTree
+	err := xml.Unmarshal(data, &tree)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var stamp time.Time
+	for _, data := range tree.Data {
+		sec := int64(math.Floor(data.Timestamp))
+		if t := time.Unix(sec, 0); sec > 0 && t.After(stamp) {
+			stamp = t
+		}
+	}
+	if stamp.IsZero() {
+		if sec, err := strconv.ParseInt(tree.Revision, 10, 64); err == nil && sec > 0 {
+			stamp = time.Unix(sec, 0)
+		}
+	}
+	return tree.Revision, stamp, nil
+}
+
+// snapshotID returns the ID of the snapshot of a repository metadata with the
+// given revision and time
+func snapshotID(revision string, stamp time.Time) string {
+	switch {
+	case !stamp.IsZero():
+		return stamp.UTC().Format(snapshotIDFormat)
+	case reSnapshotID.MatchString(revision):
+		return revision
+	}
+	return time.Now().UTC().Format(snapshotIDFormat)
+}
+
+// saveSnapshot records the repository metadata data, together with the DB
+// file of the backend of the repository, unless it was already recorded.
+func (repo *Repository) saveSnapshot(data []byte) error {
+	db, ok := repo.Backend.(dbFiler)
+	if !ok {
+		return nil
+	}
+	revision, stamp, err := parseRepoMDInfo(data)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(repo.CacheDir, snapshotsDir, snapshotID(revision, stamp))
+	if path_exists(dir) {
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), ".snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	err = writeFile(filepath.Join(tmp, "repomd.xml"), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	err = copyFile(filepath.Join(tmp, filepath.Base(db.dbFile())), db.dbFile())
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp, 0755)
+	if err != nil {
+		return err
+	}
+	repo.msg.Debugf("snapshot of repository [%s] saved under [%s]\n", repo.Name, dir)
+	return os.Rename(tmp, dir)
+}
+
+// loadSnapshots returns the snapshots of the repository name, cached under
+// cachedir, sorted by time.
+func loadSnapshots(name, cachedir string) ([]RepoSnapshot, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(cachedir, snapshotsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	current := ""
+	if data, err := ioutil.ReadFile(filepath.Join(cachedir, "repomd.xml")); err == nil {
+		if revision, stamp, err := parseRepoMDInfo(data); err == nil {
+			current = snapshotID(revision, stamp)
+		}
+	}
+
+	snaps := make([]RepoSnapshot, 0, len(dirs))
+	for _, fi := range dirs {
+		if !fi.IsDir() || fi.Name()[0] == '.' {
+			continue
+		}
+		dir := filepath.Join(cachedir, snapshotsDir, fi.Name())
+		data, err := ioutil.ReadFile(filepath.Join(dir, "repomd.xml"))
+		if err != nil {
+			return nil, err
+		}
+		revision, stamp, err := parseRepoMDInfo(data)
+		if err != nil {
+			return nil, fmt.Errorf("yum: invalid snapshot [%s]: %v", dir, err)
+		}
+		snaps = append(snaps, RepoSnapshot{
+			Repo:      name,
+			ID:        fi.Name(),
+			Revision:  revision,
+			Timestamp: stamp,
+			Current:   fi.Name() == current,
+			Dir:       dir,
+		})
+	}
+	sort.Sort(repoSnapshots(snaps))
+	return snaps, nil
+}
+
+// findSnapshot returns the snapshot of the repository name, cached under
+// cachedir, selected by spec (see Snapshot).
+func findSnapshot(name, cachedir, spec string) (RepoSnapshot, error) {
+	snaps, err := loadSnapshots(name, cachedir)
+	if err != nil {
+		return RepoSnapshot{}, err
+	}
+	for _, snap := range snaps {
+		if snap.ID == spec {
+			return snap, nil
+		}
+	}
+
+	date, err := parseSnapshotDate(spec)
+	if err != nil {
+		return RepoSnapshot{}, err
+	}
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if !snaps[i].Timestamp.After(date) {
+			return snaps[i], nil
+		}
+	}
+	return RepoSnapshot{}, fmt.Errorf("yum: no snapshot of repository [%s] at %q", name, spec)
+}
+
+// OpenSnapshot returns the repository name, as recorded in its snapshot
+// selected by spec (see Snapshot). The repository is not one of the
+// repositories of the Client: it must be closed after use.
+func (yum *Client) OpenSnapshot(name, spec string) (*Repository, error) {
+	snap, err := findSnapshot(name, filepath.Join(yum.lbyumcache, name), spec)
+	if err != nil {
+		return nil, err
+	}
+
+	url := ""
+	yum.mux.RLock()
+	if cfg, ok := yum.repocfgs[name]; ok {
+		url = cfg.Url
+	}
+	yum.mux.RUnlock()
+
+	repo, err := newRepository(name+"@"+snap.ID, url, snap.Dir, DefaultBackends, true, false, yum.httpc)
+	if err != nil {
+		return nil, err
+	}
+	repo.msg.SetLevel(yum.msg.Level())
+	repo.Arches = CompatArches(yum.arch)
+	return repo, nil
+}
+
+// parseSnapshotDate parses the date spec. A day stands for its end.
+// Snapshot IDs are in UTC. The other dates without a time zone are in local
+// time, as displayed by 'lbpkr snapshot ls'.
+func parseSnapshotDate(spec string) (time.Time, error) {
+	for _, layout := range snapshotDateLayouts {
+		loc := time.Local
+		if layout == snapshotIDFormat {
+			loc = time.UTC
+		}
+		date, err := time.ParseInLocation(layout, spec, loc)
+		if err != nil {
+			continue
+		}
+		if len(spec) == len("2006-01-02") {
+			date = date.Add(24*time.Hour - time.Second)
+		}
+		return date, nil
+	}
+	return time.Time{}, fmt.Errorf("yum: invalid snapshot %q (not a snapshot ID nor a date)", spec)
+}
+
+// pruneSnapshots removes the snapshots of the repository name, cached under
+// cachedir, but the keep latest ones and the one in use, and returns the
+// removed snapshots. Nothing is removed if keep <= 0.
+func pruneSnapshots(name, cachedir string, keep int) ([]RepoSnapshot, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+	snaps, err := loadSnapshots(name, cachedir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []RepoSnapshot
+	for i := 0; i < len(snaps)-keep; i++ {
+		if snaps[i].Current {
+			continue
+		}
+		err = os.RemoveAll(snaps[i].Dir)
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, snaps[i])
+	}
+	return removed, nil
+}
+
+// PruneSnapshots removes the snapshots of the repositories cached under
+// siteroot (or of the repositories repos only), but the keep latest ones of
+// each repository and the ones in use, and returns the removed snapshots.
+func PruneSnapshots(siteroot string, keep int, repos ...string) ([]RepoSnapshot, error) {
+	if keep <= 0 {
+		return nil, fmt.Errorf("yum: invalid number of snapshots to keep (%d)", keep)
+	}
+	cachedir := lbyumCacheDir(siteroot)
+	if len(repos) == 0 {
+		dirs, err := ioutil.ReadDir(cachedir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			return nil, err
+		}
+		for _, fi := range dirs {
+			if fi.IsDir() {
+				repos = append(repos, fi.Name())
+			}
+		}
+	}
+
+	var removed []RepoSnapshot
+	for _, name := range repos {
+		snaps, err := pruneSnapshots(name, filepath.Join(cachedir, name), keep)
+		removed = append(removed, snaps...)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// RemoveSnapshot removes the snapshot of the repository name cached under
+// siteroot, selected by spec (see Snapshot), unless it is in use.
+func RemoveSnapshot(siteroot, name, spec string) (RepoSnapshot, error) {
+	snap, err := findSnapshot(name, filepath.Join(lbyumCacheDir(siteroot), name), spec)
+	if err != nil {
+		return snap, err
+	}
+	if snap.Current {
+		return snap, fmt.Errorf("yum: snapshot [%s] of repository [%s] is in use", snap.ID, name)
+	}
+	return snap, os.RemoveAll(snap.Dir)
+}
+
+// Snapshots returns the snapshots of the metadata of the repositories cached
+// under siteroot, sorted by repository and time.
+func Snapshots(siteroot string) ([]RepoSnapshot, error) {
+	cachedir := lbyumCacheDir(siteroot)
+	dirs, err := ioutil.ReadDir(cachedir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+	var snaps []RepoSnapshot
+	for _, fi := range dirs {
+		if !fi.IsDir() {
+			continue
+		}
+		s, err := loadSnapshots(fi.Name(), filepath.Join(cachedir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, s...)
+	}
+	return snaps, nil
+}
+
+// EOF
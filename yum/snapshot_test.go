@@ -0,0 +1,201 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gonuts/logger"
+)
+
+func TestSnapshots(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-snapshot-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dir := filepath.Join(tmpdir, "main")
+	siteroot := filepath.Join(tmpdir, "siteroot")
+	publish := func(rpms ...testRPM) {
+		writeTestRepo(t, dir, rpms...)
+	}
+
+	cfg := &RepoConfig{Name: "main", Url: "file://" + dir}
+	client := func(options ...func(*Client)) *Client {
+		options = append(options, Repositories(cfg))
+		client, err := newClient(siteroot, []string{"RepositoryXMLBackend"}, true, false, options...)
+		if err != nil {
+			t.Fatalf("could not create client: %v\n", err)
+		}
+		client.SetLevel(logger.ERROR)
+		return client
+	}
+	versions := func(client *Client) []string {
+		pkgs, err := client.ListPackages("TestA", "", "")
+		if err != nil {
+			t.Fatalf("could not list packages: %v\n", err)
+		}
+		var vers []string
+		for _, p := range pkgs {
+			vers = append(vers, p.Version())
+		}
+		return vers
+	}
+
+	publish(testRPMs...)
+	c := client()
+	c.Close()
+
+	snaps, err := Snapshots(siteroot)
+	if err != nil {
+		t.Fatalf("could not list snapshots: %v\n", err)
+	}
+	if len(snaps) != 1 || snaps[0].Repo != "main" || !snaps[0].Current {
+		t.Fatalf("expected 1 current snapshot of main. got=%#v\n", snaps)
+	}
+	first := snaps[0]
+
+	// metadata timestamps have a one second resolution
+	time.Sleep(1100 * time.Millisecond)
+
+	testA := testRPMs[0]
+	testA.version = "1.1.0"
+	publish(testA)
+	c = client(Refresh(true))
+	if got := versions(c); len(got) != 2 {
+		t.Errorf("expected 2 versions of TestA. got=%v\n", got)
+	}
+	c.Close()
+
+	snaps, err = Snapshots(siteroot)
+	if err != nil {
+		t.Fatalf("could not list snapshots: %v\n", err)
+	}
+	if len(snaps) != 2 {
+		t.Fatalf("expected 2 snapshots. got=%#v\n", snaps)
+	}
+	if snaps[0].ID != first.ID || snaps[0].Current || !snaps[1].Current {
+		t.Errorf("invalid snapshots: %#v\n", snaps)
+	}
+	if !snaps[0].Timestamp.Before(snaps[1].Timestamp) {
+		t.Errorf("snapshots not sorted by time: %#v\n", snaps)
+	}
+
+	for _, spec := range []string{
+		first.ID,
+		first.Timestamp.UTC().Format(time.RFC3339),
+		snaps[1].Timestamp.Add(-time.Second).UTC().Format(time.RFC3339),
+	} {
+		c = client(Snapshot(spec))
+		if got := versions(c); len(got) != 1 || got[0] != "1.0.0" {
+			t.Errorf("snapshot %q: expected TestA-1.0.0 only. got=%v\n", spec, got)
+		}
+		c.Close()
+	}
+
+	c = client(Snapshot(snaps[1].ID))
+	if got := versions(c); len(got) != 2 {
+		t.Errorf("expected 2 versions of TestA. got=%v\n", got)
+	}
+	c.Close()
+
+	// two snapshots can be opened side by side and compared
+	c = client()
+	var repos []*Repository
+	for _, spec := range []string{first.ID, snaps[1].Timestamp.UTC().Format(time.RFC3339)} {
+		repo, err := c.OpenSnapshot("main", spec)
+		if err != nil {
+			t.Fatalf("could not open snapshot %q: %v\n", spec, err)
+		}
+		defer repo.Close()
+		repos = append(repos, repo)
+	}
+	diffs := DiffRepositories(repos[0], repos[1])
+	if len(diffs) != 1 || diffs[0].Kind != DiffAdded || diffs[0].New != "TestA-1.1.0-1.x86_64" {
+		t.Errorf("invalid differences between snapshots: %#v\n", diffs)
+	}
+	if _, err := c.OpenSnapshot("main", "2000-01-01"); err == nil {
+		t.Errorf("expected an error for a date without snapshot\n")
+	}
+	c.Close()
+
+	for _, spec := range []string{"2000-01-01", "not-a-date"} {
+		_, err = newClient(siteroot, []string{"RepositoryXMLBackend"}, true, false,
+			Repositories(cfg), Snapshot(spec),
+		)
+		if err == nil {
+			t.Errorf("snapshot %q: expected an error\n", spec)
+		}
+	}
+
+	_, err = newClient(siteroot, []string{"RepositoryXMLBackend"}, true, false,
+		Repositories(cfg), Snapshot(first.ID), Refresh(true),
+	)
+	if err == nil {
+		t.Errorf("expected snapshot and refresh modes to be exclusive\n")
+	}
+
+	// only the latest snapshots are kept
+	time.Sleep(1100 * time.Millisecond)
+	testA.version = "1.2.0"
+	publish(testA)
+	c = client(Refresh(true), SnapshotKeep(2))
+	c.Close()
+	snaps, err = Snapshots(siteroot)
+	if err != nil {
+		t.Fatalf("could not list snapshots: %v\n", err)
+	}
+	if len(snaps) != 2 || snaps[0].ID == first.ID || !snaps[1].Current {
+		t.Fatalf("expected the 2 latest snapshots to be kept. got=%#v\n", snaps)
+	}
+
+	if _, err = RemoveSnapshot(siteroot, "main", snaps[1].ID); err == nil {
+		t.Errorf("expected an error removing the snapshot in use\n")
+	}
+	if _, err = RemoveSnapshot(siteroot, "main", snaps[0].ID); err != nil {
+		t.Errorf("could not remove snapshot: %v\n", err)
+	}
+	removed, err := PruneSnapshots(siteroot, 1)
+	if err != nil || len(removed) != 0 {
+		t.Errorf("expected nothing to prune. got=%v (err=%v)\n", removed, err)
+	}
+	if _, err = PruneSnapshots(siteroot, 0); err == nil {
+		t.Errorf("expected an error keeping no snapshot\n")
+	}
+	snaps, err = Snapshots(siteroot)
+	if err != nil {
+		t.Fatalf("could not list snapshots: %v\n", err)
+	}
+	if len(snaps) != 1 || !snaps[0].Current {
+		t.Errorf("expected the snapshot in use only. got=%#v\n", snaps)
+	}
+}
+
+func TestParseSnapshotDate(t *testing.T) {
+	for _, table := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"20141020T101530Z", time.Date(2014, 10, 20, 10, 15, 30, 0, time.UTC)},
+		{"2014-10-20T10:15:30Z", time.Date(2014, 10, 20, 10, 15, 30, 0, time.UTC)},
+		{"2014-10-20T10:15:30+02:00", time.Date(2014, 10, 20, 8, 15, 30, 0, time.UTC)},
+		{"2014-10-20 10:15", time.Date(2014, 10, 20, 10, 15, 0, 0, time.Local)},
+		{"2014-10-20", time.Date(2014, 10, 20, 23, 59, 59, 0, time.Local)},
+	} {
+		got, err := parseSnapshotDate(table.spec)
+		if err != nil {
+			t.Errorf("%q: %v\n", table.spec, err)
+			continue
+		}
+		if !got.Equal(table.want) {
+			t.Errorf("%q: expected %v. got=%v\n", table.spec, table.want, got)
+		}
+	}
+
+	if _, err := parseSnapshotDate("yesterday"); err == nil {
+		t.Errorf("expected an error\n")
+	}
+}
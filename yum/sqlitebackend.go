@@ -1,7 +1,6 @@
 package yum
 
 import (
-	"compress/bzip2"
 	"database/sql"
 	"fmt"
 	"io"
@@ -27,13 +26,12 @@ type RepositorySQLiteBackend struct {
 }
 
 func NewRepositorySQLiteBackend(repo *Repository) (*RepositorySQLiteBackend, error) {
-	const comprdbname = "primary.sqlite.bz2"
 	const dbname = "primary.sqlite"
-	primarycompr := filepath.Join(repo.CacheDir, comprdbname)
 	primary := filepath.Join(repo.CacheDir, dbname)
+	primarycompr := findCompressedDB(primary, ".bz2")
 	return &RepositorySQLiteBackend{
 		Name:         "RepositorySQLiteBackend",
-		DBNameCompr:  comprdbname,
+		DBNameCompr:  filepath.Base(primarycompr),
 		DBName:       dbname,
 		PrimaryCompr: primarycompr,
 		Primary:      primary,
@@ -71,6 +69,19 @@ func (repo *RepositorySQLiteBackend) YumDataType() string {
 // Download the DB from server
 func (repo *RepositorySQLiteBackend) GetLatestDB(url string) error {
 	var err error
+	suffix := compressionSuffix(url)
+	if suffix == "" {
+		suffix = ".bz2"
+	}
+	repo.PrimaryCompr = repo.Primary + suffix
+	repo.DBNameCompr = filepath.Base(repo.PrimaryCompr)
+
+	// make sure a stale DB with another compression is not picked up later on
+	err = removeCompressedDBs(repo.Primary, repo.PrimaryCompr)
+	if err != nil {
+		return err
+	}
+
 	repo.msg.Debugf("downloading latest version of SQLite DB\n")
 	tmp, err := ioutil.TempFile("", "lbpkr-sqlite-")
 	if err != nil {
@@ -79,7 +90,7 @@ func (repo *RepositorySQLiteBackend) GetLatestDB(url string) error {
 	defer tmp.Close()
 	defer os.RemoveAll(tmp.Name())
 
-	r, err := getRemoteData(url)
+	r, err := repo.Repository.openURL(url)
 	if err != nil {
 		return err
 	}
@@ -151,11 +162,12 @@ func (repo *RepositorySQLiteBackend) FindLatestMatchingName(name, version, relea
 	var pkg *Package
 	var err error
 
+	name, arches := repo.Repository.archesFor(name)
 	pkgs, err := repo.loadPackagesByName(name, version)
 	if err != nil {
 		return nil, err
 	}
-	matching := make(RPMSlice, 0, len(pkgs))
+	matching := make([]*Package, 0, len(pkgs))
 	req := NewRequires(name, version, release, "", "EQ", "")
 	for _, pkg := range pkgs {
 		if req.ProvideMatches(pkg) {
@@ -163,13 +175,11 @@ func (repo *RepositorySQLiteBackend) FindLatestMatchingName(name, version, relea
 		}
 	}
 
-	if len(matching) <= 0 {
-		err = fmt.Errorf("no such package %q", name)
+	pkg = latestPackage(matching, arches)
+	if pkg == nil {
+		err = fmt.Errorf("no such package %q for arch=%v", name, arches)
 		return nil, err
 	}
-
-	sort.Sort(matching)
-	pkg = matching[len(matching)-1].(*Package)
 	return pkg, nil
 }
 
@@ -180,6 +190,8 @@ func (repo *RepositorySQLiteBackend) FindLatestMatchingRequire(requirement *Requ
 
 	repo.msg.Debugf("looking for match for %v\n", requirement)
 
+	arches := repo.Repository.Arches
+
 	// list of all Provides with the same name
 	provides, err := repo.findProvidesByName(requirement.Name())
 	if err != nil {
@@ -199,34 +211,33 @@ func (repo *RepositorySQLiteBackend) FindLatestMatchingRequire(requirement *Requ
 		)
 	}
 
-	// now look-up the matching package
+	// now look-up the matching package, starting from the latest provides,
+	// until one is provided by a package of a compatible architecture.
 	sort.Sort(matching)
-	prov := matching[len(matching)-1].(*Provides)
-	pkgs, err := repo.loadPackagesProviding(prov)
-	if err != nil {
-		return nil, err
+	for i := len(matching) - 1; i >= 0; i-- {
+		prov := matching[i].(*Provides)
+		pkgs, err := repo.loadPackagesProviding(prov)
+		if err != nil {
+			return nil, err
+		}
+		pkg = latestPackage(pkgs, arches)
+		if pkg != nil {
+			break
+		}
 	}
 
-	if len(pkgs) <= 0 {
-		err = fmt.Errorf("no such package %q", requirement.Name())
+	if pkg == nil {
+		err = fmt.Errorf("no such package %q for arch=%v", requirement.Name(), arches)
 		return nil, err
 	}
 
-	matching = matching[:0]
-	for _, p := range pkgs {
-		matching = append(matching, p)
-	}
-
-	sort.Sort(matching)
-	pkg = matching[len(matching)-1].(*Package)
-
-	repo.msg.Debugf("found %d version matching - returning latest: %s.%s-%s\n", len(matching), pkg.Name(), pkg.Version(), pkg.Release())
+	repo.msg.Debugf("found %d version matching - returning latest: %s\n", len(matching), pkg.ID())
 	return pkg, err
 }
 
 // GetPackages returns all the packages known by a YUM repository
 func (repo *RepositorySQLiteBackend) GetPackages() []*Package {
-	query := "select pkgkey, name, version, release, epoch, rpm_group, arch, location_href from packages"
+	query := "select pkgkey, name, version, release, epoch, rpm_group, arch, location_href, checksum_type, pkgId from packages"
 	stmt, err := repo.db.Prepare(query)
 	if err != nil {
 		repo.msg.Errorf("db-error: %v\n", err)
@@ -287,6 +298,8 @@ func (repo *RepositorySQLiteBackend) newPackageFromScan(rows *sql.Rows) (*Packag
 	var group []byte
 	var arch []byte
 	var location []byte
+	var sumtype []byte
+	var checksum []byte
 	err := rows.Scan(
 		&pkgkey,
 		&name,
@@ -296,6 +309,8 @@ func (repo *RepositorySQLiteBackend) newPackageFromScan(rows *sql.Rows) (*Packag
 		&group,
 		&arch,
 		&location,
+		&sumtype,
+		&checksum,
 	)
 	if err != nil {
 		repo.msg.Errorf("scan error: %v\n", err)
@@ -309,6 +324,8 @@ func (repo *RepositorySQLiteBackend) newPackageFromScan(rows *sql.Rows) (*Packag
 	pkg.group = string(group)
 	pkg.arch = string(arch)
 	pkg.location = string(location)
+	pkg.sumtype = string(sumtype)
+	pkg.checksum = string(checksum)
 
 	err = repo.loadRequires(pkgkey, &pkg)
 	if err != nil {
@@ -399,7 +416,6 @@ func (repo *RepositorySQLiteBackend) loadRequires(pkgkey int, pkg *Package) erro
 	defer rows.Close()
 
 	for rows.Next() {
-		var req Requires
 		var name []byte
 		var version []byte
 		var release []byte
@@ -415,21 +431,15 @@ func (repo *RepositorySQLiteBackend) loadRequires(pkgkey int, pkg *Package) erro
 			return err
 		}
 
-		req.rpmBase.name = string(name)
-		req.rpmBase.version = string(version)
-		req.rpmBase.release = string(release)
-		req.rpmBase.epoch = string(epoch)
-		req.rpmBase.flags = string(flags)
-		req.pre = string(pre)
-
-		if err != nil {
-			return err
-		}
-
+		req := NewRequires(
+			string(name), string(version), string(release),
+			string(epoch), string(flags),
+			string(pre),
+		)
 		if req.rpmBase.flags == "" {
 			req.rpmBase.flags = "EQ"
 		}
-		pkg.requires = append(pkg.requires, &req)
+		pkg.requires = append(pkg.requires, req)
 
 	}
 	err = rows.Err()
@@ -454,7 +464,7 @@ func (repo *RepositorySQLiteBackend) loadPackagesByName(name, version string) ([
 	var err error
 	pkgs := make([]*Package, 0)
 	args := []interface{}{name}
-	query := "select pkgkey, name, version, release, epoch, rpm_group, arch, location_href" +
+	query := "select pkgkey, name, version, release, epoch, rpm_group, arch, location_href, checksum_type, pkgId" +
 		" from packages where name = ?"
 	if version != "" {
 		query += " and version = ?"
@@ -568,7 +578,7 @@ func (repo *RepositorySQLiteBackend) loadPackagesProviding(prov *Provides) ([]*P
 		prov.Name(),
 		prov.Version(),
 	}
-	query := `select p.pkgkey, p.name, p.version, p.release, p.epoch, p.rpm_group, p.arch, p.location_href
+	query := `select p.pkgkey, p.name, p.version, p.release, p.epoch, p.rpm_group, p.arch, p.location_href, p.checksum_type, p.pkgId
              from packages p, provides r
              where p.pkgkey = r.pkgkey
              and r.name = ?
@@ -618,7 +628,11 @@ func (repo *RepositorySQLiteBackend) loadPackagesProviding(prov *Provides) ([]*P
 // decompress decompresses src into dst
 func (repo *RepositorySQLiteBackend) decompress(dst io.Writer, src io.Reader) error {
 	var err error
-	r := bzip2.NewReader(src)
+	r, err := newDecompressor(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 	_, err = io.Copy(dst, r)
 	return err
 }
@@ -0,0 +1,358 @@
+package yum
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gonuts/logger"
+)
+
+// Sources of host capabilities
+const (
+	SysBuiltin = "builtin" // capabilities handled by rpm itself (rpmlib(...), /bin/sh)
+	SysConf    = "conf"    // capabilities declared in the sysprovides file
+	SysFiles   = "files"   // files present on the host
+	SysLibs    = "libs"    // shared libraries found in the ld.so paths
+	SysRpmDB   = "rpmdb"   // capabilities provided by the packages of the system rpmdb
+	SysAssumed = "assumed" // files and shared libraries, left to the hosts the packages get installed on
+)
+
+// DefaultSysSources is the default list of sources of host capabilities.
+var DefaultSysSources = []string{SysBuiltin, SysConf, SysFiles, SysLibs}
+
+// declaredSysSources are the sources of host capabilities taking precedence over
+// the repositories: the capabilities of the other sources are merely detected
+// on the host, and only used when no repository provides them.
+var declaredSysSources = []string{SysBuiltin, SysConf}
+
+// HostCapability describes a capability provided by the host system.
+type HostCapability struct {
+	Name   string // name of the capability (e.g. "libc.so.6()(64bit)")
+	Source string // source of the capability (builtin, conf, files, libs, rpmdb or assumed)
+	Origin string // where the capability was found (e.g. "/lib64/libc.so.6")
+}
+
+func (hc *HostCapability) String() string {
+	if hc.Origin == "" {
+		return fmt.Sprintf("%s [%s]", hc.Name, hc.Source)
+	}
+	return fmt.Sprintf("%s [%s: %s]", hc.Name, hc.Source, hc.Origin)
+}
+
+// SystemProvides detects the capabilities provided by the host system.
+// Detection is lazy: sources are only scanned when a requirement needs to be matched.
+type SystemProvides struct {
+	msg      *logger.Logger
+	root     string   // root of the host filesystem
+	sources  []string // enabled sources of capabilities
+	conffile string   // declarative list of host capabilities
+	rpmdb    string   // path to the system rpmdb
+
+	once sync.Once
+	mux  sync.Mutex
+	caps map[string][]hostProvides // declared (conf, rpmdb) capabilities
+	libs map[string][]string       // shared library name -> paths
+	vers map[string]map[string]bool
+}
+
+// NewSystemProvides returns a SystemProvides detecting host capabilities from
+// sources, with conffile as the declarative list of host capabilities.
+func NewSystemProvides(sources []string, conffile string) *SystemProvides {
+	sys := &SystemProvides{
+		msg:      logger.NewLogger("sysprovides", logger.INFO, stdout),
+		root:     "/",
+		sources:  make([]string, len(sources)),
+		conffile: conffile,
+		rpmdb:    "/var/lib/rpm",
+		caps:     make(map[string][]hostProvides),
+		libs:     make(map[string][]string),
+		vers:     make(map[string]map[string]bool),
+	}
+	copy(sys.sources, sources)
+	return sys
+}
+
+func (sys *SystemProvides) enabled(source string) bool {
+	return str_in_slice(source, sys.sources)
+}
+
+// Match returns the host capability satisfying req, or nil if the host does not provide it.
+func (sys *SystemProvides) Match(req *Requires) *HostCapability {
+	return sys.match(req, sys.sources)
+}
+
+// matchDeclared returns the host capability satisfying req from the builtin and
+// conf sources, or nil if there is none.
+func (sys *SystemProvides) matchDeclared(req *Requires) *HostCapability {
+	return sys.match(req, declaredSysSources)
+}
+
+// match returns the host capability satisfying req from the enabled sources
+// among sources, or nil if there is none.
+func (sys *SystemProvides) match(req *Requires, sources []string) *HostCapability {
+	sys.once.Do(sys.init)
+
+	enabled := func(source string) bool {
+		return sys.enabled(source) && str_in_slice(source, sources)
+	}
+
+	name := req.Name()
+	if enabled(SysBuiltin) && (strings.HasPrefix(name, "rpmlib(") || name == "/bin/sh") {
+		return &HostCapability{Name: name, Source: SysBuiltin}
+	}
+
+	for _, hp := range sys.caps[name] {
+		if enabled(hp.source) && req.ProvideMatches(hp.prov) {
+			return &HostCapability{Name: FormatCapability(hp.prov), Source: hp.source, Origin: hp.origin}
+		}
+	}
+
+	if enabled(SysFiles) && strings.HasPrefix(name, "/") {
+		if path_exists(filepath.Join(sys.root, name)) {
+			return &HostCapability{Name: name, Source: SysFiles, Origin: name}
+		}
+	}
+
+	if enabled(SysLibs) {
+		if path := sys.matchLib(name); path != "" {
+			return &HostCapability{Name: name, Source: SysLibs, Origin: path}
+		}
+	}
+
+	if enabled(SysAssumed) && isHostCapability(name) {
+		return &HostCapability{Name: name, Source: SysAssumed}
+	}
+	return nil
+}
+
+// isHostCapability returns whether the capability name is one a host provides
+// on its own (a file path or a shared library), as opposed to a package.
+func isHostCapability(name string) bool {
+	return strings.HasPrefix(name, "/") || reLibCap.MatchString(name)
+}
+
+// init loads the declared host capabilities and scans the ld.so paths.
+func (sys *SystemProvides) init() {
+	if sys.enabled(SysConf) && path_exists(sys.conffile) {
+		err := sys.loadConf()
+		if err != nil {
+			sys.msg.Warnf("could not load host capabilities from [%s]: %v\n", sys.conffile, err)
+		}
+	}
+
+	if sys.enabled(SysRpmDB) {
+		err := sys.loadRpmDB()
+		if err != nil {
+			sys.msg.Warnf("could not load host capabilities from rpmdb [%s]: %v\n", sys.rpmdb, err)
+		}
+	}
+
+	if sys.enabled(SysLibs) {
+		sys.scanLibs()
+	}
+}
+
+// hostProvides is a capability declared by the conf or rpmdb sources.
+type hostProvides struct {
+	prov   *Provides
+	source string
+	origin string
+}
+
+// addCapability registers a declared host capability.
+func (sys *SystemProvides) addCapability(str, source, origin string) error {
+	req, err := ParseCapability(str)
+	if err != nil {
+		return err
+	}
+	prov := NewProvides(req.Name(), req.Version(), req.Release(), req.Epoch(), req.Flags(), nil)
+	sys.caps[prov.Name()] = append(sys.caps[prov.Name()], hostProvides{prov, source, origin})
+	return nil
+}
+
+// loadConf loads the declarative list of host capabilities.
+// Each line holds a capability, e.g. "libGL.so.1()(64bit)" or "python = 2.7.5".
+// Lines starting with '#' are comments.
+func (sys *SystemProvides) loadConf() error {
+	f, err := os.Open(sys.conffile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for iline := 1; scan.Scan(); iline++ {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err = sys.addCapability(line, SysConf, sys.conffile)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", iline, err)
+		}
+	}
+	return scan.Err()
+}
+
+// loadRpmDB loads the capabilities provided by the packages of the system rpmdb.
+func (sys *SystemProvides) loadRpmDB() error {
+	rpm, err := exec.LookPath("rpm")
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command(
+		rpm, "--dbpath", sys.rpmdb, "-qa",
+		"--queryformat", "[%{PROVIDENAME} %{PROVIDEFLAGS:depflags} %{PROVIDEVERSION} %{NAME}\n]",
+	).Output()
+	if err != nil {
+		return err
+	}
+
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		toks := strings.Fields(scan.Text())
+		var str, origin string
+		switch len(toks) {
+		case 2:
+			str, origin = toks[0], toks[1]
+		case 4:
+			str, origin = strings.Join(toks[:3], " "), toks[3]
+		default:
+			continue
+		}
+		err = sys.addCapability(str, SysRpmDB, origin)
+		if err != nil {
+			sys.msg.Debugf("skipping rpmdb capability %q: %v\n", str, err)
+		}
+	}
+	return scan.Err()
+}
+
+// ldsoDirs returns the list of directories searched for shared libraries.
+func (sys *SystemProvides) ldsoDirs() []string {
+	dirs := []string{"/lib", "/lib64", "/usr/lib", "/usr/lib64"}
+
+	var parse func(fname string, depth int)
+	parse = func(fname string, depth int) {
+		if depth > 8 {
+			return
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(sys.root, fname))
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(buf), "\n") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "":
+				continue
+			case strings.HasPrefix(line, "include "):
+				pattern := strings.TrimSpace(line[len("include "):])
+				if !strings.HasPrefix(pattern, "/") {
+					pattern = filepath.Join(filepath.Dir(fname), pattern)
+				}
+				matches, _ := filepath.Glob(filepath.Join(sys.root, pattern))
+				for _, match := range matches {
+					rel, err := filepath.Rel(sys.root, match)
+					if err != nil {
+						continue
+					}
+					parse("/"+rel, depth+1)
+				}
+			case strings.HasPrefix(line, "/"):
+				dirs = append(dirs, line)
+			}
+		}
+	}
+	parse("/etc/ld.so.conf", 0)
+	return dirs
+}
+
+// scanLibs records the shared libraries found in the ld.so paths.
+func (sys *SystemProvides) scanLibs() {
+	for _, dir := range sys.ldsoDirs() {
+		fis, err := ioutil.ReadDir(filepath.Join(sys.root, dir))
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			name := fi.Name()
+			if fi.IsDir() || !strings.Contains(name, ".so") {
+				continue
+			}
+			sys.libs[name] = append(sys.libs[name], filepath.Join(dir, name))
+		}
+	}
+}
+
+// reLibCap matches the capabilities of shared libraries as generated by rpm,
+// e.g. "libc.so.6", "libc.so.6()(64bit)" or "libc.so.6(GLIBC_2.14)(64bit)".
+var reLibCap = regexp.MustCompile(`^([^()/ ]+\.so[^()/ ]*)(?:\(([^()]*)\))?(\(64bit\))?$`)
+
+// matchLib returns the path of the shared library providing the capability name,
+// or "" if there is none.
+func (sys *SystemProvides) matchLib(name string) string {
+	m := reLibCap.FindStringSubmatch(name)
+	if m == nil {
+		return ""
+	}
+	soname, version := m[1], m[2]
+	class := elf.ELFCLASS32
+	if m[3] != "" {
+		class = elf.ELFCLASS64
+	}
+
+	for _, path := range sys.libs[soname] {
+		f, err := elf.Open(filepath.Join(sys.root, path))
+		if err != nil {
+			continue
+		}
+		ok := f.Class == class
+		f.Close()
+		if !ok {
+			continue
+		}
+		if version == "" || sys.hasVersion(path, version) {
+			return path
+		}
+	}
+	return ""
+}
+
+// hasVersion returns whether the shared library at path defines the symbol version.
+func (sys *SystemProvides) hasVersion(path, version string) bool {
+	sys.mux.Lock()
+	defer sys.mux.Unlock()
+
+	vers, ok := sys.vers[path]
+	if !ok {
+		vers = make(map[string]bool)
+		f, err := elf.Open(filepath.Join(sys.root, path))
+		if err == nil {
+			syms, _ := f.DynamicSymbols()
+			for _, sym := range syms {
+				if sym.Section != elf.SHN_UNDEF && sym.Version != "" {
+					vers[sym.Version] = true
+				}
+			}
+			f.Close()
+		}
+		sys.vers[path] = vers
+	}
+	return vers[version]
+}
+
+// EOF
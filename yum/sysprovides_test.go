@@ -0,0 +1,285 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSystemProvidesConf(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	conf := filepath.Join(tmpdir, "sysprovides.conf")
+	err = ioutil.WriteFile(conf, []byte(`
+# host capabilities
+libGL.so.1()(64bit)
+python = 2.7.5-16
+`), 0644)
+	if err != nil {
+		t.Fatalf("could not create sysprovides file: %v\n", err)
+	}
+
+	sys := NewSystemProvides([]string{SysBuiltin, SysConf}, conf)
+	for _, table := range []struct {
+		req    *Requires
+		source string
+	}{
+		{NewRequires("rpmlib(CompressedFileNames)", "3.0.4", "1", "", "LE", ""), SysBuiltin},
+		{NewRequires("rpmlib(PayloadIsXz)", "5.2", "1", "", "LE", ""), SysBuiltin},
+		{NewRequires("/bin/sh", "", "", "", "", ""), SysBuiltin},
+		{NewRequires("libGL.so.1()(64bit)", "", "", "", "", ""), SysConf},
+		{NewRequires("python", "", "", "", "", ""), SysConf},
+		{NewRequires("python", "2.6", "", "", "GE", ""), SysConf},
+		{NewRequires("python", "3.0", "", "", "GE", ""), ""},
+		{NewRequires("libGL.so.1", "", "", "", "", ""), ""},
+		{NewRequires("/usr/bin/python", "", "", "", "", ""), ""},
+	} {
+		hc := sys.Match(table.req)
+		switch {
+		case hc == nil && table.source == "":
+			// ok
+		case hc == nil:
+			t.Errorf("%s: expected a host capability (source=%s)\n", table.req, table.source)
+		case hc.Source != table.source:
+			t.Errorf("%s: expected source=%q. got=%q (%v)\n", table.req, table.source, hc.Source, hc)
+		}
+	}
+}
+
+func TestSystemProvidesFilesAndLibs(t *testing.T) {
+	const libc = "/lib/x86_64-linux-gnu/libc.so.6"
+	if !path_exists(libc) {
+		t.Skipf("no %s on this host\n", libc)
+	}
+
+	root, err := ioutil.TempDir("", "lbpkr-yum-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{"etc/ld.so.conf.d", "opt/lib", "usr/bin"} {
+		err = os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			t.Fatalf("could not create dir: %v\n", err)
+		}
+	}
+	for fname, content := range map[string]string{
+		"etc/ld.so.conf":            "include ld.so.conf.d/*.conf\n",
+		"etc/ld.so.conf.d/opt.conf": "# optional libraries\n/opt/lib\n",
+		"usr/bin/python":            "#!/bin/true\n",
+	} {
+		err = ioutil.WriteFile(filepath.Join(root, fname), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("could not create file: %v\n", err)
+		}
+	}
+	err = os.Symlink(libc, filepath.Join(root, "opt", "lib", "libc.so.6"))
+	if err != nil {
+		t.Fatalf("could not create symlink: %v\n", err)
+	}
+
+	sys := NewSystemProvides([]string{SysFiles, SysLibs}, "")
+	sys.root = root
+
+	for _, table := range []struct {
+		name   string
+		origin string
+	}{
+		{"/usr/bin/python", "/usr/bin/python"},
+		{"/usr/bin/python3", ""},
+		{"/bin/sh", ""},
+		{"libc.so.6()(64bit)", "/opt/lib/libc.so.6"},
+		{"libc.so.6(GLIBC_2.2.5)(64bit)", "/opt/lib/libc.so.6"},
+		{"libc.so.6(GLIBC_0.0)(64bit)", ""},
+		{"libc.so.6", ""},
+		{"libm.so.6()(64bit)", ""},
+	} {
+		hc := sys.Match(NewRequires(table.name, "", "", "", "", ""))
+		switch {
+		case hc == nil && table.origin == "":
+			// ok
+		case hc == nil:
+			t.Errorf("%s: expected a host capability\n", table.name)
+		case hc.Origin != table.origin:
+			t.Errorf("%s: expected origin=%q. got=%q\n", table.name, table.origin, hc.Origin)
+		}
+	}
+}
+
+func TestHostProvidedDeps(t *testing.T) {
+	yum, err := getTestClient(t)
+	if err != nil {
+		t.Fatalf("could not create test repo: %v\n", err)
+	}
+	defer yum.Close()
+
+	pkg := NewPackage("HostDeps", "1.0.0", "1", "0")
+	pkg.requires = append(pkg.requires,
+		NewRequires("rpmlib(CompressedFileNames)", "3.0.4", "1", "", "LE", ""),
+		NewRequires("/bin/sh", "", "", "", "", ""),
+		NewRequires("TestPackage", "1.0.0", "1", "", "EQ", ""),
+	)
+
+	deps, err := yum.PackageDeps(pkg, -1)
+	if err != nil {
+		t.Fatalf("could not resolve deps: %v\n", err)
+	}
+	for _, dep := range deps {
+		if dep.Host() != nil {
+			t.Errorf("host capability %v listed as a dependency\n", dep.Host())
+		}
+	}
+
+	host := yum.HostProvided()
+	for _, req := range []string{"rpmlib(CompressedFileNames) <= 3.0.4-1", "/bin/sh"} {
+		hc, ok := host[req]
+		if !ok {
+			t.Errorf("requirement %q not reported as host-provided (%v)\n", req, host)
+			continue
+		}
+		if hc.Source != SysBuiltin {
+			t.Errorf("requirement %q: expected source=%q. got=%q\n", req, SysBuiltin, hc.Source)
+		}
+	}
+}
+
+func TestHostProvidedPrecedence(t *testing.T) {
+	yum, err := getTestClient(t)
+	if err != nil {
+		t.Fatalf("could not create test repo: %v\n", err)
+	}
+	defer yum.Close()
+
+	sys := NewSystemProvides([]string{SysBuiltin, SysConf, SysRpmDB}, "")
+	sys.once.Do(func() {})
+	for _, v := range [][2]string{
+		{"TestPackage = 1.0.0-1", SysRpmDB},
+		{"NoSuchPackage = 1.0", SysRpmDB},
+		{"TP2 = 1.2.5-2", SysConf},
+	} {
+		err = sys.addCapability(v[0], v[1], "test")
+		if err != nil {
+			t.Fatalf("could not add capability %q: %v\n", v[0], err)
+		}
+	}
+	yum.sysprov = sys
+
+	for _, table := range []struct {
+		req    *Requires
+		source string // expected host source, or "" for a repository package
+	}{
+		// detected on the host, but provided by the repository
+		{NewRequires("TestPackage", "1.0.0", "1", "", "EQ", ""), ""},
+		// detected on the host, not in the repository
+		{NewRequires("NoSuchPackage", "", "", "", "", ""), SysRpmDB},
+		// declared as provided by the host
+		{NewRequires("TP2", "1.2.5", "2", "", "EQ", ""), SysConf},
+		{NewRequires("/bin/sh", "", "", "", "", ""), SysBuiltin},
+	} {
+		pkg, err := yum.FindLatestMatchingRequire(table.req)
+		if err != nil {
+			t.Errorf("%s: could not find match: %v\n", table.req.ID(), err)
+			continue
+		}
+		switch hc := pkg.Host(); {
+		case hc == nil && table.source != "":
+			t.Errorf("%s: expected a host capability (source=%s). got=%s\n", table.req.ID(), table.source, pkg.ID())
+		case hc != nil && hc.Source != table.source:
+			t.Errorf("%s: expected source=%q. got=%v\n", table.req.ID(), table.source, hc)
+		}
+	}
+}
+
+func TestAssumedHostSources(t *testing.T) {
+	yum, err := getTestClient(t)
+	if err != nil {
+		t.Fatalf("could not create test repo: %v\n", err)
+	}
+	defer yum.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("could not locate test binary: %v\n", err)
+	}
+
+	// make TestPackage provide a library the host has as well
+	tp, err := yum.FindLatestProvider("TestPackage", "", "")
+	if err != nil {
+		t.Fatalf("could not find TestPackage: %v\n", err)
+	}
+	prov := NewProvides("libTest.so.1()(64bit)", "", "", "", "", tp)
+	tp.provides = append(tp.provides, prov)
+	backend := tp.Repository().Backend.(*RepositoryXMLBackend)
+	backend.Provides[prov.Name()] = append(backend.Provides[prov.Name()], prov)
+
+	sys := NewSystemProvides([]string{SysBuiltin, SysConf, SysLibs}, "")
+	sys.once.Do(func() {})
+	sys.libs["libTest.so.1"] = []string{exe}
+	sys.libs["libHost.so.1"] = []string{exe}
+	if sys.matchLib("libHost.so.1()(64bit)") == "" {
+		t.Skipf("test binary is not a 64b ELF file\n")
+	}
+	yum.sysprov = sys
+
+	pkg := NewPackage("HostLibs", "1.0.0", "1", "0")
+	pkg.requires = append(pkg.requires,
+		NewRequires("libTest.so.1()(64bit)", "", "", "", "", ""),
+		NewRequires("libHost.so.1()(64bit)", "", "", "", "", ""),
+	)
+
+	for _, table := range []struct {
+		sources []string
+		source  string // expected source of libHost.so.1
+	}{
+		{nil, SysLibs},
+		{[]string{SysBuiltin, SysConf, SysAssumed}, SysAssumed},
+	} {
+		if table.sources != nil {
+			yum.SetSystemSources(table.sources...)
+			yum.hostreqs = make(map[string]*HostCapability)
+		}
+
+		deps, err := yum.PackageDeps(pkg, -1)
+		if err != nil {
+			t.Fatalf("%v: could not resolve deps: %v\n", table.sources, err)
+		}
+		if len(deps) != 1 || deps[0] != tp {
+			t.Errorf("%v: expected deps=[%s]. got=%v\n", table.sources, tp.ID(), deps)
+		}
+
+		host := yum.HostProvided()
+		if hc := host["libTest.so.1()(64bit)"]; hc != nil {
+			t.Errorf("%v: shadowed requirement satisfied by the host (%v)\n", table.sources, hc)
+		}
+		hc := host["libHost.so.1()(64bit)"]
+		if hc == nil || hc.Source != table.source {
+			t.Errorf("%v: expected source=%q. got=%v\n", table.sources, table.source, hc)
+		}
+	}
+
+	// only files and shared libraries are assumed to be provided by the hosts
+	pkg.requires = append(pkg.requires,
+		NewRequires("/opt/host/bin/tool", "", "", "", "", ""),
+		NewRequires("NoSuchPackage", "", "", "", "", ""),
+	)
+	deps, err := yum.PackageDeps(pkg, -1)
+	if err == nil {
+		t.Errorf("expected an error resolving NoSuchPackage\n")
+	}
+	if len(deps) != 1 || deps[0] != tp {
+		t.Errorf("expected deps=[%s]. got=%v\n", tp.ID(), deps)
+	}
+	if hc := yum.HostProvided()["/opt/host/bin/tool"]; hc == nil || hc.Source != SysAssumed {
+		t.Errorf("expected /opt/host/bin/tool to be assumed. got=%v\n", hc)
+	}
+	unresolved := yum.Unresolved()
+	if len(unresolved) != 1 || len(unresolved["NoSuchPackage"]) != 1 || unresolved["NoSuchPackage"][0] != pkg.ID() {
+		t.Errorf("expected NoSuchPackage to be unresolved. got=%v\n", unresolved)
+	}
+}
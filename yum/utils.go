@@ -2,11 +2,26 @@ package yum
 
 import (
 	"io"
-	"net/http"
-	"net/url"
 	"os"
+	"sync"
 )
 
+// stdout is the writer shared by all the loggers of the package.
+// It may be used from multiple goroutines.
+var stdout io.Writer = &syncWriter{w: os.Stdout}
+
+// syncWriter serializes the writes to an underlying io.Writer.
+type syncWriter struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.w.Write(p)
+}
+
 func path_exists(name string) bool {
 	_, err := os.Stat(name)
 	if err == nil {
@@ -26,26 +41,3 @@ func str_in_slice(str string, slice []string) bool {
 	}
 	return false
 }
-
-func getRemoteData(rpath string) (io.ReadCloser, error) {
-	url, err := url.Parse(rpath)
-	if err != nil {
-		return nil, err
-	}
-
-	switch url.Scheme {
-	case "file":
-		f, err := os.Open(url.Path)
-		if err != nil {
-			return nil, err
-		}
-		return f, nil
-
-	default:
-		resp, err := http.Get(rpath)
-		if err != nil {
-			return nil, err
-		}
-		return resp.Body, nil
-	}
-}
@@ -1,13 +1,11 @@
 package yum
 
 import (
-	"compress/gzip"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
 
 	"github.com/gonuts/logger"
 )
@@ -24,13 +22,13 @@ type RepositoryXMLBackend struct {
 }
 
 func NewRepositoryXMLBackend(repo *Repository) (*RepositoryXMLBackend, error) {
-	const dbname = "primary.xml.gz"
+	primary := findCompressedDB(filepath.Join(repo.CacheDir, "primary.xml"), ".gz")
 	return &RepositoryXMLBackend{
 		Name:       "RepositoryXMLBackend",
 		Packages:   make(map[string][]*Package),
 		Provides:   make(map[string][]*Provides),
-		DBName:     dbname,
-		Primary:    filepath.Join(repo.CacheDir, dbname),
+		DBName:     filepath.Base(primary),
+		Primary:    primary,
 		Repository: repo,
 		msg:        repo.msg,
 	}, nil
@@ -49,13 +47,27 @@ func (repo *RepositoryXMLBackend) YumDataType() string {
 // Download the DB from server
 func (repo *RepositoryXMLBackend) GetLatestDB(url string) error {
 	var err error
+	suffix := compressionSuffix(url)
+	if suffix == "" {
+		suffix = ".gz"
+	}
+	base := filepath.Join(repo.Repository.CacheDir, "primary.xml")
+	repo.Primary = base + suffix
+	repo.DBName = filepath.Base(repo.Primary)
+
+	// make sure a stale DB with another compression is not picked up later on
+	err = removeCompressedDBs(base, repo.Primary)
+	if err != nil {
+		return err
+	}
+
 	out, err := os.Create(repo.Primary)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	r, err := getRemoteData(url)
+	r, err := repo.Repository.openURL(url)
 	if err != nil {
 		return err
 	}
@@ -74,78 +86,6 @@ func (repo *RepositoryXMLBackend) LoadDB() error {
 	var err error
 
 	repo.msg.Debugf("start parsing metadata XML file... (%s)\n", repo.Primary)
-	type xmlTree struct {
-		XMLName  xml.Name `xml:"metadata"`
-		Packages []struct {
-			Type string `xml:"type,attr"`
-			Name string `xml:"name"`
-			Arch string `xml:"arch"`
-
-			Version struct {
-				Epoch   string `xml:"epoch,attr"`
-				Version string `xml:"ver,attr"`
-				Release string `xml:"rel,attr"`
-			} `xml:"version"`
-
-			Checksum struct {
-				Value string `xml:",innerxml"`
-				Type  string `xml:"type,attr"`
-				PkgId string `xml:"pkgid,attr"`
-			} `xml:"checksum"`
-
-			Summary  string `xml:"summary"`
-			Descr    string `xml:"description"`
-			Packager string `xml:"packager"`
-			Url      string `xml:"url"`
-
-			Time struct {
-				File  string `xml:"file,attr"`
-				Build string `xml:"build,attr"`
-			} `xml:"time"`
-
-			Size struct {
-				Package   int64 `xml:"package,attr"`
-				Installed int64 `xml:"installed,attr"`
-				Archive   int64 `xml:"archive,attr"`
-			} `xml:"size"`
-
-			Location struct {
-				Href string `xml:"href,attr"`
-			} `xml:"location"`
-
-			Format struct {
-				License   string `xml:"license"`
-				Vendor    string `xml:"vendor"`
-				Group     string `xml:"group"`
-				BuildHost string `xml:"buildhost"`
-				SourceRpm string `xml:"sourcerpm"`
-
-				HeaderRange struct {
-					Beg int64 `xml:"start,attr"`
-					End int64 `xml:"end,attr"`
-				} `xml:"header-range"`
-
-				Provides []struct {
-					Name    string `xml:"name,attr"`
-					Flags   string `xml:"flags,attr"`
-					Epoch   string `xml:"epoch,attr"`
-					Version string `xml:"ver,attr"`
-					Release string `xml:"rel,attr"`
-				} `xml:"provides>entry"`
-
-				Requires []struct {
-					Name    string `xml:"name,attr"`
-					Flags   string `xml:"flags,attr"`
-					Epoch   string `xml:"epoch,attr"`
-					Version string `xml:"ver,attr"`
-					Release string `xml:"rel,attr"`
-					Pre     string `xml:"pre,attr"`
-				} `xml:"requires>entry"`
-
-				Files []string `xml:"file"`
-			} `xml:"format"`
-		} `xml:"package"`
-	}
 
 	// load the yum XML package list
 	f, err := os.Open(repo.Primary)
@@ -154,78 +94,220 @@ func (repo *RepositoryXMLBackend) LoadDB() error {
 	}
 	defer f.Close()
 
-	var r io.Reader
-	if rr, err := gzip.NewReader(f); err != nil {
-		if err != gzip.ErrHeader {
+	r, err := newDecompressor(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// stream through the document, one <package> at a time, so we never
+	// hold more than a single package worth of XML in memory.
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
 			return err
 		}
-		// perhaps not a compressed file after all...
-		_, err = f.Seek(0, 0)
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "package" {
+			continue
+		}
+
+		pkg, err := repo.decodePackage(dec)
 		if err != nil {
 			return err
 		}
-		r = f
-	} else {
-		r = rr
-		defer rr.Close()
+		repo.addPackage(pkg)
 	}
 
-	var tree xmlTree
-	err = xml.NewDecoder(r).Decode(&tree)
-	if err != nil {
-		return err
+	repo.msg.Debugf("start parsing metadata XML file... (%s) [done]\n", repo.Primary)
+	return nil
+}
+
+// addPackage registers pkg and its provides with the backend
+func (repo *RepositoryXMLBackend) addPackage(pkg *Package) {
+	pkg.repository = repo.Repository
+	for _, prov := range pkg.provides {
+		repo.Provides[prov.Name()] = append(repo.Provides[prov.Name()], prov)
 	}
 
-	for _, xml := range tree.Packages {
-		pkg := NewPackage(
-			xml.Name, xml.Version.Version, xml.Version.Release,
-			xml.Version.Epoch,
-		)
-		pkg.arch = xml.Arch
-		pkg.group = xml.Format.Group
-		pkg.location = xml.Location.Href
-		for _, v := range xml.Format.Provides {
-			prov := NewProvides(
-				v.Name,
-				v.Version,
-				v.Release,
-				v.Epoch,
-				v.Flags,
-				pkg,
-			)
-			pkg.provides = append(pkg.provides, prov)
-
-			if !str_in_slice(prov.Name(), IGNORED_PACKAGES) {
-				repo.Provides[prov.Name()] = append(repo.Provides[prov.Name()], prov)
+	// add package to repository
+	repo.Packages[pkg.Name()] = append(repo.Packages[pkg.Name()], pkg)
+	repo.msg.Debugf(
+		"(repo=%s) added package: %s.%s-%s\n",
+		repo.Primary,
+		pkg.Name(),
+		pkg.Version(),
+		pkg.Release(),
+	)
+}
+
+// decodePackage decodes the content of a <package> element, up to and
+// including its end element.
+// Elements lbpkr does not use (file lists, descriptions, ...) are skipped.
+func (repo *RepositoryXMLBackend) decodePackage(dec *xml.Decoder) (*Package, error) {
+	pkg := NewPackage("", "", "", "")
+	for {
+		tok, err := dec.RawToken()
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.EndElement:
+			return pkg, nil
+
+		case xml.StartElement:
+			switch tok.Name.Local {
+			case "name":
+				pkg.name, err = xmlText(dec)
+			case "arch":
+				pkg.arch, err = xmlText(dec)
+			case "version":
+				pkg.epoch = xmlAttr(tok, "epoch")
+				pkg.version = xmlAttr(tok, "ver")
+				pkg.release = xmlAttr(tok, "rel")
+				err = xmlSkip(dec)
+			case "location":
+				pkg.location = xmlAttr(tok, "href")
+				err = xmlSkip(dec)
+			case "checksum":
+				pkg.sumtype = xmlAttr(tok, "type")
+				pkg.checksum, err = xmlText(dec)
+			case "format":
+				err = repo.decodeFormat(dec, pkg)
+			default:
+				err = xmlSkip(dec)
+			}
+			if err != nil {
+				return nil, err
 			}
 		}
+	}
+}
 
-		for _, v := range xml.Format.Requires {
-			req := NewRequires(
-				v.Name,
-				v.Version,
-				v.Release,
-				v.Epoch,
-				v.Flags,
-				v.Pre,
-			)
-			pkg.requires = append(pkg.requires, req)
+// decodeFormat decodes the content of the <format> element of a package.
+func (repo *RepositoryXMLBackend) decodeFormat(dec *xml.Decoder, pkg *Package) error {
+	for {
+		tok, err := dec.RawToken()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.EndElement:
+			return nil
+
+		case xml.StartElement:
+			switch tok.Name.Local {
+			case "group":
+				pkg.group, err = xmlText(dec)
+			case "provides":
+				err = xmlEntries(dec, func(e xml.StartElement) {
+					pkg.provides = append(pkg.provides, NewProvides(
+						xmlAttr(e, "name"),
+						xmlAttr(e, "ver"),
+						xmlAttr(e, "rel"),
+						xmlAttr(e, "epoch"),
+						xmlAttr(e, "flags"),
+						pkg,
+					))
+				})
+			case "requires":
+				err = xmlEntries(dec, func(e xml.StartElement) {
+					pkg.requires = append(pkg.requires, NewRequires(
+						xmlAttr(e, "name"),
+						xmlAttr(e, "ver"),
+						xmlAttr(e, "rel"),
+						xmlAttr(e, "epoch"),
+						xmlAttr(e, "flags"),
+						xmlAttr(e, "pre"),
+					))
+				})
+			default:
+				err = xmlSkip(dec)
+			}
+			if err != nil {
+				return err
+			}
 		}
-		pkg.repository = repo.Repository
-
-		// add package to repository
-		repo.Packages[pkg.Name()] = append(repo.Packages[pkg.Name()], pkg)
-		repo.msg.Debugf(
-			"(repo=%s) added package: %s.%s-%s\n",
-			repo.Primary,
-			pkg.Name(),
-			pkg.Version(),
-			pkg.Release(),
-		)
 	}
+}
 
-	repo.msg.Debugf("start parsing metadata XML file... (%s) [done]\n", repo.Primary)
-	return err
+// xmlEntries calls fct for each <entry> child of the current element.
+func xmlEntries(dec *xml.Decoder, fct func(e xml.StartElement)) error {
+	for {
+		tok, err := dec.RawToken()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.EndElement:
+			return nil
+		case xml.StartElement:
+			if tok.Name.Local == "entry" {
+				fct(tok)
+			}
+			err = xmlSkip(dec)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// xmlText returns the character data of the current element.
+func xmlText(dec *xml.Decoder) (string, error) {
+	var str []byte
+	for {
+		tok, err := dec.RawToken()
+		if err != nil {
+			return "", err
+		}
+		switch tok := tok.(type) {
+		case xml.CharData:
+			str = append(str, tok...)
+		case xml.StartElement:
+			err = xmlSkip(dec)
+			if err != nil {
+				return "", err
+			}
+		case xml.EndElement:
+			return string(str), nil
+		}
+	}
+}
+
+// xmlSkip skips the remainder of the current element, including all its children.
+func xmlSkip(dec *xml.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.RawToken()
+		if err != nil {
+			return err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		}
+	}
+}
+
+// xmlAttr returns the value of the attribute named name.
+func xmlAttr(e xml.StartElement, name string) string {
+	for _, attr := range e.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
 }
 
 // FindLatestMatchingName locats a package by name, returns the latest available version.
@@ -233,6 +315,7 @@ func (repo *RepositoryXMLBackend) FindLatestMatchingName(name, version, release
 	var pkg *Package
 	var err error
 
+	name, arches := repo.Repository.archesFor(name)
 	pkgs, ok := repo.Packages[name]
 	if !ok {
 		repo.msg.Debugf("could not find package %q\n", name)
@@ -241,25 +324,22 @@ func (repo *RepositoryXMLBackend) FindLatestMatchingName(name, version, release
 
 	if version == "" && len(pkgs) > 0 {
 		// return latest
-		sorted := make([]*Package, len(pkgs))
-		copy(sorted, pkgs)
-		sort.Sort(Packages(sorted))
-		pkg = sorted[len(sorted)-1]
+		pkg = latestPackage(pkgs, arches)
 	} else {
 		// trying to match the requirements
 		req := NewRequires(name, version, release, "", "EQ", "")
-		sorted := make(Packages, 0, len(pkgs))
+		matching := make([]*Package, 0, len(pkgs))
 		for _, p := range pkgs {
 			if req.ProvideMatches(p) {
-				sorted = append(sorted, p)
+				matching = append(matching, p)
 			}
 		}
-		if len(sorted) > 0 {
-			sort.Sort(sorted)
-			pkg = sorted[len(sorted)-1]
-		}
+		pkg = latestPackage(matching, arches)
 	}
 
+	if pkg == nil {
+		return nil, fmt.Errorf("no such package %q for arch=%v", name, arches)
+	}
 	return pkg, err
 }
 
@@ -270,6 +350,7 @@ func (repo *RepositoryXMLBackend) FindLatestMatchingRequire(requirement *Require
 
 	repo.msg.Debugf("looking for match for %v\n", requirement)
 
+	arches := repo.Repository.Arches
 	pkgs, ok := repo.Provides[requirement.Name()]
 	if !ok {
 		repo.msg.Debugf("could not find package providing %s-%s\n", requirement.Name(), requirement.Version())
@@ -280,27 +361,28 @@ func (repo *RepositoryXMLBackend) FindLatestMatchingRequire(requirement *Require
 
 	if requirement.Version() == "" && len(pkgs) > 0 {
 		// return latest
-		sorted := make([]RPM, 0, len(pkgs))
-		for _, p := range pkgs {
-			sorted = append(sorted, p)
+		if prov := latestProvider(pkgs, arches); prov != nil {
+			pkg = prov.Package
 		}
-		sort.Sort(RPMSlice(sorted))
-		pkg = sorted[len(sorted)-1].(*Provides).Package
 	} else {
 		// trying to match the requirements
-		sorted := make(RPMSlice, 0, len(pkgs))
+		matching := make([]*Provides, 0, len(pkgs))
 		for _, p := range pkgs {
 			if requirement.ProvideMatches(p) {
-				sorted = append(sorted, p)
+				matching = append(matching, p)
 			}
 		}
-		if len(sorted) > 0 {
-			sort.Sort(sorted)
-			pkg = sorted[len(sorted)-1].(*Provides).Package
-			repo.msg.Debugf("found %d version matching - returning latest: %s.%s-%s\n", len(sorted), pkg.Name(), pkg.Version(), pkg.Release())
+		if prov := latestProvider(matching, arches); prov != nil {
+			pkg = prov.Package
+			repo.msg.Debugf("found %d version matching - returning latest: %s\n", len(matching), pkg.ID())
 		}
 	}
 
+	if pkg == nil {
+		return nil, fmt.Errorf("no package providing name=%q version=%q release=%q for arch=%v",
+			requirement.Name(), requirement.Version(), requirement.Release(), arches,
+		)
+	}
 	return pkg, err
 }
 
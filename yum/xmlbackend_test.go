@@ -0,0 +1,198 @@
+package yum
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/gonuts/logger"
+)
+
+func newTestXMLBackend(primary string) (*RepositoryXMLBackend, error) {
+	repo := &Repository{
+		msg:      logger.NewLogger("repo", logger.INFO, ioutil.Discard),
+		Name:     "testrepo",
+		RepoUrl:  "http://dummy-url.org",
+		CacheDir: filepath.Dir(primary),
+	}
+	backend, err := NewRepositoryXMLBackend(repo)
+	if err != nil {
+		return nil, err
+	}
+	backend.Primary = primary
+	repo.Backend = backend
+	return backend, nil
+}
+
+func TestXMLBackendLoadDB(t *testing.T) {
+	backend, err := newTestXMLBackend("testdata/repo.xml")
+	if err != nil {
+		t.Fatalf("could not create backend: %v\n", err)
+	}
+
+	err = backend.LoadDB()
+	if err != nil {
+		t.Fatalf("could not load DB: %v\n", err)
+	}
+
+	pkgs := backend.GetPackages()
+	if len(pkgs) != 12 {
+		t.Fatalf("expected 12 packages. got=%d\n", len(pkgs))
+	}
+
+	pkg, err := backend.FindLatestMatchingName("TestPackage", "1.0.0", "1")
+	if err != nil {
+		t.Fatalf("could not find TestPackage: %v\n", err)
+	}
+
+	for _, table := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"arch", pkg.Arch(), "noarch"},
+		{"epoch", pkg.Epoch(), "0"},
+		{"group", pkg.Group(), "LHCb"},
+		{"location", pkg.Location(), "TestPackage-1.0.0-1.noarch.rpm"},
+	} {
+		if table.got != table.want {
+			t.Errorf("expected %s=%q. got=%q\n", table.name, table.want, table.got)
+		}
+	}
+
+	if n := len(pkg.Provides()); n != 2 {
+		t.Errorf("expected 2 provides. got=%d\n", n)
+	}
+
+	if n := len(pkg.Requires()); n != 3 {
+		t.Errorf("expected 3 requires. got=%d\n", n)
+	}
+
+	if req := pkg.Requires()[0]; req.Flags() != "LE" || req.Version() != "3.0.4" || req.pre != "1" {
+		t.Errorf("invalid requires: %v\n", req)
+	}
+
+	if pkg.Repository() != backend.Repository {
+		t.Errorf("package not attached to its repository\n")
+	}
+}
+
+// genPrimaryXML writes a synthetic primary.xml.gz with npkgs packages into fname.
+func genPrimaryXML(fname string, npkgs int) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := gzip.NewWriter(f)
+	_, err = fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="%d">
+`, npkgs)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < npkgs; i++ {
+		name := fmt.Sprintf("Pkg%06d_x86_64_slc6_gcc48_opt", i)
+		_, err = fmt.Fprintf(w, `<package type="rpm">
+  <name>%[1]s</name>
+  <arch>noarch</arch>
+  <version epoch="0" ver="1.0.0" rel="%[2]d"/>
+  <checksum type="sha256" pkgid="YES">e9d167358fd0558594d38ada09cf4eae429c03a4178990d6961b44941fddde27</checksum>
+  <summary>%[1]s</summary>
+  <description>%[1]s is a synthetic package used for benchmarking the XML backend.</description>
+  <packager></packager>
+  <url></url>
+  <time file="1343665660" build="1343665658"/>
+  <size package="2846803" installed="10986607" archive="11425580"/>
+  <location href="%[1]s-1.0.0-%[2]d.noarch.rpm"/>
+  <format>
+    <rpm:license>GPL</rpm:license>
+    <rpm:vendor>LHCb</rpm:vendor>
+    <rpm:group>LHCb</rpm:group>
+    <rpm:buildhost>lxplus401.cern.ch</rpm:buildhost>
+    <rpm:sourcerpm>%[1]s-1.0.0-%[2]d.src.rpm</rpm:sourcerpm>
+    <rpm:header-range start="280" end="261899"/>
+    <rpm:provides>
+      <rpm:entry name="%[1]s" flags="EQ" epoch="0" ver="1.0.0" rel="%[2]d"/>
+    </rpm:provides>
+    <rpm:requires>
+      <rpm:entry name="/bin/sh" pre="1"/>
+      <rpm:entry name="Pkg%06[3]d_x86_64_slc6_gcc48_opt" flags="GE" epoch="0" ver="1.0.0"/>
+    </rpm:requires>
+`, name, i%7, (i+1)%npkgs)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < 20; j++ {
+			_, err = fmt.Fprintf(w, "    <file>/opt/LHCbSoft/%s/lib/libPkg%02d.so</file>\n", name, j)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = io.WriteString(w, "  </format>\n</package>\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "</metadata>\n")
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func BenchmarkXMLBackendLoadDB(b *testing.B) {
+	const npkgs = 100000
+
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-bench-")
+	if err != nil {
+		b.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fname := filepath.Join(tmpdir, "primary.xml.gz")
+	err = genPrimaryXML(fname, npkgs)
+	if err != nil {
+		b.Fatalf("could not generate primary.xml.gz: %v\n", err)
+	}
+
+	var heap uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		backend, err := newTestXMLBackend(fname)
+		if err != nil {
+			b.Fatalf("could not create backend: %v\n", err)
+		}
+		err = backend.LoadDB()
+		if err != nil {
+			b.Fatalf("could not load DB: %v\n", err)
+		}
+		if n := len(backend.Packages); n != npkgs {
+			b.Fatalf("expected %d packages. got=%d\n", npkgs, n)
+		}
+
+		// record the memory retained by the loaded DB
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		if stats.HeapInuse > heap {
+			heap = stats.HeapInuse
+		}
+		runtime.KeepAlive(backend)
+	}
+	b.ReportMetric(float64(heap), "heap-B")
+}
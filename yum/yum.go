@@ -2,17 +2,33 @@ package yum
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	gocfg "github.com/gonuts/config"
 	"github.com/gonuts/logger"
 )
 
+// DefaultMetadataExpire is the delay after which the metadata of a repository
+// is checked again against the remote server, when not configured otherwise.
+const DefaultMetadataExpire = 6 * time.Hour
+
+// DefaultMaxJobs is the default maximum number of repositories set up concurrently.
+const DefaultMaxJobs = 4
+
+// DefaultSnapshotKeep is the default number of snapshots kept for each
+// repository, besides the one in use.
+const DefaultSnapshotKeep = 10
+
 type Client struct {
 	msg         *logger.Logger
 	siteroot    string
@@ -21,39 +37,194 @@ type Client struct {
 	yumconf     string
 	yumreposdir string
 	configured  bool
-	repos       map[string]*Repository
-	repourls    map[string]string
+
+	mux      sync.RWMutex // protects repos and skipped
+	repos    map[string]*Repository
+	repocfgs map[string]*RepoConfig
+	skipped  map[string]error // repositories skipped because they were unavailable
+
+	expire    time.Duration // default metadata_expire for all repositories
+	skip      bool          // default skip_if_unavailable for all repositories
+	njobs     int           // maximum number of repositories set up concurrently
+	cacheonly bool          // only use the local metadata cache
+	refresh   bool          // always check remote metadata, regardless of metadata_expire
+	snapshot  string        // snapshot of the metadata to use (ID or date), if any
+	snapkeep  int           // number of snapshots kept for each repository (<= 0: all)
+	arch      string        // architecture of the host the packages are installed on
+	httpc     *http.Client  // HTTP client retrieving the remote data
+
+	syssources []string        // sources of host capabilities
+	sysrpmdb   string          // path to the system rpmdb
+	sysprov    *SystemProvides // capabilities provided by the host
+	hostmux    sync.Mutex      // protects hostreqs and unresolved
+	hostreqs   map[string]*HostCapability
+	unresolved map[string][]string // requirements without provider -> requiring packages
+}
+
+// RepoConfig holds the configuration of a repository, as declared in a .repo file.
+type RepoConfig struct {
+	Name string
+	Url  string
+
+	// MetadataExpire is the delay after which the remote metadata is checked again.
+	// A negative value means the cached metadata never expires.
+	MetadataExpire time.Duration
+
+	// SkipIfUnavailable allows the Client to carry on without this repository
+	// when it could not be set up.
+	SkipIfUnavailable bool
+}
+
+// SkippedError is returned when a package could not be resolved while some
+// repositories had been skipped because they were unavailable.
+type SkippedError struct {
+	Err   error
+	Repos map[string]error // skipped repositories and the reason why
+}
+
+// InitError is returned when some repositories could not be set up.
+type InitError struct {
+	Repos map[string]error // failed repositories and the reason why
+}
+
+func (e *InitError) Error() string {
+	names := make([]string, 0, len(e.Repos))
+	for name := range e.Repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msg := "yum: could not initialize repositories:"
+	for _, name := range names {
+		msg += fmt.Sprintf("\n - %s: %v", name, e.Repos[name])
+	}
+	return msg
+}
+
+func (e *SkippedError) Error() string {
+	names := make([]string, 0, len(e.Repos))
+	for name := range e.Repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msg := fmt.Sprintf("%v\nthe following repositories were unavailable and skipped:", e.Err)
+	for _, name := range names {
+		msg += fmt.Sprintf("\n - %s: %v", name, e.Repos[name])
+	}
+	return msg
+}
+
+// CacheOnly makes the Client only use the local metadata cache, never contacting
+// the remote repositories.
+func CacheOnly(cacheonly bool) func(*Client) {
+	return func(yum *Client) {
+		yum.cacheonly = cacheonly
+	}
+}
+
+// Arch sets the architecture of the host the packages are installed on.
+// Only packages built for a compatible architecture are considered.
+func Arch(arch string) func(*Client) {
+	return func(yum *Client) {
+		yum.arch = arch
+	}
+}
+
+// MaxJobs sets the maximum number of repositories set up concurrently.
+func MaxJobs(n int) func(*Client) {
+	return func(yum *Client) {
+		yum.njobs = n
+	}
+}
+
+// Refresh makes the Client check all the remote repositories for new metadata,
+// regardless of their metadata_expire setting.
+func Refresh(refresh bool) func(*Client) {
+	return func(yum *Client) {
+		yum.refresh = refresh
+	}
+}
+
+// Repositories makes the Client use the repositories repos, instead of the
+// ones configured under its siteroot.
+func Repositories(repos ...*RepoConfig) func(*Client) {
+	return func(yum *Client) {
+		for _, repo := range repos {
+			yum.repocfgs[repo.Name] = repo
+		}
+		yum.configured = true
+	}
+}
+
+// CacheDir makes the Client cache the metadata of the repositories under dir,
+// instead of under its siteroot.
+func CacheDir(dir string) func(*Client) {
+	return func(yum *Client) {
+		yum.lbyumcache = dir
+	}
 }
 
 // newClient returns a Client from siteroot and backends.
 // manualConfig is just for internal tests
-func newClient(siteroot string, backends []string, checkForUpdates, manualConfig bool) (*Client, error) {
+func newClient(siteroot string, backends []string, checkForUpdates, manualConfig bool, options ...func(*Client)) (*Client, error) {
 	client := &Client{
-		msg:         logger.NewLogger("yum", logger.INFO, os.Stdout),
+		msg:         logger.NewLogger("yum", logger.INFO, stdout),
 		siteroot:    siteroot,
 		etcdir:      filepath.Join(siteroot, "etc"),
-		lbyumcache:  filepath.Join(siteroot, "var", "cache", "lbyum"),
+		lbyumcache:  lbyumCacheDir(siteroot),
 		yumconf:     filepath.Join(siteroot, "etc", "yum.conf"),
 		yumreposdir: filepath.Join(siteroot, "etc", "yum.repos.d"),
 		configured:  false,
 		repos:       make(map[string]*Repository),
-		repourls:    make(map[string]string),
+		repocfgs:    make(map[string]*RepoConfig),
+		skipped:     make(map[string]error),
+		expire:      DefaultMetadataExpire,
+		njobs:       DefaultMaxJobs,
+		snapkeep:    DefaultSnapshotKeep,
+		arch:        HostArch(),
+		syssources:  DefaultSysSources,
+		hostreqs:    make(map[string]*HostCapability),
+		unresolved:  make(map[string][]string),
+		httpc:       HTTPClient,
+	}
+
+	for _, opt := range options {
+		opt(client)
+	}
+
+	if client.cacheonly && client.refresh {
+		return nil, fmt.Errorf("yum: cache-only and refresh modes are mutually exclusive")
+	}
+
+	if client.snapshot != "" && client.refresh {
+		return nil, fmt.Errorf("yum: snapshot and refresh modes are mutually exclusive")
+	}
+
+	if client.cacheonly {
+		checkForUpdates = false
 	}
 
 	if manualConfig {
+		client.initSystemProvides()
 		return client, nil
 	}
 
 	// load the config and set the URLs accordingly
-	urls, err := client.loadConfig()
-	if err != nil {
-		client.msg.Errorf("could not load yum config: %v\n", err)
-		return nil, err
+	repos := client.repocfgs
+	if !client.configured {
+		var err error
+		repos, err = client.loadConfig()
+		if err != nil {
+			client.msg.Errorf("could not load yum config: %v\n", err)
+			return nil, err
+		}
 	}
+	client.initSystemProvides()
 
-	// At this point we have the repo names and URLs in self.repourls
+	// At this point we have the repo names and URLs in self.repocfgs
 	// we know connect to them to get the best method to get the appropriate files
-	err = client.initRepositories(urls, checkForUpdates, backends)
+	err := client.initRepositories(repos, checkForUpdates, backends)
 	if err != nil {
 		client.msg.Errorf("could not initialize repositories: %v\n", err)
 		return nil, err
@@ -62,27 +233,36 @@ func newClient(siteroot string, backends []string, checkForUpdates, manualConfig
 	return client, err
 }
 
+// DefaultBackends lists the backends used to load the repositories, from the
+// most preferred.
+var DefaultBackends = []string{
+	"RepositorySQLiteBackend",
+	"RepositoryXMLBackend",
+}
+
+// lbyumCacheDir returns the directory holding the metadata of the
+// repositories of the siteroot
+func lbyumCacheDir(siteroot string) string {
+	return filepath.Join(siteroot, "var", "cache", "lbyum")
+}
+
 // New returns a new YUM Client, rooted at siteroot.
-func New(siteroot string) (*Client, error) {
+func New(siteroot string, options ...func(*Client)) (*Client, error) {
 	checkForUpdates := true
 	manualConfig := false
-	backends := []string{
-		"RepositorySQLiteBackend",
-		"RepositoryXMLBackend",
-	}
-	return newClient(siteroot, backends, checkForUpdates, manualConfig)
+	return newClient(siteroot, DefaultBackends, checkForUpdates, manualConfig, options...)
 }
 
 // Close cleans up after use
 func (yum *Client) Close() error {
 	var err error
-	for name, repo := range yum.repos {
+	for _, repo := range yum.Repositories() {
 		e := repo.Close()
 		if e != nil {
-			yum.msg.Errorf("error closing repo [%s]: %v\n", name, e)
+			yum.msg.Errorf("error closing repo [%s]: %v\n", repo.Name, e)
 			e = err
 		} else {
-			yum.msg.Debugf("closed repo [%s]\n", name)
+			yum.msg.Debugf("closed repo [%s]\n", repo.Name)
 		}
 	}
 	return err
@@ -91,19 +271,88 @@ func (yum *Client) Close() error {
 // SetLevel sets the verbosity level of Client
 func (yum *Client) SetLevel(lvl logger.Level) {
 	yum.msg.SetLevel(lvl)
-	for _, repo := range yum.repos {
+	for _, repo := range yum.Repositories() {
 		repo.msg.SetLevel(lvl)
 	}
+	yum.sysprov.msg.SetLevel(lvl)
+}
+
+// Repositories returns the list of repositories, sorted by name.
+func (yum *Client) Repositories() []*Repository {
+	yum.mux.RLock()
+	defer yum.mux.RUnlock()
+	repos := make([]*Repository, 0, len(yum.repos))
+	for _, repo := range yum.repos {
+		repos = append(repos, repo)
+	}
+	sort.Sort(reposByName(repos))
+	return repos
+}
+
+// OpenURL returns a reader over the content of rpath, a file:// or http(s):// URL,
+// retrieved with the HTTP client configured for the Client.
+func (yum *Client) OpenURL(rpath string) (io.ReadCloser, error) {
+	r, _, err := fetch(yum.httpc, rpath, nil)
+	return r, err
 }
 
+// NewRepository creates a new Repository outside of the ones of the Client
+// (see NewRepository), retrieving its remote data with the HTTP client of the Client.
+func (yum *Client) NewRepository(name, url, cachedir string, backends []string, setupBackend, checkForUpdates bool) (*Repository, error) {
+	repo, err := newRepository(name, url, cachedir, backends, setupBackend, checkForUpdates, yum.httpc)
+	if err != nil {
+		return nil, err
+	}
+	repo.msg.SetLevel(yum.msg.Level())
+	repo.Arches = CompatArches(yum.arch)
+	return repo, nil
+}
+
+// SkippedRepositories returns the repositories which were skipped because
+// they were unavailable, together with the reason why.
+func (yum *Client) SkippedRepositories() map[string]error {
+	yum.mux.RLock()
+	defer yum.mux.RUnlock()
+	skipped := make(map[string]error, len(yum.skipped))
+	for name, err := range yum.skipped {
+		skipped[name] = err
+	}
+	return skipped
+}
+
+// notFound decorates the error of a failed package lookup with the list of
+// skipped repositories, if any.
+func (yum *Client) notFound(err error) error {
+	skipped := yum.SkippedRepositories()
+	if len(skipped) <= 0 {
+		return err
+	}
+	return &SkippedError{
+		Err:   err,
+		Repos: skipped,
+	}
+}
+
+type reposByName []*Repository
+
+func (p reposByName) Len() int           { return len(p) }
+func (p reposByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p reposByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+
 // FindLatestMatchingName locates a package by name and returns the latest available version
+// name may be suffixed with the requested architecture (e.g. "name.x86_64").
 func (yum *Client) FindLatestMatchingName(name, version, release string) (*Package, error) {
 	var err error
 	var pkg *Package
+	arches := CompatArches(yum.arch)
+	if _, arch := SplitArch(name); arch != "" {
+		arches = []string{arch}
+	}
 	found := make(Packages, 0)
-	errors := make([]error, 0, len(yum.repos))
+	repos := yum.Repositories()
+	errors := make([]error, 0, len(repos))
 
-	for _, repo := range yum.repos {
+	for _, repo := range repos {
 		p, err := repo.FindLatestMatchingName(name, version, release)
 		if err != nil {
 			errors = append(errors, err)
@@ -113,26 +362,47 @@ func (yum *Client) FindLatestMatchingName(name, version, release string) (*Packa
 	}
 
 	if len(found) > 0 {
-		sort.Sort(found)
-		pkg = found[len(found)-1]
+		pkg = latestPackage(found, arches)
 		return pkg, err
 	}
 
-	if len(errors) == len(yum.repos) && len(errors) > 0 {
-		return nil, errors[0]
+	if len(errors) == len(repos) && len(errors) > 0 {
+		return nil, yum.notFound(errors[0])
 	}
 
 	return pkg, err
 }
 
 // FindLatestMatchingRequire locates a package providing a given functionality.
+// Functionalities provided by the host are satisfied by a virtual package (see Package.Host).
+// Only the builtin and declared (conf) host capabilities take precedence over
+// the repositories: the ones detected on the host (files, libs, rpmdb) are
+// used when no repository provides the functionality.
 func (yum *Client) FindLatestMatchingRequire(requirement *Requires) (*Package, error) {
+	if hc := yum.sysprov.matchDeclared(requirement); hc != nil {
+		yum.msg.Debugf("   match for req=%s (host=%v)\n", requirement.ID(), hc)
+		return newHostPackage(hc), nil
+	}
+	pkg, err := yum.findLatestMatchingRequire(requirement)
+	if err == nil && pkg != nil {
+		return pkg, err
+	}
+	if hc := yum.sysprov.Match(requirement); hc != nil {
+		yum.msg.Debugf("   match for req=%s (host=%v)\n", requirement.ID(), hc)
+		return newHostPackage(hc), nil
+	}
+	return pkg, err
+}
+
+// findLatestMatchingRequire locates a package providing a given functionality in the repositories.
+func (yum *Client) findLatestMatchingRequire(requirement *Requires) (*Package, error) {
 	var err error
 	var pkg *Package
 	found := make(Packages, 0)
-	errors := make([]error, 0, len(yum.repos))
+	repos := yum.Repositories()
+	errors := make([]error, 0, len(repos))
 
-	for _, repo := range yum.repos {
+	for _, repo := range repos {
 		p, err := repo.FindLatestMatchingRequire(requirement)
 		if err != nil {
 			errors = append(errors, err)
@@ -150,38 +420,49 @@ func (yum *Client) FindLatestMatchingRequire(requirement *Requires) (*Package, e
 	}
 
 	if len(found) > 0 {
-		sort.Sort(found)
-		pkg = found[len(found)-1]
+		pkg = latestPackage(found, CompatArches(yum.arch))
 		return pkg, err
 	}
 
-	if len(errors) == len(yum.repos) && len(errors) > 0 {
-		return nil, errors[0]
+	if len(errors) == len(repos) && len(errors) > 0 {
+		return nil, yum.notFound(errors[0])
 	}
 
 	return pkg, err
 }
 
 // FindLatestProvider returns the requested package (found by "provides") or an error.
+// name may be suffixed with the requested architecture (e.g. "name.x86_64").
 func (yum *Client) FindLatestProvider(name, version, release string) (*Package, error) {
+	if _, arch := SplitArch(name); arch != "" {
+		// packages provide their own name: look them up by name for that architecture.
+		return yum.FindLatestMatchingName(name, version, release)
+	}
 	req := NewRequires(name, version, release, "", "EQ", "")
-	pkg, err := yum.FindLatestMatchingRequire(req)
+	pkg, err := yum.findLatestMatchingRequire(req)
 	return pkg, err
 }
 
 // ListPackages lists all packages satisfying pattern (a regexp)
 func (yum *Client) ListPackages(name, version, release string) ([]*Package, error) {
-	var err error
-	re_name := regexp.MustCompile(name)
-	re_vers := regexp.MustCompile(version)
-	re_rel := regexp.MustCompile(release)
+	re_name, err := regexp.Compile(name)
+	if err != nil {
+		return nil, err
+	}
+	re_vers, err := regexp.Compile(version)
+	if err != nil {
+		return nil, err
+	}
+	re_rel, err := regexp.Compile(release)
+	if err != nil {
+		return nil, err
+	}
 	pkgs := make([]*Package, 0)
-	for _, repo := range yum.repos {
+	for _, repo := range yum.Repositories() {
 		for _, pkg := range repo.GetPackages() {
 			if re_name.MatchString(pkg.Name()) &&
 				re_vers.MatchString(pkg.Version()) &&
-				// FIXME: sprintf is ugly
-				re_rel.MatchString(fmt.Sprintf("%d", pkg.Release())) {
+				re_rel.MatchString(pkg.Release()) {
 				pkgs = append(pkgs, pkg)
 			}
 		}
@@ -238,36 +519,33 @@ func (yum *Client) pkgDeps(pkg *Package, processed map[string]*Package, maxdepth
 	msg.Verbosef(">>> pkg %s (req=%d)\n", pkg.ID(), nreqs)
 	for ireq, req := range pkg.Requires() {
 		msg.Verbosef("[%03d/%03d] processing deps for %s\n", ireq, nreqs, req.ID())
-		if str_in_slice(req.Name(), IGNORED_PACKAGES) {
-			msg.Verbosef("[%03d/%03d] processing deps for %s [IGNORE]\n", ireq, nreqs, req.ID())
-			continue
-		}
-		p, err := yum.FindLatestMatchingRequire(req)
+		ps, err := yum.resolveRequire(req, selectedIn(processed))
 		if err != nil {
 			lasterr = err
 			msg.Errorf("could not find match for %s\n", req.ID())
+			yum.addUnresolved(req, pkg)
 			continue
 		}
-		if _, dup := processed[p.ID()]; dup {
-			msg.Debugf("package %s already processed (required by pkg=%s | req=%s)\n", p.ID(), pkg.ID(), req.ID())
-			continue
-		}
-		if p == nil {
-			msg.Errorf("package %s not found!\n", req.ID())
-			lasterr = fmt.Errorf("package %s not found", req.ID())
-			continue
-			//return nil, fmt.Errorf("package %s.%s-%s not found", req.Name(), req.Version(), req.Release())
-		}
-		msg.Verbosef("--> adding dep %s\n", p.ID())
-		required[p.ID()] = p
-		if maxdepth < 0 || maxdepth > idepth+1 {
-			sdeps, err := yum.pkgDeps(p, processed, maxdepth, idepth+1)
-			if err != nil {
-				lasterr = err
+		for _, p := range ps {
+			if hc := p.Host(); hc != nil {
+				msg.Verbosef("[%03d/%03d] processing deps for %s [HOST: %v]\n", ireq, nreqs, req.ID(), hc)
+				yum.addHostProvided(req, hc)
 				continue
 			}
-			for _, sdep := range sdeps {
-				required[sdep.ID()] = sdep
+			if _, dup := processed[p.ID()]; dup {
+				msg.Debugf("package %s already processed (required by pkg=%s | req=%s)\n", p.ID(), pkg.ID(), req.ID())
+				continue
+			}
+			msg.Verbosef("--> adding dep %s\n", p.ID())
+			required[p.ID()] = p
+			if maxdepth < 0 || maxdepth > idepth+1 {
+				sdeps, err := yum.pkgDeps(p, processed, maxdepth, idepth+1)
+				if err != nil {
+					lasterr = err
+				}
+				for _, sdep := range sdeps {
+					required[sdep.ID()] = sdep
+				}
 			}
 		}
 	}
@@ -278,8 +556,93 @@ func (yum *Client) pkgDeps(pkg *Package, processed map[string]*Package, maxdepth
 	return required, err
 }
 
+// HostProvided returns the requirements which were satisfied by the host while
+// resolving dependencies, together with the host capability satisfying them.
+func (yum *Client) HostProvided() map[string]*HostCapability {
+	yum.hostmux.Lock()
+	defer yum.hostmux.Unlock()
+	reqs := make(map[string]*HostCapability, len(yum.hostreqs))
+	for id, hc := range yum.hostreqs {
+		reqs[id] = hc
+	}
+	return reqs
+}
+
+func (yum *Client) addHostProvided(req *Requires, hc *HostCapability) {
+	yum.hostmux.Lock()
+	defer yum.hostmux.Unlock()
+	yum.hostreqs[FormatCapability(req)] = hc
+}
+
+// Unresolved returns the requirements which could not be satisfied while
+// resolving dependencies, together with the IDs of the packages requiring them.
+func (yum *Client) Unresolved() map[string][]string {
+	yum.hostmux.Lock()
+	defer yum.hostmux.Unlock()
+	reqs := make(map[string][]string, len(yum.unresolved))
+	for id, pkgs := range yum.unresolved {
+		reqs[id] = append([]string(nil), pkgs...)
+	}
+	return reqs
+}
+
+func (yum *Client) addUnresolved(req *Requires, pkg *Package) {
+	yum.hostmux.Lock()
+	defer yum.hostmux.Unlock()
+	id := FormatCapability(req)
+	if !str_in_slice(pkg.ID(), yum.unresolved[id]) {
+		yum.unresolved[id] = append(yum.unresolved[id], pkg.ID())
+	}
+}
+
+// SystemSources returns the sources of host capabilities used to resolve dependencies.
+func (yum *Client) SystemSources() []string {
+	sources := make([]string, len(yum.syssources))
+	copy(sources, yum.syssources)
+	return sources
+}
+
+// SetSystemSources sets the sources of host capabilities used to resolve dependencies.
+// With SysAssumed, the files and shared libraries no repository provides are
+// left to the host the packages get installed on, instead of being checked
+// against this one.
+func (yum *Client) SetSystemSources(sources ...string) {
+	yum.syssources = make([]string, len(sources))
+	copy(yum.syssources, sources)
+	yum.initSystemProvides()
+	yum.sysprov.msg.SetLevel(yum.msg.Level())
+}
+
+// initSystemProvides sets up the detection of the capabilities provided by the host.
+func (yum *Client) initSystemProvides() {
+	yum.sysprov = NewSystemProvides(yum.syssources, filepath.Join(yum.etcdir, "sysprovides.conf"))
+	if yum.sysrpmdb != "" {
+		yum.sysprov.rpmdb = yum.sysrpmdb
+	}
+}
+
+// selectedIn returns a function reporting whether a requirement is satisfied
+// by one of the packages already processed.
+func selectedIn(processed map[string]*Package) func(*Requires) bool {
+	return func(req *Requires) bool {
+		for _, pkg := range processed {
+			for _, prov := range pkg.Provides() {
+				if req.ProvideMatches(prov) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
 // loadConfig looks up the location of the yum repository
-func (yum *Client) loadConfig() (map[string]string, error) {
+func (yum *Client) loadConfig() (map[string]*RepoConfig, error) {
+	err := yum.loadMainConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	fis, err := ioutil.ReadDir(yum.yumreposdir)
 	if err != nil {
 		return nil, err
@@ -298,21 +661,90 @@ func (yum *Client) loadConfig() (map[string]string, error) {
 			return nil, err
 		}
 		for k, v := range repos {
-			yum.repourls[k] = v
+			yum.repocfgs[k] = v
 		}
 	}
 
 	yum.configured = true
-	if len(yum.repourls) <= 0 {
+	if len(yum.repocfgs) <= 0 {
 		return nil, fmt.Errorf("could not find repository config file in [%s]", yum.yumreposdir)
 	}
-	return yum.repourls, err
+	return yum.repocfgs, err
 }
 
-// parseRepoConfigFile parses the xyz.repo file and returns a map of reponame/repourl
-func (yum *Client) parseRepoConfigFile(fname string) (map[string]string, error) {
+// loadMainConfig loads the [main] section of the yum.conf file, if any.
+func (yum *Client) loadMainConfig() error {
+	if !path_exists(yum.yumconf) {
+		return nil
+	}
+
+	cfg, err := gocfg.ReadDefault(yum.yumconf)
+	if err != nil {
+		return err
+	}
+
+	if cfg.HasOption("main", "metadata_expire") {
+		v, err := cfg.String("main", "metadata_expire")
+		if err != nil {
+			return err
+		}
+		yum.expire, err = parseMetadataExpire(v)
+		if err != nil {
+			return fmt.Errorf("yum: invalid metadata_expire in [%s]: %v", yum.yumconf, err)
+		}
+	}
+
+	if cfg.HasOption("main", "skip_if_unavailable") {
+		yum.skip, err = cfg.Bool("main", "skip_if_unavailable")
+		if err != nil {
+			return fmt.Errorf("yum: invalid skip_if_unavailable in [%s]: %v", yum.yumconf, err)
+		}
+	}
+
+	if cfg.HasOption("main", "timeout") {
+		timeout, err := cfg.Int("main", "timeout")
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("yum: invalid timeout in [%s]", yum.yumconf)
+		}
+		yum.httpc = NewHTTPClient(time.Duration(timeout) * time.Second)
+	}
+
+	if cfg.HasOption("main", "snapshot_keep") {
+		yum.snapkeep, err = cfg.Int("main", "snapshot_keep")
+		if err != nil {
+			return fmt.Errorf("yum: invalid snapshot_keep in [%s]: %v", yum.yumconf, err)
+		}
+	}
+
+	if cfg.HasOption("main", "system_provides") {
+		v, err := cfg.String("main", "system_provides")
+		if err != nil {
+			return err
+		}
+		sources := strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		for _, src := range sources {
+			switch src {
+			case SysBuiltin, SysConf, SysFiles, SysLibs, SysRpmDB:
+			default:
+				return fmt.Errorf("yum: invalid system_provides source %q in [%s]", src, yum.yumconf)
+			}
+		}
+		yum.syssources = sources
+	}
+
+	if cfg.HasOption("main", "system_rpmdb") {
+		yum.sysrpmdb, err = cfg.String("main", "system_rpmdb")
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// parseRepoConfigFile parses the xyz.repo file and returns a map of reponame/repoconfig
+func (yum *Client) parseRepoConfigFile(fname string) (map[string]*RepoConfig, error) {
 	var err error
-	repos := make(map[string]string)
+	repos := make(map[string]*RepoConfig)
 
 	cfg, err := gocfg.ReadDefault(fname)
 	if err != nil {
@@ -330,45 +762,199 @@ func (yum *Client) parseRepoConfigFile(fname string) (map[string]string, error)
 		if strings.HasPrefix(repourl, "/") {
 			repourl = "file://" + repourl
 		}
+		repo := &RepoConfig{
+			Name:              section,
+			Url:               repourl,
+			MetadataExpire:    yum.expire,
+			SkipIfUnavailable: yum.skip,
+		}
+		if cfg.HasOption(section, "metadata_expire") {
+			v, err := cfg.String(section, "metadata_expire")
+			if err != nil {
+				return nil, err
+			}
+			repo.MetadataExpire, err = parseMetadataExpire(v)
+			if err != nil {
+				return nil, fmt.Errorf("yum: invalid metadata_expire for repo [%s] in [%s]: %v", section, fname, err)
+			}
+		}
+		if cfg.HasOption(section, "skip_if_unavailable") {
+			repo.SkipIfUnavailable, err = cfg.Bool(section, "skip_if_unavailable")
+			if err != nil {
+				return nil, fmt.Errorf("yum: invalid skip_if_unavailable for repo [%s] in [%s]: %v", section, fname, err)
+			}
+		}
 		yum.msg.Debugf("adding repo=%q url=%q from file [%s]\n", section, repourl, fname)
-		repos[section] = repourl
+		repos[section] = repo
 	}
 	return repos, err
 }
 
-func (yum *Client) initRepositories(urls map[string]string, checkForUpdates bool, backends []string) error {
+// parseMetadataExpire parses a metadata_expire value.
+// As for yum, values are in seconds, unless suffixed with one of 's', 'm', 'h' or 'd'.
+// "never" (or "-1") means the metadata never expires.
+func parseMetadataExpire(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	switch v {
+	case "never", "-1":
+		return -1, nil
+	case "":
+		return 0, fmt.Errorf("empty value")
+	}
+
+	unit := time.Second
+	switch v[len(v)-1] {
+	case 's':
+		v = v[:len(v)-1]
+	case 'm':
+		unit = time.Minute
+		v = v[:len(v)-1]
+	case 'h':
+		unit = time.Hour
+		v = v[:len(v)-1]
+	case 'd':
+		unit = 24 * time.Hour
+		v = v[:len(v)-1]
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative value %d", n)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func (yum *Client) initRepositories(repos map[string]*RepoConfig, checkForUpdates bool, backends []string) error {
 	var err error
 
+	names := make([]string, 0, len(repos))
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type result struct {
+		name string
+		repo *Repository
+		err  error
+	}
+
+	// setup the repositories concurrently, at most yum.njobs at a time.
+	njobs := yum.njobs
+	if njobs <= 0 {
+		njobs = 1
+	}
+	throttle := make(chan struct{}, njobs)
+	results := make(chan result, len(names))
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string, cfg *RepoConfig) {
+			defer wg.Done()
+			throttle <- struct{}{}
+			defer func() { <-throttle }()
+			repo, err := yum.initRepository(name, cfg, checkForUpdates, backends)
+			results <- result{name, repo, err}
+		}(name, repos[name])
+	}
+	wg.Wait()
+	close(results)
+
+	errs := make(map[string]error)
+	yum.mux.Lock()
+	for res := range results {
+		cfg := repos[res.name]
+		switch {
+		case res.err == nil:
+			res.repo.msg = yum.msg
+			yum.repos[res.name] = res.repo
+
+		case cfg.SkipIfUnavailable:
+			yum.msg.Warnf("repository [%s] (url=%v) is unavailable and will be skipped: %v\n",
+				res.name, cfg.Url,
+				res.err,
+			)
+			yum.skipped[res.name] = res.err
+
+		default:
+			yum.msg.Errorf("could not create yum repository repo [%s] (url=%v): %v\n",
+				res.name, cfg.Url,
+				res.err,
+			)
+			errs[res.name] = res.err
+		}
+	}
+	yum.repocfgs = repos
+	nrepos := len(yum.repos)
+	nskipped := len(yum.skipped)
+	yum.mux.Unlock()
+
+	if len(errs) > 0 {
+		// do not leak the repositories which could be set up.
+		yum.Close()
+		return &InitError{Repos: errs}
+	}
+
+	if nrepos <= 0 && nskipped > 0 {
+		return fmt.Errorf("yum: all repositories are unavailable")
+	}
+	return err
+}
+
+// initRepository creates the cache directory of a repository and sets it up.
+func (yum *Client) initRepository(name string, cfg *RepoConfig, checkForUpdates bool, backends []string) (*Repository, error) {
 	const setupBackend = true
 
-	// setup the repositories
-	for repo, repourl := range urls {
-		cachedir := filepath.Join(yum.lbyumcache, repo)
-		err = os.MkdirAll(cachedir, 0755)
+	cachedir := filepath.Join(yum.lbyumcache, name)
+	err := os.MkdirAll(cachedir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cachedir [%s]: %v", cachedir, err)
+	}
+
+	if yum.snapshot != "" {
+		snap, err := findSnapshot(name, cachedir, yum.snapshot)
 		if err != nil {
-			yum.msg.Errorf("could not create cachedir [%s] for repo [%s]: %v\n",
-				cachedir, repo,
-				err,
-			)
-			return err
+			return nil, err
 		}
-		r, err := NewRepository(
-			repo, repourl, cachedir,
-			backends, setupBackend, checkForUpdates,
+		yum.msg.Debugf("using snapshot [%s] of repo [%s]\n", snap.ID, name)
+		repo, err := newRepository(
+			name, cfg.Url, snap.Dir,
+			backends, setupBackend, false,
+			yum.httpc,
 		)
 		if err != nil {
-			yum.msg.Errorf("could not create yum repository repo [%s] (url=%v): %v\n",
-				repo, repourl,
-				err,
-			)
-			return err
+			return nil, err
 		}
-		r.msg = yum.msg
-		yum.repos[repo] = r
+		repo.Arches = CompatArches(yum.arch)
+		return repo, nil
 	}
 
-	yum.repourls = urls
-	return err
+	// only contact the remote repository when our metadata is stale
+	check := checkForUpdates && (yum.refresh || metadataExpired(cachedir, cfg.MetadataExpire))
+	if checkForUpdates && !check {
+		yum.msg.Debugf("metadata for repo [%s] not expired yet, using cache\n", name)
+	}
+
+	repo, err := newRepository(
+		name, cfg.Url, cachedir,
+		backends, setupBackend, check,
+		yum.httpc,
+	)
+	if err != nil {
+		return nil, err
+	}
+	repo.Arches = CompatArches(yum.arch)
+
+	if check {
+		_, err = pruneSnapshots(name, cachedir, yum.snapkeep)
+		if err != nil {
+			yum.msg.Warnf("could not prune snapshots of repository [%s]: %v\n", name, err)
+		}
+	}
+	return repo, nil
 }
 
 // EOF
@@ -1,9 +1,14 @@
 package yum
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 )
 
 func getTestClient(t *testing.T) (*Client, error) {
@@ -591,3 +596,359 @@ func TestLoadConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMetadataExpire(t *testing.T) {
+	for _, table := range []struct {
+		value string
+		want  time.Duration
+		err   bool
+	}{
+		{"3600", time.Hour, false},
+		{"90s", 90 * time.Second, false},
+		{"30m", 30 * time.Minute, false},
+		{"6h", 6 * time.Hour, false},
+		{"2d", 48 * time.Hour, false},
+		{"0", 0, false},
+		{"never", -1, false},
+		{"-1", -1, false},
+		{"", 0, true},
+		{"-2", 0, true},
+		{"1w", 0, true},
+	} {
+		got, err := parseMetadataExpire(table.value)
+		if table.err {
+			if err == nil {
+				t.Errorf("%q: expected an error\n", table.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v\n", table.value, err)
+			continue
+		}
+		if got != table.want {
+			t.Errorf("%q: expected %v. got=%v\n", table.value, table.want, got)
+		}
+	}
+}
+
+// newTestSiteroot creates a siteroot with a single file:// repository, serving testdata/repo.xml.
+func newTestSiteroot(tmpdir, expire string) (siteroot, srvdir string, err error) {
+	siteroot = filepath.Join(tmpdir, "siteroot")
+	srvdir = filepath.Join(tmpdir, "srv")
+
+	err = os.MkdirAll(filepath.Join(srvdir, "repodata"), 0755)
+	if err != nil {
+		return
+	}
+	err = compressFile(filepath.Join(srvdir, "repodata", "primary.xml.gz"), "testdata/repo.xml")
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(srvdir, "repodata", "repomd.xml"),
+		[]byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<repomd xmlns="http://linux.duke.edu/metadata/repo">
+  <data type="primary">
+    <location href="repodata/primary.xml.gz"/>
+    <timestamp>%d</timestamp>
+  </data>
+</repomd>
+`, time.Now().Unix())),
+		0644,
+	)
+	if err != nil {
+		return
+	}
+
+	reposdir := filepath.Join(siteroot, "etc", "yum.repos.d")
+	err = os.MkdirAll(reposdir, 0755)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(reposdir, "test.repo"),
+		[]byte(fmt.Sprintf("[testrepo]\nname=testrepo\nbaseurl=file://%s\nenabled=1\nmetadata_expire=%s\n", srvdir, expire)),
+		0644,
+	)
+	return
+}
+
+func TestCacheOnly(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-cacheonly-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	siteroot, srvdir, err := newTestSiteroot(tmpdir, "1h")
+	if err != nil {
+		t.Fatalf("could not create test siteroot: %v\n", err)
+	}
+
+	backends := []string{"RepositoryXMLBackend"}
+
+	// no metadata cached yet
+	_, err = newClient(siteroot, backends, true, false, CacheOnly(true))
+	if err == nil {
+		t.Fatalf("expected an error in cache-only mode with an empty cache\n")
+	}
+
+	// fill the cache
+	client, err := newClient(siteroot, backends, true, false, Refresh(true))
+	if err != nil {
+		t.Fatalf("could not create client: %v\n", err)
+	}
+	client.Close()
+
+	// make the remote repository unreachable
+	err = os.RemoveAll(srvdir)
+	if err != nil {
+		t.Fatalf("could not remove server dir: %v\n", err)
+	}
+
+	for _, opts := range [][]func(*Client){
+		{CacheOnly(true)},
+		{}, // metadata not expired yet: remote not contacted
+	} {
+		client, err = newClient(siteroot, backends, true, false, opts...)
+		if err != nil {
+			t.Fatalf("could not create client from cache: %v\n", err)
+		}
+
+		repos := client.Repositories()
+		if len(repos) != 1 || repos[0].Name != "testrepo" {
+			t.Fatalf("invalid repositories: %v\n", repos)
+		}
+
+		pkg, err := client.FindLatestMatchingName("TestPackage", "1.0.0", "1")
+		if err != nil {
+			t.Fatalf("could not find TestPackage: %v\n", err)
+		}
+		if pkg == nil || pkg.Version() != "1.0.0" {
+			t.Fatalf("invalid package: %v\n", pkg)
+		}
+		client.Close()
+	}
+
+	// a refresh needs the remote repository
+	_, err = newClient(siteroot, backends, true, false, Refresh(true))
+	if err == nil {
+		t.Fatalf("expected an error when refreshing from an unreachable repository\n")
+	}
+}
+
+func TestMetadataExpired(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-expire-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	if !metadataExpired(tmpdir, -1) {
+		t.Fatalf("empty cache should always be expired\n")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tmpdir, "repomd.xml"), nil, 0644)
+	if err != nil {
+		t.Fatalf("could not create repomd.xml: %v\n", err)
+	}
+	if !metadataExpired(tmpdir, -1) {
+		t.Fatalf("cache without cookie should always be expired\n")
+	}
+
+	err = touchFile(filepath.Join(tmpdir, cacheCookie))
+	if err != nil {
+		t.Fatalf("could not create cache cookie: %v\n", err)
+	}
+
+	for _, table := range []struct {
+		expire time.Duration
+		want   bool
+	}{
+		{-1, false},
+		{0, true},
+		{time.Hour, false},
+	} {
+		got := metadataExpired(tmpdir, table.expire)
+		if got != table.want {
+			t.Errorf("expire=%v: expected %v. got=%v\n", table.expire, table.want, got)
+		}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(filepath.Join(tmpdir, cacheCookie), old, old)
+	if err != nil {
+		t.Fatalf("could not change cookie time: %v\n", err)
+	}
+	if !metadataExpired(tmpdir, time.Hour) {
+		t.Fatalf("expected metadata to be expired\n")
+	}
+}
+
+func TestSkipIfUnavailable(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-skip-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	siteroot, _, err := newTestSiteroot(tmpdir, "0")
+	if err != nil {
+		t.Fatalf("could not create test siteroot: %v\n", err)
+	}
+
+	backends := []string{"RepositoryXMLBackend"}
+	deadrepo := filepath.Join(siteroot, "etc", "yum.repos.d", "dead.repo")
+	for _, table := range []struct {
+		repo string
+		conf string
+		skip bool
+	}{
+		{"[dead]\nbaseurl=file:///dev/null/dead\n", "", false},
+		{"[dead]\nbaseurl=file:///dev/null/dead\nskip_if_unavailable=1\n", "", true},
+		{"[dead]\nbaseurl=file:///dev/null/dead\n", "[main]\nskip_if_unavailable=1\n", true},
+		{"[dead]\nbaseurl=file:///dev/null/dead\nskip_if_unavailable=0\n", "[main]\nskip_if_unavailable=1\n", false},
+	} {
+		err = ioutil.WriteFile(deadrepo, []byte(table.repo), 0644)
+		if err != nil {
+			t.Fatalf("could not create repo file: %v\n", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(siteroot, "etc", "yum.conf"), []byte(table.conf), 0644)
+		if err != nil {
+			t.Fatalf("could not create yum.conf: %v\n", err)
+		}
+
+		client, err := newClient(siteroot, backends, true, false)
+		if !table.skip {
+			if err == nil {
+				t.Fatalf("expected an error with an unavailable repository (conf=%q, repo=%q)\n", table.conf, table.repo)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("could not create client: %v\n", err)
+		}
+
+		if _, ok := client.SkippedRepositories()["dead"]; !ok {
+			t.Fatalf("expected repository [dead] to be skipped. got=%v\n", client.SkippedRepositories())
+		}
+
+		pkg, err := client.FindLatestMatchingName("TestPackage", "1.0.0", "1")
+		if err != nil || pkg == nil {
+			t.Fatalf("could not find TestPackage: %v\n", err)
+		}
+
+		_, err = client.FindLatestMatchingName("NoSuchPackage", "", "")
+		if _, ok := err.(*SkippedError); !ok {
+			t.Fatalf("expected a *SkippedError. got=%T (%v)\n", err, err)
+		}
+		client.Close()
+	}
+}
+
+func TestInitRepositoriesConcurrently(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-init-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	siteroot, srvdir, err := newTestSiteroot(tmpdir, "0")
+	if err != nil {
+		t.Fatalf("could not create test siteroot: %v\n", err)
+	}
+
+	const nrepos = 10
+	reposdir := filepath.Join(siteroot, "etc", "yum.repos.d")
+	for i := 0; i < nrepos; i++ {
+		err = ioutil.WriteFile(
+			filepath.Join(reposdir, fmt.Sprintf("test-%02d.repo", i)),
+			[]byte(fmt.Sprintf("[test-%02d]\nbaseurl=file://%s\n", i, srvdir)),
+			0644,
+		)
+		if err != nil {
+			t.Fatalf("could not create repo file: %v\n", err)
+		}
+	}
+
+	backends := []string{"RepositoryXMLBackend"}
+	for _, njobs := range []int{1, 3, nrepos + 1} {
+		client, err := newClient(siteroot, backends, true, false, MaxJobs(njobs))
+		if err != nil {
+			t.Fatalf("njobs=%d: could not create client: %v\n", njobs, err)
+		}
+		if n := len(client.Repositories()); n != nrepos+1 {
+			t.Fatalf("njobs=%d: expected %d repositories. got=%d\n", njobs, nrepos+1, n)
+		}
+		client.Close()
+	}
+
+	// all the failing repositories should be reported
+	for _, name := range []string{"dead-1", "dead-2"} {
+		err = ioutil.WriteFile(
+			filepath.Join(reposdir, name+".repo"),
+			[]byte(fmt.Sprintf("[%s]\nbaseurl=file:///dev/null/%s\n", name, name)),
+			0644,
+		)
+		if err != nil {
+			t.Fatalf("could not create repo file: %v\n", err)
+		}
+	}
+
+	_, err = newClient(siteroot, backends, true, false, MaxJobs(4))
+	ierr, ok := err.(*InitError)
+	if !ok {
+		t.Fatalf("expected an *InitError. got=%T (%v)\n", err, err)
+	}
+	if len(ierr.Repos) != 2 {
+		t.Fatalf("expected 2 failed repositories. got=%v\n", ierr.Repos)
+	}
+	for _, name := range []string{"dead-1", "dead-2"} {
+		if _, ok := ierr.Repos[name]; !ok {
+			t.Errorf("expected repository [%s] to be reported. got=%v\n", name, ierr.Repos)
+		}
+	}
+}
+
+func TestRepositories(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "lbpkr-yum-repos-")
+	if err != nil {
+		t.Fatalf("could not create tmpdir: %v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	siteroot, srvdir, err := newTestSiteroot(tmpdir, "0")
+	if err != nil {
+		t.Fatalf("could not create test siteroot: %v\n", err)
+	}
+
+	// the configured repositories are ignored
+	err = ioutil.WriteFile(
+		filepath.Join(siteroot, "etc", "yum.repos.d", "dead.repo"),
+		[]byte("[dead]\nbaseurl=file:///dev/null/dead\n"),
+		0644,
+	)
+	if err != nil {
+		t.Fatalf("could not create repo file: %v\n", err)
+	}
+
+	backends := []string{"RepositoryXMLBackend"}
+	client, err := newClient(siteroot, backends, true, false,
+		Repositories(&RepoConfig{Name: "explicit", Url: "file://" + srvdir}),
+	)
+	if err != nil {
+		t.Fatalf("could not create client: %v\n", err)
+	}
+	defer client.Close()
+
+	repos := client.Repositories()
+	if len(repos) != 1 || repos[0].Name != "explicit" {
+		t.Fatalf("expected only the [explicit] repository. got=%v\n", repos)
+	}
+
+	pkg, err := client.FindLatestMatchingName("TestPackage", "1.0.0", "1")
+	if err != nil || pkg == nil {
+		t.Fatalf("could not find TestPackage: %v\n", err)
+	}
+}